@@ -11,6 +11,7 @@ import (
 	"github.com/nyaruka/logrus_sentry"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/logging"
 
 	_ "github.com/nyaruka/mailroom/core/handlers"
 	_ "github.com/nyaruka/mailroom/core/hooks"
@@ -23,6 +24,7 @@ import (
 	_ "github.com/nyaruka/mailroom/core/tasks/interrupts"
 	_ "github.com/nyaruka/mailroom/core/tasks/ivr"
 	_ "github.com/nyaruka/mailroom/core/tasks/msgs"
+	_ "github.com/nyaruka/mailroom/core/tasks/publishing"
 	_ "github.com/nyaruka/mailroom/core/tasks/schedules"
 	_ "github.com/nyaruka/mailroom/core/tasks/starts"
 	_ "github.com/nyaruka/mailroom/core/tasks/timeouts"
@@ -31,10 +33,12 @@ import (
 	_ "github.com/nyaruka/mailroom/services/tickets/intern"
 	_ "github.com/nyaruka/mailroom/services/tickets/mailgun"
 	_ "github.com/nyaruka/mailroom/services/tickets/zendesk"
+	_ "github.com/nyaruka/mailroom/web/admin"
 	_ "github.com/nyaruka/mailroom/web/contact"
 	_ "github.com/nyaruka/mailroom/web/docs"
 	_ "github.com/nyaruka/mailroom/web/expression"
 	_ "github.com/nyaruka/mailroom/web/flow"
+	_ "github.com/nyaruka/mailroom/web/health"
 	_ "github.com/nyaruka/mailroom/web/ivr"
 	_ "github.com/nyaruka/mailroom/web/msg"
 	_ "github.com/nyaruka/mailroom/web/org"
@@ -75,7 +79,9 @@ func main() {
 
 	logrus.SetLevel(level)
 	logrus.SetOutput(os.Stdout)
-	logrus.SetFormatter(&logrus.TextFormatter{})
+	if err := logging.SetFormat(config.LogFormat); err != nil {
+		logrus.Fatal(err)
+	}
 	logrus.WithField("version", version).WithField("released", date).Info("starting mailroom")
 
 	// if we have a DSN entry, try to initialize it
@@ -30,6 +30,7 @@ func handleContactFieldChanged(ctx context.Context, rt *runtime.Runtime, tx *sql
 	scene.AppendToEventPreCommitHook(hooks.CommitFieldChangesHook, event)
 	scene.AppendToEventPreCommitHook(hooks.UpdateCampaignEventsHook, event)
 	scene.AppendToEventPostCommitHook(hooks.ContactModifiedHook, event)
+	scene.AppendToEventPostCommitHook(hooks.PublishChangesHook, event)
 
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/triggers"
 	"github.com/nyaruka/mailroom/core/hooks"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
@@ -91,6 +92,9 @@ func handleMsgCreated(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa
 		if channel == nil {
 			return errors.Errorf("unable to load channel with uuid: %s", event.Msg.Channel().UUID)
 		}
+
+		// if that channel is unhealthy, use a fallback channel if we have one
+		channel = models.RouteChannel(oa, channel, event.Msg.URN())
 	}
 
 	// and the flow
@@ -106,6 +110,12 @@ func handleMsgCreated(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa
 		return errors.Wrapf(err, "error creating outgoing message to %s", event.Msg.URN())
 	}
 
+	// messages from campaign flows which aren't replies count towards the org's frequency caps, which are checked for
+	// all scenes at once before the messages are committed
+	if run.Session().Trigger().Type() == triggers.TypeCampaign && scene.Session().IncomingMsgID() == models.NilMsgID {
+		scene.AppendToEventPostCommitHook(hooks.RecordFrequencyCapsHook, msg)
+	}
+
 	// register to have this message committed
 	scene.AppendToEventPreCommitHook(hooks.CommitMessagesHook, msg)
 
@@ -114,5 +124,7 @@ func handleMsgCreated(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa
 		scene.AppendToEventPostCommitHook(hooks.SendMessagesHook, msg)
 	}
 
+	scene.AppendToEventPostCommitHook(hooks.PublishChangesHook, msg)
+
 	return nil
 }
@@ -31,5 +31,9 @@ func handleSprintEnded(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa
 		scene.AppendToEventPostCommitHook(hooks.ContactModifiedHook, event)
 	}
 
+	if scene.Session().Status() != models.SessionStatusWaiting {
+		scene.AppendToEventPostCommitHook(hooks.PublishChangesHook, scene.Session())
+	}
+
 	return nil
 }
@@ -18,10 +18,20 @@ type commitMessagesHook struct{}
 // Apply takes care of inserting all the messages in the passed in scene.
 func (h *commitMessagesHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
 	msgs := make([]*models.Msg, 0, len(scenes))
-	for _, s := range scenes {
-		for _, m := range s {
+	capped := make([]*models.Msg, 0)
+	for s, args := range scenes {
+		for _, m := range args {
 			msgs = append(msgs, m.(*models.Msg))
 		}
+
+		// messages which will be counted towards frequency caps once committed need to be checked against them first
+		for _, m := range s.PostCommitEvents(RecordFrequencyCapsHook) {
+			capped = append(capped, m.(*models.Msg))
+		}
+	}
+
+	if err := models.ApplyFrequencyCaps(rt, oa.Org(), capped); err != nil {
+		return errors.Wrapf(err, "error applying frequency caps")
 	}
 
 	// insert all our messages
@@ -0,0 +1,37 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/publish"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// PublishChangesHook is our hook for publishing change events once they've been committed
+var PublishChangesHook models.EventCommitHook = &publishChangesHook{}
+
+type publishChangesHook struct{}
+
+// Apply publishes change events for everything which has been committed for the passed in scenes
+func (h *publishChangesHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	changes := make([]*publish.Event, 0, len(scenes))
+
+	for scene, args := range scenes {
+		for _, a := range args {
+			if e := publish.NewChangeEvent(oa.OrgID(), scene.ContactUUID(), a); e != nil {
+				changes = append(changes, e)
+			}
+		}
+	}
+
+	// changes are already committed so a failure to publish is reported but doesn't fail this commit
+	if err := publish.Publish(ctx, rt, changes); err != nil {
+		logrus.WithError(err).WithField("org_id", oa.OrgID()).Error("error publishing change events")
+	}
+
+	return nil
+}
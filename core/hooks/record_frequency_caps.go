@@ -0,0 +1,30 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// RecordFrequencyCapsHook is our hook for counting committed non-conversational messages towards frequency caps
+var RecordFrequencyCapsHook models.EventCommitHook = &recordFrequencyCapsHook{}
+
+type recordFrequencyCapsHook struct{}
+
+// Apply counts the messages of all the scenes towards their contacts' frequency caps
+func (h *recordFrequencyCapsHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	msgs := make([]*models.Msg, 0, len(scenes))
+
+	for _, args := range scenes {
+		for _, m := range args {
+			msgs = append(msgs, m.(*models.Msg))
+		}
+	}
+
+	err := models.RecordFrequencyCapSends(rt, oa.Org(), msgs)
+	return errors.Wrapf(err, "error recording messages towards frequency caps")
+}
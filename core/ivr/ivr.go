@@ -430,7 +430,7 @@ func ResumeIVRFlow(
 
 	// check if call has been marked as errored - it maybe have been updated by status callback
 	if call.Status() == models.CallStatusErrored || call.Status() == models.CallStatusFailed {
-		err = models.ExitSessions(ctx, rt.DB, []models.SessionID{session.ID()}, models.SessionStatusInterrupted)
+		err = models.ExitSessions(ctx, rt, []models.SessionID{session.ID()}, models.SessionStatusInterrupted)
 		if err != nil {
 			logrus.WithError(err).Error("error interrupting session")
 		}
@@ -513,7 +513,7 @@ func ResumeIVRFlow(
 			return errors.Wrapf(err, "error writing ivr response for resume")
 		}
 	} else {
-		err = models.ExitSessions(ctx, rt.DB, []models.SessionID{session.ID()}, models.SessionStatusCompleted)
+		err = models.ExitSessions(ctx, rt, []models.SessionID{session.ID()}, models.SessionStatusCompleted)
 		if err != nil {
 			logrus.WithError(err).Error("error closing session")
 		}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/pkg/errors"
+)
+
+const (
+	// how long we keep stats for broadcast variants
+	broadcastVariantStatsExpire = time.Hour * 24 * 30
+
+	// how long after a broadcast a response from the contact is attributed to the variant they were sent
+	broadcastVariantResponseWindow = time.Hour * 24 * 7
+)
+
+// BroadcastVariant is one of several weighted versions of a broadcast's content
+type BroadcastVariant struct {
+	Name         string                                  `json:"name"         validate:"required"`
+	Weight       int                                     `json:"weight"`
+	Translations map[envs.Language]*BroadcastTranslation `json:"translations" validate:"required"`
+}
+
+// Variants returns the variants of this broadcast if it has any
+func (b *Broadcast) Variants() []*BroadcastVariant { return b.b.Variants }
+
+// AssignVariant deterministically picks the variant for the given contact, weighting the choice by variant weights
+func (b *Broadcast) AssignVariant(contactID ContactID) *BroadcastVariant {
+	variants := b.b.Variants
+	if len(variants) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, v := range variants {
+		total += variantWeight(v)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(fmt.Sprintf("%d:%d", b.b.BroadcastID, contactID)))
+	n := int(h.Sum32() % uint32(total))
+
+	for _, v := range variants {
+		n -= variantWeight(v)
+		if n < 0 {
+			return v
+		}
+	}
+	return variants[len(variants)-1]
+}
+
+// CreateVariantBatch creates a batch of contacts who have all been assigned the given variant
+func (b *Broadcast) CreateVariantBatch(contactIDs []ContactID, variant *BroadcastVariant) *BroadcastBatch {
+	batch := b.CreateBatch(contactIDs)
+	if variant != nil {
+		batch.Variant = variant.Name
+		batch.Translations = variant.Translations
+	}
+	return batch
+}
+
+// variants without a weight are treated as having a weight of one
+func variantWeight(v *BroadcastVariant) int {
+	if v.Weight <= 0 {
+		return 1
+	}
+	return v.Weight
+}
+
+// BroadcastVariantStats are the counts of messages sent and contacts who responded for a broadcast variant
+type BroadcastVariantStats struct {
+	Sent      int `json:"sent"`
+	Responded int `json:"responded"`
+}
+
+// RecordBroadcastVariantSends records that the passed in messages were sent for the given broadcast variant, so that
+// responses from their contacts can be attributed to that variant
+func RecordBroadcastVariantSends(rc redis.Conn, orgID OrgID, broadcastID BroadcastID, variant string, msgs []*Msg) error {
+	statsKey := fmt.Sprintf("broadcast_variant_stats:%d:%d", orgID, broadcastID)
+	attribution := fmt.Sprintf("%d:%d:%s", orgID, broadcastID, variant)
+
+	sent := 0
+	rc.Send("MULTI")
+	for _, m := range msgs {
+		if m.Status() == MsgStatusFailed {
+			continue
+		}
+		rc.Send("SET", fmt.Sprintf("broadcast_variant_contact:%d", m.ContactID()), attribution, "EX", int(broadcastVariantResponseWindow/time.Second))
+		sent++
+	}
+	rc.Send("HINCRBY", statsKey, variant+":sent", sent)
+	rc.Send("EXPIRE", statsKey, int(broadcastVariantStatsExpire/time.Second))
+
+	_, err := rc.Do("EXEC")
+	return errors.Wrapf(err, "error recording sends for broadcast variant")
+}
+
+var broadcastVariantResponseScript = redis.NewScript(1, `
+local contact_key = KEYS[1]
+local stats_expire = tonumber(ARGV[1])
+
+local attribution = redis.call("GET", contact_key)
+if not attribution then
+	return ""
+end
+
+redis.call("DEL", contact_key)
+
+local org_sep = string.find(attribution, ":")
+local sep = string.find(attribution, ":", org_sep + 1)
+local stats_key = "broadcast_variant_stats:" .. string.sub(attribution, 1, sep - 1)
+redis.call("HINCRBY", stats_key, string.sub(attribution, sep + 1) .. ":responded", 1)
+redis.call("EXPIRE", stats_key, stats_expire)
+
+return attribution
+`)
+
+// RecordBroadcastVariantResponse attributes a response from the given contact to the broadcast variant they were last
+// sent, if any, returning that broadcast and variant. Only the first response after a broadcast is counted.
+func RecordBroadcastVariantResponse(rc redis.Conn, contactID ContactID) (BroadcastID, string, error) {
+	contactKey := fmt.Sprintf("broadcast_variant_contact:%d", contactID)
+
+	attribution, err := redis.String(broadcastVariantResponseScript.Do(rc, contactKey, int(broadcastVariantStatsExpire/time.Second)))
+	if err != nil {
+		return NilBroadcastID, "", errors.Wrapf(err, "error recording broadcast variant response")
+	}
+
+	parts := strings.SplitN(attribution, ":", 3)
+	if len(parts) != 3 {
+		return NilBroadcastID, "", nil
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return NilBroadcastID, "", errors.Wrapf(err, "invalid broadcast variant attribution: %s", attribution)
+	}
+	return BroadcastID(id), parts[2], nil
+}
+
+const sqlUpdateMsgBroadcastVariant = `
+UPDATE msgs_msg
+   SET metadata = COALESCE(metadata::jsonb, '{}'::jsonb) || $2::jsonb
+ WHERE id = $1`
+
+// RecordMsgBroadcastVariant records on an incoming message the broadcast and variant that it was a response to
+func RecordMsgBroadcastVariant(ctx context.Context, db Queryer, msgID flows.MsgID, broadcastID BroadcastID, variant string) error {
+	attribution := jsonx.MustMarshal(map[string]interface{}{"broadcast_id": broadcastID, "broadcast_variant": variant})
+
+	_, err := db.ExecContext(ctx, sqlUpdateMsgBroadcastVariant, msgID, string(attribution))
+	return errors.Wrapf(err, "error recording broadcast variant on msg #%d", msgID)
+}
+
+// GetBroadcastVariantStats gets the stats for each variant of the given broadcast
+func GetBroadcastVariantStats(rc redis.Conn, orgID OrgID, broadcastID BroadcastID) (map[string]*BroadcastVariantStats, error) {
+	counts, err := redis.IntMap(rc.Do("HGETALL", fmt.Sprintf("broadcast_variant_stats:%d:%d", orgID, broadcastID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting broadcast variant stats")
+	}
+
+	stats := make(map[string]*BroadcastVariantStats)
+	for field, count := range counts {
+		sep := strings.LastIndex(field, ":")
+		if sep < 0 {
+			continue
+		}
+		variant, counter := field[:sep], field[sep+1:]
+
+		if stats[variant] == nil {
+			stats[variant] = &BroadcastVariantStats{}
+		}
+		if counter == "sent" {
+			stats[variant].Sent = count
+		} else if counter == "responded" {
+			stats[variant].Responded = count
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,122 @@
+package models_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/redisx/assertredis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroadcastVariants(t *testing.T) {
+	bcast := &models.Broadcast{}
+	err := json.Unmarshal([]byte(`{
+		"broadcast_id": 123,
+		"org_id": 1,
+		"base_language": "eng",
+		"translations": {"eng": {"text": "Hi there"}},
+		"variants": [
+			{"name": "A", "weight": 3, "translations": {"eng": {"text": "Hello!"}}},
+			{"name": "B", "weight": 1, "translations": {"eng": {"text": "Howdy!"}}}
+		]
+	}`), bcast)
+	require.NoError(t, err)
+	require.Len(t, bcast.Variants(), 2)
+
+	// assignment is deterministic and roughly follows the weights
+	counts := map[string]int{}
+	for i := 1; i <= 1000; i++ {
+		v := bcast.AssignVariant(models.ContactID(i))
+		assert.Equal(t, v, bcast.AssignVariant(models.ContactID(i)))
+		counts[v.Name]++
+	}
+	assert.InDelta(t, 750, counts["A"], 60)
+	assert.InDelta(t, 250, counts["B"], 60)
+
+	batch := bcast.CreateVariantBatch([]models.ContactID{1, 2}, bcast.Variants()[1])
+	assert.Equal(t, "B", batch.Variant)
+	assert.Equal(t, "Howdy!", batch.Translations["eng"].Text)
+
+	// broadcasts without variants don't assign any
+	bcast = models.NewBroadcast(1, 123, nil, models.TemplateStateUnevaluated, "eng", nil, nil, nil, models.NilTicketID, models.NilUserID)
+	assert.Nil(t, bcast.AssignVariant(models.ContactID(1)))
+
+	batch = bcast.CreateVariantBatch([]models.ContactID{1, 2}, nil)
+	assert.Equal(t, "", batch.Variant)
+}
+
+func TestBroadcastVariantStats(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	oa := testdata.Org1.Load(rt)
+	channel := oa.ChannelByUUID(testdata.TwilioChannel.UUID)
+
+	newMsg := func(contact *testdata.Contact, text string, unsendable flows.UnsendableReason) *models.Msg {
+		_, fc := contact.Load(db, oa)
+		out := flows.NewMsgOut(contact.URN, channel.ChannelReference(), text, nil, nil, nil, flows.NilMsgTopic, unsendable)
+		msg, err := models.NewOutgoingBroadcastMsg(rt, oa.Org(), channel, fc, out, time.Now(), models.NilBroadcastID)
+		require.NoError(t, err)
+		return msg
+	}
+
+	bcastID := models.BroadcastID(123)
+	cathyMsg := newMsg(testdata.Cathy, "Hello!", flows.NilUnsendableReason)
+	bobMsg := newMsg(testdata.Bob, "Howdy!", flows.NilUnsendableReason)
+	georgeMsg := newMsg(testdata.George, "Howdy!", flows.UnsendableReasonNoDestination)
+
+	err := models.RecordBroadcastVariantSends(rc, testdata.Org1.ID, bcastID, "A", []*models.Msg{cathyMsg})
+	require.NoError(t, err)
+	err = models.RecordBroadcastVariantSends(rc, testdata.Org1.ID, bcastID, "B", []*models.Msg{bobMsg, georgeMsg})
+	require.NoError(t, err)
+
+	assertredis.HGetAll(t, rp, fmt.Sprintf("broadcast_variant_stats:1:%d", bcastID), map[string]string{"A:sent": "1", "B:sent": "1"})
+	assertredis.Get(t, rp, fmt.Sprintf("broadcast_variant_contact:%d", testdata.Cathy.ID), "1:123:A")
+
+	// first response from Cathy is attributed to variant A
+	respBcastID, variant, err := models.RecordBroadcastVariantResponse(rc, testdata.Cathy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, bcastID, respBcastID)
+	assert.Equal(t, "A", variant)
+
+	// and can be recorded on her message
+	msgIn := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", models.MsgStatusPending)
+
+	err = models.RecordMsgBroadcastVariant(ctx, db, msgIn.ID(), respBcastID, variant)
+	assert.NoError(t, err)
+	assertdb.Query(t, db, `SELECT metadata::jsonb->>'broadcast_variant' FROM msgs_msg WHERE id = $1`, msgIn.ID()).Returns("A")
+	assertdb.Query(t, db, `SELECT (metadata::jsonb->>'broadcast_id')::int FROM msgs_msg WHERE id = $1`, msgIn.ID()).Returns(123)
+
+	// but later responses aren't
+	respBcastID, variant, err = models.RecordBroadcastVariantResponse(rc, testdata.Cathy.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.NilBroadcastID, respBcastID)
+	assert.Equal(t, "", variant)
+
+	// George's message failed so a response from him isn't attributed
+	_, variant, err = models.RecordBroadcastVariantResponse(rc, testdata.George.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", variant)
+
+	stats, err := models.GetBroadcastVariantStats(rc, testdata.Org1.ID, bcastID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*models.BroadcastVariantStats{"A": {Sent: 1, Responded: 1}, "B": {Sent: 1, Responded: 0}}, stats)
+
+	// stats are scoped by org
+	stats, err = models.GetBroadcastVariantStats(rc, testdata.Org2.ID, bcastID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*models.BroadcastVariantStats{}, stats)
+}
@@ -377,6 +377,27 @@ const sqlDeleteEventFires = `
 DELETE FROM campaigns_eventfire
       WHERE id = ANY($1) AND fired IS NULL`
 
+// RescheduleEventFires changes the scheduled time of the passed in unfired event fires (used when a contact is in quiet hours)
+func RescheduleEventFires(ctx context.Context, db Queryer, fires []*EventFire, scheduled time.Time) error {
+	ids := make([]FireID, 0, len(fires))
+	for _, f := range fires {
+		f.Scheduled = scheduled
+		ids = append(ids, f.FireID)
+	}
+
+	_, err := db.ExecContext(ctx, sqlRescheduleEventFires, pq.Array(ids), scheduled)
+	if err != nil {
+		return errors.Wrapf(err, "error rescheduling event fires")
+	}
+
+	return nil
+}
+
+const sqlRescheduleEventFires = `
+UPDATE campaigns_eventfire
+   SET scheduled = $2
+ WHERE id = ANY($1) AND fired IS NULL`
+
 // EventFireResult represents how a event fire was fired
 type EventFireResult = null.String
 
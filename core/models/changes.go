@@ -0,0 +1,48 @@
+package models
+
+import (
+	"context"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/sirupsen/logrus"
+)
+
+// Change is something which has been committed for a contact outside of the flow engine, i.e. a broadcast message or a
+// session exited by an expiration or interrupt, and which should be published as a change event
+type Change struct {
+	OrgID       OrgID
+	ContactUUID flows.ContactUUID
+	Value       interface{} // *Msg or *ExitedSession
+}
+
+// ChangePublisher is a func which publishes changes
+type ChangePublisher func(context.Context, *runtime.Runtime, []*Change) error
+
+var changePublisher ChangePublisher
+
+// RegisterChangePublisher registers the publisher of changes which are committed outside of the flow engine
+func RegisterChangePublisher(publisher ChangePublisher) {
+	changePublisher = publisher
+}
+
+// PublishChanges publishes the given committed changes with the registered publisher if there is one. Changes are
+// already committed so a failure to publish is logged rather than returned.
+func PublishChanges(ctx context.Context, rt *runtime.Runtime, changes []*Change) {
+	if changePublisher == nil || len(changes) == 0 {
+		return
+	}
+
+	if err := changePublisher(ctx, rt, changes); err != nil {
+		logrus.WithError(err).WithField("count", len(changes)).Error("error publishing change events")
+	}
+}
+
+// PublishExitedSessions publishes session ended events for the given exited sessions
+func PublishExitedSessions(ctx context.Context, rt *runtime.Runtime, sessions []*ExitedSession) {
+	changes := make([]*Change, len(sessions))
+	for i, s := range sessions {
+		changes[i] = &Change{OrgID: s.OrgID, ContactUUID: s.ContactUUID, Value: s}
+	}
+	PublishChanges(ctx, rt, changes)
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const configChannelFallbacks = "channel_fallbacks"
+
+// ChannelFallbacks returns the ordered UUIDs of the channels to fail over to for the given URN scheme. These are
+// configured on the org like {"channel_fallbacks": {"tel": ["<uuid1>", "<uuid2>"]}}.
+func (o *Org) ChannelFallbacks(scheme string) []assets.ChannelUUID {
+	byScheme, _ := o.o.Config.Get(configChannelFallbacks, nil).(map[string]interface{})
+	list, _ := byScheme[scheme].([]interface{})
+
+	uuids := make([]assets.ChannelUUID, 0, len(list))
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			uuids = append(uuids, assets.ChannelUUID(s))
+		}
+	}
+	return uuids
+}
+
+// NextFallbackChannel returns the next eligible channel after the given channel in the org's fallback channels for
+// the given URN, i.e. the first healthy channel after it which can send to that URN, or nil if there isn't one. If
+// the given channel isn't itself a fallback channel, we start from the first fallback channel.
+func NextFallbackChannel(oa *OrgAssets, current *Channel, urn urns.URN) *Channel {
+	fallbacks := oa.Org().ChannelFallbacks(urn.Scheme())
+
+	start := 0
+	if current != nil {
+		for i, uuid := range fallbacks {
+			if uuid == current.UUID() {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	for _, uuid := range fallbacks[start:] {
+		ch := oa.ChannelByUUID(uuid)
+		if ch == nil || ch.Unhealthy() || (current != nil && ch.ID() == current.ID()) {
+			continue
+		}
+		if !utils.StringSliceContains(ch.Schemes(), urn.Scheme(), false) || !hasChannelRole(ch, assets.ChannelRoleSend) {
+			continue
+		}
+		return ch
+	}
+	return nil
+}
+
+// RouteChannel returns the channel a new message to the given URN should be sent on, which is the given channel
+// unless that is unhealthy and the org has an eligible fallback channel
+func RouteChannel(oa *OrgAssets, channel *Channel, urn urns.URN) *Channel {
+	if channel == nil || !channel.Unhealthy() || urn == urns.NilURN {
+		return channel
+	}
+
+	fallback := NextFallbackChannel(oa, channel, urn)
+	if fallback == nil {
+		return channel
+	}
+
+	logrus.WithFields(logrus.Fields{"channel_uuid": channel.UUID(), "fallback_uuid": fallback.UUID()}).Debug("routing message to fallback channel")
+	return fallback
+}
+
+func hasChannelRole(ch *Channel, role assets.ChannelRole) bool {
+	for _, r := range ch.Roles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+var loadMessagesForFailoverSQL = `
+SELECT
+	m.id,
+	m.broadcast_id,
+	m.uuid,
+	m.text,
+	m.created_on,
+	m.modified_on,
+	m.direction,
+	m.status,
+	m.visibility,
+	m.msg_count,
+	m.error_count,
+	m.next_attempt,
+	m.failed_reason,
+	m.high_priority,
+	m.external_id,
+	m.attachments,
+	m.metadata,
+	m.channel_id,
+	m.contact_id,
+	m.contact_urn_id,
+	m.org_id,
+	u.identity AS "urn_urn",
+	u.auth AS "urn_auth"
+FROM
+	msgs_msg m
+INNER JOIN
+	contacts_contacturn u ON u.id = m.contact_urn_id
+WHERE
+	m.direction = 'O' AND
+	m.status = 'F' AND
+	(m.failed_reason IS NULL OR m.failed_reason = 'E') AND
+	m.channel_id IS NOT NULL AND
+	(m.modified_on, m.id) > ($1, $2)
+ORDER BY
+    m.modified_on ASC, m.id ASC
+LIMIT $3`
+
+// GetMessagesForFailover gets up to limit outgoing messages which have been permanently failed by their channel, and
+// were last modified after the given message, i.e. the last message of the previous page, ordered by when they were
+// modified and then id
+func GetMessagesForFailover(ctx context.Context, db Queryer, afterModifiedOn time.Time, afterID flows.MsgID, limit int) ([]*Msg, error) {
+	return loadMessages(ctx, db, loadMessagesForFailoverSQL, afterModifiedOn, afterID, limit)
+}
+
+// FailoverMessages re-routes the passed in failed messages to the next eligible fallback channel for their URNs,
+// marking them as PENDING, and returns those which could be re-routed
+func FailoverMessages(ctx context.Context, db Queryer, oa *OrgAssets, msgs []*Msg) ([]*Msg, error) {
+	updates := make([]interface{}, 0, len(msgs))
+	rerouted := make([]*Msg, 0, len(msgs))
+
+	for _, msg := range msgs {
+		current := oa.ChannelByID(msg.ChannelID())
+		if current == nil {
+			// channel has been removed so can't be a fallback, but we still want to fail over from it
+			current = msg.Channel()
+		}
+
+		fallback := NextFallbackChannel(oa, current, msg.URN())
+		if fallback == nil {
+			continue
+		}
+
+		msg.channel = fallback
+		msg.m.ChannelID = fallback.ID()
+		msg.m.ChannelUUID = fallback.UUID()
+		msg.m.Status = MsgStatusPending
+		msg.m.QueuedOn = dates.Now()
+		msg.m.SentOn = nil
+		msg.m.ErrorCount = 0
+		msg.m.FailedReason = ""
+		msg.m.IsResend = true // queue to courier as a resend since it already exists
+
+		updates = append(updates, msg.m)
+		rerouted = append(rerouted, msg)
+	}
+
+	err := BulkQuery(ctx, "updating messages for failover", db, sqlUpdateMsgForResending, updates)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error updating messages for failover")
+	}
+
+	return rerouted, nil
+}
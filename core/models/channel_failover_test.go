@@ -0,0 +1,101 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelFailover(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	urn := urns.URN("tel:+250700000001")
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg|models.RefreshChannels)
+	require.NoError(t, err)
+
+	twilio := oa.ChannelByID(testdata.TwilioChannel.ID)
+	vonage := oa.ChannelByID(testdata.VonageChannel.ID)
+
+	// no fallbacks configured and channels are healthy
+	assert.Equal(t, []assets.ChannelUUID{}, oa.Org().ChannelFallbacks("tel"))
+	assert.False(t, twilio.Unhealthy())
+	assert.Nil(t, models.NextFallbackChannel(oa, twilio, urn))
+	assert.Equal(t, twilio, models.RouteChannel(oa, twilio, urn))
+
+	// configure Vonage as the fallback for tel URNs and flag the Twilio channel as disconnected
+	db.MustExec(fmt.Sprintf(`UPDATE orgs_org SET config = '{"channel_fallbacks": {"tel": ["%s", "%s"]}}' WHERE id = $1`, testdata.TwilioChannel.UUID, testdata.VonageChannel.UUID), testdata.Org1.ID)
+	db.MustExec(`INSERT INTO notifications_incident(org_id, incident_type, scope, started_on, channel_id) VALUES($1, 'channel:disconnected', $2, NOW(), $2)`, testdata.Org1.ID, testdata.TwilioChannel.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg|models.RefreshChannels)
+	require.NoError(t, err)
+
+	twilio = oa.ChannelByID(testdata.TwilioChannel.ID)
+	vonage = oa.ChannelByID(testdata.VonageChannel.ID)
+
+	assert.Equal(t, []assets.ChannelUUID{testdata.TwilioChannel.UUID, testdata.VonageChannel.UUID}, oa.Org().ChannelFallbacks("tel"))
+	assert.Equal(t, []assets.ChannelUUID{}, oa.Org().ChannelFallbacks("twitter"))
+	assert.True(t, twilio.Unhealthy())
+	assert.False(t, vonage.Unhealthy())
+
+	// new messages on Twilio go to Vonage instead, but healthy Vonage isn't re-routed
+	assert.Equal(t, vonage, models.RouteChannel(oa, twilio, urn))
+	assert.Equal(t, vonage, models.RouteChannel(oa, vonage, urn))
+
+	// there's nothing after Vonage, and Twilio is unhealthy so we can't go back to it
+	assert.Nil(t, models.NextFallbackChannel(oa, vonage, urn))
+	assert.Equal(t, vonage, models.NextFallbackChannel(oa, nil, urn))
+
+	// no fallbacks for other schemes
+	assert.Nil(t, models.NextFallbackChannel(oa, twilio, urns.URN("twitter:bob")))
+
+	// a message permanently failed by Twilio can be failed over to Vonage
+	out := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", nil, models.MsgStatusFailed, false)
+	db.MustExec(`UPDATE msgs_msg SET modified_on = NOW() WHERE id = $1`, out.ID())
+
+	// and another failed at the same time
+	out2 := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "Hi", nil, models.MsgStatusFailed, false)
+	db.MustExec(`UPDATE msgs_msg SET modified_on = (SELECT modified_on FROM msgs_msg WHERE id = $2) WHERE id = $1`, out2.ID(), out.ID())
+
+	// failed messages are fetched in pages ordered by when they were modified and their ids
+	msgs, err := models.GetMessagesForFailover(ctx, db, time.Now().Add(-time.Minute), flows.NilMsgID, 1)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, out.ID(), msgs[0].ID())
+
+	page2, err := models.GetMessagesForFailover(ctx, db, msgs[0].ModifiedOn(), msgs[0].ID(), 1)
+	require.NoError(t, err)
+	require.Len(t, page2, 1)
+	assert.Equal(t, out2.ID(), page2[0].ID())
+
+	page3, err := models.GetMessagesForFailover(ctx, db, page2[0].ModifiedOn(), page2[0].ID(), 1)
+	require.NoError(t, err)
+	assert.Len(t, page3, 0)
+
+	rerouted, err := models.FailoverMessages(ctx, db, oa, msgs)
+	assert.NoError(t, err)
+	assert.Len(t, rerouted, 1)
+	assert.Equal(t, testdata.VonageChannel.ID, rerouted[0].ChannelID())
+	assert.True(t, rerouted[0].IsResend())
+
+	assertdb.Query(t, db, `SELECT status, channel_id FROM msgs_msg WHERE id = $1`, out.ID()).Columns(map[string]interface{}{"status": "P", "channel_id": int64(testdata.VonageChannel.ID)})
+
+	// but if it then fails on Vonage, there's nowhere left to go
+	msgs[0].SetChannel(vonage)
+	rerouted, err = models.FailoverMessages(ctx, db, oa, msgs)
+	assert.NoError(t, err)
+	assert.Len(t, rerouted, 0)
+}
@@ -55,6 +55,7 @@ type Channel struct {
 		AllowInternational bool                     `json:"allow_international"`
 		MachineDetection   bool                     `json:"machine_detection"`
 		Config             map[string]interface{}   `json:"config"`
+		Unhealthy          bool                     `json:"unhealthy"`
 	}
 }
 
@@ -97,6 +98,9 @@ func (c *Channel) MachineDetection() bool { return c.c.MachineDetection }
 // Parent returns a reference to the parent channel of this channel (if any)
 func (c *Channel) Parent() *assets.ChannelReference { return c.c.Parent }
 
+// Unhealthy returns whether this channel has an open incident, e.g. it's disconnected
+func (c *Channel) Unhealthy() bool { return c.c.Unhealthy }
+
 // Config returns the config for this channel
 func (c *Channel) Config() map[string]interface{} { return c.c.Config }
 
@@ -210,7 +214,8 @@ SELECT ROW_TO_JSON(r) FROM (SELECT
 	) as roles,
 	JSON_EXTRACT_PATH(c.config::json, 'matching_prefixes') as match_prefixes,
 	JSON_EXTRACT_PATH(c.config::json, 'allow_international') as allow_international,
-	JSON_EXTRACT_PATH(c.config::json, 'machine_detection') as machine_detection
+	JSON_EXTRACT_PATH(c.config::json, 'machine_detection') as machine_detection,
+	EXISTS(SELECT 1 FROM notifications_incident i WHERE i.channel_id = c.id AND i.ended_on IS NULL) as unhealthy
 FROM 
 	channels_channel c
 WHERE 
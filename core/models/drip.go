@@ -0,0 +1,124 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// how long we keep the progress of a drip fed job after its estimated completion
+const dripProgressExpire = time.Hour * 24 * 7
+
+// DripKind is the kind of job whose batches are being drip fed
+type DripKind string
+
+// drip kind constants
+const (
+	DripKindStart     = DripKind("start")
+	DripKindBroadcast = DripKind("broadcast")
+)
+
+// DripFeed spaces out the release of batches of contacts so that they're processed at a given number of contacts per
+// minute rather than all at once
+type DripFeed struct {
+	rate      int
+	start     time.Time
+	batchSize int
+	released  int
+}
+
+// NewDripFeed creates a new drip feed for the given rate, or returns nil if the rate isn't positive
+func NewDripFeed(contactsPerMinute int, start time.Time) *DripFeed {
+	if contactsPerMinute <= 0 {
+		return nil
+	}
+	return &DripFeed{rate: contactsPerMinute, start: start, batchSize: contactsPerMinute}
+}
+
+// BatchSize returns the size of batches to release, which is never more than a minute's worth of contacts
+func (d *DripFeed) BatchSize(max int) int {
+	d.batchSize = max
+	if d.rate < max {
+		d.batchSize = d.rate
+	}
+	return d.batchSize
+}
+
+// Release returns when a batch of the given size should be released, given all the batches released before it
+func (d *DripFeed) Release(size int) time.Time {
+	at := d.start.Add(time.Duration(d.released) * time.Minute / time.Duration(d.rate))
+	d.released += size
+	return at
+}
+
+// ETA returns when the last batch of the given number of contacts will be released, which is when all the contacts
+// before that batch have been released. This assumes only the last batch is smaller than the batch size.
+func (d *DripFeed) ETA(total int) time.Time {
+	lastBatch := total % d.batchSize
+	if lastBatch == 0 {
+		lastBatch = d.batchSize
+	}
+	return d.start.Add(time.Duration(total-lastBatch) * time.Minute / time.Duration(d.rate))
+}
+
+// DripProgress is the progress of a drip fed start or broadcast
+type DripProgress struct {
+	ContactsPerMinute int       `json:"contacts_per_minute"`
+	Total             int       `json:"total"`
+	Processed         int       `json:"processed"`
+	StartedOn         time.Time `json:"started_on"`
+	ETA               time.Time `json:"eta"`
+}
+
+func dripProgressKey(kind DripKind, orgID OrgID, id int) string {
+	return fmt.Sprintf("drip_progress:%s:%d:%d", kind, orgID, id)
+}
+
+// StartDripProgress starts tracking the progress of the given drip fed job, whose last batch is released at eta
+func StartDripProgress(rc redis.Conn, kind DripKind, orgID OrgID, id int, d *DripFeed, total int, eta time.Time) error {
+	key := dripProgressKey(kind, orgID, id)
+
+	rc.Send("MULTI")
+	rc.Send("HSET", key, "contacts_per_minute", d.rate, "total", total, "processed", 0, "started_on", d.start.Format(time.RFC3339Nano), "eta", eta.Format(time.RFC3339Nano))
+	rc.Send("EXPIRE", key, int((eta.Sub(d.start)+dripProgressExpire)/time.Second))
+
+	_, err := rc.Do("EXEC")
+	return errors.Wrapf(err, "error starting progress for drip fed %s", kind)
+}
+
+var recordDripProgressScript = redis.NewScript(1, `
+local key, count = KEYS[1], tonumber(ARGV[1])
+
+if redis.call("EXISTS", key) == 1 then
+	redis.call("HINCRBY", key, "processed", count)
+end
+`)
+
+// RecordDripProgress records that the given number of contacts have been processed for the given job, which is a
+// no-op if that job isn't being drip fed
+func RecordDripProgress(rc redis.Conn, kind DripKind, orgID OrgID, id int, count int) error {
+	_, err := recordDripProgressScript.Do(rc, dripProgressKey(kind, orgID, id), count)
+	return errors.Wrapf(err, "error recording progress for drip fed %s", kind)
+}
+
+// GetDripProgress gets the progress of the given drip fed job, or nil if it isn't being drip fed
+func GetDripProgress(rc redis.Conn, kind DripKind, orgID OrgID, id int) (*DripProgress, error) {
+	values, err := redis.StringMap(rc.Do("HGETALL", dripProgressKey(kind, orgID, id)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting progress for drip fed %s", kind)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	p := &DripProgress{}
+	p.ContactsPerMinute, _ = strconv.Atoi(values["contacts_per_minute"])
+	p.Total, _ = strconv.Atoi(values["total"])
+	p.Processed, _ = strconv.Atoi(values["processed"])
+	p.StartedOn, _ = time.Parse(time.RFC3339Nano, values["started_on"])
+	p.ETA, _ = time.Parse(time.RFC3339Nano, values["eta"])
+	return p, nil
+}
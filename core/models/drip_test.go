@@ -0,0 +1,85 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDripFeed(t *testing.T) {
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, models.NewDripFeed(0, start))
+
+	// a slow rate means batches are no bigger than a minute's worth of contacts
+	drip := models.NewDripFeed(80, start)
+	assert.Equal(t, 80, drip.BatchSize(100))
+	assert.Equal(t, start, drip.Release(80))
+	assert.Equal(t, start.Add(time.Minute), drip.Release(80))
+	assert.Equal(t, start.Add(2*time.Minute), drip.Release(20))
+	assert.Equal(t, start.Add(135*time.Second), drip.Release(0))
+	assert.Equal(t, start.Add(149*time.Minute), drip.ETA(12000)) // last batch of 80 released after the first 11920
+	assert.Equal(t, start.Add(2*time.Minute), drip.ETA(200))     // last batch of 40 released after the first 160
+
+	// a fast rate means several batches per minute
+	drip = models.NewDripFeed(400, start)
+	assert.Equal(t, 100, drip.BatchSize(100))
+	assert.Equal(t, start, drip.Release(100))
+	assert.Equal(t, start.Add(15*time.Second), drip.Release(100))
+	assert.Equal(t, start.Add(30*time.Second), drip.Release(100))
+	assert.Equal(t, start.Add(45*time.Second), drip.ETA(400))
+	assert.Equal(t, start, drip.ETA(50))
+}
+
+func TestDripProgress(t *testing.T) {
+	_, _, _, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// nothing recorded for starts which aren't being drip fed
+	err := models.RecordDripProgress(rc, models.DripKindStart, testdata.Org1.ID, 123, 100)
+	assert.NoError(t, err)
+
+	progress, err := models.GetDripProgress(rc, models.DripKindStart, testdata.Org1.ID, 123)
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+
+	drip := models.NewDripFeed(80, start)
+	err = models.StartDripProgress(rc, models.DripKindStart, testdata.Org1.ID, 123, drip, 1000, drip.ETA(1000))
+	require.NoError(t, err)
+
+	err = models.RecordDripProgress(rc, models.DripKindStart, testdata.Org1.ID, 123, 80)
+	assert.NoError(t, err)
+	err = models.RecordDripProgress(rc, models.DripKindStart, testdata.Org1.ID, 123, 80)
+	assert.NoError(t, err)
+
+	progress, err = models.GetDripProgress(rc, models.DripKindStart, testdata.Org1.ID, 123)
+	assert.NoError(t, err)
+	assert.Equal(t, &models.DripProgress{
+		ContactsPerMinute: 80,
+		Total:             1000,
+		Processed:         160,
+		StartedOn:         start,
+		ETA:               start.Add(720 * time.Second),
+	}, progress)
+
+	// progress is scoped by kind and org
+	progress, err = models.GetDripProgress(rc, models.DripKindBroadcast, testdata.Org1.ID, 123)
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+
+	progress, err = models.GetDripProgress(rc, models.DripKindStart, testdata.Org2.ID, 123)
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/goflow/flows"
@@ -9,6 +10,7 @@ import (
 	"github.com/nyaruka/goflow/flows/modifiers"
 	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	"github.com/pkg/errors"
 )
 
@@ -72,6 +74,11 @@ func (s *Scene) AppendToEventPostCommitHook(hook EventCommitHook, event interfac
 	s.postCommits[hook] = append(s.postCommits[hook], event)
 }
 
+// PostCommitEvents returns the events which have been added to the passed in post commit hook
+func (s *Scene) PostCommitEvents(hook EventCommitHook) []interface{} {
+	return s.postCommits[hook]
+}
+
 // EventHandler defines a call for handling events that occur in a flow
 type EventHandler func(context.Context, *runtime.Runtime, *sqlx.Tx, *OrgAssets, *Scene, flows.Event) error
 
@@ -102,7 +109,10 @@ func RegisterEventPreWriteHandler(eventType string, handler EventHandler) {
 }
 
 // HandleEvents handles the passed in event, IE, creates the db objects required etc..
-func HandleEvents(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *OrgAssets, scene *Scene, events []flows.Event) error {
+func HandleEvents(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *OrgAssets, scene *Scene, events []flows.Event) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "handle events", tracing.OrgID(int64(oa.OrgID())), tracing.ContactID(int64(scene.ContactID())))
+	defer func() { tracing.EndSpan(span, err) }()
+
 	for _, e := range events {
 
 		handler, found := eventHandlers[e.Type()]
@@ -151,7 +161,7 @@ func ApplyEventPreCommitHooks(ctx context.Context, rt *runtime.Runtime, tx *sqlx
 
 	// now fire each of our hooks
 	for hook, args := range preHooks {
-		err := hook.Apply(ctx, rt, tx, oa, args)
+		err := applyHook(ctx, rt, tx, oa, "pre", hook, args)
 		if err != nil {
 			return errors.Wrapf(err, "error applying pre commit hook: %T", hook)
 		}
@@ -177,7 +187,7 @@ func ApplyEventPostCommitHooks(ctx context.Context, rt *runtime.Runtime, tx *sql
 
 	// now fire each of our hooks
 	for hook, args := range postHooks {
-		err := hook.Apply(ctx, rt, tx, oa, args)
+		err := applyHook(ctx, rt, tx, oa, "post", hook, args)
 		if err != nil {
 			return errors.Wrapf(err, "error applying post commit hook: %v", hook)
 		}
@@ -186,6 +196,14 @@ func ApplyEventPostCommitHooks(ctx context.Context, rt *runtime.Runtime, tx *sql
 	return nil
 }
 
+// applies a single commit hook inside its own span
+func applyHook(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *OrgAssets, kind string, hook EventCommitHook, scenes map[*Scene][]interface{}) error {
+	ctx, span := tracing.StartSpan(ctx, fmt.Sprintf("%s commit hook %T", kind, hook), tracing.OrgID(int64(oa.OrgID())))
+	err := hook.Apply(ctx, rt, tx, oa, scenes)
+	tracing.EndSpan(span, err)
+	return err
+}
+
 // HandleAndCommitEvents takes a set of contacts and events, handles the events and applies any hooks, and commits everything
 func HandleAndCommitEvents(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, userID UserID, contactEvents map[*flows.Contact][]flows.Event) error {
 	// create scenes for each contact
@@ -0,0 +1,242 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	configFrequencyCapDaily  = "frequency_cap_daily"
+	configFrequencyCapWeekly = "frequency_cap_weekly"
+	configFrequencyCapAction = "frequency_cap_action"
+)
+
+// what we do with broadcasts and campaign events for contacts who have reached a frequency cap
+const (
+	FrequencyCapFail  = "fail"  // fail their messages
+	FrequencyCapDefer = "defer" // defer them until the cap resets
+)
+
+const (
+	frequencyCapDayExpire  = 60 * 60 * 24 * 2
+	frequencyCapWeekExpire = 60 * 60 * 24 * 14
+)
+
+// FrequencyCaps are the maximum numbers of non-conversational messages, i.e. broadcasts and messages from campaign
+// flows which aren't replies, that a contact can be sent per day and per week in the org's timezone. Zero means no cap.
+type FrequencyCaps struct {
+	Daily    int
+	Weekly   int
+	Timezone *time.Location
+	Action   string
+}
+
+// FrequencyCaps returns the frequency caps of this org or nil if it doesn't have any
+func (o *Org) FrequencyCaps() *FrequencyCaps {
+	daily := o.configInt(configFrequencyCapDaily)
+	weekly := o.configInt(configFrequencyCapWeekly)
+	if daily <= 0 && weekly <= 0 {
+		return nil
+	}
+
+	action := o.ConfigValue(configFrequencyCapAction, FrequencyCapFail)
+	if action != FrequencyCapDefer {
+		action = FrequencyCapFail
+	}
+
+	return &FrequencyCaps{Daily: daily, Weekly: weekly, Timezone: o.Timezone(), Action: action}
+}
+
+// returns the keys of the hashes which hold the counts of messages sent to each contact on the day and in the week of now
+func (c *FrequencyCaps) keys(now time.Time) (string, string) {
+	now = now.In(c.Timezone)
+	year, week := now.ISOWeek()
+	return fmt.Sprintf("msg_frequency:day:%s", now.Format("2006-01-02")), fmt.Sprintf("msg_frequency:week:%d-%02d", year, week)
+}
+
+// returns when a contact with the given counts can be sent to again, or the zero time if they haven't reached a cap
+func (c *FrequencyCaps) resetsAt(now time.Time, daily, weekly int) time.Time {
+	now = now.In(c.Timezone)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, c.Timezone)
+
+	if c.Weekly > 0 && weekly >= c.Weekly {
+		daysToMonday := 7 - (int(now.Weekday())+6)%7
+		return midnight.AddDate(0, 0, daysToMonday)
+	}
+	if c.Daily > 0 && daily >= c.Daily {
+		return midnight.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// gets the numbers of messages already sent to each of the given contacts on the day and in the week of now
+func (c *FrequencyCaps) counts(rc redis.Conn, contactIDs []ContactID, now time.Time) (map[ContactID]int, map[ContactID]int, error) {
+	daily := make(map[ContactID]int, len(contactIDs))
+	weekly := make(map[ContactID]int, len(contactIDs))
+	if len(contactIDs) == 0 {
+		return daily, weekly, nil
+	}
+
+	dayKey, weekKey := c.keys(now)
+
+	dayArgs := redis.Args{}.Add(dayKey).AddFlat(contactIDs)
+	weekArgs := redis.Args{}.Add(weekKey).AddFlat(contactIDs)
+
+	rc.Send("HMGET", dayArgs...)
+	rc.Send("HMGET", weekArgs...)
+	rc.Flush()
+
+	dayCounts, err := redis.Ints(rc.Receive())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error reading daily msg frequencies")
+	}
+	weekCounts, err := redis.Ints(rc.Receive())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error reading weekly msg frequencies")
+	}
+
+	for i, id := range contactIDs {
+		daily[id] = dayCounts[i]
+		weekly[id] = weekCounts[i]
+	}
+	return daily, weekly, nil
+}
+
+// gets when each of the given contacts who have reached a cap can be sent to again
+func (c *FrequencyCaps) capped(rc redis.Conn, contactIDs []ContactID, now time.Time) (map[ContactID]time.Time, error) {
+	daily, weekly, err := c.counts(rc, contactIDs, now)
+	if err != nil {
+		return nil, err
+	}
+
+	capped := make(map[ContactID]time.Time)
+	for _, id := range contactIDs {
+		if until := c.resetsAt(now, daily[id], weekly[id]); !until.IsZero() {
+			capped[id] = until
+		}
+	}
+	return capped, nil
+}
+
+// ApplyFrequencyCaps fails those of the passed in non-conversational messages whose contacts have reached one of the
+// org's frequency caps. Messages earlier in the slice to the same contact which aren't failed are counted as pending,
+// as messages which are sent are only counted towards the caps by RecordFrequencyCapSends once they've been committed.
+func ApplyFrequencyCaps(rt *runtime.Runtime, org *Org, msgs []*Msg) error {
+	caps := org.FrequencyCaps()
+	if caps == nil || len(msgs) == 0 {
+		return nil
+	}
+
+	contactIDs := make([]ContactID, 0, len(msgs))
+	pending := make(map[ContactID]int, len(msgs))
+	for _, m := range msgs {
+		if _, seen := pending[m.ContactID()]; !seen {
+			contactIDs = append(contactIDs, m.ContactID())
+			pending[m.ContactID()] = 0
+		}
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	now := dates.Now()
+
+	daily, weekly, err := caps.counts(rc, contactIDs, now)
+	if err != nil {
+		return errors.Wrap(err, "error checking msg frequency caps")
+	}
+
+	for _, m := range msgs {
+		if m.Status() == MsgStatusFailed {
+			continue
+		}
+
+		id := m.ContactID()
+		if until := caps.resetsAt(now, daily[id]+pending[id], weekly[id]+pending[id]); !until.IsZero() {
+			m.m.Status = MsgStatusFailed
+			m.m.FailedReason = MsgFailedFrequencyCap
+
+			logrus.WithFields(logrus.Fields{"contact_id": id, "daily_cap": caps.Daily, "weekly_cap": caps.Weekly}).Info("contact over frequency cap, failing message")
+		} else {
+			pending[id]++
+		}
+	}
+
+	return nil
+}
+
+// DeferCappedContacts splits the passed in contacts into those who can be sent non-conversational messages now, and
+// those who have reached one of the org's frequency caps grouped by when those caps reset. Contacts are only deferred
+// if the org's frequency cap action is to defer.
+func DeferCappedContacts(rt *runtime.Runtime, org *Org, contactIDs []ContactID, now time.Time) ([]ContactID, map[time.Time][]ContactID, error) {
+	caps := org.FrequencyCaps()
+	if caps == nil || caps.Action != FrequencyCapDefer {
+		return contactIDs, nil, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	capped, err := caps.capped(rc, contactIDs, now)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error checking msg frequency caps")
+	}
+
+	sendNow := make([]ContactID, 0, len(contactIDs))
+	deferred := make(map[time.Time][]ContactID)
+	for _, id := range contactIDs {
+		if until, isCapped := capped[id]; isCapped {
+			deferred[until] = append(deferred[until], id)
+		} else {
+			sendNow = append(sendNow, id)
+		}
+	}
+	return sendNow, deferred, nil
+}
+
+// RecordFrequencyCapSends counts the passed in committed non-conversational messages towards their contacts' frequency
+// caps, ignoring those which were failed
+func RecordFrequencyCapSends(rt *runtime.Runtime, org *Org, msgs []*Msg) error {
+	caps := org.FrequencyCaps()
+	if caps == nil {
+		return nil
+	}
+
+	dayKey, weekKey := caps.keys(dates.Now())
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	rc.Send("MULTI")
+	for _, m := range msgs {
+		if m.Status() == MsgStatusFailed {
+			continue
+		}
+		rc.Send("HINCRBY", dayKey, m.ContactID(), 1)
+		rc.Send("HINCRBY", weekKey, m.ContactID(), 1)
+	}
+	rc.Send("EXPIRE", dayKey, frequencyCapDayExpire)
+	rc.Send("EXPIRE", weekKey, frequencyCapWeekExpire)
+
+	_, err := rc.Do("EXEC")
+	return errors.Wrap(err, "error recording msg frequencies")
+}
+
+// gets an integer config value which may have been saved as a JSON number or a string, returning zero if not set or invalid
+func (o *Org) configInt(key string) int {
+	switch v := o.o.Config.Get(key, nil).(type) {
+	case float64:
+		return int(v)
+	case string:
+		i, _ := strconv.Atoi(v)
+		return i
+	}
+	return 0
+}
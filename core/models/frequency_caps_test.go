@@ -0,0 +1,113 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/redisx/assertredis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrequencyCaps(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetRedis | testsuite.ResetData)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)))
+
+	oa := testdata.Org1.Load(rt)
+	assert.Nil(t, oa.Org().FrequencyCaps())
+
+	db.MustExec(`UPDATE orgs_org SET timezone = 'UTC', config = '{"frequency_cap_daily": 2, "frequency_cap_weekly": "3"}' WHERE id = $1`, testdata.Org1.ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+	assert.Equal(t, 2, oa.Org().FrequencyCaps().Daily)
+	assert.Equal(t, 3, oa.Org().FrequencyCaps().Weekly)
+
+	channel := oa.ChannelByUUID(testdata.TwilioChannel.UUID)
+	_, cathy := testdata.Cathy.Load(db, oa)
+
+	newMsg := func() *models.Msg {
+		out := flows.NewMsgOut(testdata.Cathy.URN, channel.ChannelReference(), "Blast", nil, nil, nil, flows.NilMsgTopic, flows.NilUnsendableReason)
+		msg, err := models.NewOutgoingBroadcastMsg(rt, oa.Org(), channel, cathy, out, dates.Now(), models.NilBroadcastID)
+		require.NoError(t, err)
+		return msg
+	}
+
+	// sends a message to cathy, applying the caps and recording it if it's sent
+	assertCapped := func(expected bool) {
+		msg := newMsg()
+		err := models.ApplyFrequencyCaps(rt, oa.Org(), []*models.Msg{msg})
+		assert.NoError(t, err)
+
+		if expected {
+			assert.Equal(t, models.MsgStatusFailed, msg.Status())
+			assert.Equal(t, models.MsgFailedFrequencyCap, msg.FailedReason())
+		} else {
+			assert.Equal(t, models.MsgStatusQueued, msg.Status())
+			assert.Equal(t, models.NilMsgFailedReason, msg.FailedReason())
+		}
+
+		err = models.RecordFrequencyCapSends(rt, oa.Org(), []*models.Msg{msg})
+		assert.NoError(t, err)
+	}
+
+	// messages which are never committed and recorded don't count
+	msg := newMsg()
+	assert.NoError(t, models.ApplyFrequencyCaps(rt, oa.Org(), []*models.Msg{msg}))
+	assert.Equal(t, models.MsgStatusQueued, msg.Status())
+
+	// but earlier messages to the same contact in the same batch do
+	msgs := []*models.Msg{newMsg(), newMsg(), newMsg()}
+	assert.NoError(t, models.ApplyFrequencyCaps(rt, oa.Org(), msgs))
+	assert.Equal(t, models.MsgStatusQueued, msgs[0].Status())
+	assert.Equal(t, models.MsgStatusQueued, msgs[1].Status())
+	assert.Equal(t, models.MsgStatusFailed, msgs[2].Status())
+	assert.Equal(t, models.MsgFailedFrequencyCap, msgs[2].FailedReason())
+
+	// first two messages are allowed, third hits the daily cap
+	assertCapped(false)
+	assertCapped(false)
+	assertCapped(true)
+
+	assertredis.HGetAll(t, rp, "msg_frequency:day:2022-06-01", map[string]string{"10000": "2"})
+	assertredis.HGetAll(t, rp, "msg_frequency:week:2022-22", map[string]string{"10000": "2"})
+
+	// by default capped contacts aren't deferred
+	now, deferred, err := models.DeferCappedContacts(rt, oa.Org(), []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, dates.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, now)
+	assert.Nil(t, deferred)
+
+	// next day we can send one more before hitting the weekly cap
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2022, 6, 2, 12, 0, 0, 0, time.UTC)))
+
+	assertCapped(false)
+	assertCapped(true)
+
+	// if the org defers capped contacts, cathy is deferred until the cap resets at the start of next week
+	db.MustExec(`UPDATE orgs_org SET config = '{"frequency_cap_daily": 2, "frequency_cap_weekly": "3", "frequency_cap_action": "defer"}' WHERE id = $1`, testdata.Org1.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+	assert.Equal(t, models.FrequencyCapDefer, oa.Org().FrequencyCaps().Action)
+
+	now, deferred, err = models.DeferCappedContacts(rt, oa.Org(), []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, dates.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Bob.ID}, now)
+	assert.Equal(t, map[time.Time][]models.ContactID{time.Date(2022, 6, 6, 0, 0, 0, 0, time.UTC): {testdata.Cathy.ID}}, deferred)
+
+	// and next week we can send again
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2022, 6, 6, 12, 0, 0, 0, time.UTC)))
+
+	assertCapped(false)
+}
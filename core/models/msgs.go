@@ -86,6 +86,7 @@ const (
 	MsgFailedTooOld         = MsgFailedReason("O")
 	MsgFailedNoDestination  = MsgFailedReason("D")
 	MsgFailedChannelRemoved = MsgFailedReason("R")
+	MsgFailedFrequencyCap   = MsgFailedReason("Q") // contact over org's frequency caps
 )
 
 var unsendableToFailedReason = map[flows.UnsendableReason]MsgFailedReason{
@@ -659,6 +660,11 @@ func MarkMessagesQueued(ctx context.Context, db Queryer, msgs []*Msg) error {
 	return updateMessageStatus(ctx, db, msgs, MsgStatusQueued)
 }
 
+// MarkMessagesWired marks the passed in messages as wired(W)
+func MarkMessagesWired(ctx context.Context, db Queryer, msgs []*Msg) error {
+	return updateMessageStatus(ctx, db, msgs, MsgStatusWired)
+}
+
 func updateMessageStatus(ctx context.Context, db Queryer, msgs []*Msg, status MsgStatus) error {
 	is := make([]interface{}, len(msgs))
 	for i, msg := range msgs {
@@ -705,6 +711,10 @@ type Broadcast struct {
 		CreatedByID   UserID                                  `json:"created_by_id,omitempty" db:"created_by_id"`
 		ParentID      BroadcastID                             `json:"parent_id,omitempty"     db:"parent_id"`
 		TicketID      TicketID                                `json:"ticket_id,omitempty"     db:"ticket_id"`
+		Variants      []*BroadcastVariant                     `json:"variants,omitempty"`
+		Metadata      null.Map                                `json:"-"                       db:"metadata"`
+
+		ContactsPerMinute int `json:"contacts_per_minute,omitempty"` // if set, batches are drip fed at this rate
 	}
 }
 
@@ -718,10 +728,24 @@ func (b *Broadcast) BaseLanguage() envs.Language                           { ret
 func (b *Broadcast) Translations() map[envs.Language]*BroadcastTranslation { return b.b.Translations }
 func (b *Broadcast) TemplateState() TemplateState                          { return b.b.TemplateState }
 func (b *Broadcast) TicketID() TicketID                                    { return b.b.TicketID }
+func (b *Broadcast) ContactsPerMinute() int                                { return b.b.ContactsPerMinute }
 
 func (b *Broadcast) MarshalJSON() ([]byte, error)    { return json.Marshal(b.b) }
 func (b *Broadcast) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &b.b) }
 
+// builds the metadata we save on a broadcast, which is where its variants and drip feed rate are persisted so that
+// they're not lost by broadcasts which are scheduled
+func (b *Broadcast) metadata() null.Map {
+	metadata := make(map[string]interface{})
+	if len(b.b.Variants) > 0 {
+		metadata["variants"] = b.b.Variants
+	}
+	if b.b.ContactsPerMinute > 0 {
+		metadata["contacts_per_minute"] = b.b.ContactsPerMinute
+	}
+	return null.NewMap(metadata)
+}
+
 // NewBroadcast creates a new broadcast with the passed in parameters
 func NewBroadcast(
 	orgID OrgID, id BroadcastID, translations map[envs.Language]*BroadcastTranslation,
@@ -757,6 +781,9 @@ func InsertChildBroadcast(ctx context.Context, db Queryer, parent *Broadcast) (*
 		parent.b.CreatedByID,
 	)
 	child.b.ParentID = parent.ID()
+	child.b.Variants = parent.b.Variants
+	child.b.Metadata = parent.metadata()
+	child.b.ContactsPerMinute = parent.b.ContactsPerMinute
 
 	// populate text from our translations
 	child.b.Text.Map = make(map[string]sql.NullString)
@@ -842,8 +869,8 @@ type broadcastGroup struct {
 
 const insertBroadcastSQL = `
 INSERT INTO
-	msgs_broadcast( org_id,  parent_id,  ticket_id, created_on, modified_on, status,  text,  base_language, send_all, is_active)
-			VALUES(:org_id, :parent_id, :ticket_id, NOW()     , NOW(),       'Q',    :text, :base_language, FALSE,    TRUE)
+	msgs_broadcast( org_id,  parent_id,  ticket_id, created_on, modified_on, status,  text,  base_language, metadata,  send_all, is_active)
+			VALUES(:org_id, :parent_id, :ticket_id, NOW()     , NOW(),       'Q',    :text, :base_language, :metadata, FALSE,    TRUE)
 RETURNING
 	id
 `
@@ -921,8 +948,89 @@ type BroadcastBatch struct {
 	OrgID         OrgID                                   `json:"org_id"`
 	CreatedByID   UserID                                  `json:"created_by_id"`
 	TicketID      TicketID                                `json:"ticket_id"`
+	Variant       string                                  `json:"variant,omitempty"`
+	DeferredUntil *time.Time                              `json:"deferred_until,omitempty"`
+}
+
+// IdempotencyKey returns the key which ensures this batch is only queued once, assuming that batches of the same
+// broadcast never share contacts
+func (b *BroadcastBatch) IdempotencyKey() string {
+	if b.BroadcastID == NilBroadcastID {
+		return ""
+	}
+
+	first := NilContactID
+	for _, id := range b.ContactIDs {
+		if first == NilContactID || id < first {
+			first = id
+		}
+	}
+	for id := range b.URNs {
+		if first == NilContactID || id < first {
+			first = id
+		}
+	}
+	if first == NilContactID {
+		return ""
+	}
+
+	if b.DeferredUntil != nil {
+		return fmt.Sprintf("broadcast_batch:%d:%d:%d", b.BroadcastID, first, b.DeferredUntil.Unix())
+	}
+	return fmt.Sprintf("broadcast_batch:%d:%d", b.BroadcastID, first)
 }
 
+// ExcludeSent returns a copy of this batch without the contacts which have already been sent messages by its broadcast,
+// e.g. before a previous attempt to send this batch failed
+func (b *BroadcastBatch) ExcludeSent(ctx context.Context, db Queryer) (*BroadcastBatch, error) {
+	if b.BroadcastID == NilBroadcastID {
+		return b, nil
+	}
+
+	contactIDs := make([]ContactID, 0, len(b.ContactIDs)+len(b.URNs))
+	contactIDs = append(contactIDs, b.ContactIDs...)
+	for id := range b.URNs {
+		contactIDs = append(contactIDs, id)
+	}
+	if len(contactIDs) == 0 {
+		return b, nil
+	}
+
+	var sent []ContactID
+	if err := db.SelectContext(ctx, &sent, sqlSelectBroadcastRecipients, b.BroadcastID, pq.Array(contactIDs)); err != nil {
+		return nil, errors.Wrapf(err, "error selecting contacts already sent broadcast #%d", b.BroadcastID)
+	}
+	if len(sent) == 0 {
+		return b, nil
+	}
+
+	wasSent := make(map[ContactID]bool, len(sent))
+	for _, id := range sent {
+		wasSent[id] = true
+	}
+
+	remaining := *b
+	remaining.ContactIDs = make([]ContactID, 0, len(b.ContactIDs))
+	remaining.URNs = nil
+
+	for _, id := range b.ContactIDs {
+		if !wasSent[id] {
+			remaining.ContactIDs = append(remaining.ContactIDs, id)
+		}
+	}
+	for id, u := range b.URNs {
+		if !wasSent[id] {
+			if remaining.URNs == nil {
+				remaining.URNs = make(map[ContactID]urns.URN)
+			}
+			remaining.URNs[id] = u
+		}
+	}
+	return &remaining, nil
+}
+
+const sqlSelectBroadcastRecipients = `SELECT DISTINCT contact_id FROM msgs_msg WHERE broadcast_id = $1 AND contact_id = ANY($2)`
+
 func (b *BroadcastBatch) CreateMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets) ([]*Msg, error) {
 	repeatedContacts := make(map[ContactID]bool)
 	broadcastURNs := b.URNs
@@ -1002,6 +1110,9 @@ func (b *BroadcastBatch) CreateMessages(ctx context.Context, rt *runtime.Runtime
 			return nil, nil
 		}
 
+		// if that channel is unhealthy, use a fallback channel if we have one
+		channel = RouteChannel(oa, channel, urn)
+
 		// resolve our translations, the order is:
 		//   1) valid contact language
 		//   2) org default language
@@ -1081,6 +1192,11 @@ func (b *BroadcastBatch) CreateMessages(ctx context.Context, rt *runtime.Runtime
 			return nil, errors.Wrapf(err, "error creating outgoing message")
 		}
 
+		// record which variant of the broadcast this contact was sent
+		if b.Variant != "" {
+			msg.m.Metadata.Map()["broadcast_variant"] = b.Variant
+		}
+
 		return msg, nil
 	}
 
@@ -1110,12 +1226,37 @@ func (b *BroadcastBatch) CreateMessages(ctx context.Context, rt *runtime.Runtime
 		}
 	}
 
+	// ticket replies are conversational so don't count towards frequency caps
+	if b.TicketID == NilTicketID {
+		if err := ApplyFrequencyCaps(rt, oa.Org(), msgs); err != nil {
+			return nil, errors.Wrapf(err, "error applying frequency caps to broadcast messages")
+		}
+	}
+
 	// insert them in a single request
 	err = InsertMessages(ctx, rt.DB, msgs)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error inserting broadcast messages")
 	}
 
+	// now that they're committed, count them towards frequency caps
+	if b.TicketID == NilTicketID {
+		if err := RecordFrequencyCapSends(rt, oa.Org(), msgs); err != nil {
+			logrus.WithError(err).Error("error recording broadcast messages towards frequency caps")
+		}
+	}
+
+	// and publish them as changes
+	contactUUIDs := make(map[ContactID]flows.ContactUUID, len(contacts))
+	for _, c := range contacts {
+		contactUUIDs[c.ID()] = c.UUID()
+	}
+	changes := make([]*Change, len(msgs))
+	for i, m := range msgs {
+		changes[i] = &Change{OrgID: b.OrgID, ContactUUID: contactUUIDs[m.ContactID()], Value: m}
+	}
+	PublishChanges(ctx, rt, changes)
+
 	// if the broadcast was a ticket reply, update the ticket
 	if b.TicketID != NilTicketID {
 		if err := b.updateTicket(ctx, rt.DB, oa); err != nil {
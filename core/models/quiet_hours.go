@@ -0,0 +1,123 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	configQuietHoursStart         = "quiet_hours_start"
+	configQuietHoursEnd           = "quiet_hours_end"
+	configQuietHoursTimezoneField = "quiet_hours_timezone_field"
+)
+
+// QuietHours is a daily window, e.g. 21:00 to 08:00, during which non-interactive sends like broadcasts, campaign
+// events and scheduled flow starts are deferred. The window is in the org's timezone unless the contact has a valid
+// timezone name in the configured timezone field.
+type QuietHours struct {
+	start         time.Duration // offset from midnight
+	end           time.Duration // offset from midnight, can be less than start for windows spanning midnight
+	timezone      *time.Location
+	timezoneField string
+}
+
+// NewQuietHours creates new quiet hours
+func NewQuietHours(start, end time.Duration, timezone *time.Location, timezoneField string) *QuietHours {
+	return &QuietHours{start: start, end: end, timezone: timezone, timezoneField: timezoneField}
+}
+
+// QuietHours returns the quiet hours of this org or nil if it doesn't have any or they're not valid
+func (o *Org) QuietHours() *QuietHours {
+	start, err1 := parseTimeOfDay(o.ConfigValue(configQuietHoursStart, ""))
+	end, err2 := parseTimeOfDay(o.ConfigValue(configQuietHoursEnd, ""))
+	if err1 != nil || err2 != nil || start == end {
+		return nil
+	}
+
+	return NewQuietHours(start, end, o.Timezone(), o.ConfigValue(configQuietHoursTimezoneField, ""))
+}
+
+// Timezone returns the timezone in which quiet hours apply for the passed in contact
+func (q *QuietHours) Timezone(c *Contact) *time.Location {
+	if q.timezoneField != "" {
+		value := c.Fields()[q.timezoneField]
+		if value != nil && value.Text.Native() != "" {
+			tz, err := time.LoadLocation(strings.TrimSpace(value.Text.Native()))
+			if err == nil {
+				return tz
+			}
+		}
+	}
+	return q.timezone
+}
+
+// EndsAt returns the time when quiet hours end if the passed in time is within them, otherwise the zero time
+func (q *QuietHours) EndsAt(tz *time.Location, now time.Time) time.Time {
+	local := now.In(tz)
+	offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	endDay := local.Day()
+
+	if q.start < q.end {
+		if offset < q.start || offset >= q.end {
+			return time.Time{}
+		}
+	} else {
+		if offset < q.start && offset >= q.end {
+			return time.Time{}
+		}
+		// if we're before midnight, quiet hours end tomorrow
+		if offset >= q.start {
+			endDay++
+		}
+	}
+
+	// build the end from its hour and minute rather than adding it to midnight, which is off by an hour on DST days
+	return time.Date(local.Year(), local.Month(), endDay, int(q.end/time.Hour), int((q.end%time.Hour)/time.Minute), 0, 0, tz)
+}
+
+// DeferQuietContacts splits the passed in contacts into those which can be sent to now and those which are in their
+// org's quiet hours, with the latter grouped by when their quiet hours end
+func DeferQuietContacts(ctx context.Context, db Queryer, oa *OrgAssets, ids []ContactID, now time.Time) ([]ContactID, map[time.Time][]ContactID, error) {
+	quietHours := oa.Org().QuietHours()
+	if quietHours == nil || len(ids) == 0 {
+		return ids, nil, nil
+	}
+
+	contacts, err := LoadContacts(ctx, db, oa, ids)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error loading contacts to check quiet hours")
+	}
+
+	deferred := make(map[time.Time][]ContactID)
+	isDeferred := make(map[ContactID]bool)
+
+	for _, c := range contacts {
+		endsAt := quietHours.EndsAt(quietHours.Timezone(c), now)
+		if !endsAt.IsZero() {
+			deferred[endsAt] = append(deferred[endsAt], c.ID())
+			isDeferred[c.ID()] = true
+		}
+	}
+
+	// preserve the order of the contacts we're not deferring
+	sendNow := make([]ContactID, 0, len(ids))
+	for _, id := range ids {
+		if !isDeferred[id] {
+			sendNow = append(sendNow, id)
+		}
+	}
+
+	return sendNow, deferred, nil
+}
+
+// parses a time of day like 21:30 as an offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
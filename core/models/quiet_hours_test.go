@@ -0,0 +1,97 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuietHoursEndsAt(t *testing.T) {
+	kgl, _ := time.LoadLocation("Africa/Kigali")
+	ny, _ := time.LoadLocation("America/New_York")
+
+	overnight := models.NewQuietHours(21*time.Hour, 8*time.Hour, kgl, "")
+	daytime := models.NewQuietHours(12*time.Hour, 14*time.Hour+30*time.Minute, kgl, "")
+
+	tcs := []struct {
+		quietHours *models.QuietHours
+		tz         *time.Location
+		now        time.Time
+		endsAt     time.Time
+	}{
+		{overnight, kgl, time.Date(2022, 6, 1, 20, 59, 0, 0, kgl), time.Time{}},
+		{overnight, kgl, time.Date(2022, 6, 1, 21, 0, 0, 0, kgl), time.Date(2022, 6, 2, 8, 0, 0, 0, kgl)},
+		{overnight, kgl, time.Date(2022, 6, 30, 23, 30, 0, 0, kgl), time.Date(2022, 7, 1, 8, 0, 0, 0, kgl)},
+		{overnight, kgl, time.Date(2022, 6, 2, 3, 0, 0, 0, kgl), time.Date(2022, 6, 2, 8, 0, 0, 0, kgl)},
+		{overnight, kgl, time.Date(2022, 6, 2, 8, 0, 0, 0, kgl), time.Time{}},
+		{overnight, ny, time.Date(2022, 6, 2, 3, 0, 0, 0, kgl), time.Date(2022, 6, 2, 8, 0, 0, 0, ny)}, // 21:00 in NY
+		{overnight, ny, time.Date(2022, 6, 2, 16, 0, 0, 0, kgl), time.Time{}},                          // 10:00 in NY
+		{daytime, kgl, time.Date(2022, 6, 1, 11, 59, 0, 0, kgl), time.Time{}},
+		{daytime, kgl, time.Date(2022, 6, 1, 13, 0, 0, 0, kgl), time.Date(2022, 6, 1, 14, 30, 0, 0, kgl)},
+		{daytime, kgl, time.Date(2022, 6, 1, 14, 30, 0, 0, kgl), time.Time{}},
+		{overnight, ny, time.Date(2023, 3, 12, 6, 0, 0, 0, time.UTC), time.Date(2023, 3, 12, 8, 0, 0, 0, ny)}, // DST starts at 02:00
+		{overnight, ny, time.Date(2023, 11, 5, 7, 0, 0, 0, time.UTC), time.Date(2023, 11, 5, 8, 0, 0, 0, ny)}, // DST ends at 02:00
+	}
+
+	for _, tc := range tcs {
+		endsAt := tc.quietHours.EndsAt(tc.tz, tc.now)
+		assert.True(t, tc.endsAt.Equal(endsAt), "end mismatch for %s in %s, expected %s, got %s", tc.now, tc.tz, tc.endsAt, endsAt)
+	}
+}
+
+func TestDeferQuietContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer db.MustExec(`UPDATE orgs_org SET config = '{}' WHERE id = $1`, testdata.Org1.ID)
+
+	now := time.Date(2022, 6, 1, 22, 0, 0, 0, time.UTC)
+	contactIDs := []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID}
+
+	// org with no quiet hours defers nobody
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+	assert.Nil(t, oa.Org().QuietHours())
+
+	sendNow, deferred, err := models.DeferQuietContacts(ctx, db, oa, contactIDs, now)
+	assert.NoError(t, err)
+	assert.Equal(t, contactIDs, sendNow)
+	assert.Len(t, deferred, 0)
+
+	// give org quiet hours from 21:00 to 08:00 UTC with a contact field override
+	db.MustExec(`UPDATE orgs_org SET timezone = 'UTC', config = '{"quiet_hours_start": "21:00", "quiet_hours_end": "08:00", "quiet_hours_timezone_field": "gender"}' WHERE id = $1`, testdata.Org1.ID)
+	db.MustExec(`UPDATE contacts_contact SET fields = COALESCE(fields, '{}') || jsonb_build_object($2::text, jsonb_build_object('text', 'Asia/Tokyo')) WHERE id = $1`, testdata.Bob.ID, testdata.GenderField.UUID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+	assert.NotNil(t, oa.Org().QuietHours())
+
+	// Bob is in Tokyo where it's 07:00 so his quiet hours end sooner than everyone else's
+	sendNow, deferred, err = models.DeferQuietContacts(ctx, db, oa, contactIDs, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{}, sendNow)
+	assert.Len(t, deferred, 2)
+
+	deferredUntil := make(map[models.ContactID]time.Time)
+	for endsAt, ids := range deferred {
+		for _, id := range ids {
+			deferredUntil[id] = endsAt
+		}
+	}
+	assert.Equal(t, time.Date(2022, 6, 2, 8, 0, 0, 0, time.UTC).Unix(), deferredUntil[testdata.Cathy.ID].Unix())
+	assert.Equal(t, time.Date(2022, 6, 2, 8, 0, 0, 0, time.UTC).Unix(), deferredUntil[testdata.George.ID].Unix())
+	assert.Equal(t, time.Date(2022, 6, 1, 23, 0, 0, 0, time.UTC).Unix(), deferredUntil[testdata.Bob.ID].Unix())
+
+	// outside of quiet hours for everyone, nobody is deferred
+	sendNow, deferred, err = models.DeferQuietContacts(ctx, db, oa, contactIDs, time.Date(2022, 6, 2, 10, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, contactIDs, sendNow)
+	assert.Len(t, deferred, 0)
+
+	testsuite.Reset(testsuite.ResetData)
+}
@@ -212,6 +212,8 @@ SELECT ROW_TO_JSON(s) FROM (SELECT
 			(SELECT JSON_OBJECT_AGG(ts.key, ts.value) FROM (SELECT key, JSON_BUILD_OBJECT('text', t.value) as value FROM each(b.text) t) ts) as translations,
 			'unevaluated' as template_state,
 			b.base_language as base_language,
+			NULLIF(b.metadata, '')::json->'variants' as variants,
+			NULLIF(b.metadata, '')::json->'contacts_per_minute' as contacts_per_minute,
 			s.org_id as org_id,
 			(SELECT ARRAY_AGG(bc.contact_id) FROM (
 				SELECT
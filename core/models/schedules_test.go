@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/mailroom/core/models"
@@ -11,6 +12,7 @@ import (
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetExpired(t *testing.T) {
@@ -33,6 +35,9 @@ func TestGetExpired(t *testing.T) {
 	// add a URN
 	db.MustExec(`INSERT INTO msgs_broadcast_urns(broadcast_id, contacturn_id) VALUES($1, $2)`, b1, testdata.Cathy.URNID)
 
+	// and some variants, which are persisted in the broadcast's metadata
+	db.MustExec(`UPDATE msgs_broadcast SET metadata = $2 WHERE id = $1`, b1, `{"variants": [{"name": "A", "weight": 2, "translations": {"eng": {"text": "Hi A"}}}, {"name": "B", "translations": {"eng": {"text": "Hi B"}}}], "contacts_per_minute": 500}`)
+
 	// add another and tie a trigger to it
 	var s2 models.ScheduleID
 	err = db.Get(
@@ -98,6 +103,18 @@ func TestGetExpired(t *testing.T) {
 	assert.Equal(t, []models.ContactID{testdata.Cathy.ID, testdata.George.ID}, bcast.ContactIDs())
 	assert.Equal(t, []models.GroupID{testdata.DoctorsGroup.ID}, bcast.GroupIDs())
 	assert.Equal(t, []urns.URN{urns.URN("tel:+16055741111?id=10000")}, bcast.URNs())
+	assert.Len(t, bcast.Variants(), 2)
+	assert.Equal(t, "A", bcast.Variants()[0].Name)
+	assert.Equal(t, 2, bcast.Variants()[0].Weight)
+	assert.Equal(t, "Hi B", bcast.Variants()[1].Translations["eng"].Text)
+	assert.Equal(t, 500, bcast.ContactsPerMinute())
+
+	// variants are copied to the child broadcast created when the schedule fires
+	child, err := models.InsertChildBroadcast(ctx, db, bcast)
+	require.NoError(t, err)
+	assert.Len(t, child.Variants(), 2)
+	assert.Equal(t, 500, child.ContactsPerMinute())
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_broadcast WHERE id = $1 AND metadata::json->'variants'->1->>'name' = 'B' AND metadata::json->>'contacts_per_minute' = '500'`, child.ID()).Returns(1)
 }
 
 func TestNextFire(t *testing.T) {
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+// SessionTimer is the payload of the delayed tasks which check whether a session's wait has timed out or expired.
+// Timers are only hints of when to check a session, so it's always safe for one to fire early or for one to be lost,
+// and timers for waits which have since changed or ended are ignored when they fire.
+type SessionTimer struct {
+	SessionID SessionID `json:"session_id" validate:"required"`
+	ContactID ContactID `json:"contact_id" validate:"required"`
+	On        time.Time `json:"on"         validate:"required"`
+}
+
+// ScheduleSessionTimer queues a delayed task of the given type (i.e. queue.FireSessionTimeout or
+// queue.FireSessionExpiration) to check the passed in session at the passed in time
+func ScheduleSessionTimer(ctx context.Context, rc redis.Conn, taskType string, orgID OrgID, sessionID SessionID, contactID ContactID, on time.Time) error {
+	timer := &SessionTimer{SessionID: sessionID, ContactID: contactID, On: on}
+
+	err := queue.AddTaskAt(ctx, rc, queue.HandlerQueue, taskType, int(orgID), timer, on)
+	return errors.Wrapf(err, "error scheduling %s for session #%d", taskType, sessionID)
+}
+
+// ScheduleSessionTimers queues timers for the timeouts and expirations of the passed in sessions' waits. Voice sessions
+// are skipped as they're expired along with their calls.
+func ScheduleSessionTimers(ctx context.Context, rc redis.Conn, sessions []*Session) error {
+	for _, s := range sessions {
+		if s.SessionType() != FlowTypeMessaging || s.Status() != SessionStatusWaiting {
+			continue
+		}
+
+		if s.WaitTimeoutOn() != nil {
+			if err := ScheduleSessionTimer(ctx, rc, queue.FireSessionTimeout, s.OrgID(), s.ID(), s.ContactID(), *s.WaitTimeoutOn()); err != nil {
+				return err
+			}
+		}
+		if s.WaitExpiresOn() != nil {
+			if err := ScheduleSessionTimer(ctx, rc, queue.FireSessionExpiration, s.OrgID(), s.ID(), s.ContactID(), *s.WaitExpiresOn()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// our hook for scheduling the timers of sessions whose waits have been set, once those waits have been committed
+var scheduleSessionTimersHook EventCommitHook = &sessionTimersHook{}
+
+type sessionTimersHook struct{}
+
+// Apply schedules timers for the sessions of all the scenes passed in
+func (h *sessionTimersHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *OrgAssets, scenes map[*Scene][]interface{}) error {
+	sessions := make([]*Session, 0, len(scenes))
+	for scene := range scenes {
+		sessions = append(sessions, scene.Session())
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	return ScheduleSessionTimers(ctx, rc, sessions)
+}
@@ -0,0 +1,51 @@
+package models_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleSessionTimer(t *testing.T) {
+	ctx, _, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	on := time.Now().Add(time.Hour)
+
+	err := models.ScheduleSessionTimer(ctx, rc, queue.FireSessionTimeout, testdata.Org1.ID, models.SessionID(123), testdata.Cathy.ID, on)
+	assert.NoError(t, err)
+
+	// timer is a delayed task on the handler queue which isn't runnable yet
+	delayed, err := queue.DelayedSize(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delayed)
+
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	payloads, err := redis.Strings(rc.Do("zrange", "handler:delayed", 0, -1))
+	require.NoError(t, err)
+
+	task = &queue.Task{}
+	require.NoError(t, json.Unmarshal([]byte(payloads[0]), task))
+	assert.Equal(t, queue.FireSessionTimeout, task.Type)
+	assert.Equal(t, int(testdata.Org1.ID), task.OrgID)
+
+	timer := &models.SessionTimer{}
+	require.NoError(t, json.Unmarshal(task.Task, timer))
+	assert.Equal(t, models.SessionID(123), timer.SessionID)
+	assert.Equal(t, testdata.Cathy.ID, timer.ContactID)
+	assert.True(t, on.Equal(timer.On))
+}
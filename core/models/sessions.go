@@ -236,6 +236,11 @@ func (s *Session) updateWait(evts []flows.Event) {
 			s.s.WaitResumeOnExpire = canResume(run)
 		}
 	}
+
+	// if we have a new wait, its timers are scheduled once it's been committed
+	if s.s.WaitTimeoutOn != nil || s.s.WaitExpiresOn != nil {
+		s.scene.AppendToEventPostCommitHook(scheduleSessionTimersHook, s)
+	}
 }
 
 const sqlUpdateSession = `
@@ -843,36 +848,53 @@ func GetSessionWaitExpiresOn(ctx context.Context, db *sqlx.DB, sessionID Session
 	return &expiresOn, nil
 }
 
-// ExitSessions exits sessions and their runs. It batches the given session ids and exits each batch in a transaction.
-func ExitSessions(ctx context.Context, db *sqlx.DB, sessionIDs []SessionID, status SessionStatus) error {
+// ExitedSession is a session which has been exited outside of the flow engine
+type ExitedSession struct {
+	ID          SessionID         `db:"id"`
+	UUID        flows.SessionUUID `db:"uuid"`
+	SessionType FlowType          `db:"session_type"`
+	Status      SessionStatus     `db:"status"`
+	OrgID       OrgID             `db:"org_id"`
+	ContactID   ContactID         `db:"contact_id"`
+	ContactUUID flows.ContactUUID `db:"contact_uuid"`
+}
+
+// ExitSessions exits sessions and their runs. It batches the given session ids and exits each batch in a transaction,
+// publishing session ended events for each batch once it's been committed.
+func ExitSessions(ctx context.Context, rt *runtime.Runtime, sessionIDs []SessionID, status SessionStatus) error {
 	if len(sessionIDs) == 0 {
 		return nil
 	}
 
 	// split into batches and exit each batch in a transaction
 	for _, idBatch := range chunkSlice(sessionIDs, 100) {
-		tx, err := db.BeginTxx(ctx, nil)
+		tx, err := rt.DB.BeginTxx(ctx, nil)
 		if err != nil {
 			return errors.Wrapf(err, "error starting transaction to exit sessions")
 		}
 
-		if err := exitSessionBatch(ctx, tx, idBatch, status); err != nil {
+		exited, err := exitSessionBatch(ctx, tx, idBatch, status)
+		if err != nil {
+			tx.Rollback()
 			return errors.Wrapf(err, "error exiting batch of sessions")
 		}
 
 		if err := tx.Commit(); err != nil {
 			return errors.Wrapf(err, "error committing session exits")
 		}
+
+		PublishExitedSessions(ctx, rt, exited)
 	}
 
 	return nil
 }
 
 const sqlExitSessions = `
-   UPDATE flows_flowsession
+   UPDATE flows_flowsession s
       SET status = $3, ended_on = $2, wait_started_on = NULL, wait_expires_on = NULL, timeout_on = NULL, current_flow_id = NULL
-    WHERE id = ANY ($1) AND status = 'W'
-RETURNING contact_id`
+     FROM contacts_contact c
+    WHERE s.id = ANY ($1) AND s.status = 'W' AND c.id = s.contact_id
+RETURNING s.id, s.uuid, s.session_type, s.status, s.org_id, s.contact_id, c.uuid AS contact_uuid`
 
 const sqlExitSessionRuns = `
 UPDATE flows_flowrun
@@ -884,17 +906,22 @@ const sqlExitSessionContacts = `
     SET current_flow_id = NULL, modified_on = NOW() 
   WHERE id = ANY($1)`
 
-// exits sessions and their runs inside the given transaction
-func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID, status SessionStatus) error {
+// exits sessions and their runs inside the given transaction, returning the sessions which were exited
+func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID, status SessionStatus) ([]*ExitedSession, error) {
 	runStatus := RunStatus(status) // session status codes are subset of run status codes
-	contactIDs := make([]SessionID, 0, len(sessionIDs))
+	exited := make([]*ExitedSession, 0, len(sessionIDs))
 
-	// first update the sessions themselves and get the contact ids
+	// first update the sessions themselves and get the contacts
 	start := time.Now()
 
-	err := tx.SelectContext(ctx, &contactIDs, sqlExitSessions, pq.Array(sessionIDs), time.Now(), status)
+	err := tx.SelectContext(ctx, &exited, sqlExitSessions, pq.Array(sessionIDs), time.Now(), status)
 	if err != nil {
-		return errors.Wrapf(err, "error exiting sessions")
+		return nil, errors.Wrapf(err, "error exiting sessions")
+	}
+
+	contactIDs := make([]ContactID, len(exited))
+	for i, s := range exited {
+		contactIDs[i] = s.ContactID
 	}
 
 	logrus.WithField("count", len(contactIDs)).WithField("elapsed", time.Since(start)).Debug("exited session batch")
@@ -904,7 +931,7 @@ func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID,
 
 	res, err := tx.ExecContext(ctx, sqlExitSessionRuns, pq.Array(sessionIDs), time.Now(), runStatus)
 	if err != nil {
-		return errors.Wrapf(err, "error exiting session runs")
+		return nil, errors.Wrapf(err, "error exiting session runs")
 	}
 
 	rows, _ := res.RowsAffected()
@@ -915,13 +942,13 @@ func exitSessionBatch(ctx context.Context, tx *sqlx.Tx, sessionIDs []SessionID,
 
 	res, err = tx.ExecContext(ctx, sqlExitSessionContacts, pq.Array(contactIDs))
 	if err != nil {
-		return errors.Wrapf(err, "error exiting sessions")
+		return nil, errors.Wrapf(err, "error exiting sessions")
 	}
 
 	rows, _ = res.RowsAffected()
 	logrus.WithField("count", rows).WithField("elapsed", time.Since(start)).Debug("exited session batch contacts")
 
-	return nil
+	return exited, nil
 }
 
 func getWaitingSessionsForContacts(ctx context.Context, db Queryer, contactIDs []ContactID) ([]SessionID, error) {
@@ -935,25 +962,29 @@ func getWaitingSessionsForContacts(ctx context.Context, db Queryer, contactIDs [
 	return sessionIDs, nil
 }
 
-// InterruptSessionsForContacts interrupts any waiting sessions for the given contacts
-func InterruptSessionsForContacts(ctx context.Context, db *sqlx.DB, contactIDs []ContactID) (int, error) {
-	sessionIDs, err := getWaitingSessionsForContacts(ctx, db, contactIDs)
+// InterruptSessionsForContacts interrupts any waiting sessions for the given contacts in the given org
+func InterruptSessionsForContacts(ctx context.Context, rt *runtime.Runtime, orgID OrgID, contactIDs []ContactID) (int, error) {
+	sessionIDs := make([]SessionID, 0, len(contactIDs))
+
+	err := rt.DB.SelectContext(ctx, &sessionIDs, `SELECT id FROM flows_flowsession WHERE status = 'W' AND contact_id = ANY($1) AND org_id = $2`, pq.Array(contactIDs), orgID)
 	if err != nil {
-		return 0, err
+		return 0, errors.Wrapf(err, "error selecting waiting sessions for contacts")
 	}
 
-	return len(sessionIDs), errors.Wrapf(ExitSessions(ctx, db, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
+	return len(sessionIDs), errors.Wrapf(ExitSessions(ctx, rt, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
 }
 
 // InterruptSessionsForContactsTx interrupts any waiting sessions for the given contacts inside the given transaction.
 // This version is used for interrupting during flow starts where contacts are already batched and we have an open transaction.
-func InterruptSessionsForContactsTx(ctx context.Context, tx *sqlx.Tx, contactIDs []ContactID) error {
+// The caller is responsible for publishing the returned exited sessions once the transaction has been committed.
+func InterruptSessionsForContactsTx(ctx context.Context, tx *sqlx.Tx, contactIDs []ContactID) ([]*ExitedSession, error) {
 	sessionIDs, err := getWaitingSessionsForContacts(ctx, tx, contactIDs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return errors.Wrapf(exitSessionBatch(ctx, tx, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
+	exited, err := exitSessionBatch(ctx, tx, sessionIDs, SessionStatusInterrupted)
+	return exited, errors.Wrapf(err, "error exiting sessions")
 }
 
 const sqlWaitingSessionIDsForChannel = `
@@ -963,15 +994,15 @@ SELECT fs.id
  WHERE fs.status = 'W' AND cc.channel_id = $1;`
 
 // InterruptSessionsForChannel interrupts any waiting sessions with calls on the given channel
-func InterruptSessionsForChannel(ctx context.Context, db *sqlx.DB, channelID ChannelID) error {
+func InterruptSessionsForChannel(ctx context.Context, rt *runtime.Runtime, channelID ChannelID) error {
 	sessionIDs := make([]SessionID, 0, 10)
 
-	err := db.SelectContext(ctx, &sessionIDs, sqlWaitingSessionIDsForChannel, channelID)
+	err := rt.DB.SelectContext(ctx, &sessionIDs, sqlWaitingSessionIDsForChannel, channelID)
 	if err != nil {
 		return errors.Wrapf(err, "error selecting waiting sessions for channel %d", channelID)
 	}
 
-	return errors.Wrapf(ExitSessions(ctx, db, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
+	return errors.Wrapf(ExitSessions(ctx, rt, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
 }
 
 const sqlWaitingSessionIDsForFlows = `
@@ -980,17 +1011,17 @@ SELECT id
  WHERE status = 'W' AND current_flow_id = ANY($1);`
 
 // InterruptSessionsForFlows interrupts any waiting sessions currently in the given flows
-func InterruptSessionsForFlows(ctx context.Context, db *sqlx.DB, flowIDs []FlowID) error {
+func InterruptSessionsForFlows(ctx context.Context, rt *runtime.Runtime, flowIDs []FlowID) error {
 	if len(flowIDs) == 0 {
 		return nil
 	}
 
 	sessionIDs := make([]SessionID, 0, len(flowIDs))
 
-	err := db.SelectContext(ctx, &sessionIDs, sqlWaitingSessionIDsForFlows, pq.Array(flowIDs))
+	err := rt.DB.SelectContext(ctx, &sessionIDs, sqlWaitingSessionIDsForFlows, pq.Array(flowIDs))
 	if err != nil {
 		return errors.Wrapf(err, "error selecting waiting sessions for flows")
 	}
 
-	return errors.Wrapf(ExitSessions(ctx, db, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
+	return errors.Wrapf(ExitSessions(ctx, rt, sessionIDs, SessionStatusInterrupted), "error exiting sessions")
 }
@@ -13,14 +13,15 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/redisx/assertredis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestSessionCreationAndUpdating(t *testing.T) {
-	ctx, rt, db, _ := testsuite.Get()
+	ctx, rt, db, rp := testsuite.Get()
 
-	defer testsuite.Reset(testsuite.ResetData)
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
 
 	testFlows := testdata.ImportFlows(db, testdata.Org1, "testdata/session_test_flows.json")
 	flow := testFlows[0]
@@ -61,6 +62,13 @@ func TestSessionCreationAndUpdating(t *testing.T) {
 	assert.False(t, session.WaitResumeOnExpire())
 	assert.NotNil(t, session.Timeout())
 
+	// timers for the wait's timeout and expiration are only scheduled once it's committed
+	assertredis.ZCard(t, rp, "handler:delayed", 0)
+
+	require.NoError(t, models.ApplyEventPostCommitHooks(ctx, rt, tx, oa, []*models.Scene{session.Scene()}))
+
+	assertredis.ZCard(t, rp, "handler:delayed", 2)
+
 	// check that matches what is in the db
 	assertdb.Query(t, db, `SELECT status, session_type, current_flow_id, responded, ended_on, wait_resume_on_expire FROM flows_flowsession`).
 		Columns(map[string]interface{}{
@@ -93,6 +101,11 @@ func TestSessionCreationAndUpdating(t *testing.T) {
 	assert.False(t, session.WaitResumeOnExpire())
 	assert.Nil(t, session.Timeout()) // this wait doesn't have a timeout
 
+	// this wait only gets an expiration timer
+	require.NoError(t, models.ApplyEventPostCommitHooks(ctx, rt, tx, oa, []*models.Scene{session.Scene()}))
+
+	assertredis.ZCard(t, rp, "handler:delayed", 3)
+
 	flowSession, err = session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
 	require.NoError(t, err)
 
@@ -117,6 +130,11 @@ func TestSessionCreationAndUpdating(t *testing.T) {
 	assert.Nil(t, session.Timeout())
 	assert.NotNil(t, session.EndedOn())
 
+	// and no timers are scheduled now that it's ended
+	require.NoError(t, models.ApplyEventPostCommitHooks(ctx, rt, tx, oa, []*models.Scene{session.Scene()}))
+
+	assertredis.ZCard(t, rp, "handler:delayed", 3)
+
 	// check that matches what is in the db
 	assertdb.Query(t, db, `SELECT status, session_type, current_flow_id, responded FROM flows_flowsession`).
 		Columns(map[string]interface{}{"status": "C", "session_type": "M", "current_flow_id": nil, "responded": true})
@@ -301,7 +319,7 @@ func TestSessionFailedStart(t *testing.T) {
 }
 
 func TestInterruptSessionsForContacts(t *testing.T) {
-	ctx, _, db, _ := testsuite.Get()
+	ctx, rt, db, _ := testsuite.Get()
 
 	defer testsuite.Reset(testsuite.ResetData)
 
@@ -311,7 +329,7 @@ func TestInterruptSessionsForContacts(t *testing.T) {
 	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, models.NilCallID)
 
 	// noop if no contacts
-	_, err := models.InterruptSessionsForContacts(ctx, db, []models.ContactID{})
+	_, err := models.InterruptSessionsForContacts(ctx, rt, testdata.Org1.ID, []models.ContactID{})
 	assert.NoError(t, err)
 
 	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted)
@@ -319,7 +337,7 @@ func TestInterruptSessionsForContacts(t *testing.T) {
 	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)
 	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
 
-	count, err := models.InterruptSessionsForContacts(ctx, db, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.Alexandria.ID})
+	count, err := models.InterruptSessionsForContacts(ctx, rt, testdata.Org1.ID, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.Alexandria.ID})
 	assert.Equal(t, 2, count)
 	assert.NoError(t, err)
 
@@ -328,6 +346,13 @@ func TestInterruptSessionsForContacts(t *testing.T) {
 	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusInterrupted)
 	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting) // contact not included
 
+	// contacts aren't interrupted by requests for other orgs
+	count, err = models.InterruptSessionsForContacts(ctx, rt, testdata.Org2.ID, []models.ContactID{testdata.George.ID})
+	assert.Equal(t, 0, count)
+	assert.NoError(t, err)
+
+	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
+
 	// check other columns are correct on interrupted session, run and contact
 	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowsession WHERE ended_on IS NOT NULL AND wait_started_on IS NULL AND wait_expires_on IS NULL AND timeout_on IS NULL AND current_flow_id IS NULL AND id = $1`, session2ID).Returns(1)
 	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE id = $1`, run2ID).Columns(map[string]interface{}{"status": "I"})
@@ -347,7 +372,7 @@ func TestInterruptSessionsForContactsTx(t *testing.T) {
 	tx := db.MustBegin()
 
 	// noop if no contacts
-	err := models.InterruptSessionsForContactsTx(ctx, tx, []models.ContactID{})
+	_, err := models.InterruptSessionsForContactsTx(ctx, tx, []models.ContactID{})
 	require.NoError(t, err)
 
 	require.NoError(t, tx.Commit())
@@ -359,8 +384,9 @@ func TestInterruptSessionsForContactsTx(t *testing.T) {
 
 	tx = db.MustBegin()
 
-	err = models.InterruptSessionsForContactsTx(ctx, tx, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	exited, err := models.InterruptSessionsForContactsTx(ctx, tx, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
 	require.NoError(t, err)
+	assert.Len(t, exited, 2)
 
 	require.NoError(t, tx.Commit())
 
@@ -376,7 +402,7 @@ func TestInterruptSessionsForContactsTx(t *testing.T) {
 }
 
 func TestInterruptSessionsForChannels(t *testing.T) {
-	ctx, _, db, _ := testsuite.Get()
+	ctx, rt, db, _ := testsuite.Get()
 
 	defer testsuite.Reset(testsuite.ResetData)
 
@@ -390,7 +416,7 @@ func TestInterruptSessionsForChannels(t *testing.T) {
 	session3ID, _ := insertSessionAndRun(db, testdata.Bob, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, bobCallID)
 	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.Favorites, georgeCallID)
 
-	err := models.InterruptSessionsForChannel(ctx, db, testdata.TwilioChannel.ID)
+	err := models.InterruptSessionsForChannel(ctx, rt, testdata.TwilioChannel.ID)
 	require.NoError(t, err)
 
 	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
@@ -404,7 +430,7 @@ func TestInterruptSessionsForChannels(t *testing.T) {
 }
 
 func TestInterruptSessionsForFlows(t *testing.T) {
-	ctx, _, db, _ := testsuite.Get()
+	ctx, rt, db, _ := testsuite.Get()
 
 	defer testsuite.Reset(testsuite.ResetData)
 
@@ -419,7 +445,7 @@ func TestInterruptSessionsForFlows(t *testing.T) {
 	session4ID, _ := insertSessionAndRun(db, testdata.George, models.FlowTypeMessaging, models.SessionStatusWaiting, testdata.PickANumber, georgeCallID)
 
 	// noop if no flows
-	err := models.InterruptSessionsForFlows(ctx, db, []models.FlowID{})
+	err := models.InterruptSessionsForFlows(ctx, rt, []models.FlowID{})
 	require.NoError(t, err)
 
 	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted)
@@ -427,7 +453,7 @@ func TestInterruptSessionsForFlows(t *testing.T) {
 	assertSessionAndRunStatus(t, db, session3ID, models.SessionStatusWaiting)
 	assertSessionAndRunStatus(t, db, session4ID, models.SessionStatusWaiting)
 
-	err = models.InterruptSessionsForFlows(ctx, db, []models.FlowID{testdata.Favorites.ID})
+	err = models.InterruptSessionsForFlows(ctx, rt, []models.FlowID{testdata.Favorites.ID})
 	require.NoError(t, err)
 
 	assertSessionAndRunStatus(t, db, session1ID, models.SessionStatusCompleted) // wasn't waiting
@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql/driver"
 	"encoding/json"
+	"fmt"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/gocommon/uuids"
@@ -108,6 +111,8 @@ type FlowStartBatch struct {
 		IsLast        bool `json:"is_last,omitempty"`
 		TotalContacts int  `json:"total_contacts"`
 
+		DeferredUntil *time.Time `json:"deferred_until,omitempty"`
+
 		CreatedBy string `json:"created_by"` // deprecated
 	}
 }
@@ -122,11 +127,71 @@ func (b *FlowStartBatch) ExcludeStartedPreviously() bool { return !b.b.RestartPa
 func (b *FlowStartBatch) ExcludeInAFlow() bool           { return !b.b.IncludeActive }
 func (b *FlowStartBatch) IsLast() bool                   { return b.b.IsLast }
 func (b *FlowStartBatch) TotalContacts() int             { return b.b.TotalContacts }
+func (b *FlowStartBatch) DeferredUntil() *time.Time      { return b.b.DeferredUntil }
 
 func (b *FlowStartBatch) ParentSummary() json.RawMessage  { return json.RawMessage(b.b.ParentSummary) }
 func (b *FlowStartBatch) SessionHistory() json.RawMessage { return json.RawMessage(b.b.SessionHistory) }
 func (b *FlowStartBatch) Extra() json.RawMessage          { return json.RawMessage(b.b.Extra) }
 
+// IdempotencyKey returns the key which ensures this batch is only queued once, assuming that batches of the same start
+// are always created from the same ordering of contacts
+func (b *FlowStartBatch) IdempotencyKey() string {
+	if b.b.StartID == NilStartID || len(b.b.ContactIDs) == 0 {
+		return ""
+	}
+	if b.b.DeferredUntil != nil {
+		return fmt.Sprintf("start_batch:%d:%d:%d", b.b.StartID, b.b.ContactIDs[0], b.b.DeferredUntil.Unix())
+	}
+	return fmt.Sprintf("start_batch:%d:%d", b.b.StartID, b.b.ContactIDs[0])
+}
+
+// WithContacts returns a copy of this batch for the given contacts
+func (b *FlowStartBatch) WithContacts(contactIDs []ContactID, last bool) *FlowStartBatch {
+	c := &FlowStartBatch{}
+	c.b = b.b
+	c.b.ContactIDs = contactIDs
+	c.b.IsLast = last
+	return c
+}
+
+// Defer returns a copy of this batch for the given contacts which has been deferred until the given time
+func (b *FlowStartBatch) Defer(contactIDs []ContactID, until time.Time, last bool) *FlowStartBatch {
+	d := b.WithContacts(contactIDs, last)
+	d.b.DeferredUntil = &until
+	return d
+}
+
+// ExcludeStarted returns a copy of this batch without the contacts which have already been started by its start, e.g.
+// before a previous attempt to start this batch failed
+func (b *FlowStartBatch) ExcludeStarted(ctx context.Context, db Queryer) (*FlowStartBatch, error) {
+	if b.b.StartID == NilStartID || len(b.b.ContactIDs) == 0 {
+		return b, nil
+	}
+
+	var started []ContactID
+	if err := db.SelectContext(ctx, &started, sqlSelectStartedContacts, b.b.StartID, pq.Array(b.b.ContactIDs)); err != nil {
+		return nil, errors.Wrapf(err, "error selecting contacts already started by start #%d", b.b.StartID)
+	}
+	if len(started) == 0 {
+		return b, nil
+	}
+
+	wasStarted := make(map[ContactID]bool, len(started))
+	for _, id := range started {
+		wasStarted[id] = true
+	}
+
+	remaining := make([]ContactID, 0, len(b.b.ContactIDs)-len(started))
+	for _, id := range b.b.ContactIDs {
+		if !wasStarted[id] {
+			remaining = append(remaining, id)
+		}
+	}
+	return b.WithContacts(remaining, b.b.IsLast), nil
+}
+
+const sqlSelectStartedContacts = `SELECT DISTINCT contact_id FROM flows_flowrun WHERE start_id = $1 AND contact_id = ANY($2)`
+
 func (b *FlowStartBatch) MarshalJSON() ([]byte, error)    { return json.Marshal(b.b) }
 func (b *FlowStartBatch) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &b.b) }
 
@@ -154,6 +219,10 @@ type FlowStart struct {
 		Extra          null.JSON `json:"extra,omitempty"           db:"extra"`
 		ParentSummary  null.JSON `json:"parent_summary,omitempty"  db:"parent_summary"`
 		SessionHistory null.JSON `json:"session_history,omitempty" db:"session_history"`
+
+		ContactsPerMinute int `json:"contacts_per_minute,omitempty"` // if set, batches are drip fed at this rate (not persisted)
+
+		SubmissionKey string `json:"submission_key,omitempty"` // supplied by the caller, e.g. per form submission
 	}
 }
 
@@ -229,6 +298,31 @@ func (s *FlowStart) WithExtra(extra json.RawMessage) *FlowStart {
 	return s
 }
 
+func (s *FlowStart) ContactsPerMinute() int { return s.s.ContactsPerMinute }
+func (s *FlowStart) WithContactsPerMinute(rate int) *FlowStart {
+	s.s.ContactsPerMinute = rate
+	return s
+}
+
+func (s *FlowStart) SubmissionKey() string { return s.s.SubmissionKey }
+func (s *FlowStart) WithSubmissionKey(key string) *FlowStart {
+	s.s.SubmissionKey = key
+	return s
+}
+
+// IdempotencyKey returns the key which ensures this start is only queued once. If the caller supplied a submission
+// key, e.g. one per form submission, then we use that because a double submission will create two starts with
+// different UUIDs.
+func (s *FlowStart) IdempotencyKey() string {
+	if s.s.SubmissionKey != "" {
+		return fmt.Sprintf("start:%d:%s", s.s.OrgID, s.s.SubmissionKey)
+	}
+	if s.s.UUID == "" {
+		return ""
+	}
+	return fmt.Sprintf("start:%s", s.s.UUID)
+}
+
 func (s *FlowStart) MarshalJSON() ([]byte, error)    { return json.Marshal(s.s) }
 func (s *FlowStart) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &s.s) }
 
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
 	"github.com/nyaruka/gocommon/jsonx"
@@ -90,6 +91,15 @@ func TestStarts(t *testing.T) {
 	_, err = models.ReadSessionHistory([]byte(`{`))
 	assert.EqualError(t, err, "unexpected end of JSON input")
 
+	until := time.Date(2022, 6, 2, 8, 0, 0, 0, time.UTC)
+	deferred := batch.Defer([]models.ContactID{testdata.Bob.ID}, until, true)
+	assert.Equal(t, []models.ContactID{testdata.Bob.ID}, deferred.ContactIDs())
+	assert.Equal(t, &until, deferred.DeferredUntil())
+	assert.True(t, deferred.IsLast())
+	assert.Nil(t, batch.DeferredUntil())
+	assert.Equal(t, fmt.Sprintf("start_batch:%d:%d", startID, testdata.Cathy.ID), batch.IdempotencyKey())
+	assert.Equal(t, fmt.Sprintf("start_batch:%d:%d:1654156800", startID, testdata.Bob.ID), deferred.IdempotencyKey())
+
 	err = models.MarkStartComplete(ctx, db, startID)
 	require.NoError(t, err)
 
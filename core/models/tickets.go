@@ -247,6 +247,13 @@ func LoadTickets(ctx context.Context, db Queryer, ids []TicketID) ([]*Ticket, er
 	return loadTickets(ctx, db, sqlSelectTicketsByID, pq.Array(ids))
 }
 
+const sqlSelectOrgTicketsByID = sqlSelectTicketsByID + ` AND t.org_id = $2`
+
+// LoadOrgTickets loads the tickets with the given ids which belong to the given org, ignoring any which don't
+func LoadOrgTickets(ctx context.Context, db Queryer, orgID OrgID, ids []TicketID) ([]*Ticket, error) {
+	return loadTickets(ctx, db, sqlSelectOrgTicketsByID, pq.Array(ids), orgID)
+}
+
 func loadTickets(ctx context.Context, db Queryer, query string, params ...interface{}) ([]*Ticket, error) {
 	rows, err := db.QueryxContext(ctx, query, params...)
 	if err != nil && err != sql.ErrNoRows {
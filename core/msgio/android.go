@@ -1,6 +1,7 @@
 package msgio
 
 import (
+	"context"
 	"time"
 
 	"github.com/nyaruka/mailroom/core/models"
@@ -11,6 +12,37 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+func init() {
+	RegisterSender(models.ChannelTypeAndroid, &androidSender{})
+}
+
+// sends messages by notifying the relayer apps of Android channels to sync, where fc is the FCM client to use, and if
+// nil one is created from our config
+type androidSender struct {
+	fc *fcm.Client
+}
+
+func (s *androidSender) Send(ctx context.Context, rt *runtime.Runtime, msgs []*models.Msg) []*models.Msg {
+	// trigger syncs for the unique channels
+	channels := make([]*models.Channel, 0, 5)
+	channelsSeen := make(map[*models.Channel]bool)
+	for _, msg := range msgs {
+		if !channelsSeen[msg.Channel()] {
+			channels = append(channels, msg.Channel())
+			channelsSeen[msg.Channel()] = true
+		}
+	}
+
+	fc := s.fc
+	if fc == nil {
+		fc = CreateFCMClient(rt.Config)
+	}
+	SyncAndroidChannels(fc, channels)
+
+	// relayers sync messages on their own if this fails, so there's never anything to retry
+	return nil
+}
+
 // SyncAndroidChannels tries to trigger syncs of the given Android channels via FCM
 func SyncAndroidChannels(fc *fcm.Client, channels []*models.Channel) {
 	if fc == nil {
@@ -18,6 +18,7 @@ import (
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -60,6 +61,40 @@ else
 end
 `)
 
+// sends messages by queuing them to courier
+type courierSender struct{}
+
+func (s *courierSender) Send(ctx context.Context, rt *runtime.Runtime, msgs []*models.Msg) []*models.Msg {
+	// organize messages by contact
+	contactIDs := make([]models.ContactID, 0, len(msgs))
+	contactMsgs := make(map[models.ContactID][]*models.Msg, len(msgs))
+	for _, msg := range msgs {
+		if _, seen := contactMsgs[msg.ContactID()]; !seen {
+			contactIDs = append(contactIDs, msg.ContactID())
+		}
+		contactMsgs[msg.ContactID()] = append(contactMsgs[msg.ContactID()], msg)
+	}
+
+	rc := tracing.Conn(ctx, rt.RP.Get())
+	defer rc.Close()
+
+	unsent := make([]*models.Msg, 0, 1)
+
+	for _, contactID := range contactIDs {
+		err := QueueCourierMessages(rc, contactID, contactMsgs[contactID])
+
+		if err != nil {
+			logrus.WithField("messages", contactMsgs[contactID]).WithField("contact", contactID).WithError(err).Error("error queuing messages")
+
+			// in the case of errors we do want to change the messages back to pending however so they
+			// get queued later. (for the common case messages are only inserted and queued, without a status update)
+			unsent = append(unsent, contactMsgs[contactID]...)
+		}
+	}
+
+	return unsent
+}
+
 // PushCourierBatch pushes a batch of messages for a single contact and channel onto the appropriate courier queue
 func PushCourierBatch(rc redis.Conn, ch *models.Channel, batch []*models.Msg, timestamp string) error {
 	priority := bulkPriority
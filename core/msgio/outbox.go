@@ -0,0 +1,176 @@
+package msgio
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// OutboxTimestampHeader is the header containing the unix timestamp of when a batch was signed
+	OutboxTimestampHeader = "X-Mailroom-Timestamp"
+
+	// OutboxSignatureHeader is the header containing the signature of a batch
+	OutboxSignatureHeader = "X-Mailroom-Signature"
+
+	// max number of messages we POST in a single batch
+	outboxMaxBatchSize = 100
+)
+
+var outboxHTTPClient = &http.Client{
+	Timeout: 15 * time.Second,
+}
+
+// the sender used for any channel type configured to use the outbox
+var outbox Sender = &outboxSender{}
+
+// a batch of messages POSTed to the outbox, where each message is in the same format as it would be queued to courier
+//
+//	{
+//	  "channel_uuid": "74729f45-7f29-4868-9dc4-90e491e3c7d8",
+//	  "channel_type": "TG",
+//	  "msgs": [{"id": 1234, "uuid": "...", "text": "Hi there", ...}, ...]
+//	}
+type outboxBatch struct {
+	ChannelUUID assets.ChannelUUID `json:"channel_uuid"`
+	ChannelType models.ChannelType `json:"channel_type"`
+	Msgs        []*models.Msg      `json:"msgs"`
+}
+
+// OutboxBatch is the payload of the task which POSTs a batch of messages to the outbox. The body of the request is
+// built when the task is queued so that it contains the messages exactly as they were created.
+type OutboxBatch struct {
+	ChannelUUID assets.ChannelUUID `json:"channel_uuid" validate:"required"`
+	MsgIDs      []models.MsgID     `json:"msg_ids"      validate:"required"`
+	Body        json.RawMessage    `json:"body"         validate:"required"`
+}
+
+// sends messages by queuing them in batches, one per channel, to be POSTed to a configured HTTP endpoint by a
+// batch worker, so that we're not making HTTP requests whilst messages are being committed
+type outboxSender struct{}
+
+func (s *outboxSender) Send(ctx context.Context, rt *runtime.Runtime, msgs []*models.Msg) []*models.Msg {
+	// organize messages by channel
+	channels := make([]*models.Channel, 0, 1)
+	channelMsgs := make(map[*models.Channel][]*models.Msg, 1)
+	for _, msg := range msgs {
+		if _, seen := channelMsgs[msg.Channel()]; !seen {
+			channels = append(channels, msg.Channel())
+		}
+		channelMsgs[msg.Channel()] = append(channelMsgs[msg.Channel()], msg)
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	unsent := make([]*models.Msg, 0, 1)
+
+	for _, channel := range channels {
+		pending := channelMsgs[channel]
+
+		for len(pending) > 0 {
+			batch := pending
+			if len(batch) > outboxMaxBatchSize {
+				batch = batch[:outboxMaxBatchSize]
+			}
+			pending = pending[len(batch):]
+
+			if err := queueOutboxBatch(ctx, rc, channel, batch); err != nil {
+				logrus.WithField("channel_uuid", channel.UUID()).WithField("msgs", len(batch)).WithError(err).Error("error queuing messages for outbox")
+
+				unsent = append(unsent, batch...)
+			}
+		}
+	}
+
+	return unsent
+}
+
+func queueOutboxBatch(ctx context.Context, rc redis.Conn, channel *models.Channel, msgs []*models.Msg) error {
+	msgIDs := make([]models.MsgID, len(msgs))
+	for i, m := range msgs {
+		msgIDs[i] = models.MsgID(m.ID())
+	}
+
+	task := &OutboxBatch{
+		ChannelUUID: channel.UUID(),
+		MsgIDs:      msgIDs,
+		Body:        jsonx.MustMarshal(&outboxBatch{ChannelUUID: channel.UUID(), ChannelType: channel.Type(), Msgs: msgs}),
+	}
+
+	return queue.AddTask(ctx, rc, queue.BatchQueue, queue.PostOutboxBatch, int(msgs[0].OrgID()), task, queue.DefaultPriority)
+}
+
+// PostOutboxBatch POSTs the passed in batch of messages to the outbox. Courier won't be sending us status updates for
+// these messages so they're marked as wired as soon as they're posted, and if posting fails, they're set back to
+// pending so they'll be retried.
+func PostOutboxBatch(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, batch *OutboxBatch) error {
+	msgs, err := models.GetMessagesByID(ctx, rt.DB, orgID, models.DirectionOut, batch.MsgIDs)
+	if err != nil {
+		return errors.Wrap(err, "error loading outbox messages")
+	}
+
+	start := time.Now()
+	log := logrus.WithField("channel_uuid", batch.ChannelUUID).WithField("msgs", len(batch.MsgIDs))
+
+	if err := postOutboxBatch(ctx, rt.Config, batch.Body); err != nil {
+		log.WithError(err).Error("error posting messages to outbox")
+
+		return errors.Wrap(models.MarkMessagesPending(ctx, rt.DB, msgs), "error marking outbox messages as pending")
+	}
+
+	if err := models.MarkMessagesWired(ctx, rt.DB, msgs); err != nil {
+		return errors.Wrap(err, "error marking outbox messages as wired")
+	}
+
+	log.WithField("elapsed", time.Since(start)).Info("msgs posted to outbox")
+	return nil
+}
+
+func postOutboxBatch(ctx context.Context, cfg *runtime.Config, body []byte) error {
+	timestamp := fmt.Sprint(dates.Now().Unix())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.OutboxURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "error creating outbox request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(OutboxTimestampHeader, timestamp)
+	req.Header.Set(OutboxSignatureHeader, OutboxSignature(cfg.OutboxSecret, timestamp, body))
+
+	trace, err := httpx.DoTrace(outboxHTTPClient, req, nil, nil, -1)
+	if err != nil {
+		return errors.Wrap(err, "error making outbox request")
+	}
+	if trace.Response.StatusCode/100 != 2 {
+		return errors.Errorf("outbox returned non-2XX status: %d", trace.Response.StatusCode)
+	}
+	return nil
+}
+
+// OutboxSignature returns the signature of a batch POSTed to the outbox, which is the hex encoded HMAC-SHA256 of the
+// timestamp and body joined by a period, using the outbox secret as the key
+func OutboxSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,116 @@
+package msgio_test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxSignature(t *testing.T) {
+	assert.Equal(t, "2ffbe84d629329d8c1e75b7df2d166d504009a44c833eb8e168dc894b8113ef7", msgio.OutboxSignature("sesame", "1530880200", []byte(`{"msgs":[]}`)))
+	assert.NotEqual(t, msgio.OutboxSignature("sesame", "1530880200", []byte(`{"msgs":[]}`)), msgio.OutboxSignature("sesame", "1530880201", []byte(`{"msgs":[]}`)))
+	assert.NotEqual(t, msgio.OutboxSignature("sesame", "1530880200", []byte(`{"msgs":[]}`)), msgio.OutboxSignature("open", "1530880200", []byte(`{"msgs":[]}`)))
+}
+
+func TestSendMessagesViaOutbox(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2018, 7, 6, 12, 30, 0, 0, time.UTC)))
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	rt.Config.OutboxURL = "http://outbox.example.com/send"
+	rt.Config.OutboxSecret = "sesame"
+	rt.Config.OutboxChannelTypes = "T,TG"
+	defer func() {
+		rt.Config.OutboxURL = ""
+		rt.Config.OutboxSecret = ""
+		rt.Config.OutboxChannelTypes = ""
+	}()
+
+	mocks := httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"http://outbox.example.com/send": {
+			httpx.NewMockResponse(200, nil, []byte(`{}`)),
+			httpx.NewMockResponse(503, nil, []byte(`{"error": "unavailable"}`)),
+		},
+	})
+	httpx.SetRequestor(mocks)
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	specs := []msgSpec{
+		{Channel: testdata.TwilioChannel, Contact: testdata.Cathy},
+		{Channel: testdata.TwilioChannel, Contact: testdata.Bob},
+		{Channel: testdata.VonageChannel, Contact: testdata.Cathy},
+	}
+	msgs := make([]*models.Msg, len(specs))
+	for i, ms := range specs {
+		msgs[i] = ms.createMsg(t, rt, oa)
+	}
+
+	rc.Do("FLUSHDB")
+
+	// Twilio messages are queued for the outbox as a single batch, and the Vonage message goes to courier
+	msgio.SendMessages(ctx, rt, db, nil, msgs)
+
+	assert.Len(t, mocks.Requests(), 0)
+	testsuite.AssertCourierQueues(t, map[string][]int{"msgs:19012bfd-3ce3-4cae-9bb9-76cf92c73d49|10/0": {1}})
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE status = 'Q'`).Returns(3)
+
+	popOutboxBatch := func() *msgio.OutboxBatch {
+		tasks := testsuite.CurrentOrgTasks(t, rp)[testdata.Org1.ID]
+		require.Len(t, tasks, 1)
+		assert.Equal(t, queue.PostOutboxBatch, tasks[0].Type)
+		rc.Do("FLUSHDB")
+
+		batch := &msgio.OutboxBatch{}
+		jsonx.MustUnmarshal(tasks[0].Task, batch)
+		return batch
+	}
+
+	batch := popOutboxBatch()
+	assert.Equal(t, testdata.TwilioChannel.UUID, batch.ChannelUUID)
+	assert.Equal(t, []models.MsgID{models.MsgID(msgs[0].ID()), models.MsgID(msgs[1].ID())}, batch.MsgIDs)
+
+	// posting the batch signs it with the time it's posted
+	require.NoError(t, msgio.PostOutboxBatch(ctx, rt, testdata.Org1.ID, batch))
+
+	require.Len(t, mocks.Requests(), 1)
+	req := mocks.Requests()[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "1530880200", req.Header.Get(msgio.OutboxTimestampHeader))
+
+	body, _ := io.ReadAll(req.Body)
+	assert.JSONEq(t, string(batch.Body), string(body))
+	assert.Equal(t, msgio.OutboxSignature("sesame", "1530880200", body), req.Header.Get(msgio.OutboxSignatureHeader))
+
+	// messages posted to the outbox are marked as wired, and the one queued to courier stays queued
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE status = 'W' AND id IN ($1, $2)`, msgs[0].ID(), msgs[1].ID()).Returns(2)
+	assertdb.Query(t, db, `SELECT status FROM msgs_msg WHERE id = $1`, msgs[2].ID()).Returns("Q")
+
+	// if the outbox fails, the messages are set back to pending so they'll be retried
+	msgio.SendMessages(ctx, rt, db, nil, msgs[:2])
+
+	require.NoError(t, msgio.PostOutboxBatch(ctx, rt, testdata.Org1.ID, popOutboxBatch()))
+
+	assert.False(t, mocks.HasUnused())
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE status = 'P'`).Returns(2)
+}
@@ -6,22 +6,30 @@ import (
 	"github.com/edganiukov/fcm"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// SendMessages tries to send the given messages via Courier or Android syncing
+// SendMessages tries to send the given messages using the sender for each message's channel type
 func SendMessages(ctx context.Context, rt *runtime.Runtime, tx models.Queryer, fc *fcm.Client, msgs []*models.Msg) {
-	// messages to be sent by courier, organized by contact
-	courierMsgs := make(map[models.ContactID][]*models.Msg, 100)
+	ctx, span := tracing.StartSpan(ctx, "send messages", attribute.Int("mailroom.msg_count", len(msgs)))
+	defer span.End()
 
-	// android channels that need to be notified to sync
-	androidChannels := make([]*models.Channel, 0, 5)
-	androidChannelsSeen := make(map[*models.Channel]bool)
+	// if we've been given an FCM client, Android channels are synced with that instead of one created from config
+	var android Sender
+	if fc != nil {
+		android = &androidSender{fc: fc}
+	}
+
+	// messages to be sent organized by sender, and the order in which we first saw each sender
+	senderMsgs := make(map[Sender][]*models.Msg, 2)
+	senderOrder := make([]Sender, 0, 2)
 
 	// messages that need to be marked as pending
 	pending := make([]*models.Msg, 0, 1)
 
-	// walk through our messages, separate by whether they have a channel and if it's Android
+	// walk through our messages, separate by whether they have a channel and which sender that channel uses
 	for _, msg := range msgs {
 		// ignore any message already marked as failed (maybe org is suspended)
 		if msg.Status() == models.MsgStatusFailed {
@@ -30,44 +38,25 @@ func SendMessages(ctx context.Context, rt *runtime.Runtime, tx models.Queryer, f
 
 		channel := msg.Channel()
 		if channel != nil {
-			if channel.Type() == models.ChannelTypeAndroid {
-				if !androidChannelsSeen[channel] {
-					androidChannels = append(androidChannels, channel)
-				}
-				androidChannelsSeen[channel] = true
-			} else {
-				courierMsgs[msg.ContactID()] = append(courierMsgs[msg.ContactID()], msg)
+			sender := senderForChannel(rt, channel)
+			if _, isAndroid := sender.(*androidSender); isAndroid && android != nil {
+				sender = android
 			}
-		} else {
-			pending = append(pending, msg)
-		}
-	}
 
-	// if there are courier messages to send, do so
-	if len(courierMsgs) > 0 {
-		rc := rt.RP.Get()
-		defer rc.Close()
-
-		for contactID, contactMsgs := range courierMsgs {
-			err := QueueCourierMessages(rc, contactID, contactMsgs)
-
-			// not being able to queue a message isn't the end of the world, log but don't return an error
-			if err != nil {
-				logrus.WithField("messages", contactMsgs).WithField("contact", contactID).WithError(err).Error("error queuing messages")
-
-				// in the case of errors we do want to change the messages back to pending however so they
-				// get queued later. (for the common case messages are only inserted and queued, without a status update)
-				pending = append(pending, contactMsgs...)
+			if _, seen := senderMsgs[sender]; !seen {
+				senderOrder = append(senderOrder, sender)
 			}
+			senderMsgs[sender] = append(senderMsgs[sender], msg)
+		} else {
+			pending = append(pending, msg)
 		}
 	}
 
-	// if we have any android messages, trigger syncs for the unique channels
-	if len(androidChannels) > 0 {
-		if fc == nil {
-			fc = CreateFCMClient(rt.Config)
-		}
-		SyncAndroidChannels(fc, androidChannels)
+	// not being able to send a message isn't the end of the world, senders log errors and give us back the messages
+	// which should be retried later
+	for _, sender := range senderOrder {
+		unsent := sender.Send(ctx, rt, senderMsgs[sender])
+		pending = append(pending, unsent...)
 	}
 
 	// any messages that didn't get sent should be moved back to pending (they are queued at creation to save an
@@ -0,0 +1,42 @@
+package msgio
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+)
+
+// Sender is something which can send messages on channels of a particular type
+type Sender interface {
+	// Send tries to send the given messages, returning any which couldn't be sent and should be retried later
+	Send(ctx context.Context, rt *runtime.Runtime, msgs []*models.Msg) []*models.Msg
+}
+
+var senders = map[models.ChannelType]Sender{}
+
+// the sender used for any channel type which doesn't have one registered
+var defaultSender Sender = &courierSender{}
+
+// RegisterSender registers a sender for the given channel type
+func RegisterSender(channelType models.ChannelType, sender Sender) {
+	senders[channelType] = sender
+}
+
+// returns the sender for messages on the given channel, where channel types configured to use the outbox
+// take precedence over any registered sender
+func senderForChannel(rt *runtime.Runtime, channel *models.Channel) Sender {
+	if rt.Config.OutboxURL != "" {
+		for _, ct := range strings.Split(rt.Config.OutboxChannelTypes, ",") {
+			if models.ChannelType(strings.TrimSpace(ct)) == channel.Type() {
+				return outbox
+			}
+		}
+	}
+
+	if sender, found := senders[channel.Type()]; found {
+		return sender
+	}
+	return defaultSender
+}
@@ -0,0 +1,201 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	models.RegisterChangePublisher(publishChanges)
+}
+
+// types of change events
+const (
+	TypeMsgCreated           = "msg_created"
+	TypeContactFieldChanged  = "contact_field_changed"
+	TypeContactGroupsChanged = "contact_groups_changed"
+	TypeSessionEnded         = "session_ended"
+	TypeTicketOpened         = "ticket_opened"
+)
+
+// Event is a change which has been committed to the database
+type Event struct {
+	UUID        uuids.UUID        `json:"uuid"`
+	Type        string            `json:"type"`
+	OrgID       models.OrgID      `json:"org_id"`
+	ContactUUID flows.ContactUUID `json:"contact_uuid"`
+	CreatedOn   time.Time         `json:"created_on"`
+	Data        interface{}       `json:"data"`
+}
+
+// NewEvent creates a new change event
+func NewEvent(type_ string, orgID models.OrgID, contactUUID flows.ContactUUID, data interface{}) *Event {
+	return &Event{
+		UUID:        uuids.New(),
+		Type:        type_,
+		OrgID:       orgID,
+		ContactUUID: contactUUID,
+		CreatedOn:   dates.Now(),
+		Data:        data,
+	}
+}
+
+// NewChangeEvent creates a new change event for the passed in committed change, or returns nil if it isn't a change
+// which we publish
+func NewChangeEvent(orgID models.OrgID, contactUUID flows.ContactUUID, change interface{}) *Event {
+	switch c := change.(type) {
+	case *models.Msg:
+		return NewEvent(TypeMsgCreated, orgID, contactUUID, map[string]interface{}{
+			"msg_id":       c.ID(),
+			"msg_uuid":     c.UUID(),
+			"direction":    c.Direction(),
+			"text":         c.Text(),
+			"urn":          c.URN(),
+			"channel_uuid": c.ChannelUUID(),
+		})
+	case *events.ContactFieldChangedEvent:
+		return NewEvent(TypeContactFieldChanged, orgID, contactUUID, map[string]interface{}{"field": c.Field, "value": c.Value})
+	case *events.ContactGroupsChangedEvent:
+		return NewEvent(TypeContactGroupsChanged, orgID, contactUUID, map[string]interface{}{"groups_added": c.GroupsAdded, "groups_removed": c.GroupsRemoved})
+	case *models.Ticket:
+		return NewEvent(TypeTicketOpened, orgID, contactUUID, map[string]interface{}{"ticket_id": c.ID(), "ticket_uuid": c.UUID(), "topic_id": c.TopicID(), "assignee_id": c.AssigneeID()})
+	case *models.Session:
+		return NewEvent(TypeSessionEnded, orgID, contactUUID, map[string]interface{}{"session_id": c.ID(), "session_uuid": c.UUID(), "session_type": c.SessionType(), "status": c.Status()})
+	case *models.ExitedSession:
+		return NewEvent(TypeSessionEnded, orgID, contactUUID, map[string]interface{}{"session_id": c.ID, "session_uuid": c.UUID, "session_type": c.SessionType, "status": c.Status})
+	}
+	return nil
+}
+
+// Publisher is something which can publish change events to downstream systems, e.g. a Redis stream or a NATS or
+// Kafka topic
+type Publisher interface {
+	Publish(ctx context.Context, rt *runtime.Runtime, events []*Event) error
+}
+
+var publishers = make(map[string]Publisher)
+
+// RegisterPublisher registers a new publisher by name
+func RegisterPublisher(name string, publisher Publisher) {
+	publishers[name] = publisher
+}
+
+// Lookup returns the publisher with the passed in name, or nil if name is empty
+func Lookup(name string) (Publisher, error) {
+	if name == "" {
+		return nil, nil
+	}
+	publisher := publishers[name]
+	if publisher == nil {
+		return nil, errors.Errorf("no event publisher registered with name '%s'", name)
+	}
+	return publisher, nil
+}
+
+// batches of events which failed to publish are saved to this Redis list, up to a maximum number of batches, so that
+// they can be republished later
+const failedKey = "publish:failed"
+
+var maxFailedBatches = 10000
+
+// Publish publishes the passed in events with the configured publisher, if there is one. Rather than retrying here and
+// holding up the caller, events which fail to publish are saved to be republished later by Republish.
+func Publish(ctx context.Context, rt *runtime.Runtime, events []*Event) error {
+	publisher, err := Lookup(rt.Config.EventPublisher)
+	if err != nil {
+		return err
+	}
+	if publisher == nil || len(events) == 0 {
+		return nil
+	}
+
+	err = publisher.Publish(ctx, rt, events)
+	if err == nil {
+		return nil
+	}
+
+	if serr := saveFailed(rt, events); serr != nil {
+		return errors.Wrapf(err, "error publishing %d events and saving them to be republished", len(events))
+	}
+
+	logrus.WithError(err).WithField("count", len(events)).Warn("error publishing events, saved to be republished")
+	return nil
+}
+
+// saves the passed in events to be republished later, discarding the oldest saved batches if there are too many
+func saveFailed(rt *runtime.Runtime, events []*Event) error {
+	eventsJSON, err := json.Marshal(events)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling events")
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	rc.Send("MULTI")
+	rc.Send("RPUSH", failedKey, eventsJSON)
+	rc.Send("LTRIM", failedKey, -maxFailedBatches, -1)
+	_, err = rc.Do("EXEC")
+	return err
+}
+
+// Republish republishes batches of events which previously failed to publish, oldest first, stopping at the first which
+// fails again, and returns the number of events republished
+func Republish(ctx context.Context, rt *runtime.Runtime) (int, error) {
+	publisher, err := Lookup(rt.Config.EventPublisher)
+	if err != nil || publisher == nil {
+		return 0, err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	republished := 0
+
+	for {
+		eventsJSON, err := redis.Bytes(rc.Do("LINDEX", failedKey, 0))
+		if err == redis.ErrNil {
+			return republished, nil
+		} else if err != nil {
+			return republished, errors.Wrap(err, "error reading failed events")
+		}
+
+		events := make([]*Event, 0)
+		if err := json.Unmarshal(eventsJSON, &events); err != nil {
+			logrus.WithError(err).Error("discarding failed events which can't be unmarshaled")
+		} else if err := publisher.Publish(ctx, rt, events); err != nil {
+			return republished, errors.Wrapf(err, "error republishing %d events", len(events))
+		}
+
+		// batches are only otherwise removed from the front of the list when it's full, so this is the batch we just
+		// republished unless we're discarding batches anyway
+		if _, err := rc.Do("LPOP", failedKey); err != nil {
+			return republished, errors.Wrap(err, "error removing republished events")
+		}
+
+		republished += len(events)
+	}
+}
+
+// publishes changes which have been committed outside of the flow engine
+func publishChanges(ctx context.Context, rt *runtime.Runtime, changes []*models.Change) error {
+	events := make([]*Event, 0, len(changes))
+	for _, c := range changes {
+		if e := NewChangeEvent(c.OrgID, c.ContactUUID, c.Value); e != nil {
+			events = append(events, e)
+		}
+	}
+
+	return Publish(ctx, rt, events)
+}
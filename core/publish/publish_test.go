@@ -0,0 +1,153 @@
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/publish"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+	defer func() { rt.Config.EventPublisher = "" }()
+
+	defer dates.SetNowSource(dates.DefaultNowSource)
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2022, 11, 15, 10, 30, 0, 0, time.UTC)))
+
+	defer uuids.SetGenerator(uuids.DefaultGenerator)
+	uuids.SetGenerator(uuids.NewSeededGenerator(1234))
+
+	events := []*publish.Event{
+		publish.NewEvent(publish.TypeContactFieldChanged, testdata.Org1.ID, testdata.Cathy.UUID, map[string]interface{}{"field": "age"}),
+		publish.NewEvent(publish.TypeSessionEnded, testdata.Org1.ID, testdata.Bob.UUID, map[string]interface{}{"status": "C"}),
+	}
+
+	// no publisher configured is a noop
+	err := publish.Publish(ctx, rt, events)
+	assert.NoError(t, err)
+	assertStreamLength(t, rc, 0)
+
+	rt.Config.EventPublisher = "kafka"
+	err = publish.Publish(ctx, rt, events)
+	assert.EqualError(t, err, "no event publisher registered with name 'kafka'")
+
+	rt.Config.EventPublisher = "redis"
+	err = publish.Publish(ctx, rt, events)
+	assert.NoError(t, err)
+	assertStreamLength(t, rc, 2)
+
+	entries, err := redis.Values(rc.Do("XRANGE", "mailroom:events", "-", "+"))
+	require.NoError(t, err)
+
+	entry, _ := redis.Values(entries[0], nil)
+	fields, _ := redis.StringMap(entry[1], nil)
+	assert.Equal(t, publish.TypeContactFieldChanged, fields["type"])
+
+	event := &publish.Event{}
+	require.NoError(t, json.Unmarshal([]byte(fields["event"]), event))
+	assert.Equal(t, events[0].UUID, event.UUID)
+	assert.Equal(t, testdata.Org1.ID, event.OrgID)
+	assert.Equal(t, testdata.Cathy.UUID, event.ContactUUID)
+	assert.Equal(t, time.Date(2022, 11, 15, 10, 30, 0, 0, time.UTC), event.CreatedOn)
+	assert.Equal(t, map[string]interface{}{"field": "age"}, event.Data)
+
+	// stream is trimmed to approximately its max length
+	rt.Config.EventStreamMaxLen = 1
+	defer func() { rt.Config.EventStreamMaxLen = 1000000 }()
+
+	for i := 0; i < 300; i++ {
+		err = publish.Publish(ctx, rt, events)
+		assert.NoError(t, err)
+	}
+
+	length, err := redis.Int(rc.Do("XLEN", "mailroom:events"))
+	assert.NoError(t, err)
+	assert.Less(t, length, 602)
+}
+
+type flakyPublisher struct {
+	failures  int
+	published int
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, rt *runtime.Runtime, events []*publish.Event) error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("boom")
+	}
+	p.published += len(events)
+	return nil
+}
+
+func TestPublishFailures(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+	defer func() { rt.Config.EventPublisher = "" }()
+
+	events := []*publish.Event{
+		publish.NewChangeEvent(testdata.Org1.ID, testdata.Cathy.UUID, &events.ContactFieldChangedEvent{}),
+		publish.NewChangeEvent(testdata.Org1.ID, testdata.Bob.UUID, &models.ExitedSession{ID: 123, Status: models.SessionStatusExpired}),
+	}
+	assert.Equal(t, publish.TypeContactFieldChanged, events[0].Type)
+	assert.Equal(t, publish.TypeSessionEnded, events[1].Type)
+	assert.Nil(t, publish.NewChangeEvent(testdata.Org1.ID, testdata.Bob.UUID, "foo"))
+
+	flaky := &flakyPublisher{failures: 2}
+	publish.RegisterPublisher("flaky", flaky)
+	rt.Config.EventPublisher = "flaky"
+
+	// failed publishes aren't retried straight away but are saved to be republished
+	err := publish.Publish(ctx, rt, events)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, flaky.published)
+	assertFailedBatches(t, rc, 1)
+
+	// republishing stops at the first batch which fails again
+	count, err := publish.Republish(ctx, rt)
+	assert.EqualError(t, err, "error republishing 2 events: boom")
+	assert.Equal(t, 0, count)
+	assertFailedBatches(t, rc, 1)
+
+	count, err = publish.Republish(ctx, rt)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 2, flaky.published)
+	assertFailedBatches(t, rc, 0)
+
+	// nothing left to republish
+	count, err = publish.Republish(ctx, rt)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func assertFailedBatches(t *testing.T, rc redis.Conn, expected int) {
+	length, err := redis.Int(rc.Do("LLEN", "publish:failed"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, length)
+}
+
+func assertStreamLength(t *testing.T, rc redis.Conn, expected int) {
+	length, err := redis.Int(rc.Do("XLEN", "mailroom:events"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, length)
+}
@@ -0,0 +1,42 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterPublisher("redis", &redisPublisher{})
+}
+
+// publishes events to a Redis stream, trimmed to approximately the configured maximum length, where each entry has
+// a type field and an event field containing the JSON encoded event
+type redisPublisher struct{}
+
+func (p *redisPublisher) Publish(ctx context.Context, rt *runtime.Runtime, events []*Event) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	rc.Send("MULTI")
+	for _, e := range events {
+		eventJSON, err := json.Marshal(e)
+		if err != nil {
+			rc.Do("DISCARD")
+			return errors.Wrap(err, "error marshaling event")
+		}
+
+		args := []interface{}{rt.Config.EventStream}
+		if rt.Config.EventStreamMaxLen > 0 {
+			args = append(args, "MAXLEN", "~", rt.Config.EventStreamMaxLen)
+		}
+		args = append(args, "*", "type", e.Type, "event", eventJSON)
+
+		rc.Send("XADD", args...)
+	}
+	_, err := rc.Do("EXEC")
+
+	return errors.Wrapf(err, "error adding events to stream %s", rt.Config.EventStream)
+}
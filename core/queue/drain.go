@@ -0,0 +1,26 @@
+package queue
+
+import "context"
+
+type drainKey struct{}
+
+// WithDrain returns a copy of the passed in context which is considered draining once the passed in channel is closed
+func WithDrain(ctx context.Context, draining <-chan bool) context.Context {
+	return context.WithValue(ctx, drainKey{}, draining)
+}
+
+// IsDraining returns whether the worker handling a task with the passed in context has been asked to stop. Tasks
+// which loop over multiple items of work should check this between items and leave any remaining work queued.
+func IsDraining(ctx context.Context) bool {
+	draining, _ := ctx.Value(drainKey{}).(<-chan bool)
+	if draining == nil {
+		return false
+	}
+
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const idempotencyPattern = "task_key:%s"
+
+// how long a claimed idempotency key prevents the same work being queued again
+var idempotencyWindow = time.Hour * 24
+
+// IdempotentTask can be implemented by tasks which represent a single logical piece of work, so that adding the same
+// work more than once within our idempotency window is a no-op
+type IdempotentTask interface {
+	// IdempotencyKey returns the key which identifies the work of this task, or empty if it can't be identified
+	IdempotencyKey() string
+}
+
+// SetIdempotencyWindow sets how long a claimed idempotency key prevents the same work being queued again
+func SetIdempotencyWindow(window time.Duration) {
+	idempotencyWindow = window
+}
+
+// ClaimIdempotencyKey claims the passed in key, returning false if it was already claimed within our idempotency window.
+// Producers which don't add tasks with AddTask can use this to check whether work has already been queued.
+func ClaimIdempotencyKey(rc redis.Conn, key string) (bool, error) {
+	_, err := redis.String(rc.Do("set", fmt.Sprintf(idempotencyPattern, key), 1, "NX", "EX", int(idempotencyWindow/time.Second)))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "error claiming idempotency key: %s", key)
+	}
+	return true, nil
+}
+
+// ReleaseIdempotencyKey releases the passed in key so that its work can be queued again, e.g. if it failed
+func ReleaseIdempotencyKey(rc redis.Conn, key string) error {
+	_, err := rc.Do("del", fmt.Sprintf(idempotencyPattern, key))
+	return errors.Wrapf(err, "error releasing idempotency key: %s", key)
+}
+
+var addUniqueTask = redis.NewScript(2, refreshOrgLua+`-- KEYS: [SetKey, IdempotencyKey] ARGV: [Score, Payload, Window, QueueName, OrgID]
+	-- only add the task if we're the first to claim its key
+	if not redis.call("set", KEYS[2], "1", "NX", "EX", ARGV[3]) then
+		return 0
+	end
+
+	redis.call("zadd", KEYS[1], ARGV[1], ARGV[2])
+	if ARGV[4] ~= "" then
+		refreshOrg(ARGV[4], ARGV[5])
+	end
+	return 1
+`)
+
+// returns the idempotency key of the passed in task if it has one
+func idempotencyKey(task interface{}) string {
+	if it, ok := task.(IdempotentTask); ok {
+		return it.IdempotencyKey()
+	}
+	return ""
+}
@@ -1,30 +1,48 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/utils/logging"
 	"github.com/pkg/errors"
 )
 
 // Task is a utility struct for encoding a task
 type Task struct {
-	Type       string          `json:"type"`
-	OrgID      int             `json:"org_id"`
-	Task       json.RawMessage `json:"task"`
-	QueuedOn   time.Time       `json:"queued_on"`
-	ErrorCount int             `json:"error_count,omitempty"`
+	Type           string          `json:"type"`
+	OrgID          int             `json:"org_id"`
+	Task           json.RawMessage `json:"task"`
+	QueuedOn       time.Time       `json:"queued_on"`
+	ErrorCount     int             `json:"error_count,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CorrelationID  string          `json:"correlation_id,omitempty"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
 }
 
 // Priority is the priority for the task
 type Priority int
 
 const (
-	queuePattern  = "%s:%d"
-	activePattern = "%s:active"
+	queuePattern   = "%s:%d"
+	activePattern  = "%s:active"
+	blockedPattern = "%s:blocked"
+	delayedPattern = "%s:delayed"
+	deadPattern    = "%s:dead"
+	pausedPattern  = "%s:paused"
+	limitsPattern  = "%s:limits"
+	drainedPattern = "%s:drained:%d"
+
+	// the maximum number of tasks we keep in a dead letter set, oldest are trimmed first
+	maxDeadTasks = 10000
+
+	// the number of tasks we move at a time when draining or replaying an org so we don't block redis for long
+	moveBatchSize = 1000
 
 	// DefaultPriority is the default priority for tasks
 	DefaultPriority = Priority(0)
@@ -58,15 +76,29 @@ const (
 
 	// StartIVRFlowBatch is our task for starting an ivr batch
 	StartIVRFlowBatch = "start_ivr_flow_batch"
+
+	// FireSessionTimeout is our task type for checking whether a session's wait has timed out
+	FireSessionTimeout = "fire_session_timeout"
+
+	// FireSessionExpiration is our task type for checking whether a session's wait has expired
+	FireSessionExpiration = "fire_session_expiration"
+
+	// PostOutboxBatch is our task type for POSTing a batch of messages to the outbox
+	PostOutboxBatch = "post_outbox_batch"
 )
 
-// Size returns the number of tasks for the passed in queue
+// Size returns the number of tasks for the passed in queue, including those of orgs which are paused or limited
 func Size(rc redis.Conn, queue string) (int, error) {
-	// get all the active queues
-	queues, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queue), 0, -1))
+	// get all the active and blocked queues
+	active, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queue), 0, -1))
 	if err != nil {
 		return 0, errors.Wrapf(err, "error getting active queues for: %s", queue)
 	}
+	blocked, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(blockedPattern, queue), 0, -1))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting blocked queues for: %s", queue)
+	}
+	queues := append(active, blocked...)
 
 	// add up each
 	size := 0
@@ -81,42 +113,165 @@ func Size(rc redis.Conn, queue string) (int, error) {
 	return size, nil
 }
 
-// AddTask adds the passed in task to our queue for execution
-func AddTask(rc redis.Conn, queue string, taskType string, orgID int, task interface{}, priority Priority) error {
-	score := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000)+float64(priority), 'f', 6, 64)
+// OldestTaskAge returns the age of the oldest task at the front of any active org's queue for the passed in queue, which
+// is roughly how long the next task popped will have been waiting
+func OldestTaskAge(rc redis.Conn, queue string) (time.Duration, error) {
+	queues, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queue), 0, -1))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting active queues for: %s", queue)
+	}
 
-	taskBody, err := json.Marshal(task)
+	var oldest time.Duration
+	for _, q := range queues {
+		fronts, err := redis.ByteSlices(rc.Do("zrange", fmt.Sprintf(queuePattern, queue, q), 0, 0))
+		if err != nil {
+			return 0, errors.Wrapf(err, "error getting front of: %d", q)
+		}
+		if len(fronts) == 0 {
+			continue
+		}
+
+		task := &Task{}
+		if err := json.Unmarshal(fronts[0], task); err != nil {
+			return 0, errors.Wrapf(err, "error unmarshalling task from: %d", q)
+		}
+		if age := dates.Since(task.QueuedOn); age > oldest {
+			oldest = age
+		}
+	}
+
+	return oldest, nil
+}
+
+// formats the passed in time as a score in seconds with microsecond precision
+func timeScore(t time.Time, offset float64) string {
+	return strconv.FormatFloat(float64(t.UnixNano()/int64(time.Microsecond))/float64(1000000)+offset, 'f', 6, 64)
+}
+
+// AddTask adds the passed in task to our queue for execution, or to whichever queue its type has been routed to. The
+// task inherits the correlation ID of the passed in context so that any logging it does can be tied back to whatever
+// queued it. If the task implements IdempotentTask and its key has already been claimed, this is a no-op.
+func AddTask(ctx context.Context, rc redis.Conn, queue string, taskType string, orgID int, task interface{}, priority Priority) error {
+	queue = QueueFor(taskType, queue)
+	score := timeScore(time.Now(), float64(priority))
+
+	jsonPayload, key, err := newTaskPayload(ctx, taskType, orgID, task, dates.Now())
 	if err != nil {
 		return err
 	}
 
-	payload := &Task{
-		Type:     taskType,
-		OrgID:    orgID,
-		Task:     taskBody,
-		QueuedOn: time.Now(),
+	if key != "" {
+		_, err = addUniqueTask.Do(rc, fmt.Sprintf(queuePattern, queue, orgID), fmt.Sprintf(idempotencyPattern, key), score, jsonPayload, int(idempotencyWindow/time.Second), queue, orgID)
+		return errors.Wrapf(err, "error adding task to: %s", queue)
 	}
-	jsonPayload, err := json.Marshal(payload)
+
+	_, err = pushTask.Do(rc, queue, orgID, score, jsonPayload)
+	return err
+}
+
+// AddTaskAt adds the passed in task to our queue, or to whichever queue its type has been routed to, but it won't become
+// runnable until the passed in time. Until then it waits in the delayed set for the queue, and once due it's moved onto
+// the org's queue the next time a task is popped. Like AddTask, this is a no-op if the task's idempotency key has
+// already been claimed.
+func AddTaskAt(ctx context.Context, rc redis.Conn, queue string, taskType string, orgID int, task interface{}, runAt time.Time) error {
+	queue = QueueFor(taskType, queue)
+
+	// the task is only considered queued from when it becomes runnable, so that its age doesn't include its delay
+	queuedOn := dates.Now()
+	if runAt.After(queuedOn) {
+		queuedOn = runAt
+	}
+
+	jsonPayload, key, err := newTaskPayload(ctx, taskType, orgID, task, queuedOn)
 	if err != nil {
 		return err
 	}
 
-	rc.Send("zadd", fmt.Sprintf(queuePattern, queue, orgID), score, jsonPayload)
-	rc.Send("zincrby", fmt.Sprintf(activePattern, queue), 0, orgID)
-	_, err = rc.Do("")
-	return err
+	if key != "" {
+		_, err = addUniqueTask.Do(rc, fmt.Sprintf(delayedPattern, queue), fmt.Sprintf(idempotencyPattern, key), timeScore(runAt, 0), jsonPayload, int(idempotencyWindow/time.Second), "", orgID)
+	} else {
+		_, err = rc.Do("zadd", fmt.Sprintf(delayedPattern, queue), timeScore(runAt, 0), jsonPayload)
+	}
+	return errors.Wrapf(err, "error adding delayed task to: %s", queue)
 }
 
-var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
-    -- first get what is the active queue
-	local result = redis.call("zrange", KEYS[1] .. ":active", 0, 0, "WITHSCORES")
+// encodes the passed in task for adding to a queue, returning the encoded task and its idempotency key
+func newTaskPayload(ctx context.Context, taskType string, orgID int, task interface{}, queuedOn time.Time) ([]byte, string, error) {
+	taskBody, err := json.Marshal(task)
+	if err != nil {
+		return nil, "", err
+	}
+
+	payload := &Task{
+		Type:           taskType,
+		OrgID:          orgID,
+		Task:           taskBody,
+		QueuedOn:       queuedOn,
+		CorrelationID:  logging.CorrelationID(ctx),
+		IdempotencyKey: idempotencyKey(task),
+	}
+	jsonPayload, err := json.Marshal(payload)
+	return jsonPayload, payload.IdempotencyKey, err
+}
+
+// lua function used by scripts which change the state of an org in a queue, which keeps the org in our active set, from
+// which tasks are popped, unless it has no tasks, is paused or already has as many workers as its limit allows, in which
+// case it's kept in our blocked set instead. This means popping never has to skip over orgs. The score of an org in either
+// set is its number of workers, and orgs with no workers and no tasks are removed from both.
+const refreshOrgLua = `
+local function refreshOrg(queue, org)
+	local workers = tonumber(redis.call("zscore", queue .. ":active", org) or redis.call("zscore", queue .. ":blocked", org) or 0)
+	if workers < 0 then
+		workers = 0
+	end
+
+	redis.call("zrem", queue .. ":active", org)
+	redis.call("zrem", queue .. ":blocked", org)
+
+	local size = redis.call("zcard", queue .. ":" .. org)
+	if workers == 0 and size == 0 then
+		return
+	end
+
+	local limit = tonumber(redis.call("hget", queue .. ":limits", org))
+	if size > 0 and redis.call("sismember", queue .. ":paused", org) == 0 and (not limit or workers < limit) then
+		redis.call("zadd", queue .. ":active", workers, org)
+	else
+		redis.call("zadd", queue .. ":blocked", workers, org)
+	end
+end
+`
+
+var pushTask = redis.NewScript(1, refreshOrgLua+`-- KEYS: [QueueName] ARGV: [OrgID, Score, Payload]
+	redis.call("zadd", KEYS[1] .. ":" .. ARGV[1], ARGV[2], ARGV[3])
+	refreshOrg(KEYS[1], ARGV[1])
+`)
+
+var popTask = redis.NewScript(1, refreshOrgLua+`-- KEYS: [QueueName] ARGV: [Now]
+	-- first promote any delayed tasks which are now due to their org queues
+	local due = redis.call("zrangebyscore", KEYS[1] .. ":delayed", "-inf", ARGV[1], "LIMIT", 0, 100)
+	for _, payload in ipairs(due) do
+		local org = string.format("%d", cjson.decode(payload)["org_id"])
+		redis.call("zadd", KEYS[1] .. ":" .. org, ARGV[1], payload)
+		refreshOrg(KEYS[1], org)
+		redis.call("zrem", KEYS[1] .. ":delayed", payload)
+	end
+
+	-- then get what is the active queue with the fewest workers
+	local group = redis.call("zrange", KEYS[1] .. ":active", 0, 0)[1]
 
 	-- nothing? return nothing
-	local group = result[1]
 	if not group then
 		return {"empty", ""}
 	end
 
+	-- orgs which were paused or limited before we kept them out of the active set may still be in it
+	local limit = tonumber(redis.call("hget", KEYS[1] .. ":limits", group))
+	if redis.call("sismember", KEYS[1] .. ":paused", group) == 1 or (limit and tonumber(redis.call("zscore", KEYS[1] .. ":active", group)) >= limit) then
+		refreshOrg(KEYS[1], group)
+		return {"retry", ""}
+	end
+
 	local queue = KEYS[1] .. ":" .. group
 
 	-- pop off our queue
@@ -127,13 +282,14 @@ var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
 		-- then remove it from the queue
 		redis.call('zremrangebyrank', queue, 0, 0)
 
-		-- and add a worker to this queue
+		-- and add a worker to this queue, which may take it to its limit
 		redis.call("zincrby", KEYS[1] .. ":active", 1, group)
+		refreshOrg(KEYS[1], group)
 
 		return {group, result[1]}
 	else
-		-- no result found, remove this group from active queues
-		redis.call("zrem", KEYS[1] .. ":active", group)
+		-- no result found, move this group out of the active set whilst keeping its workers
+		refreshOrg(KEYS[1], group)
 
 		return {"retry", ""}
 	end
@@ -143,7 +299,7 @@ var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
 func PopNextTask(rc redis.Conn, queue string) (*Task, error) {
 	task := Task{}
 	for {
-		values, err := redis.Strings(popTask.Do(rc, queue))
+		values, err := redis.Strings(popTask.Do(rc, queue, timeScore(time.Now(), 0)))
 		if err != nil {
 			return nil, err
 		}
@@ -161,14 +317,15 @@ func PopNextTask(rc redis.Conn, queue string) (*Task, error) {
 	}
 }
 
-var markComplete = redis.NewScript(2, `-- KEYS: [QueueName] [TaskGroup]
-	-- decrement our active
-	local active = tonumber(redis.call("zincrby", KEYS[1] .. ":active", -1, KEYS[2]))
-
-	-- reset to zero if we somehow go below
-	if active < 0 then
-		redis.call("zadd", KEYS[1] .. ":active", 0, KEYS[2])
+var markComplete = redis.NewScript(2, refreshOrgLua+`-- KEYS: [QueueName] [TaskGroup]
+	-- decrement our workers in whichever set we're in, which may take us back under our limit
+	if redis.call("zscore", KEYS[1] .. ":blocked", KEYS[2]) then
+		redis.call("zincrby", KEYS[1] .. ":blocked", -1, KEYS[2])
+	else
+		redis.call("zincrby", KEYS[1] .. ":active", -1, KEYS[2])
 	end
+
+	refreshOrg(KEYS[1], KEYS[2])
 `)
 
 // MarkTaskComplete marks the passed in task as complete. Callers must call this in order
@@ -177,3 +334,369 @@ func MarkTaskComplete(rc redis.Conn, queue string, orgID int) error {
 	_, err := markComplete.Do(rc, queue, strconv.FormatInt(int64(orgID), 10))
 	return err
 }
+
+// ForwardTask adds the passed in task, which was popped from another queue, to the end of the passed in queue
+func ForwardTask(rc redis.Conn, queue string, task *Task) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	_, err = pushTask.Do(rc, queue, task.OrgID, timeScore(time.Now(), 0), payload)
+	return errors.Wrapf(err, "error forwarding task to: %s", queue)
+}
+
+// RetryTask re-adds the passed in task to our queue, but only after the given delay has passed
+func RetryTask(rc redis.Conn, queue string, task *Task, delay time.Duration) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	_, err = rc.Do("zadd", fmt.Sprintf(delayedPattern, queue), timeScore(time.Now().Add(delay), 0), payload)
+	return err
+}
+
+// DelayedSize returns the number of tasks waiting to be retried or scheduled for later for the passed in queue
+func DelayedSize(rc redis.Conn, queue string) (int, error) {
+	return redis.Int(rc.Do("zcard", fmt.Sprintf(delayedPattern, queue)))
+}
+
+// DeadLetterTask moves the passed in task to the dead letter set for the passed in queue where it can
+// be inspected, replayed or purged
+func DeadLetterTask(rc redis.Conn, queue string, task *Task) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	deadKey := fmt.Sprintf(deadPattern, queue)
+
+	rc.Send("zadd", deadKey, timeScore(time.Now(), 0), payload)
+	rc.Send("zremrangebyrank", deadKey, 0, -(maxDeadTasks + 1))
+	_, err = rc.Do("")
+	return err
+}
+
+// DeadSize returns the number of tasks in the dead letter set for the passed in queue
+func DeadSize(rc redis.Conn, queue string) (int, error) {
+	return redis.Int(rc.Do("zcard", fmt.Sprintf(deadPattern, queue)))
+}
+
+// DeadTasks returns up to count tasks from the dead letter set for the passed in queue, oldest first
+func DeadTasks(rc redis.Conn, queue string, offset, count int) ([]*Task, error) {
+	payloads, err := redis.ByteSlices(rc.Do("zrange", fmt.Sprintf(deadPattern, queue), offset, offset+count-1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading dead tasks for: %s", queue)
+	}
+
+	tasks := make([]*Task, len(payloads))
+	for i, payload := range payloads {
+		tasks[i] = &Task{}
+		if err := json.Unmarshal(payload, tasks[i]); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling dead task")
+		}
+	}
+	return tasks, nil
+}
+
+var replayDead = redis.NewScript(1, refreshOrgLua+`-- KEYS: [QueueName] ARGV: [DeadPayload, Payload, OrgID, Now]
+	-- only replay if we were the ones to remove this task from the dead letter set
+	if redis.call("zrem", KEYS[1] .. ":dead", ARGV[1]) == 1 then
+		redis.call("zadd", KEYS[1] .. ":" .. ARGV[3], ARGV[4], ARGV[2])
+		refreshOrg(KEYS[1], ARGV[3])
+		return 1
+	end
+	return 0
+`)
+
+// ReplayDeadTasks moves up to count of the oldest tasks, starting at offset, in the dead letter set for the passed
+// in queue back onto the queue, returning the number of tasks replayed
+func ReplayDeadTasks(rc redis.Conn, queue string, offset, count int) (int, error) {
+	payloads, err := redis.ByteSlices(rc.Do("zrange", fmt.Sprintf(deadPattern, queue), offset, offset+count-1))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading dead tasks for: %s", queue)
+	}
+
+	replayed := 0
+	for _, payload := range payloads {
+		task := &Task{}
+		if err := json.Unmarshal(payload, task); err != nil {
+			return replayed, errors.Wrapf(err, "error unmarshalling dead task")
+		}
+
+		// reset our error count so the task gets a full set of retries
+		task.ErrorCount = 0
+		task.LastError = ""
+
+		newPayload, err := json.Marshal(task)
+		if err != nil {
+			return replayed, err
+		}
+
+		moved, err := redis.Int(replayDead.Do(rc, queue, payload, newPayload, task.OrgID, timeScore(time.Now(), 0)))
+		if err != nil {
+			return replayed, errors.Wrapf(err, "error replaying dead task")
+		}
+		replayed += moved
+	}
+
+	return replayed, nil
+}
+
+// PurgeDeadTasks deletes all tasks in the dead letter set for the passed in queue, returning the number deleted
+func PurgeDeadTasks(rc redis.Conn, queue string) (int, error) {
+	deadKey := fmt.Sprintf(deadPattern, queue)
+
+	rc.Send("MULTI")
+	rc.Send("zcard", deadKey)
+	rc.Send("del", deadKey)
+	values, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error purging dead tasks for: %s", queue)
+	}
+
+	return redis.Int(values[0], nil)
+}
+
+// OrgQueue is the state of a single org's tasks within a queue
+type OrgQueue struct {
+	OrgID   int
+	Size    int
+	Workers int
+	Paused  bool
+	Limit   int
+}
+
+// OrgQueues returns the state of each org which has tasks in the passed in queue
+func OrgQueues(rc redis.Conn, queue string) ([]*OrgQueue, error) {
+	// the score of each org in our active and blocked sets is the number of workers currently working on its tasks
+	rc.Send("MULTI")
+	rc.Send("zrange", fmt.Sprintf(activePattern, queue), 0, -1, "WITHSCORES")
+	rc.Send("zrange", fmt.Sprintf(blockedPattern, queue), 0, -1, "WITHSCORES")
+	sets, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting queues for: %s", queue)
+	}
+	active, _ := redis.Values(sets[0], nil)
+	blocked, _ := redis.Values(sets[1], nil)
+	values := append(active, blocked...)
+
+	paused, err := PausedOrgs(rc, queue)
+	if err != nil {
+		return nil, err
+	}
+	isPaused := make(map[int]bool, len(paused))
+	for _, orgID := range paused {
+		isPaused[orgID] = true
+	}
+
+	limits, err := OrgLimits(rc, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs := make([]*OrgQueue, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		orgID, _ := redis.Int(values[i], nil)
+		workers, _ := redis.Int(values[i+1], nil)
+
+		size, err := OrgSize(rc, queue, orgID)
+		if err != nil {
+			return nil, err
+		}
+
+		orgs = append(orgs, &OrgQueue{OrgID: orgID, Size: size, Workers: workers, Paused: isPaused[orgID], Limit: limits[orgID]})
+	}
+	return orgs, nil
+}
+
+// GetOrgQueue returns the state of the passed in org in the passed in queue, whether or not it has any tasks
+func GetOrgQueue(rc redis.Conn, queue string, orgID int) (*OrgQueue, error) {
+	rc.Send("MULTI")
+	rc.Send("zscore", fmt.Sprintf(activePattern, queue), orgID)
+	rc.Send("zscore", fmt.Sprintf(blockedPattern, queue), orgID)
+	rc.Send("zcard", fmt.Sprintf(queuePattern, queue, orgID))
+	rc.Send("sismember", fmt.Sprintf(pausedPattern, queue), orgID)
+	rc.Send("hget", fmt.Sprintf(limitsPattern, queue), orgID)
+	values, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting state of org %d in: %s", orgID, queue)
+	}
+
+	workers, _ := redis.Int(values[0], nil)
+	if values[0] == nil {
+		workers, _ = redis.Int(values[1], nil)
+	}
+	size, _ := redis.Int(values[2], nil)
+	paused, _ := redis.Bool(values[3], nil)
+	limit, _ := redis.Int(values[4], nil)
+
+	return &OrgQueue{OrgID: orgID, Size: size, Workers: workers, Paused: paused, Limit: limit}, nil
+}
+
+// OrgSize returns the number of tasks for the passed in org in the passed in queue
+func OrgSize(rc redis.Conn, queue string, orgID int) (int, error) {
+	size, err := redis.Int(rc.Do("zcard", fmt.Sprintf(queuePattern, queue, orgID)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting size of: %d", orgID)
+	}
+	return size, nil
+}
+
+// PeekTasks returns up to count of the next tasks for the passed in org in the passed in queue without removing them
+func PeekTasks(rc redis.Conn, queue string, orgID int, count int) ([]*Task, error) {
+	payloads, err := redis.ByteSlices(rc.Do("zrange", fmt.Sprintf(queuePattern, queue, orgID), 0, count-1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading tasks for: %d", orgID)
+	}
+
+	tasks := make([]*Task, len(payloads))
+	for i, payload := range payloads {
+		tasks[i] = &Task{}
+		if err := json.Unmarshal(payload, tasks[i]); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling task")
+		}
+	}
+	return tasks, nil
+}
+
+var pauseOrg = redis.NewScript(1, refreshOrgLua+`-- KEYS: [QueueName] ARGV: [OrgID, Paused]
+	if ARGV[2] == "1" then
+		redis.call("sadd", KEYS[1] .. ":paused", ARGV[1])
+	else
+		redis.call("srem", KEYS[1] .. ":paused", ARGV[1])
+	end
+	refreshOrg(KEYS[1], ARGV[1])
+`)
+
+// PauseOrg pauses the passed in org in the passed in queue so that none of its tasks will be popped until it is resumed
+func PauseOrg(rc redis.Conn, queue string, orgID int) error {
+	_, err := pauseOrg.Do(rc, queue, orgID, true)
+	return err
+}
+
+// ResumeOrg resumes the passed in paused org in the passed in queue
+func ResumeOrg(rc redis.Conn, queue string, orgID int) error {
+	_, err := pauseOrg.Do(rc, queue, orgID, false)
+	return err
+}
+
+// PausedOrgs returns the ids of the orgs which are paused in the passed in queue
+func PausedOrgs(rc redis.Conn, queue string) ([]int, error) {
+	orgIDs, err := redis.Ints(rc.Do("smembers", fmt.Sprintf(pausedPattern, queue)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting paused orgs for: %s", queue)
+	}
+	return orgIDs, nil
+}
+
+var setOrgLimit = redis.NewScript(1, refreshOrgLua+`-- KEYS: [QueueName] ARGV: [OrgID, Limit]
+	if tonumber(ARGV[2]) > 0 then
+		redis.call("hset", KEYS[1] .. ":limits", ARGV[1], ARGV[2])
+	else
+		redis.call("hdel", KEYS[1] .. ":limits", ARGV[1])
+	end
+	refreshOrg(KEYS[1], ARGV[1])
+`)
+
+// SetOrgLimit sets the maximum number of workers which can work on tasks for the passed in org in the passed in
+// queue at once. A limit of zero removes any limit.
+func SetOrgLimit(rc redis.Conn, queue string, orgID int, limit int) error {
+	_, err := setOrgLimit.Do(rc, queue, orgID, limit)
+	return err
+}
+
+// OrgLimits returns the worker limits of orgs in the passed in queue
+func OrgLimits(rc redis.Conn, queue string) (map[int]int, error) {
+	values, err := redis.IntMap(rc.Do("hgetall", fmt.Sprintf(limitsPattern, queue)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting org limits for: %s", queue)
+	}
+
+	limits := make(map[int]int, len(values))
+	for org, limit := range values {
+		orgID, _ := strconv.Atoi(org)
+		limits[orgID] = limit
+	}
+	return limits, nil
+}
+
+var moveTasks = redis.NewScript(2, refreshOrgLua+`-- KEYS: [FromKey, ToKey] ARGV: [Count, QueueName, OrgID]
+	local tasks = redis.call("zrange", KEYS[1], 0, tonumber(ARGV[1]) - 1, "WITHSCORES")
+	if #tasks == 0 then
+		return 0
+	end
+
+	-- keep each task's score so that priorities and ordering are preserved
+	for i = 1, #tasks, 2 do
+		redis.call("zadd", KEYS[2], tasks[i + 1], tasks[i])
+	end
+	redis.call("zremrangebyrank", KEYS[1], 0, (#tasks / 2) - 1)
+
+	if ARGV[2] ~= "" then
+		refreshOrg(ARGV[2], ARGV[3])
+	end
+
+	return #tasks / 2
+`)
+
+// DrainOrgTasks moves all pending tasks for the passed in org in the passed in queue to a drained set for that org,
+// from where they can be replayed later, returning the number of tasks moved
+func DrainOrgTasks(rc redis.Conn, queue string, orgID int) (int, error) {
+	from, to := fmt.Sprintf(queuePattern, queue, orgID), fmt.Sprintf(drainedPattern, queue, orgID)
+
+	drained := 0
+	for {
+		moved, err := redis.Int(moveTasks.Do(rc, from, to, moveBatchSize, "", orgID))
+		if err != nil {
+			return drained, errors.Wrapf(err, "error draining tasks for org %d in %s", orgID, queue)
+		}
+		drained += moved
+		if moved < moveBatchSize {
+			return drained, nil
+		}
+	}
+}
+
+// DrainedSize returns the number of drained tasks for the passed in org in the passed in queue
+func DrainedSize(rc redis.Conn, queue string, orgID int) (int, error) {
+	return redis.Int(rc.Do("zcard", fmt.Sprintf(drainedPattern, queue, orgID)))
+}
+
+// ReplayDrainedTasks moves up to count of the drained tasks for the passed in org in the passed in queue back onto
+// the queue, or all of them if count is zero, returning the number of tasks replayed
+func ReplayDrainedTasks(rc redis.Conn, queue string, orgID int, count int) (int, error) {
+	from, to := fmt.Sprintf(drainedPattern, queue, orgID), fmt.Sprintf(queuePattern, queue, orgID)
+
+	replayed := 0
+	for count <= 0 || replayed < count {
+		batchSize := moveBatchSize
+		if count > 0 && count-replayed < batchSize {
+			batchSize = count - replayed
+		}
+
+		moved, err := redis.Int(moveTasks.Do(rc, from, to, batchSize, queue, orgID))
+		if err != nil {
+			return replayed, errors.Wrapf(err, "error replaying drained tasks for org %d in %s", orgID, queue)
+		}
+		replayed += moved
+		if moved < batchSize {
+			break
+		}
+	}
+	return replayed, nil
+}
+
+var deleteOrg = redis.NewScript(1, refreshOrgLua+`-- KEYS: [QueueName] ARGV: [OrgID]
+	local queue = KEYS[1] .. ":" .. ARGV[1]
+	local count = redis.call("zcard", queue)
+	redis.call("del", queue)
+	refreshOrg(KEYS[1], ARGV[1])
+	return count
+`)
+
+// DeleteOrgTasks deletes all pending tasks for the passed in org in the passed in queue, returning the number deleted
+func DeleteOrgTasks(rc redis.Conn, queue string, orgID int) (int, error) {
+	return redis.Int(deleteOrg.Do(rc, queue, orgID))
+}
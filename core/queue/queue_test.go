@@ -1,17 +1,23 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/logging"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestQueues(t *testing.T) {
+	ctx := context.Background()
 	rc, err := redis.Dial("tcp", "localhost:6379")
 	assert.NoError(t, err)
-	rc.Do("del", "test:active", "test:1", "test:2", "test:3")
+	rc.Do("del", "test:active", "test:blocked", "test:1", "test:2", "test:3")
 
 	popPriority := Priority(-1)
 	markCompletePriority := Priority(-2)
@@ -26,6 +32,7 @@ func TestQueues(t *testing.T) {
 	}{
 		{"test", 1, "campaign", "task1", DefaultPriority, 1},
 		{"test", 1, "campaign", "task1", popPriority, 0},
+		{"test", 1, "campaign", "", markCompletePriority, 0},
 		{"test", 1, "campaign", "", popPriority, 0},
 		{"test", 1, "campaign", "task1", DefaultPriority, 1},
 		{"test", 1, "campaign", "task2", DefaultPriority, 2},
@@ -67,7 +74,7 @@ func TestQueues(t *testing.T) {
 		} else if tc.Priority == markCompletePriority {
 			assert.NoError(t, MarkTaskComplete(rc, tc.Queue, tc.TaskGroup))
 		} else {
-			assert.NoError(t, AddTask(rc, tc.Queue, tc.TaskType, tc.TaskGroup, tc.Task, tc.Priority))
+			assert.NoError(t, AddTask(ctx, rc, tc.Queue, tc.TaskType, tc.TaskGroup, tc.Task, tc.Priority))
 		}
 
 		size, err := Size(rc, tc.Queue)
@@ -75,3 +82,539 @@ func TestQueues(t *testing.T) {
 		assert.Equal(t, tc.Size, size, "%d: mismatch", i)
 	}
 }
+
+func TestRetriesAndDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:blocked", "test:1", "test:2", "test:delayed", "test:dead")
+
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task1", DefaultPriority))
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.NoError(t, MarkTaskComplete(rc, "test", 1))
+
+	// retry our task in the future, it shouldn't be poppable yet
+	task.ErrorCount++
+	task.LastError = "boom"
+	assert.NoError(t, RetryTask(rc, "test", task, time.Hour))
+
+	delayed, err := DelayedSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delayed)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// retry a task with no delay, it should be promoted and popped
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 2, "task2", DefaultPriority))
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.NoError(t, MarkTaskComplete(rc, "test", 2))
+
+	task.ErrorCount++
+	assert.NoError(t, RetryTask(rc, "test", task, 0))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, task.OrgID)
+	assert.Equal(t, 1, task.ErrorCount)
+	assert.NoError(t, MarkTaskComplete(rc, "test", 2))
+
+	delayed, err = DelayedSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delayed)
+
+	// move our task to the dead letter set
+	task.LastError = "boom again"
+	assert.NoError(t, DeadLetterTask(rc, "test", task))
+
+	dead, err := DeadSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dead)
+
+	deadTasks, err := DeadTasks(rc, "test", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, deadTasks, 1)
+	assert.Equal(t, "boom again", deadTasks[0].LastError)
+
+	// nothing to replay past the end of the dead letter set
+	replayed, err := ReplayDeadTasks(rc, "test", 1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+
+	// replay it, it should come back with its error count reset
+	replayed, err = ReplayDeadTasks(rc, "test", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, task.OrgID)
+	assert.Equal(t, 0, task.ErrorCount)
+	assert.Equal(t, "", task.LastError)
+
+	var value string
+	assert.NoError(t, json.Unmarshal(task.Task, &value))
+	assert.Equal(t, "task2", value)
+
+	// dead letter it again and purge
+	assert.NoError(t, DeadLetterTask(rc, "test", task))
+
+	purged, err := PurgeDeadTasks(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	dead, err = DeadSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dead)
+}
+
+func TestOrgControls(t *testing.T) {
+	ctx := context.Background()
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:blocked", "test:1", "test:2", "test:3", "test:paused", "test:limits", "test:dead", "test:drained:1")
+
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task2", DefaultPriority))
+	assert.NoError(t, AddTask(ctx, rc, "test", "import", 2, "task3", DefaultPriority))
+
+	// pause org 1, we should only get org 2's task
+	assert.NoError(t, PauseOrg(rc, "test", 1))
+
+	paused, err := PausedOrgs(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, paused)
+
+	// paused orgs are kept out of the active set so popping doesn't have to skip over them
+	assert.Equal(t, []string{"2"}, zmembers(t, rc, "test:active"))
+	assert.Equal(t, []string{"1"}, zmembers(t, rc, "test:blocked"))
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, task.OrgID)
+	assert.NoError(t, MarkTaskComplete(rc, "test", 2))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	orgs, err := OrgQueues(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, []*OrgQueue{{OrgID: 1, Size: 2, Workers: 0, Paused: true}}, orgs)
+
+	tasks, err := PeekTasks(rc, "test", 1, 10)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 2)
+	assert.Equal(t, "campaign", tasks[0].Type)
+
+	// resume it and we can pop its tasks again
+	assert.NoError(t, ResumeOrg(rc, "test", 1))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, task.OrgID)
+
+	orgs, err = OrgQueues(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, []*OrgQueue{{OrgID: 1, Size: 1, Workers: 1, Paused: false}}, orgs)
+
+	// drain its remaining task to its drained set
+	drained, err := DrainOrgTasks(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, drained)
+
+	size, err := Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	drained, err = DrainedSize(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, drained)
+
+	dead, err := DeadSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dead)
+
+	// replay it back onto the queue
+	replayed, err := ReplayDrainedTasks(rc, "test", 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, task.OrgID)
+	assert.NoError(t, MarkTaskComplete(rc, "test", 1))
+
+	// add some more tasks and delete them
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task4", DefaultPriority))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task5", DefaultPriority))
+
+	deleted, err := DeleteOrgTasks(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	size, err = Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	// limit org 1 to a single worker, it already has one so its tasks shouldn't be popped
+	assert.NoError(t, SetOrgLimit(rc, "test", 1, 1))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task6", DefaultPriority))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task7", DefaultPriority))
+
+	limits, err := OrgLimits(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{1: 1}, limits)
+
+	org, err := GetOrgQueue(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, &OrgQueue{OrgID: 1, Size: 2, Workers: 1, Paused: false, Limit: 1}, org)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	assert.Equal(t, []string{}, zmembers(t, rc, "test:active"))
+	assert.Equal(t, []string{"1"}, zmembers(t, rc, "test:blocked"))
+
+	// once its current task completes, it can have another
+	assert.NoError(t, MarkTaskComplete(rc, "test", 1))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, task.OrgID)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// remove the limit and we can pop the last task
+	assert.NoError(t, SetOrgLimit(rc, "test", 1, 0))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, task.OrgID)
+
+	// and we can get the state of orgs without tasks
+	org, err = GetOrgQueue(rc, "test", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, &OrgQueue{OrgID: 3}, org)
+
+	// a paused org which is still in the active set, e.g. from before we kept them out of it, is moved when popped
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 2, "task8", DefaultPriority))
+	rc.Do("sadd", "test:paused", 2)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+	assert.Equal(t, []string{"2", "1"}, zmembers(t, rc, "test:blocked"))
+
+	assert.NoError(t, ResumeOrg(rc, "test", 2))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, task.OrgID)
+
+	// an org with no tasks which is still in the active set is moved when popped without losing its workers
+	rc.Do("zadd", "test:active", 1, 3)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	org, err = GetOrgQueue(rc, "test", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, &OrgQueue{OrgID: 3, Workers: 1}, org)
+	assert.Equal(t, []string{}, zmembers(t, rc, "test:active"))
+}
+
+func zmembers(t *testing.T, rc redis.Conn, key string) []string {
+	members, err := redis.Strings(rc.Do("zrange", key, 0, -1))
+	assert.NoError(t, err)
+	return members
+}
+
+func TestAddTaskAt(t *testing.T) {
+	ctx := context.Background()
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:blocked", "test:1", "test:2", "test:delayed")
+
+	// schedule one task for the future and one which is already due
+	assert.NoError(t, AddTaskAt(ctx, rc, "test", "campaign", 1, "later", time.Now().Add(time.Hour)))
+	assert.NoError(t, AddTaskAt(ctx, rc, "test", "campaign", 2, "now", time.Now().Add(-time.Second)))
+
+	delayed, err := DelayedSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, delayed)
+
+	size, err := Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	// only the due task can be popped
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, task.OrgID)
+	assert.Equal(t, "campaign", task.Type)
+	assert.NoError(t, MarkTaskComplete(rc, "test", 2))
+
+	var value string
+	assert.NoError(t, json.Unmarshal(task.Task, &value))
+	assert.Equal(t, "now", value)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	delayed, err = DelayedSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delayed)
+
+	// move our remaining task's time into the past and it becomes poppable
+	payloads, err := redis.Strings(rc.Do("zrange", "test:delayed", 0, 0))
+	assert.NoError(t, err)
+	rc.Do("zadd", "test:delayed", timeScore(time.Now().Add(-time.Second), 0), payloads[0])
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, task.OrgID)
+	assert.NoError(t, json.Unmarshal(task.Task, &value))
+	assert.Equal(t, "later", value)
+
+	// and its age is from when it was scheduled to run rather than when it was added
+	assert.True(t, task.QueuedOn.After(time.Now().Add(59*time.Minute)))
+}
+
+func TestRoutes(t *testing.T) {
+	ctx := context.Background()
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:blocked", "test:1", "imports:active", "imports:1", "imports:delayed")
+
+	cfg := runtime.NewDefaultConfig()
+	cfg.Queues = "imports:2,campaigns:3"
+	assert.Equal(t, []string{BatchQueue, HandlerQueue, "campaigns", "imports"}, Names(cfg))
+	assert.Equal(t, 4, Workers(cfg, BatchQueue))
+	assert.Equal(t, 32, Workers(cfg, HandlerQueue))
+	assert.Equal(t, 2, Workers(cfg, "imports"))
+
+	SetRoutes(map[string]string{"import_contact_batch": "imports"})
+	defer SetRoutes(map[string]string{})
+
+	assert.Equal(t, "imports", QueueFor("import_contact_batch", "test"))
+	assert.Equal(t, "test", QueueFor("campaign", "test"))
+
+	// routed tasks are added to their routed queue instead
+	assert.NoError(t, AddTask(ctx, rc, "test", "import_contact_batch", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task2", DefaultPriority))
+	assert.NoError(t, AddTaskAt(ctx, rc, "test", "import_contact_batch", 1, "task3", time.Now().Add(time.Hour)))
+
+	size, err := Size(rc, "imports")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	delayed, err := DelayedSize(rc, "imports")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delayed)
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "campaign", task.Type)
+
+	// tasks can be forwarded to another queue as is
+	task.ErrorCount = 1
+	assert.NoError(t, ForwardTask(rc, "imports", task))
+
+	size, err = Size(rc, "imports")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	task, err = PopNextTask(rc, "imports")
+	assert.NoError(t, err)
+	assert.Equal(t, "import_contact_batch", task.Type)
+
+	task, err = PopNextTask(rc, "imports")
+	assert.NoError(t, err)
+	assert.Equal(t, "campaign", task.Type)
+	assert.Equal(t, 1, task.ErrorCount)
+}
+
+func TestCorrelationID(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:blocked", "test:1")
+
+	ctx := logging.WithCorrelationID(context.Background(), "abc123")
+
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(context.Background(), rc, "test", "campaign", 1, "task2", DefaultPriority))
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", task.CorrelationID)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "", task.CorrelationID)
+}
+
+func TestDrain(t *testing.T) {
+	assert.False(t, IsDraining(context.Background()))
+
+	quit := make(chan bool)
+	ctx := WithDrain(context.Background(), quit)
+	assert.False(t, IsDraining(ctx))
+
+	close(quit)
+	assert.True(t, IsDraining(ctx))
+}
+
+type testIdempotentTask struct {
+	Key  string `json:"key"`
+	Text string `json:"text"`
+}
+
+func (t *testIdempotentTask) IdempotencyKey() string { return t.Key }
+
+func TestIdempotency(t *testing.T) {
+	ctx := context.Background()
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:blocked", "test:1", "test:delayed", "task_key:fire:1", "task_key:fire:2", "task_key:fire:3")
+
+	// adding the same work twice only queues it once
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, &testIdempotentTask{Key: "fire:1", Text: "first"}, DefaultPriority))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, &testIdempotentTask{Key: "fire:1", Text: "second"}, DefaultPriority))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, &testIdempotentTask{Key: "", Text: "unkeyed"}, DefaultPriority))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, &testIdempotentTask{Key: "", Text: "unkeyed"}, DefaultPriority))
+
+	size, err := Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "fire:1", task.IdempotencyKey)
+	assert.JSONEq(t, `{"key": "fire:1", "text": "first"}`, string(task.Task))
+
+	// the key stays claimed after the task is popped
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, &testIdempotentTask{Key: "fire:1", Text: "third"}, DefaultPriority))
+	size, _ = Size(rc, "test")
+	assert.Equal(t, 2, size)
+
+	// keys are shared with scheduled tasks
+	assert.NoError(t, AddTaskAt(ctx, rc, "test", "campaign", 1, &testIdempotentTask{Key: "fire:2"}, time.Now().Add(time.Hour)))
+	assert.NoError(t, AddTaskAt(ctx, rc, "test", "campaign", 1, &testIdempotentTask{Key: "fire:2"}, time.Now().Add(time.Hour)))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, &testIdempotentTask{Key: "fire:2"}, DefaultPriority))
+
+	delayed, _ := DelayedSize(rc, "test")
+	assert.Equal(t, 1, delayed)
+
+	// keys can be claimed directly and released so that work can be queued again
+	claimed, err := ClaimIdempotencyKey(rc, "fire:3")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = ClaimIdempotencyKey(rc, "fire:3")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	assert.NoError(t, ReleaseIdempotencyKey(rc, "fire:3"))
+
+	claimed, err = ClaimIdempotencyKey(rc, "fire:3")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	// keys expire after our window
+	SetIdempotencyWindow(time.Second)
+	defer SetIdempotencyWindow(time.Hour * 24)
+
+	ttl, _ := redis.Int(rc.Do("ttl", "task_key:fire:1"))
+	assert.Greater(t, ttl, 60*60)
+
+	rc.Do("del", "task_key:fire:3")
+	ClaimIdempotencyKey(rc, "fire:3")
+
+	ttl, _ = redis.Int(rc.Do("ttl", "task_key:fire:3"))
+	assert.Equal(t, 1, ttl)
+}
+
+func TestOldestTaskAge(t *testing.T) {
+	ctx := context.Background()
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:blocked", "test:1", "test:2")
+
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	age, err := OldestTaskAge(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), age)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, "task1", DefaultPriority))
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2022, 1, 1, 12, 0, 30, 0, time.UTC)))
+	assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 2, "task2", DefaultPriority))
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2022, 1, 1, 12, 1, 0, 0, time.UTC)))
+
+	age, err = OldestTaskAge(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, age)
+
+	// once org 1's task is popped, org 2's task is the oldest
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, task.OrgID)
+
+	age, err = OldestTaskAge(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second*30, age)
+}
+
+func TestDrainLargeOrg(t *testing.T) {
+	ctx := context.Background()
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:blocked", "test:1", "test:dead", "test:drained:1")
+
+	for i := 0; i < 2500; i++ {
+		assert.NoError(t, AddTask(ctx, rc, "test", "campaign", 1, i, DefaultPriority))
+	}
+
+	// all tasks are drained and none are lost to the dead letter set's limit
+	drained, err := DrainOrgTasks(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2500, drained)
+
+	size, err := DrainedSize(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2500, size)
+
+	// replay some of them
+	replayed, err := ReplayDrainedTasks(rc, "test", 1, 1200)
+	assert.NoError(t, err)
+	assert.Equal(t, 1200, replayed)
+
+	size, err = OrgSize(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1200, size)
+
+	// and then the rest, which come back in their original order
+	replayed, err = ReplayDrainedTasks(rc, "test", 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1300, replayed)
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+
+	var value int
+	assert.NoError(t, json.Unmarshal(task.Task, &value))
+	assert.Equal(t, 0, value)
+}
@@ -0,0 +1,51 @@
+package queue
+
+import (
+	"sort"
+
+	"github.com/nyaruka/mailroom/runtime"
+)
+
+// task types which have been routed to a queue other than the one their producers add them to
+var routes = map[string]string{}
+
+// SetRoutes sets which queue tasks of each type should be added to, regardless of which queue their producers use
+func SetRoutes(r map[string]string) {
+	routes = r
+}
+
+// QueueFor returns the queue that tasks of the passed in type should be added to, which is the passed in default
+// queue unless the type has been routed to another queue
+func QueueFor(taskType string, defaultQueue string) string {
+	if q, found := routes[taskType]; found {
+		return q
+	}
+	return defaultQueue
+}
+
+// Names returns the names of all the queues for the passed in config, i.e. our batch and handler queues followed by
+// any extra configured queues in alphabetical order
+func Names(cfg *runtime.Config) []string {
+	extras, _ := cfg.ParseQueues()
+
+	names := make([]string, 0, 2+len(extras))
+	for name := range extras {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return append([]string{BatchQueue, HandlerQueue}, names...)
+}
+
+// Workers returns the number of workers the passed in queue should have for the passed in config
+func Workers(cfg *runtime.Config, queue string) int {
+	switch queue {
+	case BatchQueue:
+		return cfg.BatchWorkers
+	case HandlerQueue:
+		return cfg.HandlerWorkers
+	}
+
+	extras, _ := cfg.ParseQueues()
+	return extras[queue]
+}
@@ -15,9 +15,12 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/logging"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	"github.com/nyaruka/redisx"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -62,17 +65,25 @@ func NewStartOptions() *StartOptions {
 type TriggerBuilder func(contact *flows.Contact) flows.Trigger
 
 // ResumeFlow resumes the passed in session using the passed in session
-func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, session *models.Session, contact *models.Contact, resume flows.Resume, hook models.SessionCommitHook) (*models.Session, error) {
+func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, session *models.Session, contact *models.Contact, resume flows.Resume, hook models.SessionCommitHook) (_ *models.Session, err error) {
+	ctx, span := tracing.StartSpan(ctx, "resume flow",
+		tracing.OrgID(int64(oa.OrgID())),
+		tracing.ContactUUID(string(contact.UUID())),
+		tracing.SessionUUID(string(session.UUID())),
+		attribute.String("mailroom.resume_type", resume.Type()),
+	)
+	defer func() { tracing.EndSpan(span, err) }()
+
 	start := time.Now()
 	sa := oa.SessionAssets()
 
 	// does the flow this session is part of still exist?
-	_, err := oa.FlowByID(session.CurrentFlowID())
+	_, err = oa.FlowByID(session.CurrentFlowID())
 	if err != nil {
 		// if this flow just isn't available anymore, log this error
 		if err == models.ErrNotFound {
 			logrus.WithField("contact_uuid", session.Contact().UUID()).WithField("session_uuid", session.UUID()).WithField("flow_id", session.CurrentFlowID()).Error("unable to find flow for resume")
-			return nil, models.ExitSessions(ctx, rt.DB, []models.SessionID{session.ID()}, models.SessionStatusFailed)
+			return nil, models.ExitSessions(ctx, rt, []models.SessionID{session.ID()}, models.SessionStatusFailed)
 		}
 		return nil, errors.Wrapf(err, "error loading session flow: %d", session.CurrentFlowID())
 	}
@@ -84,7 +95,9 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 	}
 
 	// resume our session
+	_, engineSpan := tracing.StartSpan(ctx, "engine resume")
 	sprint, err := fs.Resume(resume)
+	tracing.EndSpan(engineSpan, err)
 
 	// had a problem resuming our flow? bail
 	if err != nil {
@@ -133,7 +146,7 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 		return nil, errors.Wrapf(err, "error committing session changes on resume")
 	}
 
-	logrus.WithField("contact_uuid", resume.Contact().UUID()).WithField("session_uuid", session.UUID()).WithField("resume_type", resume.Type()).WithField("elapsed", time.Since(start)).Info("resumed session")
+	logging.FromContext(ctx).WithField("contact_uuid", resume.Contact().UUID()).WithField("session_uuid", session.UUID()).WithField("resume_type", resume.Type()).WithField("elapsed", time.Since(start)).Info("resumed session")
 	return session, nil
 }
 
@@ -533,7 +546,14 @@ func StartFlow(
 // StartFlowForContacts runs the passed in flow for the passed in contact
 func StartFlowForContacts(
 	ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
-	flow *models.Flow, contacts []*models.Contact, triggers []flows.Trigger, hook models.SessionCommitHook, interrupt bool) ([]*models.Session, error) {
+	flow *models.Flow, contacts []*models.Contact, triggers []flows.Trigger, hook models.SessionCommitHook, interrupt bool) (_ []*models.Session, err error) {
+	ctx, span := tracing.StartSpan(ctx, "start flow",
+		tracing.OrgID(int64(oa.OrgID())),
+		attribute.String("mailroom.flow_uuid", string(flow.UUID())),
+		attribute.Int("mailroom.contact_count", len(contacts)),
+	)
+	defer func() { tracing.EndSpan(span, err) }()
+
 	sa := oa.SessionAssets()
 
 	// no triggers? nothing to do
@@ -542,7 +562,7 @@ func StartFlowForContacts(
 	}
 
 	start := time.Now()
-	log := logrus.WithField("flow_name", flow.Name()).WithField("flow_uuid", flow.UUID())
+	log := logging.FromContext(ctx).WithField("flow_name", flow.Name()).WithField("flow_uuid", flow.UUID())
 
 	// for each trigger start the flow
 	sessions := make([]flows.Session, 0, len(triggers))
@@ -553,7 +573,9 @@ func StartFlowForContacts(
 		log := log.WithField("contact_uuid", trigger.Contact().UUID())
 		start := time.Now()
 
+		_, engineSpan := tracing.StartSpan(ctx, "engine start", tracing.ContactUUID(string(trigger.Contact().UUID())))
 		session, sprint, err := goflow.Engine(rt.Config).NewSession(sa, trigger)
+		tracing.EndSpan(engineSpan, err)
 		if err != nil {
 			log.WithError(err).Errorf("error starting flow")
 			continue
@@ -585,8 +607,9 @@ func StartFlowForContacts(
 	}
 
 	// interrupt all our contacts if desired
+	var interrupted []*models.ExitedSession
 	if interrupt {
-		err = models.InterruptSessionsForContactsTx(txCTX, tx, contactIDs)
+		interrupted, err = models.InterruptSessionsForContactsTx(txCTX, tx, contactIDs)
 		if err != nil {
 			tx.Rollback()
 			return nil, errors.Wrap(err, "error interrupting contacts")
@@ -602,6 +625,8 @@ func StartFlowForContacts(
 
 		if err == nil {
 			logrus.WithField("elapsed", time.Since(commitStart)).WithField("count", len(sessions)).Debug("sessions committed")
+
+			models.PublishExitedSessions(ctx, rt, interrupted)
 		}
 	}
 
@@ -626,8 +651,9 @@ func StartFlowForContacts(
 			}
 
 			// interrupt this contact if appropriate
+			var interrupted []*models.ExitedSession
 			if interrupt {
-				err = models.InterruptSessionsForContactsTx(txCTX, tx, []models.ContactID{models.ContactID(session.Contact().ID())})
+				interrupted, err = models.InterruptSessionsForContactsTx(txCTX, tx, []models.ContactID{models.ContactID(session.Contact().ID())})
 				if err != nil {
 					tx.Rollback()
 					log.WithField("contact_uuid", session.Contact().UUID()).WithError(err).Errorf("error interrupting contact")
@@ -649,6 +675,8 @@ func StartFlowForContacts(
 				continue
 			}
 
+			models.PublishExitedSessions(ctx, rt, interrupted)
+
 			dbSessions = append(dbSessions, dbSession[0])
 		}
 	}
@@ -751,7 +779,7 @@ func TriggerIVRFlow(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID
 	// queue this to our ivr starter, it will take care of creating the calls then calling back in
 	rc := rt.RP.Get()
 	defer rc.Close()
-	err = queue.AddTask(rc, queue.BatchQueue, queue.StartIVRFlowBatch, int(orgID), task, queue.HighPriority)
+	err = queue.AddTask(ctx, rc, queue.BatchQueue, queue.StartIVRFlowBatch, int(orgID), task, queue.HighPriority)
 	if err != nil {
 		return errors.Wrapf(err, "error queuing ivr flow start")
 	}
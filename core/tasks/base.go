@@ -34,6 +34,13 @@ func RegisterType(name string, initFunc func() Task) {
 	})
 }
 
+// RegisterRetriedType registers a new type of task which is safe to retry if it fails
+func RegisterRetriedType(name string, initFunc func() Task) {
+	RegisterType(name, initFunc)
+
+	mailroom.RetryTaskType(name)
+}
+
 // Task is the common interface for all task types
 type Task interface {
 	// Timeout is the maximum amount of time the task can run for
@@ -12,7 +12,6 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
-	"github.com/nyaruka/redisx"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -22,7 +21,10 @@ const (
 	maxBatchSize = 100
 )
 
-var campaignsMarker = redisx.NewIntervalSet("campaign_event", time.Hour*24, 2)
+// returns the idempotency key used to ensure the passed in fire is only queued once
+func fireKey(id models.FireID) string {
+	return fmt.Sprintf("campaign_fire:%d", id)
+}
 
 func init() {
 	mailroom.RegisterCron("campaign_event", time.Second*60, false, QueueEventFires)
@@ -50,24 +52,30 @@ func QueueEventFires(ctx context.Context, rt *runtime.Runtime) error {
 	var task *FireCampaignEventTask
 	numFires, numDupes, numTasks := 0, 0, 0
 
+	// releases our claims on the fires of the current task which hasn't been queued yet
+	releaseUnqueued := func() {
+		if task != nil {
+			releaseFires(rc, task.FireIDs)
+		}
+	}
+
 	for rows.Next() {
 		row := &eventFireRow{}
 		err := rows.StructScan(row)
 		if err != nil {
+			releaseUnqueued()
 			return errors.Wrapf(err, "error reading event fire row")
 		}
 
 		numFires++
 
-		// check whether this event has already been queued to fire
-		taskID := fmt.Sprintf("%d", row.FireID)
-		dupe, err := campaignsMarker.Contains(rc, taskID)
+		// claim this fire, and skip it if it has already been queued
+		claimed, err := queue.ClaimIdempotencyKey(rc, fireKey(row.FireID))
 		if err != nil {
-			return errors.Wrap(err, "error checking task lock")
+			releaseUnqueued()
+			return err
 		}
-
-		// this has already been queued, skip
-		if dupe {
+		if !claimed {
 			numDupes++
 			continue
 		}
@@ -80,8 +88,10 @@ func QueueEventFires(ctx context.Context, rt *runtime.Runtime) error {
 
 		// if not, queue up current task...
 		if task != nil {
-			err = queueFiresTask(rt.RP, orgID, task)
+			err = queueFiresTask(ctx, rt.RP, orgID, task)
 			if err != nil {
+				// task's own fires have been released but this row has also been claimed
+				releaseFires(rc, []models.FireID{row.FireID})
 				return errors.Wrapf(err, "error queueing task")
 			}
 			numTasks++
@@ -101,7 +111,7 @@ func QueueEventFires(ctx context.Context, rt *runtime.Runtime) error {
 
 	// queue our last task if we have one
 	if task != nil {
-		if err := queueFiresTask(rt.RP, orgID, task); err != nil {
+		if err := queueFiresTask(ctx, rt.RP, orgID, task); err != nil {
 			return errors.Wrapf(err, "error queueing task")
 		}
 		numTasks++
@@ -118,27 +128,31 @@ func QueueEventFires(ctx context.Context, rt *runtime.Runtime) error {
 	return nil
 }
 
-func queueFiresTask(rp *redis.Pool, orgID models.OrgID, task *FireCampaignEventTask) error {
+func queueFiresTask(ctx context.Context, rp *redis.Pool, orgID models.OrgID, task *FireCampaignEventTask) error {
 	rc := rp.Get()
 	defer rc.Close()
 
-	err := queue.AddTask(rc, queue.BatchQueue, TypeFireCampaignEvent, int(orgID), task, queue.DefaultPriority)
+	err := queue.AddTask(ctx, rc, queue.BatchQueue, TypeFireCampaignEvent, int(orgID), task, queue.DefaultPriority)
 	if err != nil {
-		return errors.Wrap(err, "error queuing task")
-	}
+		// release our claims on these fires so they can be queued again
+		releaseFires(rc, task.FireIDs)
 
-	// mark each of these fires as queued
-	for _, id := range task.FireIDs {
-		err = campaignsMarker.Add(rc, fmt.Sprintf("%d", id))
-		if err != nil {
-			return errors.Wrap(err, "error marking fire as queued")
-		}
+		return errors.Wrap(err, "error queuing task")
 	}
 
 	logrus.WithField("comp", "campaign_events").WithField("event", task.EventUUID).WithField("fires", len(task.FireIDs)).Debug("queued campaign event fire task")
 	return nil
 }
 
+// releases the claims on the passed in fires so that they can be queued again
+func releaseFires(rc redis.Conn, fireIDs []models.FireID) {
+	for _, id := range fireIDs {
+		if err := queue.ReleaseIdempotencyKey(rc, fireKey(id)); err != nil {
+			logrus.WithError(err).WithField("fire_id", id).Error("error releasing campaign fire")
+		}
+	}
+}
+
 type eventFireRow struct {
 	FireID       models.FireID   `db:"fire_id"`
 	EventID      int64           `db:"event_id"`
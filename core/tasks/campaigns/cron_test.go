@@ -156,6 +156,52 @@ func TestFireCampaignEvents(t *testing.T) {
 	assertdb.Query(t, db, `SELECT fired IS NOT NULL AS fired, fired_result FROM campaigns_eventfire WHERE id = $1`, f4ID).Columns(map[string]interface{}{"fired": true, "fired_result": "F"})
 }
 
+func TestFireCampaignEventsQuietHours(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// give the org quiet hours that we're in now, except for Bob who is twelve hours away
+	now := time.Now().UTC()
+	db.MustExec(`UPDATE orgs_org SET timezone = 'UTC', config = $2 WHERE id = $1`, testdata.Org1.ID,
+		fmt.Sprintf(`{"quiet_hours_start": "%s", "quiet_hours_end": "%s", "quiet_hours_timezone_field": "gender"}`, now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")))
+	db.MustExec(`UPDATE contacts_contact SET fields = COALESCE(fields, '{}') || jsonb_build_object($2::text, jsonb_build_object('text', 'Etc/GMT+12')) WHERE id = $1`, testdata.Bob.ID, testdata.GenderField.UUID)
+
+	_, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	f1ID := testdata.InsertEventFire(rt.DB, testdata.Cathy, testdata.RemindersEvent1, time.Now().Add(-time.Minute))
+	f2ID := testdata.InsertEventFire(rt.DB, testdata.Bob, testdata.RemindersEvent1, time.Now().Add(-time.Minute))
+
+	err = campaigns.QueueEventFires(ctx, rt)
+	assert.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+
+	typedTask, err := tasks.ReadTask(task.Type, task.Task)
+	require.NoError(t, err)
+
+	err = typedTask.Perform(ctx, rt, models.OrgID(task.OrgID))
+	assert.NoError(t, err)
+
+	// Bob's fire is fired now
+	assertdb.Query(t, db, `SELECT COUNT(*) FROM flows_flowrun WHERE contact_id = $1 AND flow_id = $2`, testdata.Bob.ID, testdata.Favorites.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT fired IS NOT NULL FROM campaigns_eventfire WHERE id = $1`, f2ID).Returns(true)
+
+	// but Cathy's is rescheduled for when her quiet hours end, and released so that it can be queued again then
+	assertdb.Query(t, db, `SELECT COUNT(*) FROM flows_flowrun WHERE contact_id = $1 AND flow_id = $2`, testdata.Cathy.ID, testdata.Favorites.ID).Returns(0)
+	assertdb.Query(t, db, `SELECT fired IS NULL AND scheduled > $2 FROM campaigns_eventfire WHERE id = $1`, f1ID, now).Returns(true)
+
+	assertFireTasks(t, rp, testdata.Org1, [][]models.FireID{})
+	err = campaigns.QueueEventFires(ctx, rt)
+	assert.NoError(t, err)
+	assertFireTasks(t, rp, testdata.Org1, [][]models.FireID{})
+}
+
 func TestIVRCampaigns(t *testing.T) {
 	ctx, rt, db, rp := testsuite.Get()
 	rc := rp.Get()
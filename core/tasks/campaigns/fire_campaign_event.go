@@ -2,7 +2,6 @@ package campaigns
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	"github.com/nyaruka/goflow/assets"
@@ -54,14 +53,9 @@ func (t *FireCampaignEventTask) Perform(ctx context.Context, rt *runtime.Runtime
 	// grab all the fires for this event
 	fires, err := models.LoadEventFires(ctx, db, t.FireIDs)
 	if err != nil {
-		// unmark all these fires as fires so they can retry
+		// release all these fires so they can retry
 		rc := rp.Get()
-		for _, id := range t.FireIDs {
-			rerr := campaignsMarker.Remove(rc, fmt.Sprintf("%d", id))
-			if rerr != nil {
-				log.WithError(rerr).WithField("fire_id", id).Error("error unmarking campaign fire")
-			}
-		}
+		releaseFires(rc, t.FireIDs)
 		rc.Close()
 
 		// if we had an error, return that
@@ -79,6 +73,19 @@ func (t *FireCampaignEventTask) Perform(ctx context.Context, rt *runtime.Runtime
 		contactMap[fire.ContactID] = fire
 	}
 
+	// reschedule the fires of any contacts who are in quiet hours
+	fires, err = deferFires(ctx, rt, orgID, fires, contactMap)
+	if err != nil {
+		rc := rp.Get()
+		releaseFires(rc, t.FireIDs)
+		rc.Close()
+
+		return errors.Wrapf(err, "error deferring campaign events in quiet hours or over frequency caps: %v", t.FireIDs)
+	}
+	if len(fires) == 0 {
+		return nil
+	}
+
 	campaign := triggers.NewCampaignReference(triggers.CampaignUUID(t.CampaignUUID), t.CampaignName)
 
 	started, err := runner.FireCampaignEvents(ctx, rt, orgID, fires, t.FlowUUID, campaign, triggers.CampaignEventUUID(t.EventUUID))
@@ -88,15 +95,15 @@ func (t *FireCampaignEventTask) Perform(ctx context.Context, rt *runtime.Runtime
 		delete(contactMap, contactID)
 	}
 
-	// what remains in our contact map are fires that failed for some reason, umark these
+	// what remains in our contact map are fires that failed for some reason, release these
 	if len(contactMap) > 0 {
-		rc := rp.Get()
-		for _, failed := range contactMap {
-			rerr := campaignsMarker.Remove(rc, fmt.Sprintf("%d", failed.FireID))
-			if rerr != nil {
-				log.WithError(rerr).WithField("fire_id", failed.FireID).Error("error unmarking campaign fire")
-			}
+		failed := make([]models.FireID, 0, len(contactMap))
+		for _, fire := range contactMap {
+			failed = append(failed, fire.FireID)
 		}
+
+		rc := rp.Get()
+		releaseFires(rc, failed)
 		rc.Close()
 	}
 
@@ -106,3 +113,65 @@ func (t *FireCampaignEventTask) Perform(ctx context.Context, rt *runtime.Runtime
 
 	return nil
 }
+
+// reschedules the passed in fires whose contacts are currently in quiet hours, or have reached a frequency cap that the
+// org defers sends for, for when those end, and releases them so that the cron can queue them again, returning the
+// fires which can be fired now
+func deferFires(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, fires []*models.EventFire, contactMap map[models.ContactID]*models.EventFire) ([]*models.EventFire, error) {
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading org assets")
+	}
+
+	contactIDs := make([]models.ContactID, len(fires))
+	for i, fire := range fires {
+		contactIDs[i] = fire.ContactID
+	}
+
+	now := time.Now()
+
+	fireNow, deferred, err := models.DeferQuietContacts(ctx, rt.DB, oa, contactIDs, now)
+	if err != nil {
+		return nil, err
+	}
+
+	fireNow, capped, err := models.DeferCappedContacts(rt, oa.Org(), fireNow, now)
+	if err != nil {
+		return nil, err
+	}
+	for until, ids := range capped {
+		if deferred == nil {
+			deferred = make(map[time.Time][]models.ContactID)
+		}
+		deferred[until] = append(deferred[until], ids...)
+	}
+
+	if len(deferred) == 0 {
+		return fires, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for until, ids := range deferred {
+		deferredFires := make([]*models.EventFire, len(ids))
+		deferredIDs := make([]models.FireID, len(ids))
+		for i, id := range ids {
+			deferredFires[i] = contactMap[id]
+			deferredIDs[i] = contactMap[id].FireID
+			delete(contactMap, id)
+		}
+
+		if err := models.RescheduleEventFires(ctx, rt.DB, deferredFires, until); err != nil {
+			return nil, err
+		}
+
+		releaseFires(rc, deferredIDs)
+	}
+
+	remaining := make([]*models.EventFire, len(fireNow))
+	for i, id := range fireNow {
+		remaining[i] = contactMap[id]
+	}
+	return remaining, nil
+}
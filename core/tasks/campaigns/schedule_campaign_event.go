@@ -18,7 +18,7 @@ const TypeScheduleCampaignEvent = "schedule_campaign_event"
 const scheduleLockKey string = "lock:schedule_campaign_event_%d"
 
 func init() {
-	tasks.RegisterType(TypeScheduleCampaignEvent, func() tasks.Task { return &ScheduleCampaignEventTask{} })
+	tasks.RegisterRetriedType(TypeScheduleCampaignEvent, func() tasks.Task { return &ScheduleCampaignEventTask{} })
 }
 
 // ScheduleCampaignEventTask is our definition of our event recalculation task
@@ -21,7 +21,7 @@ const TypePopulateDynamicGroup = "populate_dynamic_group"
 const populateLockKey string = "lock:pop_dyn_group_%d"
 
 func init() {
-	tasks.RegisterType(TypePopulateDynamicGroup, func() tasks.Task { return &PopulateDynamicGroupTask{} })
+	tasks.RegisterRetriedType(TypePopulateDynamicGroup, func() tasks.Task { return &PopulateDynamicGroupTask{} })
 }
 
 // PopulateDynamicGroupTask is our task to populate the contacts for a dynamic group
@@ -2,15 +2,14 @@ package expirations
 
 import (
 	"context"
-	"fmt"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/core/ivr"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/tasks/handler"
 	"github.com/nyaruka/mailroom/runtime"
-	"github.com/nyaruka/redisx"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -19,15 +18,14 @@ const (
 	expireBatchSize = 500
 )
 
-var expirationsMarker = redisx.NewIntervalSet("run_expirations", time.Hour*24, 2)
-
 func init() {
-	mailroom.RegisterCron("run_expirations", time.Minute, false, HandleWaitExpirations)
+	mailroom.RegisterCron("run_expirations", time.Minute*15, false, HandleWaitExpirations)
 	mailroom.RegisterCron("expire_ivr_calls", time.Minute, false, ExpireVoiceSessions)
 }
 
 // HandleWaitExpirations handles waiting messaging sessions whose waits have expired, resuming those that can be resumed,
-// and expiring those that can't
+// and expiring those that can't. Expirations are normally handled by their timers so this is just a safety net for any
+// timers which were lost.
 func HandleWaitExpirations(ctx context.Context, rt *runtime.Runtime) error {
 	log := logrus.WithField("comp", "expirer")
 	start := time.Now()
@@ -45,7 +43,7 @@ func HandleWaitExpirations(ctx context.Context, rt *runtime.Runtime) error {
 	}
 	defer rows.Close()
 
-	numExpired, numDupes, numQueued := 0, 0, 0
+	numExpired, numQueued := 0, 0
 
 	for rows.Next() {
 		expiredWait := &ExpiredWait{}
@@ -60,7 +58,7 @@ func HandleWaitExpirations(ctx context.Context, rt *runtime.Runtime) error {
 
 			// batch is full? commit it
 			if len(expiredSessions) == expireBatchSize {
-				err = models.ExitSessions(ctx, rt.DB, expiredSessions, models.SessionStatusExpired)
+				err = models.ExitSessions(ctx, rt, expiredSessions, models.SessionStatusExpired)
 				if err != nil {
 					return errors.Wrapf(err, "error expiring batch of sessions")
 				}
@@ -72,46 +70,31 @@ func HandleWaitExpirations(ctx context.Context, rt *runtime.Runtime) error {
 		}
 
 		// create a contact task to resume this session
-		taskID := fmt.Sprintf("%d:%s", expiredWait.SessionID, expiredWait.WaitExpiresOn.Format(time.RFC3339))
-		queued, err := expirationsMarker.Contains(rc, taskID)
-		if err != nil {
-			return errors.Wrapf(err, "error checking whether expiration is queued")
-		}
-
-		// already queued? move on
-		if queued {
-			numDupes++
-			continue
-		}
-
-		// ok, queue this task
-		task := handler.NewExpirationTask(expiredWait.OrgID, expiredWait.ContactID, expiredWait.SessionID, expiredWait.WaitExpiresOn)
-		err = handler.QueueHandleTask(rc, expiredWait.ContactID, task)
-		if err != nil {
-			return errors.Wrapf(err, "error adding new expiration task")
-		}
-
-		// and mark it as queued
-		err = expirationsMarker.Add(rc, taskID)
-		if err != nil {
-			return errors.Wrapf(err, "error marking expiration task as queued")
+		if err := queueExpiration(ctx, rc, expiredWait); err != nil {
+			return err
 		}
-
 		numQueued++
 	}
 
 	// commit any stragglers
 	if len(expiredSessions) > 0 {
-		err = models.ExitSessions(ctx, rt.DB, expiredSessions, models.SessionStatusExpired)
+		err = models.ExitSessions(ctx, rt, expiredSessions, models.SessionStatusExpired)
 		if err != nil {
 			return errors.Wrapf(err, "error expiring runs and sessions")
 		}
 	}
 
-	log.WithField("expired", numExpired).WithField("dupes", numDupes).WithField("queued", numQueued).WithField("elapsed", time.Since(start)).Info("session expirations queued")
+	log.WithField("expired", numExpired).WithField("queued", numQueued).WithField("elapsed", time.Since(start)).Info("session expirations queued")
 	return nil
 }
 
+// queues a task to resume the session of the passed in expired wait, which is a no-op if it has already been queued
+func queueExpiration(ctx context.Context, rc redis.Conn, expiredWait *ExpiredWait) error {
+	task := handler.NewExpirationTask(expiredWait.OrgID, expiredWait.ContactID, expiredWait.SessionID, expiredWait.WaitExpiresOn)
+	err := handler.QueueHandleTask(ctx, rc, expiredWait.ContactID, task)
+	return errors.Wrapf(err, "error adding new expiration task")
+}
+
 const sqlSelectExpiredWaits = `
     SELECT s.id as session_id, s.org_id, s.wait_expires_on, s.wait_resume_on_expire , s.contact_id
       FROM flows_flowsession s
@@ -176,7 +159,7 @@ func ExpireVoiceSessions(ctx context.Context, rt *runtime.Runtime) error {
 
 	// now expire our runs and sessions
 	if len(expiredSessions) > 0 {
-		err := models.ExitSessions(ctx, rt.DB, expiredSessions, models.SessionStatusExpired)
+		err := models.ExitSessions(ctx, rt, expiredSessions, models.SessionStatusExpired)
 		if err != nil {
 			log.WithError(err).Error("error expiring sessions for expired calls")
 		}
@@ -0,0 +1,61 @@
+package expirations
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	tasks.RegisterRetriedType(queue.FireSessionExpiration, func() tasks.Task { return &FireSessionExpirationTask{} })
+}
+
+// FireSessionExpirationTask is our delayed task for checking whether a session's wait has expired
+type FireSessionExpirationTask struct {
+	models.SessionTimer
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *FireSessionExpirationTask) Timeout() time.Duration {
+	return time.Minute
+}
+
+// Perform resumes the session if it's still waiting and its wait has expired and it can be resumed, or expires it if
+// it can't be. If its wait has been extended since this timer was scheduled, the timer is rescheduled instead.
+func (t *FireSessionExpirationTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	expiredWaits := make([]*ExpiredWait, 0, 1)
+	if err := rt.DB.SelectContext(ctx, &expiredWaits, sqlSelectSessionExpiration, t.SessionID); err != nil {
+		return errors.Wrapf(err, "error selecting expiration of session #%d", t.SessionID)
+	}
+
+	// session is no longer waiting or no longer has an expiration
+	if len(expiredWaits) == 0 {
+		return nil
+	}
+
+	expiredWait := expiredWaits[0]
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if expiredWait.WaitExpiresOn.After(dates.Now()) {
+		return models.ScheduleSessionTimer(ctx, rc, queue.FireSessionExpiration, expiredWait.OrgID, expiredWait.SessionID, expiredWait.ContactID, expiredWait.WaitExpiresOn)
+	}
+
+	if !expiredWait.WaitResumes {
+		return errors.Wrapf(models.ExitSessions(ctx, rt, []models.SessionID{expiredWait.SessionID}, models.SessionStatusExpired), "error expiring session")
+	}
+
+	return queueExpiration(ctx, rc, expiredWait)
+}
+
+const sqlSelectSessionExpiration = `
+SELECT s.id as session_id, s.org_id, s.wait_expires_on, s.wait_resume_on_expire , s.contact_id
+  FROM flows_flowsession s
+ WHERE s.id = $1 AND s.session_type = 'M' AND s.status = 'W' AND s.wait_expires_on IS NOT NULL`
@@ -0,0 +1,78 @@
+package expirations_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/jsonx"
+	_ "github.com/nyaruka/mailroom/core/handlers"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/expirations"
+	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFireSessionExpiration(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	// create single run session for Cathy, no parent to resume
+	s1ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, nil)
+	r1ID := testdata.InsertFlowRun(db, testdata.Org1, s1ID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting)
+
+	// create parent/child session for George, can resume
+	s2ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.George, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), true, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, s2ID, testdata.George, testdata.Favorites, models.RunStatusActive)
+	testdata.InsertFlowRun(db, testdata.Org1, s2ID, testdata.George, testdata.Favorites, models.RunStatusWaiting)
+
+	// create session for Bob whose expiration has been extended since his timer was scheduled
+	s3ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now().Add(time.Hour), true, nil)
+	r4ID := testdata.InsertFlowRun(db, testdata.Org1, s3ID, testdata.Bob, testdata.Favorites, models.RunStatusWaiting)
+
+	time.Sleep(5 * time.Millisecond)
+
+	for _, timer := range []models.SessionTimer{
+		{SessionID: s1ID, ContactID: testdata.Cathy.ID, On: time.Now()},
+		{SessionID: s2ID, ContactID: testdata.George.ID, On: time.Now()},
+		{SessionID: s3ID, ContactID: testdata.Bob.ID, On: time.Now()},
+	} {
+		task := &expirations.FireSessionExpirationTask{SessionTimer: timer}
+		assert.NoError(t, task.Perform(ctx, rt, testdata.Org1.ID))
+	}
+
+	// Cathy's session should be expired along with its runs
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1;`, s1ID).Columns(map[string]interface{}{"status": "X"})
+	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE id = $1;`, r1ID).Columns(map[string]interface{}{"status": "X"})
+
+	// Bob's session and run should be unchanged and his timer rescheduled
+	assertdb.Query(t, db, `SELECT status FROM flows_flowsession WHERE id = $1;`, s3ID).Columns(map[string]interface{}{"status": "W"})
+	assertdb.Query(t, db, `SELECT status FROM flows_flowrun WHERE id = $1;`, r4ID).Columns(map[string]interface{}{"status": "W"})
+
+	delayed, err := queue.DelayedSize(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delayed)
+
+	// should have created an expiration task for George
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.NotNil(t, task)
+
+	eventTask := &handler.HandleEventTask{}
+	jsonx.MustUnmarshal(task.Task, eventTask)
+	assert.Equal(t, testdata.George.ID, eventTask.ContactID)
+
+	// and our safety net doesn't queue it again
+	err = expirations.HandleWaitExpirations(ctx, rt)
+	assert.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+}
@@ -85,7 +85,7 @@ func RetryPendingMsgs(ctx context.Context, rt *runtime.Runtime) error {
 		}
 
 		// queue this event up for handling
-		err = QueueHandleTask(rc, contactID, task)
+		err = QueueHandleTask(ctx, rc, contactID, task)
 		if err != nil {
 			return errors.Wrapf(err, "error queuing retry for task")
 		}
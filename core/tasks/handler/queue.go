@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -9,17 +10,47 @@ import (
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/utils/logging"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // QueueHandleTask queues a single task for the given contact
-func QueueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task) error {
-	return queueHandleTask(rc, contactID, task, false)
+func QueueHandleTask(ctx context.Context, rc redis.Conn, contactID models.ContactID, task *queue.Task) error {
+	return queueHandleTask(ctx, rc, contactID, task, false)
 }
 
 // queueHandleTask queues a single task for the passed in contact. `front` specifies whether the task
-// should be inserted in front of all other tasks for that contact
-func queueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task, front bool) error {
+// should be inserted in front of all other tasks for that contact. If the task doesn't already have a correlation ID,
+// it inherits that of the passed in context. If the task has an idempotency key which has already been claimed, this
+// is a no-op. Tasks pushed back to the front are being retried and so aren't checked.
+func queueHandleTask(ctx context.Context, rc redis.Conn, contactID models.ContactID, task *queue.Task, front bool) error {
+	if task.CorrelationID == "" {
+		task.CorrelationID = logging.CorrelationID(ctx)
+	}
+
+	if task.IdempotencyKey != "" && !front {
+		claimed, err := queue.ClaimIdempotencyKey(rc, task.IdempotencyKey)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return nil
+		}
+	}
+
+	err := pushHandleTask(ctx, rc, contactID, task, front)
+
+	// if we couldn't queue the task, release its key so that it can be queued again
+	if err != nil && task.IdempotencyKey != "" && !front {
+		if rerr := queue.ReleaseIdempotencyKey(rc, task.IdempotencyKey); rerr != nil {
+			logrus.WithError(rerr).WithField("key", task.IdempotencyKey).Error("error releasing idempotency key")
+		}
+	}
+	return err
+}
+
+func pushHandleTask(ctx context.Context, rc redis.Conn, contactID models.ContactID, task *queue.Task, front bool) error {
 	// marshal our task
 	taskJSON, err := json.Marshal(task)
 	if err != nil {
@@ -38,18 +69,18 @@ func queueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task
 		return errors.Wrapf(err, "error adding contact event")
 	}
 
-	return queueContactTask(rc, models.OrgID(task.OrgID), contactID)
+	return queueContactTask(ctx, rc, models.OrgID(task.OrgID), contactID)
 }
 
 // pushes a single contact task on our queue. Note this does not push the actual content of the task
 // only that a task exists for the contact, addHandleTask should be used if the task has already been pushed
 // off the contact specific queue.
-func queueContactTask(rc redis.Conn, orgID models.OrgID, contactID models.ContactID) error {
+func queueContactTask(ctx context.Context, rc redis.Conn, orgID models.OrgID, contactID models.ContactID) error {
 	// create our contact event
 	contactTask := &HandleEventTask{ContactID: contactID}
 
 	// then add a handle task for that contact on our global handler queue
-	err := queue.AddTask(rc, queue.HandlerQueue, queue.HandleContactEvent, int(orgID), contactTask, queue.DefaultPriority)
+	err := queue.AddTask(ctx, rc, queue.HandlerQueue, queue.HandleContactEvent, int(orgID), contactTask, queue.DefaultPriority)
 	if err != nil {
 		return errors.Wrapf(err, "error adding handle event task")
 	}
@@ -57,7 +88,7 @@ func queueContactTask(rc redis.Conn, orgID models.OrgID, contactID models.Contac
 }
 
 // QueueTicketEvent queues a ticket event to be handled
-func QueueTicketEvent(rc redis.Conn, contactID models.ContactID, evt *models.TicketEvent) error {
+func QueueTicketEvent(ctx context.Context, rc redis.Conn, contactID models.ContactID, evt *models.TicketEvent) error {
 	eventJSON := jsonx.MustMarshal(evt)
 	var task *queue.Task
 
@@ -71,5 +102,5 @@ func QueueTicketEvent(rc redis.Conn, contactID models.ContactID, evt *models.Tic
 		}
 	}
 
-	return queueHandleTask(rc, contactID, task, false)
+	return queueHandleTask(ctx, rc, contactID, task, false)
 }
@@ -24,6 +24,8 @@ import (
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/runner"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/logging"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	"github.com/nyaruka/null"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -73,7 +75,7 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 	if lock == "" {
 		rc := rt.RP.Get()
 		defer rc.Close()
-		err = queueContactTask(rc, models.OrgID(task.OrgID), eventTask.ContactID)
+		err = queueContactTask(ctx, rc, models.OrgID(task.OrgID), eventTask.ContactID)
 		if err != nil {
 			return errors.Wrapf(err, "error re-adding contact task after failing to get lock")
 		}
@@ -88,8 +90,19 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 	// read all the events for this contact, one by one
 	contactQ := fmt.Sprintf("c:%d:%d", task.OrgID, eventTask.ContactID)
 	for {
+		// if our worker is stopping, leave any remaining events for this contact to be handled by another worker
+		if queue.IsDraining(ctx) {
+			rc := rt.RP.Get()
+			err := queueContactTask(ctx, rc, models.OrgID(task.OrgID), eventTask.ContactID)
+			rc.Close()
+			if err != nil {
+				return errors.Wrapf(err, "error re-adding contact task whilst draining")
+			}
+			return nil
+		}
+
 		// pop the next event off this contacts queue
-		rc := rt.RP.Get()
+		rc := tracing.Conn(ctx, rt.RP.Get())
 		event, err := redis.String(rc.Do("lpop", contactQ))
 		rc.Close()
 
@@ -112,6 +125,15 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 			return errors.Wrapf(err, "error unmarshalling contact event: %s", event)
 		}
 
+		// events inherit the correlation ID of whatever queued them
+		evtCtx := logging.WithCorrelationID(ctx, contactEvent.CorrelationID)
+
+		evtCtx, span := tracing.StartSpan(evtCtx, "contact event "+contactEvent.Type, tracing.OrgID(int64(task.OrgID)), tracing.ContactID(int64(eventTask.ContactID)))
+		endSpan := func(err error) error {
+			tracing.EndSpan(span, err)
+			return err
+		}
+
 		// hand off to the appropriate handler
 		switch contactEvent.Type {
 
@@ -119,46 +141,48 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 			evt := &StopEvent{}
 			err = json.Unmarshal(contactEvent.Task, evt)
 			if err != nil {
-				return errors.Wrapf(err, "error unmarshalling stop event: %s", event)
+				return endSpan(errors.Wrapf(err, "error unmarshalling stop event: %s", event))
 			}
-			err = handleStopEvent(ctx, rt, evt)
+			err = handleStopEvent(evtCtx, rt, evt)
 
 		case NewConversationEventType, ReferralEventType, MOMissEventType, WelcomeMessageEventType:
 			evt := &models.ChannelEvent{}
 			err = json.Unmarshal(contactEvent.Task, evt)
 			if err != nil {
-				return errors.Wrapf(err, "error unmarshalling channel event: %s", event)
+				return endSpan(errors.Wrapf(err, "error unmarshalling channel event: %s", event))
 			}
-			_, err = HandleChannelEvent(ctx, rt, models.ChannelEventType(contactEvent.Type), evt, nil)
+			_, err = HandleChannelEvent(evtCtx, rt, models.ChannelEventType(contactEvent.Type), evt, nil)
 
 		case MsgEventType:
 			msg := &MsgEvent{}
 			err = json.Unmarshal(contactEvent.Task, msg)
 			if err != nil {
-				return errors.Wrapf(err, "error unmarshalling msg event: %s", event)
+				return endSpan(errors.Wrapf(err, "error unmarshalling msg event: %s", event))
 			}
-			err = handleMsgEvent(ctx, rt, msg)
+			err = handleMsgEvent(evtCtx, rt, msg)
 
 		case TicketClosedEventType:
 			evt := &models.TicketEvent{}
 			err = json.Unmarshal(contactEvent.Task, evt)
 			if err != nil {
-				return errors.Wrapf(err, "error unmarshalling ticket event: %s", event)
+				return endSpan(errors.Wrapf(err, "error unmarshalling ticket event: %s", event))
 			}
-			err = handleTicketEvent(ctx, rt, evt)
+			err = handleTicketEvent(evtCtx, rt, evt)
 
 		case TimeoutEventType, ExpirationEventType:
 			evt := &TimedEvent{}
 			err = json.Unmarshal(contactEvent.Task, evt)
 			if err != nil {
-				return errors.Wrapf(err, "error unmarshalling timeout event: %s", event)
+				return endSpan(errors.Wrapf(err, "error unmarshalling timeout event: %s", event))
 			}
-			err = handleTimedEvent(ctx, rt, contactEvent.Type, evt)
+			err = handleTimedEvent(evtCtx, rt, contactEvent.Type, evt)
 
 		default:
-			return errors.Errorf("unknown contact event type: %s", contactEvent.Type)
+			return endSpan(errors.Errorf("unknown contact event type: %s", contactEvent.Type))
 		}
 
+		endSpan(err)
+
 		// log our processing time to librato
 		analytics.Gauge(fmt.Sprintf("mr.%s_elapsed", contactEvent.Type), float64(time.Since(start))/float64(time.Second))
 
@@ -167,12 +191,25 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 
 		// if we get an error processing an event, requeue it for later and return our error
 		if err != nil {
-			log := logrus.WithFields(logrus.Fields{
+			log := logging.FromContext(evtCtx).WithFields(logrus.Fields{
 				"org_id":     task.OrgID,
 				"contact_id": eventTask.ContactID,
 				"event":      event,
 			})
 
+			// if we were cancelled because our worker is stopping, push the event back to be handled after the restart
+			if queue.IsDraining(ctx) && ctx.Err() != nil {
+				rc := rt.RP.Get()
+				retryErr := queueHandleTask(ctx, rc, eventTask.ContactID, contactEvent, true)
+				rc.Close()
+				if retryErr != nil {
+					return errors.Wrapf(retryErr, "error requeuing contact event whilst draining")
+				}
+
+				log.WithError(err).Warn("contact event cancelled whilst draining, requeued")
+				return nil
+			}
+
 			if qerr := dbutil.AsQueryError(err); qerr != nil {
 				query, params := qerr.Query()
 				log = log.WithFields(logrus.Fields{"sql": query, "sql_params": params})
@@ -181,7 +218,7 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 			contactEvent.ErrorCount++
 			if contactEvent.ErrorCount < 3 {
 				rc := rt.RP.Get()
-				retryErr := queueHandleTask(rc, eventTask.ContactID, contactEvent, true)
+				retryErr := queueHandleTask(ctx, rc, eventTask.ContactID, contactEvent, true)
 				if retryErr != nil {
 					logrus.WithError(retryErr).Error("error requeuing errored contact event")
 				}
@@ -540,6 +577,21 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 		newContact = true
 	}
 
+	// attribute this response to any broadcast variant the contact was recently sent, which a new contact can't have been,
+	// and record that variant on the message
+	if !event.NewContact {
+		rc := rt.RP.Get()
+		bcastID, variant, err := models.RecordBroadcastVariantResponse(rc, modelContact.ID())
+		rc.Close()
+		if err != nil {
+			logrus.WithError(err).WithField("contact_id", modelContact.ID()).Error("error recording broadcast variant response")
+		} else if bcastID != models.NilBroadcastID {
+			if err := models.RecordMsgBroadcastVariant(ctx, rt.DB, event.MsgID, bcastID, variant); err != nil {
+				logrus.WithError(err).WithField("msg_id", event.MsgID).Error("error recording broadcast variant on message")
+			}
+		}
+	}
+
 	// build our flow contact
 	contact, err := modelContact.FlowContact(oa)
 	if err != nil {
@@ -579,7 +631,7 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 
 		// flow this session is in is gone, interrupt our session and reset it
 		if err == models.ErrNotFound {
-			err = models.ExitSessions(ctx, rt.DB, []models.SessionID{session.ID()}, models.SessionStatusFailed)
+			err = models.ExitSessions(ctx, rt, []models.SessionID{session.ID()}, models.SessionStatusFailed)
 			session = nil
 		}
 
@@ -821,7 +873,7 @@ type StopEvent struct {
 	OccurredOn time.Time        `json:"occurred_on"`
 }
 
-// creates a new event task for the passed in timeout event
+// creates a new event task for the passed in timed event, keyed so that the same event is only queued once
 func newTimedTask(eventType string, orgID models.OrgID, contactID models.ContactID, sessionID models.SessionID, eventTime time.Time) *queue.Task {
 	event := &TimedEvent{
 		OrgID:     orgID,
@@ -835,10 +887,11 @@ func newTimedTask(eventType string, orgID models.OrgID, contactID models.Contact
 	}
 
 	task := &queue.Task{
-		Type:     eventType,
-		OrgID:    int(orgID),
-		Task:     eventJSON,
-		QueuedOn: time.Now(),
+		Type:           eventType,
+		OrgID:          int(orgID),
+		Task:           eventJSON,
+		QueuedOn:       time.Now(),
+		IdempotencyKey: fmt.Sprintf("%s:%d:%s", eventType, sessionID, eventTime.UTC().Format(time.RFC3339Nano)),
 	}
 
 	return task
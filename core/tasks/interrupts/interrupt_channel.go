@@ -15,7 +15,7 @@ import (
 const TypeInterruptChannel = "interrupt_channel"
 
 func init() {
-	tasks.RegisterType(TypeInterruptChannel, func() tasks.Task { return &InterruptChannelTask{} })
+	tasks.RegisterRetriedType(TypeInterruptChannel, func() tasks.Task { return &InterruptChannelTask{} })
 }
 
 // InterruptChannelTask is our task to interrupt a channel
@@ -36,7 +36,7 @@ func (t *InterruptChannelTask) Perform(ctx context.Context, rt *runtime.Runtime,
 
 	channel := channels[0]
 
-	if err := models.InterruptSessionsForChannel(ctx, db, t.ChannelID); err != nil {
+	if err := models.InterruptSessionsForChannel(ctx, rt, t.ChannelID); err != nil {
 		return errors.Wrapf(err, "error interrupting sessions")
 	}
 
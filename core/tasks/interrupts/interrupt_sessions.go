@@ -14,7 +14,7 @@ import (
 const TypeInterruptSessions = "interrupt_sessions"
 
 func init() {
-	tasks.RegisterType(TypeInterruptSessions, func() tasks.Task { return &InterruptSessionsTask{} })
+	tasks.RegisterRetriedType(TypeInterruptSessions, func() tasks.Task { return &InterruptSessionsTask{} })
 }
 
 // InterruptSessionsTask is our task for interrupting sessions
@@ -30,20 +30,18 @@ func (t *InterruptSessionsTask) Timeout() time.Duration {
 }
 
 func (t *InterruptSessionsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
-	db := rt.DB
-
 	if len(t.ContactIDs) > 0 {
-		if _, err := models.InterruptSessionsForContacts(ctx, db, t.ContactIDs); err != nil {
+		if _, err := models.InterruptSessionsForContacts(ctx, rt, orgID, t.ContactIDs); err != nil {
 			return err
 		}
 	}
 	if len(t.FlowIDs) > 0 {
-		if err := models.InterruptSessionsForFlows(ctx, db, t.FlowIDs); err != nil {
+		if err := models.InterruptSessionsForFlows(ctx, rt, t.FlowIDs); err != nil {
 			return err
 		}
 	}
 	if len(t.SessionIDs) > 0 {
-		if err := models.ExitSessions(ctx, db, t.SessionIDs, models.SessionStatusInterrupted); err != nil {
+		if err := models.ExitSessions(ctx, rt, t.SessionIDs, models.SessionStatusInterrupted); err != nil {
 			return errors.Wrapf(err, "error interrupting sessions")
 		}
 	}
@@ -29,7 +29,16 @@ func handleFlowStartTask(ctx context.Context, rt *runtime.Runtime, task *queue.T
 		return errors.Wrapf(err, "error unmarshalling flow start batch: %s", string(task.Task))
 	}
 
-	return HandleFlowStartBatch(ctx, rt, batch)
+	err = HandleFlowStartBatch(ctx, rt, batch)
+	if err != nil {
+		return err
+	}
+
+	// if this start is being drip fed, record these contacts as processed
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	return models.RecordDripProgress(rc, models.DripKindStart, batch.OrgID(), int(batch.StartID()), len(batch.ContactIDs()))
 }
 
 // HandleFlowStartBatch starts a batch of contacts in an IVR flow
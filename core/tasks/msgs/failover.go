@@ -0,0 +1,124 @@
+package msgs
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	failoverInterval = time.Second * 60
+
+	// how far back we look for failed messages when we don't know when the last run got to
+	failoverWindow = failoverInterval * 2
+
+	// how far back we look from where the last run got to, in case messages were failed in transactions which hadn't
+	// yet committed. Failing over a message changes its status so messages are never failed over twice.
+	failoverOverlap = time.Second * 30
+
+	// how many failed messages we fetch at once
+	failoverPageSize = 1000
+
+	// where we store when the last failed message seen was modified
+	failoverCursorKey = "failover_cursor"
+)
+
+func init() {
+	mailroom.RegisterCron("failover_failed_messages", failoverInterval, false, FailoverFailedMessages)
+}
+
+// FailoverFailedMessages re-routes messages failed by their channel since the last run to the next fallback channel,
+// paging through them until there are no more
+func FailoverFailedMessages(ctx context.Context, rt *runtime.Runtime) error {
+	start := time.Now()
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	afterModifiedOn := start.Add(-failoverWindow)
+	afterID := flows.NilMsgID
+
+	last, err := redis.String(rc.Do("GET", failoverCursorKey))
+	if err != nil && err != redis.ErrNil {
+		return errors.Wrap(err, "error getting failover cursor")
+	}
+	if last != "" {
+		lastModifiedOn, err := time.Parse(time.RFC3339Nano, last)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing failover cursor '%s'", last)
+		}
+		afterModifiedOn = lastModifiedOn.Add(-failoverOverlap)
+	}
+
+	numRerouted := 0
+
+	for {
+		msgs, err := models.GetMessagesForFailover(ctx, rt.DB, afterModifiedOn, afterID, failoverPageSize)
+		if err != nil {
+			return errors.Wrap(err, "error fetching failed messages for failover")
+		}
+		if len(msgs) == 0 {
+			break
+		}
+
+		rerouted, err := failoverMessages(ctx, rt, msgs)
+		if err != nil {
+			return err
+		}
+		numRerouted += rerouted
+
+		// record how far we've got so that the next run, even if this one fails, carries on from here
+		lastMsg := msgs[len(msgs)-1]
+		afterModifiedOn, afterID = lastMsg.ModifiedOn(), lastMsg.ID()
+
+		if _, err := rc.Do("SET", failoverCursorKey, afterModifiedOn.Format(time.RFC3339Nano)); err != nil {
+			return errors.Wrap(err, "error saving failover cursor")
+		}
+
+		if len(msgs) < failoverPageSize {
+			break
+		}
+	}
+
+	if numRerouted > 0 {
+		logrus.WithField("count", numRerouted).WithField("elapsed", time.Since(start)).Info("failed over messages to fallback channels")
+	}
+
+	return nil
+}
+
+// fails over the passed in messages, returning how many could be re-routed
+func failoverMessages(ctx context.Context, rt *runtime.Runtime, msgs []*models.Msg) (int, error) {
+	// group messages by org since each org has its own fallback channels
+	byOrg := make(map[models.OrgID][]*models.Msg)
+	for _, m := range msgs {
+		byOrg[m.OrgID()] = append(byOrg[m.OrgID()], m)
+	}
+
+	numRerouted := 0
+
+	for orgID, orgMsgs := range byOrg {
+		oa, err := models.GetOrgAssets(ctx, rt, orgID)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error loading org assets for org #%d", orgID)
+		}
+
+		rerouted, err := models.FailoverMessages(ctx, rt.DB, oa, orgMsgs)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error failing over messages for org #%d", orgID)
+		}
+
+		msgio.SendMessages(ctx, rt, rt.DB, nil, rerouted)
+		numRerouted += len(rerouted)
+	}
+
+	return numRerouted, nil
+}
@@ -0,0 +1,76 @@
+package msgs_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/msgs"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/redisx/assertredis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverFailedMessages(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	// nothing to fail over
+	err := msgs.FailoverFailedMessages(ctx, rt)
+	require.NoError(t, err)
+
+	testsuite.AssertCourierQueues(t, map[string][]int{})
+
+	db.MustExec(fmt.Sprintf(`UPDATE orgs_org SET config = '{"channel_fallbacks": {"tel": ["%s"]}}' WHERE id = $1`, testdata.VonageChannel.UUID), testdata.Org1.ID)
+	models.FlushCache()
+
+	// a delivered message (should be ignored)
+	testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", nil, models.MsgStatusDelivered, false)
+
+	// a message failed by the channel a long time ago (should be ignored)
+	old := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", nil, models.MsgStatusFailed, false)
+	db.MustExec(`UPDATE msgs_msg SET modified_on = $2 WHERE id = $1`, old.ID(), time.Now().Add(-time.Hour))
+
+	// a message failed because the contact is blocked (should be ignored)
+	blocked := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "Hi", nil, models.MsgStatusFailed, false)
+	db.MustExec(`UPDATE msgs_msg SET modified_on = NOW(), failed_reason = 'C' WHERE id = $1`, blocked.ID())
+
+	// messages recently failed by the channel
+	failed1 := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Hi", nil, models.MsgStatusFailed, false)
+	failed2 := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.George, "Hi", nil, models.MsgStatusFailed, false)
+	db.MustExec(`UPDATE msgs_msg SET modified_on = NOW(), failed_reason = 'E' WHERE id = $1`, failed1.ID())
+	db.MustExec(`UPDATE msgs_msg SET modified_on = NOW() WHERE id = $1`, failed2.ID())
+
+	// a message failed by the fallback channel itself which has nowhere left to go
+	testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.VonageChannel, testdata.Cathy, "Hi", nil, models.MsgStatusFailed, false)
+	db.MustExec(`UPDATE msgs_msg SET modified_on = NOW() WHERE channel_id = $1 AND status = 'F'`, testdata.VonageChannel.ID)
+
+	err = msgs.FailoverFailedMessages(ctx, rt)
+	require.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE id = ANY(ARRAY[$1, $2]::bigint[]) AND status = 'Q' AND channel_id = $3`, failed1.ID(), failed2.ID(), testdata.VonageChannel.ID).Returns(2)
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE status = 'F'`).Returns(3)
+
+	testsuite.AssertCourierQueues(t, map[string][]int{
+		"msgs:19012bfd-3ce3-4cae-9bb9-76cf92c73d49|10/0": {2}, // vonage, bulk priority
+	})
+
+	// we record how far we got
+	assertredis.Exists(t, rp, "failover_cursor")
+
+	// so if runs are delayed, the next carries on from there rather than only looking back a fixed window
+	rc := rp.Get()
+	defer rc.Close()
+
+	_, err = rc.Do("SET", "failover_cursor", time.Now().Add(-time.Hour*2).Format(time.RFC3339Nano))
+	require.NoError(t, err)
+
+	err = msgs.FailoverFailedMessages(ctx, rt)
+	require.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'Q' AND channel_id = $2`, old.ID(), testdata.VonageChannel.ID).Returns(1)
+}
@@ -0,0 +1,31 @@
+package msgs
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+)
+
+func init() {
+	tasks.RegisterType(queue.PostOutboxBatch, func() tasks.Task { return &PostOutboxBatchTask{} })
+}
+
+// PostOutboxBatchTask is our task for POSTing a batch of messages to the outbox
+type PostOutboxBatchTask struct {
+	msgio.OutboxBatch
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *PostOutboxBatchTask) Timeout() time.Duration {
+	return time.Minute
+}
+
+// Perform POSTs the batch to the outbox, and if that fails, sets its messages back to pending so they'll be retried
+func (t *PostOutboxBatchTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	return msgio.PostOutboxBatch(ctx, rt, orgID, &t.OutboxBatch)
+}
@@ -3,6 +3,7 @@ package msgs
 import (
 	"context"
 	"encoding/json"
+	"sort"
 	"time"
 
 	"github.com/nyaruka/gocommon/urns"
@@ -22,6 +23,9 @@ const (
 func init() {
 	mailroom.AddTaskFunction(queue.SendBroadcast, handleSendBroadcast)
 	mailroom.AddTaskFunction(queue.SendBroadcastBatch, handleSendBroadcastBatch)
+
+	// batches skip contacts they've already sent to so they're safe to retry
+	mailroom.RetryTaskType(queue.SendBroadcastBatch)
 }
 
 // handleSendBroadcast creates all the batches of contacts that need to be sent to
@@ -88,42 +92,97 @@ func CreateBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *mod
 	rc := rt.RP.Get()
 	defer rc.Close()
 
-	contacts := make([]models.ContactID, 0, 100)
+	// if this broadcast has a rate, batches are released over time rather than all at once
+	batchSize := startBatchSize
+	drip := models.NewDripFeed(bcast.ContactsPerMinute(), time.Now())
+	if drip != nil {
+		batchSize = drip.BatchSize(startBatchSize)
+	}
+
+	// if our broadcast has variants, each contact is sent the variant they're assigned, so we batch by variant
+	variants := []*models.BroadcastVariant{nil}
+	if len(bcast.Variants()) > 0 {
+		variants = bcast.Variants()
+	}
+	assigned := func(id models.ContactID, variant *models.BroadcastVariant) bool {
+		return variant == nil || bcast.AssignVariant(id) == variant
+	}
+
+	batches := make([]*models.BroadcastBatch, 0, (len(contactIDs)+len(urnContacts))/batchSize+len(variants))
 
-	// utility functions for queueing the current set of contacts
-	queueBatch := func(isLast bool) {
-		// if this is our last batch include those contacts that overlap with our urns
-		if isLast {
-			for id := range repeatedContacts {
-				contacts = append(contacts, id)
+	for _, variant := range variants {
+		batch := bcast.CreateVariantBatch(make([]models.ContactID, 0, batchSize), variant)
+
+		// utility function for adding the current batch and starting a new one
+		addBatch := func() {
+			batches = append(batches, batch)
+			batch = bcast.CreateVariantBatch(make([]models.ContactID, 0, batchSize), variant)
+		}
+
+		// build up batches of contacts to send to
+		for c := range contactIDs {
+			if !assigned(c, variant) {
+				continue
 			}
+			if len(batch.ContactIDs) == batchSize {
+				addBatch()
+			}
+			batch.ContactIDs = append(batch.ContactIDs, c)
 		}
 
-		batch := bcast.CreateBatch(contacts)
+		// then add our URN contacts, including those that overlap with our contacts, which need to be in the same
+		// batch as their URN
+		for id, u := range urnContacts {
+			if !assigned(id, variant) {
+				continue
+			}
+			if batchContactCount(batch) == batchSize {
+				addBatch()
+			}
+			if batch.URNs == nil {
+				batch.URNs = make(map[models.ContactID]urns.URN)
+			}
+			batch.URNs[id] = u
 
-		// also set our URNs
-		if isLast {
-			batch.IsLast = true
-			batch.URNs = urnContacts
+			if _, repeated := repeatedContacts[id]; repeated {
+				batch.ContactIDs = append(batch.ContactIDs, id)
+			}
 		}
 
-		err = queue.AddTask(rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, queue.DefaultPriority)
-		if err != nil {
-			logrus.WithError(err).Error("error while queuing broadcast batch")
+		if batchContactCount(batch) > 0 {
+			addBatch()
 		}
-		contacts = make([]models.ContactID, 0, 100)
 	}
 
-	// build up batches of contacts to start
-	for c := range contactIDs {
-		if len(contacts) == startBatchSize {
-			queueBatch(false)
+	// our last batch marks the broadcast as sent so we always need one
+	if len(batches) == 0 {
+		batches = append(batches, bcast.CreateBatch(nil))
+	}
+	batches[len(batches)-1].IsLast = true
+
+	// if we're drip feeding, work out when each batch is released so that our ETA is when the last one actually is
+	releases := make([]time.Time, len(batches))
+	if drip != nil {
+		for i, batch := range batches {
+			releases[i] = drip.Release(batchContactCount(batch))
+		}
+
+		err = models.StartDripProgress(rc, models.DripKindBroadcast, bcast.OrgID(), int(bcast.ID()), drip, len(contactIDs)+len(urnContacts), releases[len(releases)-1])
+		if err != nil {
+			return errors.Wrapf(err, "error starting drip progress")
 		}
-		contacts = append(contacts, c)
 	}
 
-	// queue our last batch
-	queueBatch(true)
+	for i, batch := range batches {
+		if drip != nil {
+			err = queue.AddTaskAt(ctx, rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, releases[i])
+		} else {
+			err = queue.AddTask(ctx, rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, queue.DefaultPriority)
+		}
+		if err != nil {
+			logrus.WithError(err).Error("error while queuing broadcast batch")
+		}
+	}
 
 	return nil
 }
@@ -164,12 +223,158 @@ func SendBroadcastBatch(ctx context.Context, rt *runtime.Runtime, bcast *models.
 		return errors.Wrapf(err, "error getting org assets")
 	}
 
+	// ticket replies are part of a conversation, everything else respects the org's quiet hours and frequency caps
+	if bcast.TicketID == models.NilTicketID {
+		remaining, err := deferContacts(ctx, rt, oa, bcast)
+		if err != nil {
+			return errors.Wrapf(err, "error deferring contacts in quiet hours or over frequency caps")
+		}
+		if remaining == nil {
+			return nil
+		}
+		bcast = remaining
+	}
+
+	// if this batch has been tried before, don't send again to contacts who were sent to before it failed
+	unsent, err := bcast.ExcludeSent(ctx, rt.DB)
+	if err != nil {
+		return err
+	}
+
 	// create this batch of messages
-	msgs, err := bcast.CreateMessages(ctx, rt, oa)
+	msgs, err := unsent.CreateMessages(ctx, rt, oa)
 	if err != nil {
 		return errors.Wrapf(err, "error creating broadcast messages")
 	}
 
+	// record who was sent which variant so that we can attribute their responses
+	if bcast.Variant != "" {
+		rc := rt.RP.Get()
+		err := models.RecordBroadcastVariantSends(rc, bcast.OrgID, bcast.BroadcastID, bcast.Variant, msgs)
+		rc.Close()
+		if err != nil {
+			logrus.WithError(err).Error("error recording broadcast variant sends")
+		}
+	}
+
+	// if this broadcast is being drip fed, record these contacts as processed
+	if bcast.BroadcastID != models.NilBroadcastID {
+		rc := rt.RP.Get()
+		err := models.RecordDripProgress(rc, models.DripKindBroadcast, bcast.OrgID, int(bcast.BroadcastID), batchContactCount(bcast))
+		rc.Close()
+		if err != nil {
+			logrus.WithError(err).Error("error recording broadcast drip progress")
+		}
+	}
+
 	msgio.SendMessages(ctx, rt, rt.DB, nil, msgs)
 	return nil
 }
+
+// returns the number of unique contacts in the passed in batch, as contacts can be included by id and by URN
+func batchContactCount(bcast *models.BroadcastBatch) int {
+	count := len(bcast.URNs)
+	for _, id := range bcast.ContactIDs {
+		if _, found := bcast.URNs[id]; !found {
+			count++
+		}
+	}
+	return count
+}
+
+// re-queues the contacts of the passed in batch which are currently in quiet hours, or have reached a frequency cap
+// that the org defers sends for, to be sent to when those end, returning a batch of the remaining contacts or nil if all
+// contacts were deferred
+func deferContacts(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, bcast *models.BroadcastBatch) (*models.BroadcastBatch, error) {
+	contactIDs := make([]models.ContactID, 0, len(bcast.ContactIDs)+len(bcast.URNs))
+	contactIDs = append(contactIDs, bcast.ContactIDs...)
+	for id := range bcast.URNs {
+		contactIDs = append(contactIDs, id)
+	}
+
+	now := time.Now()
+
+	sendNow, deferred, err := models.DeferQuietContacts(ctx, rt.DB, oa, contactIDs, now)
+	if err != nil {
+		return nil, err
+	}
+
+	sendNow, capped, err := models.DeferCappedContacts(rt, oa.Org(), sendNow, now)
+	if err != nil {
+		return nil, err
+	}
+	for until, ids := range capped {
+		if deferred == nil {
+			deferred = make(map[time.Time][]models.ContactID)
+		}
+		deferred[until] = append(deferred[until], ids...)
+	}
+
+	if len(deferred) == 0 {
+		return bcast, nil
+	}
+
+	// splits the contacts of our batch into a new batch for the given contacts
+	split := func(ids []models.ContactID, isLast bool) *models.BroadcastBatch {
+		batch := *bcast
+		batch.ContactIDs = make([]models.ContactID, 0, len(ids))
+		batch.URNs = nil
+		batch.IsLast = isLast
+
+		inBatch := make(map[models.ContactID]bool, len(bcast.ContactIDs))
+		for _, id := range bcast.ContactIDs {
+			inBatch[id] = true
+		}
+
+		for _, id := range ids {
+			if u, ok := bcast.URNs[id]; ok {
+				if batch.URNs == nil {
+					batch.URNs = make(map[models.ContactID]urns.URN)
+				}
+				batch.URNs[id] = u
+			}
+			if inBatch[id] {
+				batch.ContactIDs = append(batch.ContactIDs, id)
+			}
+		}
+		return &batch
+	}
+
+	// contacts may be in both our ids and our URNs so dedupe those we're sending to now
+	seen := make(map[models.ContactID]bool, len(sendNow))
+	uniqueNow := make([]models.ContactID, 0, len(sendNow))
+	for _, id := range sendNow {
+		if !seen[id] {
+			uniqueNow = append(uniqueNow, id)
+			seen[id] = true
+		}
+	}
+
+	// queue deferred batches in order of when they can be sent so that the last one marks the broadcast as sent
+	times := make([]time.Time, 0, len(deferred))
+	for t := range deferred {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for i, t := range times {
+		batch := split(deferred[t], bcast.IsLast && i == len(times)-1)
+		batch.DeferredUntil = &times[i]
+
+		err := queue.AddTaskAt(ctx, rc, queue.BatchQueue, queue.SendBroadcastBatch, int(bcast.OrgID), batch, t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error queuing deferred broadcast batch")
+		}
+	}
+
+	// the last batch is now the one we deferred last so this one shouldn't mark the broadcast as sent
+	bcast.IsLast = false
+
+	if len(uniqueNow) == 0 {
+		return nil, nil
+	}
+	return split(uniqueNow, false), nil
+}
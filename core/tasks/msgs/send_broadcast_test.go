@@ -2,10 +2,12 @@ package msgs_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
@@ -18,7 +20,9 @@ import (
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBroadcastEvents(t *testing.T) {
@@ -289,3 +293,204 @@ func TestBroadcastTask(t *testing.T) {
 
 	assertdb.Query(t, db, `SELECT SUM(count) FROM tickets_ticketdailytiming WHERE count_type = 'R' AND scope = CONCAT('o:', $1::text)`, testdata.Org1.ID).Returns(1)
 }
+
+func TestBroadcastBatchRetry(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	bcastID := testdata.InsertBroadcast(db, testdata.Org1, "eng", map[envs.Language]string{"eng": "hi there"}, models.NilScheduleID, nil, nil)
+
+	batch := &models.BroadcastBatch{
+		BroadcastID:   bcastID,
+		Translations:  map[envs.Language]*models.BroadcastTranslation{"eng": {Text: "hi there"}},
+		BaseLanguage:  "eng",
+		TemplateState: models.TemplateStateEvaluated,
+		ContactIDs:    []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID},
+		IsLast:        true,
+		OrgID:         testdata.Org1.ID,
+	}
+
+	assert.NoError(t, msgs.SendBroadcastBatch(ctx, rt, batch))
+
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1`, bcastID).Returns(2)
+
+	// if the batch is performed again, e.g. because it's being retried, contacts aren't sent to twice
+	batch.ContactIDs = append(batch.ContactIDs, testdata.George.ID)
+
+	assert.NoError(t, msgs.SendBroadcastBatch(ctx, rt, batch))
+
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1`, bcastID).Returns(3)
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1 AND contact_id = $2`, bcastID, testdata.George.ID).Returns(1)
+}
+
+func TestDripFedBroadcastBatches(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// reads the delayed broadcast batches of the given queue in the order they'll be released
+	delayedBatches := func(q string) ([]*models.BroadcastBatch, []time.Time) {
+		payloads, err := redis.ByteSlices(rc.Do("ZRANGE", fmt.Sprintf("%s:delayed", q), 0, -1))
+		require.NoError(t, err)
+
+		batches := make([]*models.BroadcastBatch, len(payloads))
+		releases := make([]time.Time, len(payloads))
+		for i, payload := range payloads {
+			task := &queue.Task{}
+			jsonx.MustUnmarshal(payload, task)
+			batches[i] = &models.BroadcastBatch{}
+			jsonx.MustUnmarshal(task.Task, batches[i])
+			releases[i] = task.QueuedOn
+		}
+		rc.Do("DEL", fmt.Sprintf("%s:delayed", q))
+		return batches, releases
+	}
+
+	batchSize := func(b *models.BroadcastBatch) int {
+		size := len(b.URNs)
+		for _, id := range b.ContactIDs {
+			if _, found := b.URNs[id]; !found {
+				size++
+			}
+		}
+		return size
+	}
+
+	bcast := &models.Broadcast{}
+	jsonx.MustUnmarshal([]byte(fmt.Sprintf(`{
+		"broadcast_id": 123,
+		"org_id": 1,
+		"base_language": "eng",
+		"translations": {"eng": {"text": "Hi there"}},
+		"group_ids": [%d],
+		"urns": ["tel:+12065559999"],
+		"variants": [
+			{"name": "A", "translations": {"eng": {"text": "Hello!"}}},
+			{"name": "B", "translations": {"eng": {"text": "Howdy!"}}}
+		],
+		"contacts_per_minute": 50
+	}`, testdata.DoctorsGroup.ID)), bcast)
+
+	err := msgs.CreateBroadcastBatches(ctx, rt, bcast)
+	require.NoError(t, err)
+
+	// each variant has its own batches, none of them bigger than a minute's worth of contacts
+	batches, releases := delayedBatches(queue.BatchQueue)
+	require.Greater(t, len(batches), 2)
+
+	total := 0
+	for i, b := range batches {
+		assert.LessOrEqual(t, batchSize(b), 50)
+		assert.Equal(t, i == len(batches)-1, b.IsLast)
+		total += batchSize(b)
+	}
+	assert.Equal(t, 122, total)
+
+	// and our ETA is when the last of those batches is actually released
+	progress, err := models.GetDripProgress(rc, models.DripKindBroadcast, testdata.Org1.ID, 123)
+	require.NoError(t, err)
+	assert.Equal(t, 122, progress.Total)
+	assert.True(t, progress.ETA.Equal(releases[len(releases)-1]), "ETA %s doesn't match last release %s", progress.ETA, releases[len(releases)-1])
+
+	// URN contacts are also split into batches
+	bcast = &models.Broadcast{}
+	jsonx.MustUnmarshal([]byte(`{
+		"broadcast_id": 124,
+		"org_id": 1,
+		"base_language": "eng",
+		"translations": {"eng": {"text": "Hi there"}},
+		"urns": ["tel:+12065559901", "tel:+12065559902", "tel:+12065559903"],
+		"contacts_per_minute": 2
+	}`), bcast)
+
+	err = msgs.CreateBroadcastBatches(ctx, rt, bcast)
+	require.NoError(t, err)
+
+	batches, _ = delayedBatches(queue.HandlerQueue)
+	require.Len(t, batches, 2)
+	assert.Len(t, batches[0].URNs, 2)
+	assert.False(t, batches[0].IsLast)
+	assert.Len(t, batches[1].URNs, 1)
+	assert.True(t, batches[1].IsLast)
+}
+
+func TestBroadcastBatchQuietHours(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// give the org quiet hours that we're in now, except for Bob who is twelve hours away
+	now := time.Now().UTC()
+	db.MustExec(`UPDATE orgs_org SET timezone = 'UTC', config = $2 WHERE id = $1`, testdata.Org1.ID,
+		fmt.Sprintf(`{"quiet_hours_start": "%s", "quiet_hours_end": "%s", "quiet_hours_timezone_field": "gender"}`, now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")))
+	db.MustExec(`UPDATE contacts_contact SET fields = COALESCE(fields, '{}') || jsonb_build_object($2::text, jsonb_build_object('text', 'Etc/GMT+12')) WHERE id = $1`, testdata.Bob.ID, testdata.GenderField.UUID)
+
+	_, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	bcastID := testdata.InsertBroadcast(db, testdata.Org1, "eng", map[envs.Language]string{"eng": "hi there"}, models.NilScheduleID, nil, nil)
+
+	batch := &models.BroadcastBatch{
+		BroadcastID:   bcastID,
+		Translations:  map[envs.Language]*models.BroadcastTranslation{"eng": {Text: "hi there"}},
+		BaseLanguage:  "eng",
+		TemplateState: models.TemplateStateEvaluated,
+		ContactIDs:    []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID},
+		IsLast:        true,
+		OrgID:         testdata.Org1.ID,
+	}
+
+	require.NoError(t, msgs.SendBroadcastBatch(ctx, rt, batch))
+
+	// Bob is sent to now, and the broadcast isn't marked as sent because that's now done by the deferred batch
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1 AND contact_id = $2`, bcastID, testdata.Bob.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1 AND contact_id = $2`, bcastID, testdata.Cathy.ID).Returns(0)
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_broadcast WHERE id = $1 AND status = 'S'`, bcastID).Returns(0)
+
+	// Cathy is re-queued to be sent to when her quiet hours end
+	payloads, err := redis.ByteSlices(rc.Do("ZRANGE", "batch:delayed", 0, -1))
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+
+	task := &queue.Task{}
+	jsonx.MustUnmarshal(payloads[0], task)
+	assert.Equal(t, queue.SendBroadcastBatch, task.Type)
+
+	deferred := &models.BroadcastBatch{}
+	jsonx.MustUnmarshal(task.Task, deferred)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID}, deferred.ContactIDs)
+	assert.True(t, deferred.IsLast)
+	require.NotNil(t, deferred.DeferredUntil)
+	assert.True(t, deferred.DeferredUntil.After(now))
+
+	rc.Do("DEL", "batch:delayed")
+
+	// ticket replies are part of a conversation so aren't deferred
+	ticket := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, testdata.DefaultTopic, "Help", "", time.Now(), nil)
+	replyID := testdata.InsertBroadcast(db, testdata.Org1, "eng", map[envs.Language]string{"eng": "we can help"}, models.NilScheduleID, nil, nil)
+
+	reply := &models.BroadcastBatch{
+		BroadcastID:   replyID,
+		Translations:  map[envs.Language]*models.BroadcastTranslation{"eng": {Text: "we can help"}},
+		BaseLanguage:  "eng",
+		TemplateState: models.TemplateStateEvaluated,
+		ContactIDs:    []models.ContactID{testdata.Cathy.ID},
+		IsLast:        true,
+		OrgID:         testdata.Org1.ID,
+		TicketID:      ticket.ID,
+	}
+
+	require.NoError(t, msgs.SendBroadcastBatch(ctx, rt, reply))
+
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_msg WHERE broadcast_id = $1 AND contact_id = $2`, replyID, testdata.Cathy.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM msgs_broadcast WHERE id = $1 AND status = 'S'`, replyID).Returns(1)
+
+	delayed, err := queue.DelayedSize(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delayed)
+}
@@ -0,0 +1,26 @@
+package publishing
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/publish"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	mailroom.RegisterCron("republish_events", time.Minute, false, RepublishEvents)
+}
+
+// RepublishEvents republishes change events which previously failed to publish
+func RepublishEvents(ctx context.Context, rt *runtime.Runtime) error {
+	start := time.Now()
+
+	count, err := publish.Republish(ctx, rt)
+	if count > 0 {
+		logrus.WithField("comp", "republisher").WithField("count", count).WithField("elapsed", time.Since(start)).Info("republished failed events")
+	}
+	return err
+}
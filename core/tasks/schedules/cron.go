@@ -8,12 +8,14 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 func init() {
-	mailroom.RegisterCron("fire_schedules", time.Minute*1, false, checkSchedules)
+	// each run fires all schedules which are due, so there's no need to catch up on runs missed during deploys
+	mailroom.RegisterScheduledCron("fire_schedules", "* * * * *", cron.SkipMissed, checkSchedules)
 }
 
 // checkSchedules looks up any expired schedules and fires them, setting the next fire as needed
@@ -120,7 +122,7 @@ func checkSchedules(ctx context.Context, rt *runtime.Runtime) error {
 
 		// add our task if we have one
 		if task != nil {
-			err = queue.AddTask(rc, queue.BatchQueue, taskName, int(s.OrgID()), task, queue.HighPriority)
+			err = queue.AddTask(ctx, rc, queue.BatchQueue, taskName, int(s.OrgID()), task, queue.HighPriority)
 			if err != nil {
 				log.WithError(err).Error("error firing task with name: ", taskName)
 			}
@@ -3,6 +3,7 @@ package starts
 import (
 	"context"
 	"encoding/json"
+	"sort"
 	"time"
 
 	"github.com/nyaruka/goflow/contactql"
@@ -26,6 +27,9 @@ const (
 func init() {
 	mailroom.AddTaskFunction(queue.StartFlow, handleFlowStart)
 	mailroom.AddTaskFunction(queue.StartFlowBatch, handleFlowStartBatch)
+
+	// batches skip contacts they've already started so they're safe to retry
+	mailroom.RetryTaskType(queue.StartFlowBatch)
 }
 
 // handleFlowStart creates all the batches of contacts to start in a flow
@@ -43,10 +47,32 @@ func handleFlowStart(ctx context.Context, rt *runtime.Runtime, task *queue.Task)
 		return errors.Wrapf(err, "error unmarshalling flow start task: %s", string(task.Task))
 	}
 
+	// starts queued by other producers, e.g. from the web, haven't claimed their key yet so claim it now so that a
+	// double submission is only started once
+	if task.IdempotencyKey == "" && startTask.IdempotencyKey() != "" {
+		rc := rt.RP.Get()
+		claimed, err := queue.ClaimIdempotencyKey(rc, startTask.IdempotencyKey())
+		rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "error claiming flow start")
+		}
+		if !claimed {
+			logrus.WithField("start_id", startTask.ID()).WithField("key", startTask.IdempotencyKey()).Info("ignoring duplicate flow start")
+			return models.MarkStartFailed(ctx, rt.DB, startTask.ID())
+		}
+	}
+
 	err = CreateFlowBatches(ctx, rt, startTask)
 	if err != nil {
 		models.MarkStartFailed(ctx, rt.DB, startTask.ID())
 
+		// release our claim so that the same submission can be tried again
+		if task.IdempotencyKey == "" && startTask.IdempotencyKey() != "" {
+			rc := rt.RP.Get()
+			queue.ReleaseIdempotencyKey(rc, startTask.IdempotencyKey())
+			rc.Close()
+		}
+
 		// if error is user created query error.. don't escalate error to sentry
 		isQueryError, _ := contactql.IsQueryError(err)
 		if !isQueryError {
@@ -179,20 +205,44 @@ func CreateFlowBatches(ctx context.Context, rt *runtime.Runtime, start *models.F
 		taskType = queue.StartIVRFlowBatch
 	}
 
-	contacts := make([]models.ContactID, 0, 100)
+	// if this start has a rate, batches are released over time rather than all at once
+	batchSize := startBatchSize
+	drip := models.NewDripFeed(start.ContactsPerMinute(), time.Now())
+	if drip != nil {
+		batchSize = drip.BatchSize(startBatchSize)
+
+		err = models.StartDripProgress(rc, models.DripKindStart, start.OrgID(), int(start.ID()), drip, len(contactIDs), drip.ETA(len(contactIDs)))
+		if err != nil {
+			return errors.Wrapf(err, "error starting drip progress")
+		}
+	}
+
+	contacts := make([]models.ContactID, 0, batchSize)
 	queueBatch := func(last bool) {
 		batch := start.CreateBatch(contacts, last, len(contactIDs))
-		err = queue.AddTask(rc, q, taskType, int(start.OrgID()), batch, queue.DefaultPriority)
+		if drip != nil {
+			err = queue.AddTaskAt(ctx, rc, q, taskType, int(start.OrgID()), batch, drip.Release(len(contacts)))
+		} else {
+			err = queue.AddTask(ctx, rc, q, taskType, int(start.OrgID()), batch, queue.DefaultPriority)
+		}
 		if err != nil {
 			// TODO: is continuing the right thing here? what do we do if redis is down? (panic!)
 			logrus.WithError(err).WithField("start_id", start.ID()).Error("error while queuing start")
 		}
-		contacts = make([]models.ContactID, 0, 100)
+		contacts = make([]models.ContactID, 0, batchSize)
 	}
 
-	// build up batches of contacts to start
+	// sort our contacts so that batches are the same if this start is handled again, which lets their queuing be
+	// idempotent
+	sortedIDs := make([]models.ContactID, 0, len(contactIDs))
 	for c := range contactIDs {
-		if len(contacts) == startBatchSize {
+		sortedIDs = append(sortedIDs, c)
+	}
+	sort.Slice(sortedIDs, func(i, j int) bool { return sortedIDs[i] < sortedIDs[j] })
+
+	// build up batches of contacts to start
+	for _, c := range sortedIDs {
+		if len(contacts) == batchSize {
 			queueBatch(false)
 		}
 		contacts = append(contacts, c)
@@ -221,11 +271,77 @@ func handleFlowStartBatch(ctx context.Context, rt *runtime.Runtime, task *queue.
 		return errors.Wrapf(err, "error unmarshalling flow start batch: %s", string(task.Task))
 	}
 
+	// scheduled starts aren't interactive so they respect the org's quiet hours
+	if startBatch.StartType() == models.StartTypeTrigger {
+		startBatch, err = deferQuietContacts(ctx, rt, startBatch)
+		if err != nil {
+			return errors.Wrapf(err, "error deferring contacts in quiet hours: %s", string(task.Task))
+		}
+		if startBatch == nil {
+			return nil
+		}
+	}
+
+	// if this batch has been tried before, don't start contacts again who were started before it failed
+	unstarted, err := startBatch.ExcludeStarted(ctx, rt.DB)
+	if err != nil {
+		return errors.Wrapf(err, "error excluding already started contacts: %s", string(task.Task))
+	}
+
 	// start these contacts in our flow
-	_, err = runner.StartFlowBatch(ctx, rt, startBatch)
+	_, err = runner.StartFlowBatch(ctx, rt, unstarted)
 	if err != nil {
 		return errors.Wrapf(err, "error starting flow batch: %s", string(task.Task))
 	}
 
-	return err
+	return recordDripProgress(rt, startBatch)
+}
+
+// records the contacts of the passed in batch as processed if its start is being drip fed
+func recordDripProgress(rt *runtime.Runtime, batch *models.FlowStartBatch) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	return models.RecordDripProgress(rc, models.DripKindStart, batch.OrgID(), int(batch.StartID()), len(batch.ContactIDs()))
+}
+
+// re-queues the contacts of the passed in batch which are currently in quiet hours to be started when those end,
+// returning a batch of the remaining contacts or nil if all contacts were deferred
+func deferQuietContacts(ctx context.Context, rt *runtime.Runtime, batch *models.FlowStartBatch) (*models.FlowStartBatch, error) {
+	oa, err := models.GetOrgAssets(ctx, rt, batch.OrgID())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading org assets")
+	}
+
+	startNow, deferred, err := models.DeferQuietContacts(ctx, rt.DB, oa, batch.ContactIDs(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(deferred) == 0 {
+		return batch, nil
+	}
+
+	// queue deferred batches in order of when they can be started so that the last one can complete the start
+	times := make([]time.Time, 0, len(deferred))
+	for t := range deferred {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for i, t := range times {
+		deferredBatch := batch.Defer(deferred[t], t, batch.IsLast() && i == len(times)-1)
+
+		err := queue.AddTaskAt(ctx, rc, queue.BatchQueue, queue.StartFlowBatch, int(batch.OrgID()), deferredBatch, t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error queuing deferred start batch")
+		}
+	}
+
+	if len(startNow) == 0 {
+		return nil, nil
+	}
+	return batch.WithContacts(startNow, false), nil
 }
@@ -2,10 +2,13 @@ package starts
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/gocommon/jsonx"
 	_ "github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
@@ -301,3 +304,172 @@ func TestStarts(t *testing.T) {
 		}
 	}
 }
+
+func TestDripFedStart(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	start := models.NewFlowStart(testdata.Org1.ID, models.StartTypeManual, models.FlowTypeMessaging, testdata.SingleMessage.ID).
+		WithGroupIDs([]models.GroupID{testdata.DoctorsGroup.ID}).
+		WithContactsPerMinute(50)
+
+	err := models.InsertFlowStarts(ctx, db, []*models.FlowStart{start})
+	require.NoError(t, err)
+
+	startJSON, err := json.Marshal(start)
+	require.NoError(t, err)
+
+	err = handleFlowStart(ctx, rt, &queue.Task{Type: queue.StartFlow, Task: startJSON})
+	assert.NoError(t, err)
+
+	// only the first batch can be started now, the other two are released over the next couple of minutes
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+
+	next, err := queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, next)
+
+	delayed, err := queue.DelayedSize(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, delayed)
+
+	err = handleFlowStartBatch(ctx, rt, task)
+	assert.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE start_id = $1`, start.ID()).Returns(50)
+	assertdb.Query(t, db, `SELECT status FROM flows_flowstart WHERE id = $1`, start.ID()).Returns("S")
+
+	progress, err := models.GetDripProgress(rc, models.DripKindStart, testdata.Org1.ID, int(start.ID()))
+	require.NoError(t, err)
+	assert.Equal(t, 50, progress.ContactsPerMinute)
+	assert.Equal(t, 121, progress.Total)
+	assert.Equal(t, 50, progress.Processed)
+	assert.Equal(t, progress.StartedOn.Add(2*time.Minute), progress.ETA) // last batch of 21 released after the first 100
+}
+
+func TestDuplicateStartSubmissions(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// two starts created by a double submission of the same form
+	start1 := models.NewFlowStart(testdata.Org1.ID, models.StartTypeManual, models.FlowTypeMessaging, testdata.SingleMessage.ID).
+		WithContactIDs([]models.ContactID{testdata.Cathy.ID}).
+		WithSubmissionKey("f2a8b2c6")
+	start2 := models.NewFlowStart(testdata.Org1.ID, models.StartTypeManual, models.FlowTypeMessaging, testdata.SingleMessage.ID).
+		WithContactIDs([]models.ContactID{testdata.Cathy.ID}).
+		WithSubmissionKey("f2a8b2c6")
+
+	err := models.InsertFlowStarts(ctx, db, []*models.FlowStart{start1, start2})
+	require.NoError(t, err)
+
+	for _, start := range []*models.FlowStart{start1, start2} {
+		startJSON, err := json.Marshal(start)
+		require.NoError(t, err)
+
+		err = handleFlowStart(ctx, rt, &queue.Task{Type: queue.StartFlow, Task: startJSON})
+		assert.NoError(t, err)
+	}
+
+	// only the first start should have been started
+	assertdb.Query(t, db, `SELECT status FROM flows_flowstart WHERE id = $1`, start1.ID()).Returns("S")
+	assertdb.Query(t, db, `SELECT status FROM flows_flowstart WHERE id = $1`, start2.ID()).Returns("F")
+
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+}
+
+func TestRetriedStartBatch(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	start := models.NewFlowStart(testdata.Org1.ID, models.StartTypeManual, models.FlowTypeMessaging, testdata.SingleMessage.ID).
+		WithContactIDs([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}).
+		WithExcludeStartedPreviously(false)
+
+	err := models.InsertFlowStarts(ctx, db, []*models.FlowStart{start})
+	require.NoError(t, err)
+
+	batchJSON, err := json.Marshal(start.CreateBatch([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, true, 2))
+	require.NoError(t, err)
+
+	task := &queue.Task{Type: queue.StartFlowBatch, OrgID: int(testdata.Org1.ID), Task: batchJSON}
+
+	err = handleFlowStartBatch(ctx, rt, task)
+	assert.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE start_id = $1`, start.ID()).Returns(2)
+
+	// performing the batch again, e.g. because it's being retried, doesn't start contacts again
+	task.ErrorCount = 1
+
+	err = handleFlowStartBatch(ctx, rt, task)
+	assert.NoError(t, err)
+
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE start_id = $1`, start.ID()).Returns(2)
+	assertdb.Query(t, db, `SELECT status FROM flows_flowstart WHERE id = $1`, start.ID()).Returns("C")
+}
+
+func TestStartBatchQuietHours(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// give the org quiet hours that we're in now, except for Bob who is twelve hours away
+	now := time.Now().UTC()
+	db.MustExec(`UPDATE orgs_org SET timezone = 'UTC', config = $2 WHERE id = $1`, testdata.Org1.ID,
+		fmt.Sprintf(`{"quiet_hours_start": "%s", "quiet_hours_end": "%s", "quiet_hours_timezone_field": "gender"}`, now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")))
+	db.MustExec(`UPDATE contacts_contact SET fields = COALESCE(fields, '{}') || jsonb_build_object($2::text, jsonb_build_object('text', 'Etc/GMT+12')) WHERE id = $1`, testdata.Bob.ID, testdata.GenderField.UUID)
+
+	_, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	// starts by triggers, e.g. scheduled ones, respect quiet hours
+	start := models.NewFlowStart(testdata.Org1.ID, models.StartTypeTrigger, models.FlowTypeMessaging, testdata.SingleMessage.ID).
+		WithContactIDs([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+
+	err = models.InsertFlowStarts(ctx, db, []*models.FlowStart{start})
+	require.NoError(t, err)
+
+	batchJSON, err := json.Marshal(start.CreateBatch([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, true, 2))
+	require.NoError(t, err)
+
+	err = handleFlowStartBatch(ctx, rt, &queue.Task{Type: queue.StartFlowBatch, OrgID: int(testdata.Org1.ID), Task: batchJSON})
+	assert.NoError(t, err)
+
+	// Bob is started now, and the start isn't complete because that's now done by the deferred batch
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE start_id = $1 AND contact_id = $2`, start.ID(), testdata.Bob.ID).Returns(1)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowrun WHERE start_id = $1 AND contact_id = $2`, start.ID(), testdata.Cathy.ID).Returns(0)
+	assertdb.Query(t, db, `SELECT count(*) FROM flows_flowstart WHERE id = $1 AND status = 'C'`, start.ID()).Returns(0)
+
+	// Cathy is re-queued to be started when her quiet hours end
+	payloads, err := redis.ByteSlices(rc.Do("ZRANGE", "batch:delayed", 0, -1))
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+
+	task := &queue.Task{}
+	jsonx.MustUnmarshal(payloads[0], task)
+	assert.Equal(t, queue.StartFlowBatch, task.Type)
+
+	deferred := &models.FlowStartBatch{}
+	jsonx.MustUnmarshal(task.Task, deferred)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID}, deferred.ContactIDs())
+	assert.True(t, deferred.IsLast())
+	require.NotNil(t, deferred.DeferredUntil())
+	assert.True(t, deferred.DeferredUntil().After(now))
+}
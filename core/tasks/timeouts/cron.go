@@ -2,25 +2,23 @@ package timeouts
 
 import (
 	"context"
-	"fmt"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/tasks/handler"
 	"github.com/nyaruka/mailroom/runtime"
-	"github.com/nyaruka/redisx"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-var marker = redisx.NewIntervalSet("session_timeouts", time.Hour*24, 2)
-
 func init() {
-	mailroom.RegisterCron("sessions_timeouts", time.Second*60, false, timeoutSessions)
+	mailroom.RegisterCron("sessions_timeouts", time.Minute*15, false, timeoutSessions)
 }
 
-// timeoutRuns looks for any runs that have timed out and schedules for them to continue
+// timeoutSessions looks for any sessions that have timed out and schedules for them to continue. Timeouts are
+// normally queued by their timers so this is just a safety net for any timers which were lost.
 // TODO: extend lock
 func timeoutSessions(ctx context.Context, rt *runtime.Runtime) error {
 	log := logrus.WithField("comp", "timeout")
@@ -36,7 +34,7 @@ func timeoutSessions(ctx context.Context, rt *runtime.Runtime) error {
 	rc := rt.RP.Get()
 	defer rc.Close()
 
-	numQueued, numDupes := 0, 0
+	numQueued := 0
 
 	// add a timeout task for each run
 	timeout := &Timeout{}
@@ -46,39 +44,23 @@ func timeoutSessions(ctx context.Context, rt *runtime.Runtime) error {
 			return errors.Wrapf(err, "error scanning timeout")
 		}
 
-		// check whether we've already queued this
-		taskID := fmt.Sprintf("%d:%s", timeout.SessionID, timeout.TimeoutOn.Format(time.RFC3339))
-		queued, err := marker.Contains(rc, taskID)
-		if err != nil {
-			return errors.Wrapf(err, "error checking whether task is queued")
-		}
-
-		// already queued? move on
-		if queued {
-			numDupes++
-			continue
-		}
-
-		// ok, queue this task
-		task := handler.NewTimeoutTask(timeout.OrgID, timeout.ContactID, timeout.SessionID, timeout.TimeoutOn)
-		err = handler.QueueHandleTask(rc, timeout.ContactID, task)
-		if err != nil {
-			return errors.Wrapf(err, "error adding new handle task")
+		if err := queueTimeout(ctx, rc, timeout); err != nil {
+			return err
 		}
-
-		// and mark it as queued
-		err = marker.Add(rc, taskID)
-		if err != nil {
-			return errors.Wrapf(err, "error marking timeout task as queued")
-		}
-
 		numQueued++
 	}
 
-	log.WithField("dupes", numDupes).WithField("queued", numQueued).WithField("elapsed", time.Since(start)).Info("session timeouts queued")
+	log.WithField("queued", numQueued).WithField("elapsed", time.Since(start)).Info("session timeouts queued")
 	return nil
 }
 
+// queues a task to handle the passed in timeout, which is a no-op if it has already been queued
+func queueTimeout(ctx context.Context, rc redis.Conn, timeout *Timeout) error {
+	task := handler.NewTimeoutTask(timeout.OrgID, timeout.ContactID, timeout.SessionID, timeout.TimeoutOn)
+	err := handler.QueueHandleTask(ctx, rc, timeout.ContactID, task)
+	return errors.Wrapf(err, "error adding new handle task")
+}
+
 const timedoutSessionsSQL = `
   SELECT id as session_id, org_id, contact_id, timeout_on
     FROM flows_flowsession
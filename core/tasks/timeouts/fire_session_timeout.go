@@ -0,0 +1,57 @@
+package timeouts
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	tasks.RegisterRetriedType(queue.FireSessionTimeout, func() tasks.Task { return &FireSessionTimeoutTask{} })
+}
+
+// FireSessionTimeoutTask is our delayed task for checking whether a session's wait has timed out
+type FireSessionTimeoutTask struct {
+	models.SessionTimer
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *FireSessionTimeoutTask) Timeout() time.Duration {
+	return time.Minute
+}
+
+// Perform queues the session's timeout if it's still waiting and its timeout has passed. If its timeout has been pushed
+// back since this timer was scheduled (e.g. when courier sends the last message), the timer is rescheduled instead.
+func (t *FireSessionTimeoutTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	timeouts := make([]*Timeout, 0, 1)
+	if err := rt.DB.SelectContext(ctx, &timeouts, sqlSelectSessionTimeout, t.SessionID); err != nil {
+		return errors.Wrapf(err, "error selecting timeout of session #%d", t.SessionID)
+	}
+
+	// session is no longer waiting or no longer has a timeout
+	if len(timeouts) == 0 {
+		return nil
+	}
+
+	timeout := timeouts[0]
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if timeout.TimeoutOn.After(dates.Now()) {
+		return models.ScheduleSessionTimer(ctx, rc, queue.FireSessionTimeout, timeout.OrgID, timeout.SessionID, timeout.ContactID, timeout.TimeoutOn)
+	}
+
+	return queueTimeout(ctx, rc, timeout)
+}
+
+const sqlSelectSessionTimeout = `
+SELECT id as session_id, org_id, contact_id, timeout_on
+  FROM flows_flowsession
+ WHERE id = $1 AND status = 'W' AND timeout_on IS NOT NULL AND call_id IS NULL`
@@ -0,0 +1,71 @@
+package timeouts
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFireSessionTimeout(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	// Cathy's timeout has passed, George's has been pushed back since his timer was scheduled, and Bob's session
+	// has since ended
+	s1TimeoutOn := time.Now()
+	s1ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Cathy, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, &s1TimeoutOn)
+	s2TimeoutOn := time.Now().Add(time.Hour)
+	s2ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.George, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, &s2TimeoutOn)
+	s3TimeoutOn := time.Now()
+	s3ID := testdata.InsertWaitingSession(db, testdata.Org1, testdata.Bob, models.FlowTypeMessaging, testdata.Favorites, models.NilCallID, time.Now(), time.Now(), false, &s3TimeoutOn)
+	db.MustExec(`UPDATE flows_flowsession SET status = 'C' WHERE id = $1`, s3ID)
+
+	time.Sleep(10 * time.Millisecond)
+
+	for _, timer := range []models.SessionTimer{
+		{SessionID: s1ID, ContactID: testdata.Cathy.ID, On: s1TimeoutOn},
+		{SessionID: s2ID, ContactID: testdata.George.ID, On: s1TimeoutOn},
+		{SessionID: s3ID, ContactID: testdata.Bob.ID, On: s3TimeoutOn},
+	} {
+		task := &FireSessionTimeoutTask{SessionTimer: timer}
+		assert.NoError(t, task.Perform(ctx, rt, testdata.Org1.ID))
+	}
+
+	// should have created one task for Cathy
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.NotNil(t, task)
+
+	eventTask := &handler.HandleEventTask{}
+	err = json.Unmarshal(task.Task, eventTask)
+	assert.NoError(t, err)
+	assert.Equal(t, testdata.Cathy.ID, eventTask.ContactID)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// and rescheduled George's timer
+	delayed, err := queue.DelayedSize(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delayed)
+
+	// and our safety net doesn't queue Cathy's timeout again
+	err = timeoutSessions(ctx, rt)
+	assert.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+}
@@ -10,16 +10,21 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/nyaruka/gocommon/analytics"
 	"github.com/nyaruka/gocommon/storage"
+	"github.com/nyaruka/mailroom/core/publish"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/nyaruka/mailroom/utils/metrics"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	"github.com/nyaruka/mailroom/web"
 	"github.com/pkg/errors"
 
+	"github.com/XSAM/otelsql"
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/olivere/elastic/v7"
 	"github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 )
 
 // InitFunction is a function that will be called when mailroom starts
@@ -39,6 +44,17 @@ func RegisterCron(name string, interval time.Duration, allInstances bool, fn cro
 	})
 }
 
+// RegisterScheduledCron registers a new cron function to run on the leader instance whenever the passed in cron
+// expression matches, e.g. "0 3 * * *" for every day at 3am UTC
+func RegisterScheduledCron(name string, expression string, missed cron.Missed, fn cron.Function) {
+	schedule := cron.MustParseExpression(expression)
+
+	addInitFunction(func(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+		cron.StartSchedule(rt, wg, name, schedule, false, missed, fn, time.Minute*5, quit)
+		return nil
+	})
+}
+
 // TaskFunction is the function that will be called for a type of task
 type TaskFunction func(ctx context.Context, rt *runtime.Runtime, task *queue.Task) error
 
@@ -49,6 +65,14 @@ func AddTaskFunction(taskType string, taskFunc TaskFunction) {
 	taskFunctions[taskType] = taskFunc
 }
 
+var retriedTaskTypes = make(map[string]bool)
+
+// RetryTaskType marks a type of task as safe to retry when it fails, i.e. performing it again after a partial failure
+// won't duplicate anything. Failed tasks of other types are moved straight to the dead letter set.
+func RetryTaskType(taskType string) {
+	retriedTaskTypes[taskType] = true
+}
+
 // Mailroom is a service for handling RapidPro events
 type Mailroom struct {
 	ctx    context.Context
@@ -58,10 +82,11 @@ type Mailroom struct {
 	wg   *sync.WaitGroup
 	quit chan bool
 
-	batchForeman   *Foreman
-	handlerForeman *Foreman
+	foremen []*Foreman
 
 	webserver *web.Server
+
+	stopTracing func(context.Context) error
 }
 
 // NewMailroom creates and returns a new mailroom instance
@@ -72,8 +97,16 @@ func NewMailroom(config *runtime.Config) *Mailroom {
 		wg:   &sync.WaitGroup{},
 	}
 	mr.ctx, mr.cancel = context.WithCancel(context.Background())
-	mr.batchForeman = NewForeman(mr.rt, mr.wg, queue.BatchQueue, config.BatchWorkers)
-	mr.handlerForeman = NewForeman(mr.rt, mr.wg, queue.HandlerQueue, config.HandlerWorkers)
+
+	// route any task types which have been configured to use a specific queue
+	routes, _ := config.ParseQueueRoutes()
+	queue.SetRoutes(routes)
+	queue.SetIdempotencyWindow(time.Second * time.Duration(config.TaskIdempotency))
+
+	// and create a foreman for each of our queues
+	for _, q := range queue.Names(config) {
+		mr.foremen = append(mr.foremen, NewForeman(mr.rt, mr.wg, q, queue.Workers(config, q)))
+	}
 
 	return mr
 }
@@ -85,6 +118,14 @@ func (mr *Mailroom) Start() error {
 	log := logrus.WithFields(logrus.Fields{"state": "starting"})
 
 	var err error
+	mr.stopTracing, err = tracing.Start(c)
+	if err != nil {
+		log.WithError(err).Error("unable to start tracing")
+		mr.stopTracing = func(context.Context) error { return nil }
+	} else if c.OTLPEndpoint != "" {
+		log.Info("tracing ok")
+	}
+
 	mr.rt.DB, err = openAndCheckDBConnection(c.DB, c.DBPoolSize)
 	if err != nil {
 		log.WithError(err).Error("db not reachable")
@@ -165,6 +206,13 @@ func (mr *Mailroom) Start() error {
 		log.Info("elastic ok")
 	}
 
+	// check our event publisher exists
+	if _, err := publish.Lookup(c.EventPublisher); err != nil {
+		log.WithError(err).Error("event publisher not available")
+	} else if c.EventPublisher != "" {
+		log.Info("event publisher ok")
+	}
+
 	// warn if we won't be doing FCM syncing
 	if c.FCMKey == "" {
 		logrus.Warn("fcm not configured, no syncing of android channels")
@@ -181,9 +229,15 @@ func (mr *Mailroom) Start() error {
 
 	analytics.Start()
 
-	// init our foremen and start it
-	mr.batchForeman.Start()
-	mr.handlerForeman.Start()
+	// register our runtime with our metrics so that queue sizes and pool stats can be scraped
+	if err := metrics.RegisterRuntime(mr.rt, queue.Names(c)); err != nil {
+		log.WithError(err).Error("error registering runtime metrics")
+	}
+
+	// start our foremen
+	for _, f := range mr.foremen {
+		f.Start()
+	}
 
 	// start our web server
 	mr.webserver = web.NewServer(mr.ctx, mr.rt, mr.wg)
@@ -197,8 +251,20 @@ func (mr *Mailroom) Start() error {
 // Stop stops the mailroom service
 func (mr *Mailroom) Stop() error {
 	logrus.Info("mailroom stopping")
-	mr.batchForeman.Stop()
-	mr.handlerForeman.Stop()
+
+	drainTimeout := time.Second * time.Duration(mr.rt.Config.DrainTimeout)
+
+	// stop our foremen popping tasks and give in-flight tasks a chance to finish
+	foremenWG := &sync.WaitGroup{}
+	for _, f := range mr.foremen {
+		foremenWG.Add(1)
+		go func(f *Foreman) {
+			defer foremenWG.Done()
+			f.Stop(drainTimeout)
+		}(f)
+	}
+	foremenWG.Wait()
+
 	analytics.Stop()
 	close(mr.quit)
 	mr.cancel()
@@ -213,15 +279,28 @@ func (mr *Mailroom) Stop() error {
 		mr.rt.ES.Stop()
 	}
 
+	// flush any pending trace spans
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	if err := mr.stopTracing(ctx); err != nil {
+		logrus.WithError(err).Error("error flushing traces")
+	}
+	cancel()
+
 	logrus.Info("mailroom stopped")
 	return nil
 }
 
 func openAndCheckDBConnection(url string, maxOpenConns int) (*sqlx.DB, error) {
-	db, err := sqlx.Open("postgres", url)
+	// only trace queries which are part of a larger trace, e.g. a web request or a task
+	sqlDB, err := otelsql.Open("postgres", url,
+		otelsql.WithTracerProvider(tracing.ChildTracerProvider()),
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitRows: true, OmitConnResetSession: true, DisableErrSkip: true}),
+	)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to open database connection: '%s'", url)
 	}
+	db := sqlx.NewDb(sqlDB, "postgres")
 
 	// configure our pool
 	db.SetMaxIdleConns(8)
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/nyaruka/goflow/utils"
@@ -14,6 +15,7 @@ import (
 
 func init() {
 	utils.RegisterValidatorAlias("session_storage", "eq=db|eq=s3", func(e validator.FieldError) string { return "is not a valid session storage mode" })
+	utils.RegisterValidatorAlias("log_format", "eq=text|eq=json", func(e validator.FieldError) string { return "is not a valid log format" })
 }
 
 // Config is our top level configuration object
@@ -28,12 +30,31 @@ type Config struct {
 	Address          string `help:"the address to bind our web server to"`
 	Port             int    `help:"the port to bind our web server to"`
 	AuthToken        string `help:"the token clients will need to authenticate web requests"`
+	ScopedTokens     string `help:"comma separated list of tokens restricted to some endpoint scopes and orgs, e.g. abc123:contacts+tickets:1+2"`
+	RateLimits       string `help:"comma separated list of endpoint groups and how many requests per minute each org can make to them, e.g. search:60,simulation:120"`
 	Domain           string `help:"the domain that mailroom is listening on"`
 	AttachmentDomain string `help:"the domain that will be used for relative attachment"`
 
 	BatchWorkers         int  `help:"the number of go routines that will be used to handle batch events"`
 	HandlerWorkers       int  `help:"the number of go routines that will be used to handle messages"`
 	RetryPendingMessages bool `help:"whether to requeue pending messages older than five minutes to retry"`
+	TaskMaxRetries       int  `help:"the number of times a failed task of a type which is safe to retry will be retried before being moved to the dead letter set"`
+	TaskRetryBackoff     int  `help:"the initial backoff in milliseconds when retrying a failed task, doubled with each retry"`
+	DrainTimeout         int  `help:"the time in seconds to wait for in-flight tasks and requests to finish when stopping"`
+	TaskIdempotency      int  `help:"the time in seconds during which queuing the same work again is a no-op"`
+
+	Queues      string `help:"comma separated list of extra named queues and their number of workers, e.g. imports:2,campaigns:4"`
+	QueueRoutes string `help:"comma separated list of task types and the queue each should be added to, e.g. import_contact_batch:imports"`
+
+	AutoscaleWorkers       bool `help:"whether each queue scales its number of workers between a minimum and its configured number of workers"`
+	AutoscaleMinWorkers    int  `validate:"min=1" help:"the minimum number of workers for each queue when autoscaling"`
+	AutoscaleInterval      int  `validate:"min=1" help:"the time in seconds between adjustments of the number of workers when autoscaling"`
+	AutoscaleTargetLatency int  `help:"the age in milliseconds of the oldest queued task above which workers are added when autoscaling"`
+	AutoscaleMaxDBWait     int  `help:"the average wait in milliseconds for a database connection above which workers are removed when autoscaling"`
+
+	EventPublisher    string `help:"where to publish change events to (redis), or empty to not publish them"`
+	EventStream       string `help:"the name of the Redis stream change events are published to"`
+	EventStreamMaxLen int    `help:"the approximate maximum number of change events kept in the Redis stream, or zero for no limit"`
 
 	WebhooksTimeout              int     `help:"the timeout in milliseconds for webhook calls from engine"`
 	WebhooksMaxRetries           int     `help:"the number of times to retry a failed webhook call"`
@@ -68,8 +89,17 @@ type Config struct {
 	FCMKey            string `help:"the FCM API key used to notify Android relayers to sync"`
 	MailgunSigningKey string `help:"the signing key used to validate requests from mailgun"`
 
+	OutboxURL          string `validate:"omitempty,url" help:"the URL of an HTTP outbox to POST batches of outgoing messages to"`
+	OutboxSecret       string `                         help:"the secret used to sign batches of messages POSTed to the outbox"`
+	OutboxChannelTypes string `                         help:"comma separated list of channel types whose messages are sent via the outbox"`
+
+	OTLPEndpoint   string  `help:"the host and port of an OTLP/HTTP collector to export traces to, tracing is disabled if empty"`
+	OTLPInsecure   bool    `help:"whether to export traces to the OTLP collector without TLS"`
+	OTLPSampleRate float64 `help:"the fraction of traces which will be sampled and exported"`
+
 	InstanceName string `help:"the unique name of this instance used for analytics"`
 	LogLevel     string `help:"the logging level courier should use"`
+	LogFormat    string `validate:"omitempty,log_format" help:"the format of log lines (text|json)"`
 	UUIDSeed     int    `help:"seed to use for UUID generation in a testing environment"`
 	Version      string `help:"the version of this mailroom install"`
 }
@@ -91,6 +121,18 @@ func NewDefaultConfig() *Config {
 		BatchWorkers:         4,
 		HandlerWorkers:       32,
 		RetryPendingMessages: true,
+		TaskMaxRetries:       3,
+		TaskRetryBackoff:     10000,
+		DrainTimeout:         30,
+		TaskIdempotency:      60 * 60 * 24,
+
+		AutoscaleMinWorkers:    1,
+		AutoscaleInterval:      10,
+		AutoscaleTargetLatency: 5000,
+		AutoscaleMaxDBWait:     100,
+
+		EventStream:       "mailroom:events",
+		EventStreamMaxLen: 1000000,
 
 		WebhooksTimeout:              15000,
 		WebhooksMaxRetries:           2,
@@ -119,8 +161,11 @@ func NewDefaultConfig() *Config {
 		AWSSecretAccessKey: "",
 		AWSUseCredChain:    false,
 
+		OTLPSampleRate: 1.0,
+
 		InstanceName: hostname,
 		LogLevel:     "error",
+		LogFormat:    "text",
 		UUIDSeed:     0,
 		Version:      "Dev",
 	}
@@ -135,9 +180,195 @@ func (c *Config) Validate() error {
 	if _, _, err := c.ParseDisallowedNetworks(); err != nil {
 		return errors.Wrap(err, "unable to parse 'DisallowedNetworks'")
 	}
+
+	queues, err := c.ParseQueues()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse 'Queues'")
+	}
+	routes, err := c.ParseQueueRoutes()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse 'QueueRoutes'")
+	}
+	for taskType, queue := range routes {
+		if _, exists := queues[queue]; !exists && queue != "batch" && queue != "handler" {
+			return errors.Errorf("task type '%s' is routed to unknown queue '%s'", taskType, queue)
+		}
+	}
+
+	tokens, err := c.ParseScopedTokens()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse 'ScopedTokens'")
+	}
+	if len(tokens) > 0 && c.AuthToken == "" {
+		return errors.New("'ScopedTokens' can't be used without an 'AuthToken'")
+	}
+	if c.OutboxURL != "" && c.OutboxSecret == "" {
+		return errors.New("'OutboxURL' can't be used without an 'OutboxSecret'")
+	}
+	if _, err := c.ParseRateLimits(); err != nil {
+		return errors.Wrap(err, "unable to parse 'RateLimits'")
+	}
 	return nil
 }
 
+// ParseQueues parses the extra named queues and their number of workers
+func (c *Config) ParseQueues() (map[string]int, error) {
+	pairs, err := parseNamedValues(c.Queues)
+	if err != nil {
+		return nil, err
+	}
+
+	queues := make(map[string]int, len(pairs))
+	for name, value := range pairs {
+		if name == "batch" || name == "handler" {
+			return nil, errors.Errorf("'%s' is a reserved queue name", name)
+		}
+
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers < 1 {
+			return nil, errors.Errorf("'%s' isn't a valid number of workers for queue '%s'", value, name)
+		}
+		queues[name] = workers
+	}
+	return queues, nil
+}
+
+// ParseQueueRoutes parses the mapping of task types to the queues they should be added to
+func (c *Config) ParseQueueRoutes() (map[string]string, error) {
+	return parseNamedValues(c.QueueRoutes)
+}
+
+// TokenScopes are the groups of web endpoints which a scoped token can be restricted to
+var TokenScopes = []string{"contacts", "flows", "msgs", "tickets", "simulation"}
+
+// ScopedToken is a token which only authenticates web requests to some endpoint scopes for some orgs
+type ScopedToken struct {
+	Scopes []string
+	OrgIDs []int // empty means all orgs
+}
+
+// Allows returns whether this token allows a request to an endpoint in the passed in scope for the passed in org
+func (t *ScopedToken) Allows(scope string, orgID int) bool {
+	scopeAllowed := false
+	for _, s := range t.Scopes {
+		if s == scope {
+			scopeAllowed = true
+			break
+		}
+	}
+	if !scopeAllowed {
+		return false
+	}
+
+	if len(t.OrgIDs) == 0 {
+		return true
+	}
+	for _, id := range t.OrgIDs {
+		if id == orgID {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScopedTokens parses the scoped tokens, where each is written as token:scopes:orgs with scopes and orgs
+// separated by + and orgs being * for all orgs
+func (c *Config) ParseScopedTokens() (map[string]*ScopedToken, error) {
+	pairs, err := parseNamedValues(c.ScopedTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]*ScopedToken, len(pairs))
+	for token, value := range pairs {
+		scopes, orgs, found := strings.Cut(value, ":")
+		if !found || scopes == "" || orgs == "" {
+			return nil, errors.Errorf("couldn't parse '%s:%s' as token:scopes:orgs", token, value)
+		}
+
+		t := &ScopedToken{Scopes: strings.Split(scopes, "+")}
+		for _, scope := range t.Scopes {
+			valid := false
+			for _, s := range TokenScopes {
+				if s == scope {
+					valid = true
+				}
+			}
+			if !valid {
+				return nil, errors.Errorf("'%s' isn't a valid token scope", scope)
+			}
+		}
+
+		if orgs != "*" {
+			for _, org := range strings.Split(orgs, "+") {
+				orgID, err := strconv.Atoi(org)
+				if err != nil || orgID < 1 {
+					return nil, errors.Errorf("'%s' isn't a valid org id", org)
+				}
+				t.OrgIDs = append(t.OrgIDs, orgID)
+			}
+		}
+
+		tokens[token] = t
+	}
+	return tokens, nil
+}
+
+// RateLimitGroups are the groups of web endpoints which can be rate limited
+var RateLimitGroups = []string{"search", "simulation", "preview"}
+
+// ParseRateLimits parses the rate limits of endpoint groups as requests per minute
+func (c *Config) ParseRateLimits() (map[string]int, error) {
+	pairs, err := parseNamedValues(c.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := make(map[string]int, len(pairs))
+	for group, value := range pairs {
+		valid := false
+		for _, g := range RateLimitGroups {
+			if g == group {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, errors.Errorf("'%s' isn't a valid rate limit group", group)
+		}
+
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return nil, errors.Errorf("'%s' isn't a valid rate limit for group '%s'", value, group)
+		}
+		limits[group] = limit
+	}
+	return limits, nil
+}
+
+// parses a comma separated list of name:value pairs
+func parseNamedValues(s string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(pair, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !found || name == "" || value == "" {
+			return nil, errors.Errorf("couldn't parse '%s' as name:value", pair)
+		}
+		if _, exists := values[name]; exists {
+			return nil, errors.Errorf("'%s' is listed more than once", name)
+		}
+		values[name] = value
+	}
+
+	return values, nil
+}
+
 // ParseDisallowedNetworks parses the list of IPs and IP networks (written in CIDR notation)
 func (c *Config) ParseDisallowedNetworks() ([]net.IP, []*net.IPNet, error) {
 	addrs, err := csv.NewReader(strings.NewReader(c.DisallowedNetworks)).Read()
@@ -149,7 +149,7 @@ func Close(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, ticke
 		rc := rt.RP.Get()
 		defer rc.Close()
 
-		err = handler.QueueTicketEvent(rc, ticket.ContactID(), events[ticket])
+		err = handler.QueueTicketEvent(ctx, rc, ticket.ContactID(), events[ticket])
 		if err != nil {
 			return errors.Wrapf(err, "error queueing ticket closed event")
 		}
@@ -7,31 +7,72 @@ import (
 	"time"
 
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/metrics"
 	"github.com/nyaruka/redisx"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 // Function is the function that will be called on our schedule
 type Function func(context.Context, *runtime.Runtime) error
 
-// Start calls the passed in function every interval, making sure it acquires a
-// lock so that only one process is running at once. Note that across processes
-// crons may be called more often than duration as there is no inter-process
-// coordination of cron fires. (this might be a worthy addition)
+// how often we check whether a cron has been triggered between its scheduled fires
+const triggerPollInterval = time.Second * 5
+
+// Missed is what a cron does about fires which were missed, e.g. because no instance was running
+type Missed int
+
+const (
+	// SkipMissed makes a single fire for any number of missed fires and resumes the schedule from then
+	SkipMissed Missed = iota
+
+	// CatchUpMissed makes each missed fire in turn
+	CatchUpMissed
+)
+
+// Start calls the passed in function every interval, skipping any missed fires. See StartSchedule.
 func Start(rt *runtime.Runtime, wg *sync.WaitGroup, name string, interval time.Duration, allInstances bool, cronFunc Function, timeout time.Duration, quit chan bool) {
+	StartSchedule(rt, wg, name, Every(interval), allInstances, SkipMissed, cronFunc, timeout, quit)
+}
+
+// StartSchedule calls the passed in function on the passed in schedule. Unless the cron runs on all instances, it is
+// only run by the instance which is the elected leader, and each fire is recorded in redis so that it is made exactly
+// once across all instances, even when leadership changes. Fires which are missed, e.g. during a deploy, are either
+// skipped or caught up. We also acquire a lock whilst running so that a slow run on a previous leader doesn't overlap.
+//
+// Crons on an interval fire as soon as they are first started but crons on an expression wait for their first match.
+//
+// The status of each cron, i.e. its last run and next fire, is recorded in redis, and crons can be disabled or
+// triggered to run immediately from any instance.
+func StartSchedule(rt *runtime.Runtime, wg *sync.WaitGroup, name string, schedule Schedule, allInstances bool, missed Missed, cronFunc Function, timeout time.Duration, quit chan bool) {
 	wg.Add(1) // add ourselves to the wait group
 
 	lockName := fmt.Sprintf("lock:%s_lock", name) // for historical reasons...
+	fireKey := name
+	instance := ""
 
-	// for jobs that run on all instances, the lock key is specific to this instance
+	// for jobs that run on all instances, the lock, fires and status are specific to this instance
 	if allInstances {
 		lockName = fmt.Sprintf("%s:%s", lockName, rt.Config.InstanceName)
+		fireKey = fmt.Sprintf("%s:%s", name, rt.Config.InstanceName)
+		instance = rt.Config.InstanceName
 	}
 
 	locker := redisx.NewLocker(lockName, time.Minute*5)
 
-	wait := time.Duration(0)
-	lastFire := time.Now()
+	// when we fire if this cron has never fired before
+	firstFire := time.Now()
+	if expr, isExpr := schedule.(*Expression); isExpr {
+		firstFire = expr.Next(firstFire)
+	}
+
+	wake := firstFire
+
+	// frequent crons don't keep a history of their runs
+	history := true
+	if interval, isInterval := schedule.(intervalSchedule); isInterval && time.Duration(interval) < minHistoryInterval {
+		history = false
+	}
 
 	log := logrus.WithField("cron", name).WithField("lockName", lockName)
 
@@ -41,62 +82,243 @@ func Start(rt *runtime.Runtime, wg *sync.WaitGroup, name string, interval time.D
 			wg.Done()
 		}()
 
+		config := map[string]interface{}{"interval_seconds": 0, "all_instances": allInstances, "next_fire": firstFire}
+		if interval, isInterval := schedule.(intervalSchedule); isInterval {
+			config["interval_seconds"] = time.Duration(interval).Seconds()
+		} else if expr, isExpr := schedule.(*Expression); isExpr {
+			config["expression"] = expr.String()
+		}
+		if missed == CatchUpMissed {
+			config["catch_up"] = true
+		}
+		setStatus(rt, name, instance, config)
+
 		for {
+			wait := time.Until(wake)
+			if wait < time.Duration(0) {
+				wait = time.Duration(0)
+			} else if wait > triggerPollInterval {
+				wait = triggerPollInterval
+			}
+
 			select {
 			case <-quit:
-				// we are exiting, return so our goroutine can exit
+				// we are exiting, give up leadership so another instance can take over, and return so our goroutine can exit
+				if !allInstances {
+					resign(rt)
+				}
 				return
 
 			case <-time.After(wait):
-				lastFire = time.Now()
+				// crons which don't run on all instances are only run by the leader, and checking also renews leadership
+				if !allInstances && !elect(rt) {
+					wake = time.Now().Add(triggerPollInterval)
+					continue
+				}
+
+				triggered, disabled := checkControls(rt, name)
 
-				// try to get lock but don't retry - if lock is taken then task is still running or running on another instance
+				lastFire, err := getLastFire(rt, fireKey)
+				if err != nil {
+					log.WithError(err).Error("error getting last fire")
+					wake = time.Now().Add(triggerPollInterval)
+					continue
+				}
+
+				due := firstFire
+				if !lastFire.IsZero() {
+					due = schedule.Next(lastFire)
+				}
+
+				now := time.Now()
+				scheduled := !now.Before(due)
+				wake = due
+
+				// nothing to do until our next fire
+				if !triggered && !scheduled {
+					continue
+				}
+
+				// when skipping missed fires, we fire now and resume our schedule from now, but when catching up we fire
+				// for the time we missed, and if the fire after that has also passed, we'll make it straight after
+				fireTime := now
+				if missed == CatchUpMissed {
+					fireTime = due
+				}
+
+				if disabled && !triggered {
+					log.Debug("cron disabled, skipping")
+					if claimFire(rt, fireKey, lastFire, fireTime) {
+						wake = schedule.Next(fireTime)
+					}
+					setStatus(rt, name, instance, map[string]interface{}{"next_fire": wake})
+					continue
+				}
+
+				// try to get lock but don't retry - if lock is taken then task is still running on a previous leader
 				lock, err := locker.Grab(rt.RP, 0)
 				if err != nil {
+					wake = now.Add(triggerPollInterval)
 					break
 				}
 				log := log.WithField("lock", lock)
 
 				if lock == "" {
 					log.Debug("lock already present, sleeping")
+					setStatus(rt, name, instance, map[string]interface{}{"last_lock_missed_on": now})
+					wake = now.Add(triggerPollInterval)
 					break
 				}
 
+				// claim this fire, which will fail if another instance made it, e.g. if leadership has just changed
+				if scheduled {
+					if !claimFire(rt, fireKey, lastFire, fireTime) {
+						log.Debug("fire already made by another instance")
+						releaseLock(rt, locker, lock, log)
+						break
+					}
+					wake = schedule.Next(fireTime)
+				}
+
+				// now that we're definitely running, claim any trigger, which will fail if another instance already ran
+				// it, in which case we only run if we were due anyway
+				if triggered {
+					triggered = claimTrigger(rt, name)
+					if !triggered && !scheduled {
+						releaseLock(rt, locker, lock, log)
+						continue
+					}
+				}
+
 				// ok, got the lock, run our cron function
 				start := time.Now()
+				setStatus(rt, name, instance, map[string]interface{}{"running_since": start, "next_fire": wake})
+
 				err = fireCron(rt, cronFunc, lockName, lock)
 				if err != nil {
 					log.WithError(err).Error("error while running cron")
 				}
 				elapsed := time.Since(start)
 
-				// release our lock
-				err = locker.Release(rt.RP, lock)
-				if err != nil {
-					log.WithError(err).Error("error releasing lock")
-				}
+				metrics.RecordCron(name, err, elapsed)
+				saveRun(rt, name, instance, start, elapsed, triggered, history, err)
+
+				releaseLock(rt, locker, lock, log)
 
 				// if cron too longer than a minute, log
 				if elapsed > time.Minute {
 					logrus.WithField("cron", name).WithField("elapsed", elapsed).Error("cron took too long")
 				}
 			}
-
-			// calculate our next fire time
-			nextFire := NextFire(lastFire, interval)
-			wait = time.Until(nextFire)
-			if wait < time.Duration(0) {
-				wait = time.Duration(0)
-			}
 		}
 	}()
 }
 
+// tries to make this instance the cron leader, or renew its leadership, logging rather than returning any error
+func elect(rt *runtime.Runtime) bool {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	leader, err := Elect(rc, rt.Config.InstanceName)
+	if err != nil {
+		logrus.WithError(err).Error("error electing cron leader")
+	}
+	return leader
+}
+
+// gives up leadership if this instance is the cron leader, logging rather than returning any error
+func resign(rt *runtime.Runtime) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := Resign(rc, rt.Config.InstanceName); err != nil {
+		logrus.WithError(err).Error("error resigning cron leadership")
+	}
+}
+
+// gets when the cron with the passed in key last fired
+func getLastFire(rt *runtime.Runtime, key string) (time.Time, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	return lastFired(rc, key)
+}
+
+// claims the passed in fire of the cron with the passed in key, logging rather than returning any error
+func claimFire(rt *runtime.Runtime, key string, last, fire time.Time) bool {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	claimed, err := recordFire(rc, key, last, fire)
+	if err != nil {
+		logrus.WithField("cron", key).WithError(err).Error("error claiming cron fire")
+	}
+	return claimed
+}
+
+func releaseLock(rt *runtime.Runtime, locker *redisx.Locker, lock string, log *logrus.Entry) {
+	if err := locker.Release(rt.RP, lock); err != nil {
+		log.WithError(err).Error("error releasing lock")
+	}
+}
+
+// checks whether the cron with the passed in name has been triggered or disabled. Triggers aren't claimed here so that
+// they aren't lost if we don't end up running, e.g. because the lock is held.
+func checkControls(rt *runtime.Runtime, name string) (bool, bool) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	triggered, err := isTriggered(rc, name)
+	if err != nil {
+		logrus.WithField("cron", name).WithError(err).Error("error checking for cron trigger")
+	}
+	disabled, err := IsDisabled(rc, name)
+	if err != nil {
+		logrus.WithField("cron", name).WithError(err).Error("error checking if cron disabled")
+	}
+	return triggered, disabled
+}
+
+// claims any trigger request for the cron with the passed in name, logging rather than returning any error
+func claimTrigger(rt *runtime.Runtime, name string) bool {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	claimed, err := claimTriggerRequest(rc, name)
+	if err != nil {
+		logrus.WithField("cron", name).WithError(err).Error("error claiming cron trigger")
+	}
+	return claimed
+}
+
+// updates the status of the cron with the passed in name, logging rather than returning any error
+func setStatus(rt *runtime.Runtime, name, instance string, values map[string]interface{}) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := updateStatus(rc, name, instance, values); err != nil {
+		logrus.WithField("cron", name).WithError(err).Error("error updating cron status")
+	}
+}
+
+// records a run of the cron with the passed in name, logging rather than returning any error
+func saveRun(rt *runtime.Runtime, name, instance string, start time.Time, elapsed time.Duration, triggered, history bool, runErr error) {
+	run := &Run{Instance: rt.Config.InstanceName, StartedOn: start, ElapsedMS: elapsed.Milliseconds(), Triggered: triggered}
+	if runErr != nil {
+		run.Error = runErr.Error()
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := recordRun(rc, name, instance, run, history); err != nil {
+		logrus.WithField("cron", name).WithError(err).Error("error recording cron run")
+	}
+}
+
 // fireCron is just a wrapper around the cron function we will call for the purposes of
 // catching and logging panics
-func fireCron(rt *runtime.Runtime, cronFunc Function, lockName string, lockValue string) error {
-	log := logrus.WithField("lockValue", lockValue).WithField("func", cronFunc)
-
+func fireCron(rt *runtime.Runtime, cronFunc Function, lockName string, lockValue string) (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 	defer cancel()
 
@@ -104,7 +326,7 @@ func fireCron(rt *runtime.Runtime, cronFunc Function, lockName string, lockValue
 		// catch any panics and recover
 		panicLog := recover()
 		if panicLog != nil {
-			log.Errorf("panic running cron: %s", panicLog)
+			err = errors.Errorf("panic running cron: %s", panicLog)
 		}
 	}()
 
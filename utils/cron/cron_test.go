@@ -139,3 +139,32 @@ func TestNextFire(t *testing.T) {
 		assert.Equal(t, tc.expected, actual, "next fire mismatch for %s + %s", tc.last, tc.interval)
 	}
 }
+
+func TestMissedFires(t *testing.T) {
+	_, rt, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	// record the last fires of two crons as a second ago, as if no instance had been running since
+	lastFire := time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	_, err := rc.Do("hset", "cron:fired", "test_skip", lastFire, "test_catchup", lastFire)
+	assert.NoError(t, err)
+
+	skipped, caughtUp := 0, 0
+	wg := &sync.WaitGroup{}
+	quit := make(chan bool)
+
+	cron.StartSchedule(rt, wg, "test_skip", cron.Every(time.Millisecond*250), false, cron.SkipMissed, func(context.Context, *runtime.Runtime) error { skipped++; return nil }, time.Minute, quit)
+	cron.StartSchedule(rt, wg, "test_catchup", cron.Every(time.Millisecond*250), false, cron.CatchUpMissed, func(context.Context, *runtime.Runtime) error { caughtUp++; return nil }, time.Minute, quit)
+
+	time.Sleep(time.Millisecond * 100)
+
+	// the first cron makes a single fire for the four it missed, but the second makes each of them
+	assert.Equal(t, 1, skipped)
+	assert.Equal(t, 4, caughtUp)
+
+	close(quit)
+	wg.Wait()
+}
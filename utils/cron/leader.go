@@ -0,0 +1,57 @@
+package cron
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	leaderKey = "cron:leader"
+
+	// how long leadership lasts without being renewed, crons renew it at least every triggerPollInterval
+	leaderTTL = time.Second * 15
+)
+
+var electScript = redis.NewScript(1, `-- KEYS: [LeaderKey] ARGV: [Instance, TTL]
+	local leader = redis.call("get", KEYS[1])
+	if leader == ARGV[1] then
+		redis.call("pexpire", KEYS[1], ARGV[2])
+		return 1
+	elseif not leader then
+		redis.call("set", KEYS[1], ARGV[1], "PX", ARGV[2])
+		return 1
+	end
+	return 0
+`)
+
+var resignScript = redis.NewScript(1, `-- KEYS: [LeaderKey] ARGV: [Instance]
+	if redis.call("get", KEYS[1]) == ARGV[1] then
+		return redis.call("del", KEYS[1])
+	end
+	return 0
+`)
+
+// Elect makes the passed in instance the leader if there isn't one, or renews its leadership if it's already the
+// leader, and returns whether it's the leader. Only the leader runs crons which aren't run on all instances.
+func Elect(rc redis.Conn, instance string) (bool, error) {
+	leader, err := redis.Bool(electScript.Do(rc, leaderKey, instance, leaderTTL.Milliseconds()))
+	return leader, errors.Wrapf(err, "error electing cron leader")
+}
+
+// Resign gives up leadership if the passed in instance is the leader so that another instance can take over
+// without waiting for its leadership to expire
+func Resign(rc redis.Conn, instance string) error {
+	_, err := resignScript.Do(rc, leaderKey, instance)
+	return errors.Wrapf(err, "error resigning cron leadership")
+}
+
+// GetLeader returns the name of the instance which is currently the leader, or empty if there isn't one
+func GetLeader(rc redis.Conn) (string, error) {
+	leader, err := redis.String(rc.Do("get", leaderKey))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return leader, errors.Wrapf(err, "error getting cron leader")
+}
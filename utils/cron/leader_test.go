@@ -0,0 +1,58 @@
+package cron_test
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeader(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "cron:leader")
+
+	leader, err := cron.GetLeader(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, "", leader)
+
+	// first instance to ask becomes leader
+	elected, err := cron.Elect(rc, "mailroom1")
+	assert.NoError(t, err)
+	assert.True(t, elected)
+
+	elected, err = cron.Elect(rc, "mailroom2")
+	assert.NoError(t, err)
+	assert.False(t, elected)
+
+	// asking again renews leadership
+	elected, err = cron.Elect(rc, "mailroom1")
+	assert.NoError(t, err)
+	assert.True(t, elected)
+
+	ttl, _ := redis.Int(rc.Do("ttl", "cron:leader"))
+	assert.Equal(t, 15, ttl)
+
+	leader, err = cron.GetLeader(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, "mailroom1", leader)
+
+	// only the leader can resign
+	assert.NoError(t, cron.Resign(rc, "mailroom2"))
+
+	leader, _ = cron.GetLeader(rc)
+	assert.Equal(t, "mailroom1", leader)
+
+	assert.NoError(t, cron.Resign(rc, "mailroom1"))
+
+	leader, _ = cron.GetLeader(rc)
+	assert.Equal(t, "", leader)
+
+	// and then another instance can take over
+	elected, err = cron.Elect(rc, "mailroom2")
+	assert.NoError(t, err)
+	assert.True(t, elected)
+
+	rc.Do("del", "cron:leader")
+}
@@ -0,0 +1,195 @@
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule determines when a cron should fire
+type Schedule interface {
+	// Next returns the next time the cron should fire after the passed in time
+	Next(time.Time) time.Time
+}
+
+// Every returns a schedule which fires every interval
+func Every(interval time.Duration) Schedule {
+	return intervalSchedule(interval)
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(last time.Time) time.Time { return NextFire(last, time.Duration(s)) }
+
+// shorthands for common expressions
+var expressionMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// how far ahead we look for a time which matches an expression before giving up
+const maxExpressionSearch = time.Hour * 24 * 366 * 5
+
+// Expression is a schedule defined by a standard 5 field cron expression, i.e. minute, hour, day of month, month and
+// day of week, which is evaluated in UTC. Each field can be *, a value, a range (1-5), a step (*/15 or 0-30/10) or a
+// comma separated list of these. As with standard cron, if both day of month and day of week are restricted, a day
+// matches if either matches.
+type Expression struct {
+	source string
+
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	anyDay     bool
+	anyWeekday bool
+}
+
+// ParseExpression parses the passed in cron expression
+func ParseExpression(source string) (*Expression, error) {
+	expanded := strings.TrimSpace(source)
+	if macro, isMacro := expressionMacros[expanded]; isMacro {
+		expanded = macro
+	}
+
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("cron expression '%s' must have 5 fields", source)
+	}
+
+	e := &Expression{source: source, anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	var err error
+
+	if e.minutes, err = parseExpressionField(fields[0], 0, 59); err != nil {
+		return nil, errors.Wrapf(err, "invalid minute field in '%s'", source)
+	}
+	if e.hours, err = parseExpressionField(fields[1], 0, 23); err != nil {
+		return nil, errors.Wrapf(err, "invalid hour field in '%s'", source)
+	}
+	if e.days, err = parseExpressionField(fields[2], 1, 31); err != nil {
+		return nil, errors.Wrapf(err, "invalid day of month field in '%s'", source)
+	}
+	if e.months, err = parseExpressionField(fields[3], 1, 12); err != nil {
+		return nil, errors.Wrapf(err, "invalid month field in '%s'", source)
+	}
+	if e.weekdays, err = parseExpressionField(fields[4], 0, 7); err != nil {
+		return nil, errors.Wrapf(err, "invalid day of week field in '%s'", source)
+	}
+
+	// 7 is an alias for Sunday
+	if e.weekdays&(1<<7) != 0 {
+		e.weekdays |= 1
+	}
+
+	if e.Next(time.Now()).IsZero() {
+		return nil, errors.Errorf("cron expression '%s' never matches", source)
+	}
+
+	return e, nil
+}
+
+// MustParseExpression parses the passed in cron expression, panicking if it's invalid
+func MustParseExpression(source string) *Expression {
+	e, err := ParseExpression(source)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func (e *Expression) String() string { return e.source }
+
+// Next returns the first time after the passed in time which matches this expression, or the zero time if there
+// isn't one, e.g. for an expression like "0 0 30 2 *"
+func (e *Expression) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxExpressionSearch)
+
+	for t.Before(limit) {
+		if !has(e.months, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !e.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !has(e.hours, t.Hour()) {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !has(e.minutes, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (e *Expression) matchesDay(t time.Time) bool {
+	day, weekday := has(e.days, t.Day()), has(e.weekdays, int(t.Weekday()))
+
+	// if both are restricted then either can match
+	if !e.anyDay && !e.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+func has(bits uint64, v int) bool { return bits&(1<<uint(v)) != 0 }
+
+// parses a single field of an expression into a bit set of the values it matches
+func parseExpressionField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, errors.Errorf("invalid step '%s'", stepStr)
+			}
+		}
+
+		var start, end int
+		if rng == "*" {
+			start, end = min, max
+		} else {
+			startStr, endStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = strconv.Atoi(startStr); err != nil {
+				return 0, errors.Errorf("invalid value '%s'", startStr)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(endStr); err != nil {
+					return 0, errors.Errorf("invalid value '%s'", endStr)
+				}
+			} else if hasStep {
+				end = max // e.g. 5/15 means every 15 starting at 5
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, errors.Errorf("'%s' is outside of range %d-%d", rng, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
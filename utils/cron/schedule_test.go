@@ -0,0 +1,62 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvery(t *testing.T) {
+	s := cron.Every(time.Minute)
+	assert.Equal(t, time.Date(2000, 1, 1, 1, 2, 1, 0, time.UTC), s.Next(time.Date(2000, 1, 1, 1, 1, 4, 0, time.UTC)))
+}
+
+func TestParseExpression(t *testing.T) {
+	tcs := []struct {
+		expr     string
+		after    time.Time
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2022, 11, 9, 12, 30, 15, 0, time.UTC), time.Date(2022, 11, 9, 12, 31, 0, 0, time.UTC)},
+		{"* * * * *", time.Date(2022, 11, 9, 12, 30, 0, 0, time.UTC), time.Date(2022, 11, 9, 12, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, 11, 9, 12, 31, 0, 0, time.UTC), time.Date(2022, 11, 9, 12, 45, 0, 0, time.UTC)},
+		{"5/15 * * * *", time.Date(2022, 11, 9, 12, 51, 0, 0, time.UTC), time.Date(2022, 11, 9, 13, 5, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2022, 11, 9, 12, 30, 0, 0, time.UTC), time.Date(2022, 11, 10, 3, 0, 0, 0, time.UTC)},
+		{"30 9-17/4 * * *", time.Date(2022, 11, 9, 14, 0, 0, 0, time.UTC), time.Date(2022, 11, 9, 17, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2022, 12, 15, 0, 0, 0, 0, time.UTC), time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1,3", time.Date(2022, 11, 10, 0, 0, 0, 0, time.UTC), time.Date(2022, 11, 14, 0, 0, 0, 0, time.UTC)}, // Thursday to Monday
+		{"0 0 * * 7", time.Date(2022, 11, 10, 0, 0, 0, 0, time.UTC), time.Date(2022, 11, 13, 0, 0, 0, 0, time.UTC)},   // 7 is Sunday
+		{"0 0 13 * 5", time.Date(2022, 11, 10, 0, 0, 0, 0, time.UTC), time.Date(2022, 11, 11, 0, 0, 0, 0, time.UTC)},  // 13th or Friday
+		{"0 0 29 2 *", time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},     // leap days
+		{"@daily", time.Date(2022, 11, 9, 12, 30, 0, 0, time.UTC), time.Date(2022, 11, 10, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2022, 11, 9, 12, 30, 0, 0, time.UTC), time.Date(2022, 11, 9, 13, 0, 0, 0, time.UTC)},
+		{"0 12 * * *", time.Date(2022, 11, 9, 12, 30, 0, 0, time.FixedZone("", -3600*5)), time.Date(2022, 11, 10, 12, 0, 0, 0, time.UTC)}, // evaluated in UTC
+	}
+
+	for _, tc := range tcs {
+		expr, err := cron.ParseExpression(tc.expr)
+		assert.NoError(t, err, "unexpected error parsing %s", tc.expr)
+		assert.Equal(t, tc.expected, expr.Next(tc.after), "next fire mismatch for %s after %s", tc.expr, tc.after)
+		assert.Equal(t, tc.expr, expr.String())
+	}
+
+	errorTcs := map[string]string{
+		"* * * *":      "cron expression '* * * *' must have 5 fields",
+		"60 * * * *":   "invalid minute field in '60 * * * *': '60' is outside of range 0-59",
+		"* 5-2 * * *":  "invalid hour field in '* 5-2 * * *': '5-2' is outside of range 0-23",
+		"* * 0 * *":    "invalid day of month field in '* * 0 * *': '0' is outside of range 1-31",
+		"* * * x *":    "invalid month field in '* * * x *': invalid value 'x'",
+		"* * * * */0":  "invalid day of week field in '* * * * */0': invalid step '0'",
+		"0 0 30 2 *":   "cron expression '0 0 30 2 *' never matches",
+		"@fortnightly": "cron expression '@fortnightly' must have 5 fields",
+	}
+
+	for expr, expectedErr := range errorTcs {
+		_, err := cron.ParseExpression(expr)
+		assert.EqualError(t, err, expectedErr, "error mismatch for %s", expr)
+	}
+
+	assert.Panics(t, func() { cron.MustParseExpression("x") })
+}
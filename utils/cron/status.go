@@ -0,0 +1,259 @@
+package cron
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	statusKey      = "cron:status"
+	disabledKey    = "cron:disabled"
+	triggeredKey   = "cron:triggered"
+	firedKey       = "cron:fired"
+	historyPattern = "cron:history:%s"
+
+	// how many runs we keep in the history of each cron
+	maxHistory = 20
+
+	// crons which fire more often than this only record their last run in their status and not in their history,
+	// which would otherwise be written to every few seconds and only ever cover the last minute or so
+	minHistoryInterval = time.Minute
+)
+
+// Run is a single run of a cron
+type Run struct {
+	Instance  string    `json:"instance"`
+	StartedOn time.Time `json:"started_on"`
+	ElapsedMS int64     `json:"elapsed_ms"`
+	Triggered bool      `json:"triggered,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Status is the current status of a cron, as last recorded by any instance running it, or for a cron which runs on
+// all instances, the status of the cron on a single instance
+type Status struct {
+	Name             string     `json:"name"`
+	Instance         string     `json:"instance,omitempty"`
+	IntervalSeconds  float64    `json:"interval_seconds"`
+	Expression       string     `json:"expression,omitempty"`
+	CatchUp          bool       `json:"catch_up,omitempty"`
+	AllInstances     bool       `json:"all_instances"`
+	NextFire         time.Time  `json:"next_fire"`
+	RunningSince     *time.Time `json:"running_since"`
+	LastRun          *Run       `json:"last_run"`
+	LastLockMissedOn *time.Time `json:"last_lock_missed_on"`
+	Disabled         bool       `json:"disabled"`
+}
+
+// GetStatuses returns the statuses of all crons which have been started by any instance, sorted by name and then
+// instance for crons which run on all instances
+func GetStatuses(rc redis.Conn) ([]*Status, error) {
+	values, err := redis.StringMap(rc.Do("hgetall", statusKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading cron statuses")
+	}
+	disabled, err := redis.Strings(rc.Do("smembers", disabledKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading disabled crons")
+	}
+	isDisabled := make(map[string]bool, len(disabled))
+	for _, name := range disabled {
+		isDisabled[name] = true
+	}
+
+	statuses := make([]*Status, 0, len(values))
+	for field, value := range values {
+		status := &Status{}
+		if err := json.Unmarshal([]byte(value), status); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling status for cron %s", field)
+		}
+		status.Disabled = isDisabled[status.Name]
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Name != statuses[j].Name {
+			return statuses[i].Name < statuses[j].Name
+		}
+		return statuses[i].Instance < statuses[j].Instance
+	})
+	return statuses, nil
+}
+
+// GetStatus returns the status of the cron with the passed in name, or nil if no instance has started it. For a cron
+// which runs on all instances, an instance must be given.
+func GetStatus(rc redis.Conn, name, instance string) (*Status, error) {
+	value, err := redis.Bytes(rc.Do("hget", statusKey, statusField(name, instance)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error reading status for cron %s", name)
+	}
+
+	status := &Status{}
+	if err := json.Unmarshal(value, status); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshalling status for cron %s", name)
+	}
+
+	status.Disabled, err = IsDisabled(rc, name)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// GetHistory returns the most recent runs of the cron with the passed in name, most recent first
+func GetHistory(rc redis.Conn, name string, count int) ([]*Run, error) {
+	values, err := redis.ByteSlices(rc.Do("lrange", fmt.Sprintf(historyPattern, name), 0, count-1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading history for cron %s", name)
+	}
+
+	runs := make([]*Run, len(values))
+	for i, value := range values {
+		runs[i] = &Run{}
+		if err := json.Unmarshal(value, runs[i]); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling run for cron %s", name)
+		}
+	}
+	return runs, nil
+}
+
+// Trigger requests that the cron with the passed in name be run as soon as possible, regardless of its schedule or
+// whether it is disabled. The run is made by the first instance to notice the request.
+func Trigger(rc redis.Conn, name string) error {
+	_, err := rc.Do("sadd", triggeredKey, name)
+	return errors.Wrapf(err, "error triggering cron %s", name)
+}
+
+// Disable stops the cron with the passed in name from running on its schedule
+func Disable(rc redis.Conn, name string) error {
+	_, err := rc.Do("sadd", disabledKey, name)
+	return errors.Wrapf(err, "error disabling cron %s", name)
+}
+
+// Enable allows the cron with the passed in name to run on its schedule again
+func Enable(rc redis.Conn, name string) error {
+	_, err := rc.Do("srem", disabledKey, name)
+	return errors.Wrapf(err, "error enabling cron %s", name)
+}
+
+// IsDisabled returns whether the cron with the passed in name is disabled
+func IsDisabled(rc redis.Conn, name string) (bool, error) {
+	disabled, err := redis.Bool(rc.Do("sismember", disabledKey, name))
+	return disabled, errors.Wrapf(err, "error checking whether cron %s is disabled", name)
+}
+
+// checks for a trigger request for the cron with the passed in name without claiming it
+func isTriggered(rc redis.Conn, name string) (bool, error) {
+	triggered, err := redis.Bool(rc.Do("sismember", triggeredKey, name))
+	return triggered, errors.Wrapf(err, "error checking for trigger of cron %s", name)
+}
+
+// claims any trigger request for the cron with the passed in name, returning whether there was one
+func claimTriggerRequest(rc redis.Conn, name string) (bool, error) {
+	claimed, err := redis.Bool(rc.Do("srem", triggeredKey, name))
+	return claimed, errors.Wrapf(err, "error claiming trigger for cron %s", name)
+}
+
+// gets the field in the status hash of the cron with the passed in name, which for crons which run on all instances
+// is specific to the instance
+func statusField(name, instance string) string {
+	if instance != "" {
+		return fmt.Sprintf("%s:%s", name, instance)
+	}
+	return name
+}
+
+var updateStatusScript = redis.NewScript(1, `-- KEYS: [StatusKey] ARGV: [Field, Name1, Value1, Name2, Value2, ...]
+	local current = redis.call("hget", KEYS[1], ARGV[1])
+	local status = current and cjson.decode(current) or {}
+	for i = 2, #ARGV, 2 do
+		if ARGV[i + 1] == "null" then
+			status[ARGV[i]] = nil
+		else
+			status[ARGV[i]] = cjson.decode(ARGV[i + 1])
+		end
+	end
+	redis.call("hset", KEYS[1], ARGV[1], cjson.encode(status))
+`)
+
+// updates the passed in values of the status of the cron with the passed in name, creating it if it doesn't exist.
+// Values are merged into the status in a single step so that concurrent updates of different values aren't lost.
+func updateStatus(rc redis.Conn, name, instance string, values map[string]interface{}) error {
+	values["name"] = name
+	if instance != "" {
+		values["instance"] = instance
+	}
+
+	args := redis.Args{}.Add(statusKey, statusField(name, instance))
+	for k, v := range values {
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		args = args.Add(k, encoded)
+	}
+
+	_, err := updateStatusScript.Do(rc, args...)
+	return errors.Wrapf(err, "error writing status for cron %s", name)
+}
+
+// records a completed run of the cron with the passed in name, adding it to the history of the cron if requested
+func recordRun(rc redis.Conn, name, instance string, run *Run, history bool) error {
+	if history {
+		value, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf(historyPattern, name)
+		rc.Send("multi")
+		rc.Send("lpush", key, value)
+		rc.Send("ltrim", key, 0, maxHistory-1)
+		if _, err := rc.Do("exec"); err != nil {
+			return errors.Wrapf(err, "error recording run for cron %s", name)
+		}
+	}
+
+	return updateStatus(rc, name, instance, map[string]interface{}{"running_since": nil, "last_run": run})
+}
+
+// returns when the cron with the passed in key last fired, or the zero time if it never has
+func lastFired(rc redis.Conn, key string) (time.Time, error) {
+	value, err := redis.String(rc.Do("hget", firedKey, key))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error reading last fire of cron %s", key)
+	}
+
+	last, err := time.Parse(time.RFC3339Nano, value)
+	return last, errors.Wrapf(err, "error parsing last fire of cron %s", key)
+}
+
+var recordFireScript = redis.NewScript(1, `-- KEYS: [FiredKey] ARGV: [Key, Last, Fire]
+	local last = redis.call("hget", KEYS[1], ARGV[1])
+	if (last or "") == ARGV[2] then
+		redis.call("hset", KEYS[1], ARGV[1], ARGV[3])
+		return 1
+	end
+	return 0
+`)
+
+// records a fire of the cron with the passed in key, but only if its last fire is still the passed in time, so that
+// if two instances try to make the same fire, only one will succeed
+func recordFire(rc redis.Conn, key string, last, fire time.Time) (bool, error) {
+	lastValue := ""
+	if !last.IsZero() {
+		lastValue = last.UTC().Format(time.RFC3339Nano)
+	}
+
+	recorded, err := redis.Bool(recordFireScript.Do(rc, firedKey, key, lastValue, fire.UTC().Format(time.RFC3339Nano)))
+	return recorded, errors.Wrapf(err, "error recording fire of cron %s", key)
+}
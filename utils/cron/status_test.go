@@ -0,0 +1,144 @@
+package cron_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronStatus(t *testing.T) {
+	_, rt, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	fired := 0
+	fail := false
+	cronFunc := func(ctx context.Context, rt *runtime.Runtime) error {
+		fired++
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	}
+
+	statuses, err := cron.GetStatuses(rc)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 0)
+
+	status, err := cron.GetStatus(rc, "test", "")
+	assert.NoError(t, err)
+	assert.Nil(t, status)
+
+	wg := &sync.WaitGroup{}
+	quit := make(chan bool)
+
+	// start a cron which fires immediately and then not again for an hour
+	cron.Start(rt, wg, "test", time.Hour, false, cronFunc, time.Minute, quit)
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, 1, fired)
+
+	statuses, err = cron.GetStatuses(rc)
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "test", statuses[0].Name)
+	assert.Equal(t, float64(3600), statuses[0].IntervalSeconds)
+	assert.False(t, statuses[0].AllInstances)
+	assert.Nil(t, statuses[0].RunningSince)
+	assert.False(t, statuses[0].Disabled)
+	assert.Equal(t, rt.Config.InstanceName, statuses[0].LastRun.Instance)
+	assert.Equal(t, "", statuses[0].LastRun.Error)
+	assert.False(t, statuses[0].LastRun.Triggered)
+	assert.True(t, statuses[0].NextFire.After(time.Now().Add(time.Minute*59)))
+
+	// disabling doesn't stop it being triggered
+	require.NoError(t, cron.Disable(rc, "test"))
+	require.NoError(t, cron.Trigger(rc, "test"))
+	fail = true
+
+	time.Sleep(time.Second * 6)
+	assert.Equal(t, 2, fired)
+
+	status, err = cron.GetStatus(rc, "test", "")
+	require.NoError(t, err)
+	assert.True(t, status.Disabled)
+	assert.True(t, status.LastRun.Triggered)
+	assert.Equal(t, "boom", status.LastRun.Error)
+
+	history, err := cron.GetHistory(rc, "test", 10)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "boom", history[0].Error)
+	assert.Equal(t, "", history[1].Error)
+
+	require.NoError(t, cron.Enable(rc, "test"))
+
+	status, err = cron.GetStatus(rc, "test", "")
+	require.NoError(t, err)
+	assert.False(t, status.Disabled)
+
+	// a trigger isn't lost if the cron can't run because its lock is held
+	rc.Do("set", "lock:test_lock", "other")
+	require.NoError(t, cron.Trigger(rc, "test"))
+
+	time.Sleep(time.Second * 6)
+	assert.Equal(t, 2, fired)
+
+	rc.Do("del", "lock:test_lock")
+
+	time.Sleep(time.Second * 6)
+	assert.Equal(t, 3, fired)
+
+	// crons which fire more often than every minute record their last run but not a history
+	cron.Start(rt, wg, "test_frequent", time.Millisecond*250, false, cronFunc, time.Minute, quit)
+	time.Sleep(time.Millisecond * 600)
+
+	status, err = cron.GetStatus(rc, "test_frequent", "")
+	require.NoError(t, err)
+	assert.NotNil(t, status.LastRun)
+
+	history, err = cron.GetHistory(rc, "test_frequent", 10)
+	require.NoError(t, err)
+	assert.Len(t, history, 0)
+
+	// crons which run on all instances have a status for each instance
+	cfg1, cfg2 := *rt.Config, *rt.Config
+	cfg1.InstanceName, cfg2.InstanceName = "instance1", "instance2"
+	rt1, rt2 := *rt, *rt
+	rt1.Config, rt2.Config = &cfg1, &cfg2
+
+	cron.Start(&rt1, wg, "test_all", time.Hour, true, cronFunc, time.Minute, quit)
+	cron.Start(&rt2, wg, "test_all", time.Hour, true, cronFunc, time.Minute, quit)
+	time.Sleep(time.Millisecond * 100)
+
+	statuses, err = cron.GetStatuses(rc)
+	require.NoError(t, err)
+	require.Len(t, statuses, 4)
+	assert.Equal(t, "test", statuses[0].Name)
+	assert.Equal(t, "", statuses[0].Instance)
+	assert.Equal(t, "test_all", statuses[1].Name)
+	assert.Equal(t, "instance1", statuses[1].Instance)
+	assert.Equal(t, "instance1", statuses[1].LastRun.Instance)
+	assert.True(t, statuses[1].AllInstances)
+	assert.Equal(t, "test_all", statuses[2].Name)
+	assert.Equal(t, "instance2", statuses[2].Instance)
+	assert.Equal(t, "instance2", statuses[2].LastRun.Instance)
+	assert.Equal(t, "test_frequent", statuses[3].Name)
+
+	status, err = cron.GetStatus(rc, "test_all", "instance2")
+	require.NoError(t, err)
+	assert.Equal(t, "instance2", status.Instance)
+
+	close(quit)
+	wg.Wait()
+}
@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type contextKey int
+
+const correlationIDKey contextKey = 0
+
+// SetFormat configures the standard logger to write log lines in the passed in format, either text or json
+func SetFormat(format string) error {
+	switch format {
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("unknown log format: %s", format)
+	}
+	return nil
+}
+
+// WithCorrelationID returns a copy of the passed in context with the given correlation ID. An empty ID leaves the
+// context unchanged.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationIDKey, id)
+}
+
+// CorrelationID returns the correlation ID of the passed in context if it has one
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey).(string)
+	return id
+}
+
+// FromContext returns a log entry which includes the correlation ID of the passed in context if it has one
+func FromContext(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	if id := CorrelationID(ctx); id != "" {
+		entry = entry.WithField("correlation_id", id)
+	}
+	return entry
+}
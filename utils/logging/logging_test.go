@@ -0,0 +1,40 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/nyaruka/mailroom/utils/logging"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrelationID(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", logging.CorrelationID(ctx))
+	assert.Equal(t, ctx, logging.WithCorrelationID(ctx, ""))
+
+	ctx = logging.WithCorrelationID(ctx, "abc123")
+	assert.Equal(t, "abc123", logging.CorrelationID(ctx))
+
+	out := &bytes.Buffer{}
+	logrus.SetOutput(out)
+	defer logrus.SetOutput(os.Stderr)
+
+	require.NoError(t, logging.SetFormat("json"))
+	defer logging.SetFormat("text")
+
+	logging.FromContext(ctx).WithField("foo", "bar").Error("oops")
+
+	line := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "abc123", line["correlation_id"])
+	assert.Equal(t, "bar", line["foo"])
+	assert.Equal(t, "oops", line["msg"])
+
+	assert.EqualError(t, logging.SetFormat("xml"), "unknown log format: xml")
+}
@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mailroom"
+
+// buckets in seconds for things like tasks and crons which can take anything from milliseconds to minutes
+var longBuckets = prometheus.ExponentialBuckets(0.01, 4, 9)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	tasksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_total",
+		Help:      "the number of tasks handled by type and result",
+	}, []string{"queue", "task_type", "result"})
+
+	taskDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "task_duration_seconds",
+		Help:      "the time taken to perform tasks by type",
+		Buckets:   longBuckets,
+	}, []string{"queue", "task_type"})
+
+	taskLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "task_latency_seconds",
+		Help:      "the time between tasks being queued and completed by type",
+		Buckets:   longBuckets,
+	}, []string{"queue", "task_type"})
+
+	workers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers",
+		Help:      "the number of workers for each queue",
+	}, []string{"queue"})
+
+	cronsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "crons_total",
+		Help:      "the number of cron runs by name and result",
+	}, []string{"cron", "result"})
+
+	cronDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cron_duration_seconds",
+		Help:      "the time taken to run crons by name",
+		Buckets:   longBuckets,
+	}, []string{"cron"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "the time taken to handle web requests by route",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		tasksTotal, taskDuration, taskLatency, workers,
+		cronsTotal, cronDuration,
+		requestDuration,
+	)
+}
+
+// Handler returns an HTTP handler which serves our metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RecordTask records the handling of a task, where latency is the time since the task was queued
+func RecordTask(queueName, taskType string, err error, elapsed, latency time.Duration) {
+	tasksTotal.WithLabelValues(queueName, taskType, result(err)).Inc()
+	taskDuration.WithLabelValues(queueName, taskType).Observe(elapsed.Seconds())
+	taskLatency.WithLabelValues(queueName, taskType).Observe(latency.Seconds())
+}
+
+// SetWorkers sets the current number of workers for a queue
+func SetWorkers(queueName string, count int) {
+	workers.WithLabelValues(queueName).Set(float64(count))
+}
+
+// RecordCron records a run of a cron
+func RecordCron(name string, err error, elapsed time.Duration) {
+	cronsTotal.WithLabelValues(name, result(err)).Inc()
+	cronDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+}
+
+// RecordRequest records the handling of a web request, where route is the pattern of the matched route
+func RecordRequest(method, route string, status int, elapsed time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	requestDuration.WithLabelValues(method, route, strconv.Itoa(status)).Observe(elapsed.Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// RegisterRuntime registers collectors for the queues, database and redis pools of the passed in runtime
+func RegisterRuntime(rt *runtime.Runtime, queues []string) error {
+	cs := []prometheus.Collector{
+		&runtimeCollector{rt: rt, queues: queues},
+		collectors.NewDBStatsCollector(rt.DB.DB, "main"),
+	}
+	if rt.ReadonlyDB != rt.DB {
+		cs = append(cs, collectors.NewDBStatsCollector(rt.ReadonlyDB.DB, "readonly"))
+	}
+
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			return errors.Wrap(err, "error registering runtime metrics")
+		}
+	}
+	return nil
+}
+
+var (
+	queueSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "queue_size"),
+		"the number of tasks in each queue by state", []string{"queue", "state"}, nil,
+	)
+	redisActiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "redis", "active_connections"),
+		"the number of active connections in the redis pool", nil, nil,
+	)
+	redisIdleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "redis", "idle_connections"),
+		"the number of idle connections in the redis pool", nil, nil,
+	)
+	redisWaitCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "redis", "wait_count_total"),
+		"the total number of connections waited for in the redis pool", nil, nil,
+	)
+	redisWaitDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "redis", "wait_duration_seconds_total"),
+		"the total time spent waiting for connections in the redis pool", nil, nil,
+	)
+)
+
+// collects metrics which we read from the runtime when we are scraped
+type runtimeCollector struct {
+	rt     *runtime.Runtime
+	queues []string
+}
+
+func (c *runtimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueSizeDesc
+	ch <- redisActiveDesc
+	ch <- redisIdleDesc
+	ch <- redisWaitCountDesc
+	ch <- redisWaitDurationDesc
+}
+
+func (c *runtimeCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.rt.RP.Stats()
+	ch <- prometheus.MustNewConstMetric(redisActiveDesc, prometheus.GaugeValue, float64(stats.ActiveCount))
+	ch <- prometheus.MustNewConstMetric(redisIdleDesc, prometheus.GaugeValue, float64(stats.IdleCount))
+	ch <- prometheus.MustNewConstMetric(redisWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(redisWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+
+	rc := c.rt.RP.Get()
+	defer rc.Close()
+
+	for _, q := range c.queues {
+		sizes := make(map[string]int, 3)
+		var err error
+
+		if sizes["pending"], err = queue.Size(rc, q); err != nil {
+			ch <- prometheus.NewInvalidMetric(queueSizeDesc, err)
+			continue
+		}
+		if sizes["delayed"], err = queue.DelayedSize(rc, q); err != nil {
+			ch <- prometheus.NewInvalidMetric(queueSizeDesc, err)
+			continue
+		}
+		if sizes["dead"], err = queue.DeadSize(rc, q); err != nil {
+			ch <- prometheus.NewInvalidMetric(queueSizeDesc, err)
+			continue
+		}
+
+		for state, size := range sizes {
+			ch <- prometheus.MustNewConstMetric(queueSizeDesc, prometheus.GaugeValue, float64(size), q, state)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/utils/metrics"
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics.RecordTask("batch", "start_flow_batch", nil, time.Second, time.Second*3)
+	metrics.RecordTask("batch", "start_flow_batch", errors.New("boom"), time.Second, time.Second*3)
+	metrics.SetWorkers("handler", 12)
+	metrics.RecordCron("fire_schedules", nil, time.Millisecond*250)
+	metrics.RecordRequest("POST", "/mr/contact/create", 200, time.Millisecond*20)
+	metrics.RecordRequest("GET", "", 404, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/mr/metrics", nil))
+
+	assert.Equal(t, 200, w.Code)
+
+	body, _ := io.ReadAll(w.Body)
+	assert.Contains(t, string(body), `mailroom_tasks_total{queue="batch",result="ok",task_type="start_flow_batch"} 1`)
+	assert.Contains(t, string(body), `mailroom_tasks_total{queue="batch",result="error",task_type="start_flow_batch"} 1`)
+	assert.Contains(t, string(body), `mailroom_task_latency_seconds_count{queue="batch",task_type="start_flow_batch"} 2`)
+	assert.Contains(t, string(body), `mailroom_workers{queue="handler"} 12`)
+	assert.Contains(t, string(body), `mailroom_crons_total{cron="fire_schedules",result="ok"} 1`)
+	assert.Contains(t, string(body), `mailroom_http_request_duration_seconds_count{method="POST",route="/mr/contact/create",status="200"} 1`)
+	assert.Contains(t, string(body), `mailroom_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, string(body), `go_goroutines`)
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+var takeScript = redis.NewScript(1, `-- KEYS: [BucketKey] ARGV: [Now, Capacity, RefillInterval]
+	local now, capacity, interval = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+
+	local bucket = redis.call("hmget", KEYS[1], "tokens", "ts")
+	local tokens = tonumber(bucket[1]) or capacity
+	local ts = tonumber(bucket[2]) or now
+
+	-- refill the bucket for the time that has passed since it was last used
+	tokens = math.min(capacity, tokens + math.max(0, now - ts) / interval)
+
+	local wait = 0
+	if tokens >= 1 then
+		tokens = tokens - 1
+	else
+		wait = math.ceil((1 - tokens) * interval)
+	end
+
+	redis.call("hset", KEYS[1], "tokens", tostring(tokens), "ts", now)
+	redis.call("pexpire", KEYS[1], math.ceil(capacity * interval))
+	return wait
+`)
+
+// Take takes a token from the bucket with the passed in key, which holds up to limit tokens and is refilled at a rate
+// of limit tokens per period. If the bucket is empty, it returns how long the caller must wait until a token will be
+// available, otherwise zero.
+func Take(rc redis.Conn, key string, limit int, per time.Duration) (time.Duration, error) {
+	now := time.Now().UnixMilli()
+	interval := float64(per.Milliseconds()) / float64(limit)
+
+	wait, err := redis.Int64(takeScript.Do(rc, key, now, limit, fmt.Sprintf("%f", interval)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error taking from rate limit bucket %s", key)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,46 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/utils/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTake(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "rate_limit:test")
+
+	// bucket starts full so we can take 3 tokens straight away
+	for i := 0; i < 3; i++ {
+		wait, err := ratelimit.Take(rc, "rate_limit:test", 3, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+
+	// but then have to wait for it to refill
+	wait, err := ratelimit.Take(rc, "rate_limit:test", 3, time.Second)
+	assert.NoError(t, err)
+	assert.Greater(t, wait, time.Duration(0))
+	assert.LessOrEqual(t, wait, time.Millisecond*334)
+
+	ttl, err := redis.Int(rc.Do("pttl", "rate_limit:test"))
+	assert.NoError(t, err)
+	assert.Greater(t, ttl, 0)
+
+	time.Sleep(wait)
+
+	wait, err = ratelimit.Take(rc, "rate_limit:test", 3, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait)
+
+	// other buckets are independent
+	wait, err = ratelimit.Take(rc, "rate_limit:test2", 3, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait)
+
+	rc.Do("del", "rate_limit:test", "rate_limit:test2")
+}
@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/nyaruka/mailroom"
+
+// Start configures tracing to export spans over OTLP/HTTP to the configured collector endpoint. If no endpoint is
+// configured then spans are never recorded. Returns a function which flushes any pending spans and stops exporting.
+func Start(cfg *runtime.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.OTLPInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating OTLP trace exporter")
+	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String("mailroom"),
+		semconv.ServiceVersionKey.String(cfg.Version),
+		semconv.ServiceInstanceIDKey.String(cfg.InstanceName),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.OTLPSampleRate))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns our tracer
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// StartSpan starts a new span as a child of any span in the passed in context
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends the passed in span, recording the passed in error on it if there is one
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// OrgID returns an attribute for an org id
+func OrgID(id int64) attribute.KeyValue { return attribute.Int64("mailroom.org_id", id) }
+
+// ContactID returns an attribute for a contact id
+func ContactID(id int64) attribute.KeyValue { return attribute.Int64("mailroom.contact_id", id) }
+
+// ContactUUID returns an attribute for a contact UUID
+func ContactUUID(uuid string) attribute.KeyValue { return attribute.String("mailroom.contact_uuid", uuid) }
+
+// SessionUUID returns an attribute for a session UUID
+func SessionUUID(uuid string) attribute.KeyValue { return attribute.String("mailroom.session_uuid", uuid) }
+
+// ChildTracerProvider returns a tracer provider whose tracers only record spans which have a parent span. This
+// is used for instrumenting things like DB calls which are only meaningful as part of a larger trace.
+func ChildTracerProvider() trace.TracerProvider {
+	return childTracerProvider{}
+}
+
+type childTracerProvider struct{}
+
+func (p childTracerProvider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return childTracer{otel.Tracer(name, opts...)}
+}
+
+type childTracer struct {
+	trace.Tracer
+}
+
+func (t childTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return t.Tracer.Start(ctx, name, opts...)
+}
+
+// Conn wraps the passed in redis connection so that each command is recorded as a span in the passed in context
+func Conn(ctx context.Context, rc redis.Conn) redis.Conn {
+	return &tracedConn{Conn: rc, ctx: ctx}
+}
+
+type tracedConn struct {
+	redis.Conn
+	ctx context.Context
+}
+
+func (c *tracedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName == "" || !trace.SpanContextFromContext(c.ctx).IsValid() {
+		return c.Conn.Do(commandName, args...)
+	}
+
+	_, span := Tracer().Start(c.ctx, "redis "+commandName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemRedis,
+		semconv.DBOperationKey.String(commandName),
+	))
+
+	reply, err := c.Conn.Do(commandName, args...)
+
+	EndSpan(span, err)
+	return reply, err
+}
@@ -0,0 +1,60 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/tracing"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	// no endpoint means tracing is a no-op
+	stop, err := tracing.Start(runtime.NewDefaultConfig())
+	require.NoError(t, err)
+	assert.NoError(t, stop(context.Background()))
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	// child tracer doesn't record spans without a parent
+	_, span := tracing.ChildTracerProvider().Tracer("test").Start(context.Background(), "orphan")
+	span.End()
+	assert.Len(t, recorder.Ended(), 0)
+
+	ctx, parent := tracing.StartSpan(context.Background(), "parent", tracing.OrgID(1))
+
+	_, child := tracing.ChildTracerProvider().Tracer("test").Start(ctx, "child")
+	child.End()
+
+	// redis commands are recorded as spans too
+	rc := tracing.Conn(ctx, &testConn{})
+	_, err = rc.Do("GET", "foo")
+	assert.EqualError(t, err, "boom")
+
+	tracing.EndSpan(parent, errors.New("boom"))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "child", spans[0].Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, "redis GET", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, "parent", spans[2].Name())
+	assert.Equal(t, codes.Error, spans[2].Status().Code)
+	assert.Equal(t, "boom", spans[2].Status().Description)
+}
+
+type testConn struct {
+	redis.Conn
+}
+
+func (c *testConn) Do(string, ...interface{}) (interface{}, error) { return nil, errors.New("boom") }
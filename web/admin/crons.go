@@ -0,0 +1,188 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodGet, "/mr/admin/crons", web.RequireAuthToken(handleCrons))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/crons/inspect", web.RequireAuthToken(handleCronInspect), web.Spec(&cronInspectRequest{}, &cronInspectResponse{}))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/crons/trigger", web.RequireAuthToken(handleCronTrigger), web.Spec(&cronRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/crons/disable", web.RequireAuthToken(handleCronDisable), web.Spec(&cronRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/crons/enable", web.RequireAuthToken(handleCronEnable), web.Spec(&cronRequest{}, nil))
+}
+
+// Lists the status of every cron which has been started by any instance, where running_since is set if the cron
+// is currently running and last_lock_missed_on is the last time an instance wanted to run it but couldn't get the lock.
+// Crons which don't run on all instances are run by the leader instance, and those which do have a status for each
+// instance which includes its name. Crons on an expression rather than an interval
+// have an expression and catch_up which is whether missed fires are caught up rather than skipped.
+//
+//	{
+//	  "leader": "mailroom1",
+//	  "crons": [
+//	    {
+//	      "name": "campaign_event",
+//	      "interval_seconds": 60,
+//	      "all_instances": false,
+//	      "next_fire": "2022-11-09T12:31:01.000000Z",
+//	      "running_since": null,
+//	      "last_run": {"instance": "mailroom1", "started_on": "2022-11-09T12:30:01.000000Z", "elapsed_ms": 123},
+//	      "last_lock_missed_on": null,
+//	      "disabled": false
+//	    },
+//	    ...
+//	  ]
+//	}
+func handleCrons(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	statuses, err := cron.GetStatuses(rc)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	leader, err := cron.GetLeader(rc)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"leader": leader, "crons": statuses}, http.StatusOK, nil
+}
+
+// Request to inspect the status and recent runs of a cron. Crons which run on all instances have a status for each
+// instance so an instance must be given to inspect one of those.
+//
+//	{
+//	  "name": "campaign_event",
+//	  "count": 10
+//	}
+//
+//	{
+//	  "name": "campaign_event",
+//	  "interval_seconds": 60,
+//	  ...
+//	  "history": [{"instance": "mailroom1", "started_on": "2022-11-09T12:30:01.000000Z", "elapsed_ms": 123, "error": "boom"}, ...]
+//	}
+type cronInspectRequest struct {
+	Name     string `json:"name"      validate:"required"`
+	Instance string `json:"instance"`
+	Count    int    `json:"count"     validate:"omitempty,min=1,max=20"`
+}
+
+type cronInspectResponse struct {
+	*cron.Status
+	History []*cron.Run `json:"history"`
+}
+
+func handleCronInspect(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &cronInspectRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+	if request.Count == 0 {
+		request.Count = 10
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	status, err := cron.GetStatus(rc, request.Name, request.Instance)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if status == nil {
+		if request.Instance == "" {
+			exists, err := cronExists(rc, request.Name)
+			if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			if exists {
+				return errors.Errorf("cron %s runs on all instances, an instance is required", request.Name), http.StatusBadRequest, nil
+			}
+		}
+		return errors.Errorf("no such cron: %s", request.Name), http.StatusBadRequest, nil
+	}
+
+	history, err := cron.GetHistory(rc, request.Name, request.Count)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &cronInspectResponse{Status: status, History: history}, http.StatusOK, nil
+}
+
+// Request to trigger, disable or enable a cron. A triggered cron runs within a few seconds on the first instance to
+// notice, even if it is disabled. A disabled cron doesn't run on its schedule until it is enabled again.
+//
+//	{
+//	  "name": "campaign_event"
+//	}
+type cronRequest struct {
+	Name string `json:"name"  validate:"required"`
+}
+
+func handleCronTrigger(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return handleCronAction(ctx, rt, r, func(rc redis.Conn, name string) (interface{}, error) {
+		return map[string]interface{}{"triggered": true}, cron.Trigger(rc, name)
+	})
+}
+
+func handleCronDisable(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return handleCronAction(ctx, rt, r, func(rc redis.Conn, name string) (interface{}, error) {
+		return map[string]interface{}{"disabled": true}, cron.Disable(rc, name)
+	})
+}
+
+func handleCronEnable(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return handleCronAction(ctx, rt, r, func(rc redis.Conn, name string) (interface{}, error) {
+		return map[string]interface{}{"disabled": false}, cron.Enable(rc, name)
+	})
+}
+
+func handleCronAction(ctx context.Context, rt *runtime.Runtime, r *http.Request, action func(redis.Conn, string) (interface{}, error)) (interface{}, int, error) {
+	request := &cronRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	exists, err := cronExists(rc, request.Name)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if !exists {
+		return errors.Errorf("no such cron: %s", request.Name), http.StatusBadRequest, nil
+	}
+
+	result, err := action(rc, request.Name)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return result, http.StatusOK, nil
+}
+
+// checks whether the cron with the passed in name has been started by any instance
+func cronExists(rc redis.Conn, name string) (bool, error) {
+	statuses, err := cron.GetStatuses(rc)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range statuses {
+		if s.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,46 @@
+package admin_test
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrons(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	// record the status and history of a couple of crons as if they'd been run
+	_, err := rc.Do("hset", "cron:status",
+		"campaign_event", `{"name": "campaign_event", "interval_seconds": 60, "all_instances": false, "next_fire": "2018-07-06T12:31:01Z", "running_since": null, "last_run": {"instance": "mailroom1", "started_on": "2018-07-06T12:30:01Z", "elapsed_ms": 123}, "last_lock_missed_on": "2018-07-06T12:29:01Z"}`,
+		"analytics:mailroom1", `{"name": "analytics", "instance": "mailroom1", "interval_seconds": 60, "all_instances": true, "next_fire": "2018-07-06T12:31:01Z", "running_since": "2018-07-06T12:30:01Z", "last_run": null, "last_lock_missed_on": null}`,
+		"fire_schedules", `{"name": "fire_schedules", "interval_seconds": 0, "expression": "* * * * *", "all_instances": false, "next_fire": "2018-07-06T12:31:00Z", "running_since": null, "last_run": null, "last_lock_missed_on": null}`,
+	)
+	require.NoError(t, err)
+	_, err = rc.Do("set", "cron:leader", "mailroom1")
+	require.NoError(t, err)
+	_, err = rc.Do("rpush", "cron:history:campaign_event",
+		`{"instance": "mailroom1", "started_on": "2018-07-06T12:30:01Z", "elapsed_ms": 123}`,
+		`{"instance": "mailroom2", "started_on": "2018-07-06T12:29:01Z", "elapsed_ms": 456, "triggered": true, "error": "boom"}`,
+	)
+	require.NoError(t, err)
+
+	web.RunWebTests(t, ctx, rt, "testdata/crons.json", nil)
+
+	// check our trigger was recorded for an instance to pick up, and campaign_event was re-enabled
+	triggered, err := redis.Strings(rc.Do("smembers", "cron:triggered"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"analytics"}, triggered)
+
+	disabled, err := redis.Strings(rc.Do("smembers", "cron:disabled"))
+	require.NoError(t, err)
+	assert.Len(t, disabled, 0)
+}
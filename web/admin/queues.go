@@ -0,0 +1,427 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodGet, "/mr/admin/queues", web.RequireAuthToken(handleQueues), web.Spec(nil, &queuesResponse{}))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/inspect", web.RequireAuthToken(handleInspect), web.Spec(&inspectRequest{}, &inspectResponse{}))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/pause", web.RequireAuthToken(handlePause), web.Spec(&orgRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/resume", web.RequireAuthToken(handleResume), web.Spec(&orgRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/throttle", web.RequireAuthToken(handleThrottle), web.Spec(&throttleRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/drain", web.RequireAuthToken(handleDrain), web.Spec(&orgRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/drained/replay", web.RequireAuthToken(handleDrainedReplay), web.Spec(&drainedReplayRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/delete", web.RequireAuthToken(handleDelete), web.Spec(&orgRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/dead", web.RequireAuthToken(handleDead), web.Spec(&deadRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/dead/replay", web.RequireAuthToken(handleDeadReplay), web.Spec(&deadRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/dead/purge", web.RequireAuthToken(handleDeadPurge), web.Spec(&deadRequest{}, nil))
+}
+
+// the number of tasks we look at when calculating the age of the oldest task for an org
+const oldestSampleSize = 100
+
+// returns the names of the queues we manage
+func queueNames(rt *runtime.Runtime) []string {
+	return queue.Names(rt.Config)
+}
+
+func checkQueueName(rt *runtime.Runtime, name string) error {
+	for _, q := range queueNames(rt) {
+		if q == name {
+			return nil
+		}
+	}
+	return errors.Errorf("no such queue: %s", name)
+}
+
+type orgQueueInfo struct {
+	OrgID          int        `json:"org_id"`
+	Size           int        `json:"size"`
+	Workers        int        `json:"workers"`
+	Paused         bool       `json:"paused"`
+	Limit          int        `json:"limit"`
+	OldestQueuedOn *time.Time `json:"oldest_queued_on"`
+	OldestAge      int        `json:"oldest_age"`
+}
+
+type queueInfo struct {
+	Name    string          `json:"name"`
+	Size    int             `json:"size"`
+	Delayed int             `json:"delayed"`
+	Dead    int             `json:"dead"`
+	Orgs    []*orgQueueInfo `json:"orgs"`
+}
+
+type queuesResponse struct {
+	Queues []*queueInfo `json:"queues"`
+}
+
+// Lists the state of each of our queues and the orgs which have tasks in them, where limit is the maximum
+// number of workers the org can use at once (0 if unlimited) and oldest_age is the number of seconds since
+// the oldest task for that org was queued.
+//
+//	{
+//	  "queues": [
+//	    {
+//	      "name": "batch",
+//	      "size": 12,
+//	      "delayed": 0,
+//	      "dead": 1,
+//	      "orgs": [
+//	        {"org_id": 1, "size": 12, "workers": 2, "paused": false, "limit": 0, "oldest_queued_on": "2022-11-09T12:30:00.000000Z", "oldest_age": 45}
+//	      ]
+//	    },
+//	    ...
+//	  ]
+//	}
+func handleQueues(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	now := dates.Now()
+	queues := make([]*queueInfo, 0, 2)
+
+	for _, name := range queueNames(rt) {
+		orgs, err := queue.OrgQueues(rc, name)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading orgs for queue %s", name)
+		}
+
+		info := &queueInfo{Name: name, Orgs: make([]*orgQueueInfo, len(orgs))}
+
+		for i, org := range orgs {
+			info.Orgs[i], err = newOrgQueueInfo(rc, name, org, now)
+			if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			info.Size += org.Size
+		}
+
+		if info.Delayed, err = queue.DelayedSize(rc, name); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading delayed size of queue %s", name)
+		}
+		if info.Dead, err = queue.DeadSize(rc, name); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading dead size of queue %s", name)
+		}
+
+		queues = append(queues, info)
+	}
+
+	return &queuesResponse{Queues: queues}, http.StatusOK, nil
+}
+
+func newOrgQueueInfo(rc redis.Conn, name string, org *queue.OrgQueue, now time.Time) (*orgQueueInfo, error) {
+	info := &orgQueueInfo{OrgID: org.OrgID, Size: org.Size, Workers: org.Workers, Paused: org.Paused, Limit: org.Limit}
+
+	// tasks are ordered by priority so the oldest task may not be the first, so look at a sample of them
+	sample, err := queue.PeekTasks(rc, name, org.OrgID, oldestSampleSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading tasks for org %d in queue %s", org.OrgID, name)
+	}
+
+	for _, task := range sample {
+		if info.OldestQueuedOn == nil || task.QueuedOn.Before(*info.OldestQueuedOn) {
+			queuedOn := task.QueuedOn
+			info.OldestQueuedOn = &queuedOn
+		}
+	}
+
+	if info.OldestQueuedOn != nil {
+		info.OldestAge = int(now.Sub(*info.OldestQueuedOn) / time.Second)
+	}
+
+	return info, nil
+}
+
+// Request to inspect the pending tasks for a single org in a queue.
+//
+//	{
+//	  "queue": "batch",
+//	  "org_id": 1,
+//	  "sample_size": 10
+//	}
+//
+//	{
+//	  "org_id": 1,
+//	  "size": 12,
+//	  "workers": 2,
+//	  "paused": false,
+//	  "limit": 0,
+//	  "oldest_queued_on": "2022-11-09T12:30:00.000000Z",
+//	  "oldest_age": 45,
+//	  "types": {"start_flow_batch": 10},
+//	  "tasks": [{"type": "start_flow_batch", "org_id": 1, "task": {...}, "queued_on": "2022-11-09T12:30:00.000000Z"}, ...]
+//	}
+type inspectRequest struct {
+	Queue      string `json:"queue"        validate:"required"`
+	OrgID      int    `json:"org_id"       validate:"required"`
+	SampleSize int    `json:"sample_size"  validate:"required,min=1,max=1000"`
+}
+
+type inspectResponse struct {
+	*orgQueueInfo
+	Types map[string]int `json:"types"`
+	Tasks []*queue.Task  `json:"tasks"`
+}
+
+func handleInspect(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &inspectRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+	if err := checkQueueName(rt, request.Queue); err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	now := dates.Now()
+
+	org, err := queue.GetOrgQueue(rc, request.Queue, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading org %d in queue %s", request.OrgID, request.Queue)
+	}
+
+	info, err := newOrgQueueInfo(rc, request.Queue, org, now)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	tasks, err := queue.PeekTasks(rc, request.Queue, request.OrgID, request.SampleSize)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading tasks for org %d", request.OrgID)
+	}
+
+	types := make(map[string]int)
+	for _, task := range tasks {
+		types[task.Type]++
+	}
+
+	return &inspectResponse{orgQueueInfo: info, Types: types, Tasks: tasks}, http.StatusOK, nil
+}
+
+// Request to pause, resume, drain or delete the tasks of an org in a queue. Draining moves all pending tasks
+// to a drained set for the org from where they can be replayed, deleting discards them.
+//
+//	{
+//	  "queue": "batch",
+//	  "org_id": 1
+//	}
+type orgRequest struct {
+	Queue string `json:"queue"   validate:"required"`
+	OrgID int    `json:"org_id"  validate:"required"`
+}
+
+func handlePause(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return handleOrgAction(ctx, rt, r, func(rc redis.Conn, q string, orgID int) (interface{}, error) {
+		return map[string]interface{}{"paused": true}, queue.PauseOrg(rc, q, orgID)
+	})
+}
+
+func handleResume(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return handleOrgAction(ctx, rt, r, func(rc redis.Conn, q string, orgID int) (interface{}, error) {
+		return map[string]interface{}{"paused": false}, queue.ResumeOrg(rc, q, orgID)
+	})
+}
+
+// Request to limit the number of workers which can work on tasks for an org in a queue at once. A limit
+// of zero removes any limit.
+//
+//	{
+//	  "queue": "handler",
+//	  "org_id": 1,
+//	  "limit": 4
+//	}
+type throttleRequest struct {
+	Queue string `json:"queue"   validate:"required"`
+	OrgID int    `json:"org_id"  validate:"required"`
+	Limit int    `json:"limit"   validate:"min=0"`
+}
+
+func handleThrottle(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &throttleRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+	if err := checkQueueName(rt, request.Queue); err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := queue.SetOrgLimit(rc, request.Queue, request.OrgID, request.Limit); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error updating org %d in queue %s", request.OrgID, request.Queue)
+	}
+
+	return map[string]interface{}{"limit": request.Limit}, http.StatusOK, nil
+}
+
+func handleDrain(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return handleOrgAction(ctx, rt, r, func(rc redis.Conn, q string, orgID int) (interface{}, error) {
+		drained, err := queue.DrainOrgTasks(rc, q, orgID)
+		return map[string]interface{}{"drained": drained}, err
+	})
+}
+
+// Request to replay the drained tasks of an org in a queue back onto the queue, oldest first. A count of zero
+// replays all of them.
+//
+//	{
+//	  "queue": "batch",
+//	  "org_id": 1,
+//	  "count": 100
+//	}
+type drainedReplayRequest struct {
+	Queue string `json:"queue"   validate:"required"`
+	OrgID int    `json:"org_id"  validate:"required"`
+	Count int    `json:"count"   validate:"min=0"`
+}
+
+func handleDrainedReplay(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &drainedReplayRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+	if err := checkQueueName(rt, request.Queue); err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	replayed, err := queue.ReplayDrainedTasks(rc, request.Queue, request.OrgID, request.Count)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error replaying drained tasks of org %d in queue %s", request.OrgID, request.Queue)
+	}
+
+	remaining, err := queue.DrainedSize(rc, request.Queue, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading drained size of org %d in queue %s", request.OrgID, request.Queue)
+	}
+
+	return map[string]interface{}{"replayed": replayed, "remaining": remaining}, http.StatusOK, nil
+}
+
+func handleDelete(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return handleOrgAction(ctx, rt, r, func(rc redis.Conn, q string, orgID int) (interface{}, error) {
+		deleted, err := queue.DeleteOrgTasks(rc, q, orgID)
+		return map[string]interface{}{"deleted": deleted}, err
+	})
+}
+
+func handleOrgAction(ctx context.Context, rt *runtime.Runtime, r *http.Request, action func(redis.Conn, string, int) (interface{}, error)) (interface{}, int, error) {
+	request := &orgRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+	if err := checkQueueName(rt, request.Queue); err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	response, err := action(rc, request.Queue, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error updating org %d in queue %s", request.OrgID, request.Queue)
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// Request to list, replay or purge the tasks in the dead letter set of a queue. Offset and count are used
+// when listing and count when replaying, with the oldest tasks first.
+//
+//	{
+//	  "queue": "batch",
+//	  "offset": 0,
+//	  "count": 50
+//	}
+type deadRequest struct {
+	Queue  string `json:"queue"   validate:"required"`
+	Offset int    `json:"offset"  validate:"min=0"`
+	Count  int    `json:"count"   validate:"min=0,max=1000"`
+}
+
+func readDeadRequest(rt *runtime.Runtime, r *http.Request) (*deadRequest, error) {
+	request := &deadRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return nil, errors.Wrapf(err, "request failed validation")
+	}
+	if err := checkQueueName(rt, request.Queue); err != nil {
+		return nil, err
+	}
+	if request.Count == 0 {
+		request.Count = 50
+	}
+	return request, nil
+}
+
+func handleDead(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request, err := readDeadRequest(rt, r)
+	if err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	total, err := queue.DeadSize(rc, request.Queue)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading dead size of queue %s", request.Queue)
+	}
+
+	tasks, err := queue.DeadTasks(rc, request.Queue, request.Offset, request.Count)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error reading dead tasks of queue %s", request.Queue)
+	}
+
+	return map[string]interface{}{"total": total, "tasks": tasks}, http.StatusOK, nil
+}
+
+func handleDeadReplay(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request, err := readDeadRequest(rt, r)
+	if err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	replayed, err := queue.ReplayDeadTasks(rc, request.Queue, request.Offset, request.Count)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error replaying dead tasks of queue %s", request.Queue)
+	}
+
+	return map[string]interface{}{"replayed": replayed}, http.StatusOK, nil
+}
+
+func handleDeadPurge(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request, err := readDeadRequest(rt, r)
+	if err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	purged, err := queue.PurgeDeadTasks(rc, request.Queue)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error purging dead tasks of queue %s", request.Queue)
+	}
+
+	return map[string]interface{}{"purged": purged}, http.StatusOK, nil
+}
@@ -0,0 +1,49 @@
+package admin_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueues(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2018, 7, 6, 12, 0, 0, 0, time.UTC)))
+
+	require.NoError(t, queue.AddTask(ctx, rc, queue.BatchQueue, queue.StartFlowBatch, int(testdata.Org1.ID), map[string]int{"start_id": 1}, queue.DefaultPriority))
+	require.NoError(t, queue.AddTask(ctx, rc, queue.BatchQueue, queue.StartFlowBatch, int(testdata.Org1.ID), map[string]int{"start_id": 2}, queue.DefaultPriority))
+	require.NoError(t, queue.AddTask(ctx, rc, queue.HandlerQueue, queue.HandleContactEvent, int(testdata.Org2.ID), map[string]int{"contact_id": 3}, queue.DefaultPriority))
+
+	web.RunWebTests(t, ctx, rt, "testdata/queues.json", nil)
+}
+
+func TestDeadTasks(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2018, 7, 6, 12, 0, 0, 0, time.UTC)))
+
+	for _, startID := range []string{`{"start_id": 1}`, `{"start_id": 2}`} {
+		task := &queue.Task{Type: queue.StartFlowBatch, OrgID: int(testdata.Org1.ID), Task: []byte(startID), QueuedOn: dates.Now()}
+		require.NoError(t, queue.DeadLetterTask(rc, queue.BatchQueue, task))
+	}
+
+	web.RunWebTests(t, ctx, rt, "testdata/dead.json", nil)
+}
@@ -16,10 +16,10 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/create", web.RequireAuthToken(handleCreate))
-	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/modify", web.RequireAuthToken(handleModify))
-	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/resolve", web.RequireAuthToken(handleResolve))
-	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/interrupt", web.RequireAuthToken(handleInterrupt))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/create", web.RequireScopedAuthToken(web.ScopeContacts, handleCreate), web.Spec(&createRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/modify", web.RequireScopedAuthToken(web.ScopeContacts, handleModify), web.Spec(&modifyRequest{}, map[flows.ContactID]modifyResult{}))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/resolve", web.RequireScopedAuthToken(web.ScopeContacts, handleResolve), web.Spec(&resolveRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/interrupt", web.RequireScopedAuthToken(web.ScopeContacts, handleInterrupt), web.Spec(&interruptRequest{}, nil))
 }
 
 // Request to create a new contact.
@@ -244,7 +244,7 @@ func handleInterrupt(ctx context.Context, rt *runtime.Runtime, r *http.Request)
 		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
 	}
 
-	count, err := models.InterruptSessionsForContacts(ctx, rt.DB, []models.ContactID{request.ContactID})
+	count, err := models.InterruptSessionsForContacts(ctx, rt, request.OrgID, []models.ContactID{request.ContactID})
 	if err != nil {
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to interrupt contact")
 	}
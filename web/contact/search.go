@@ -15,8 +15,8 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/search", web.RequireAuthToken(handleSearch))
-	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/parse_query", web.RequireAuthToken(handleParseQuery))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/search", web.RequireScopedAuthToken(web.ScopeContacts, web.RateLimited(web.RateLimitSearch, handleSearch)), web.Spec(&searchRequest{}, &searchResponse{}))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/parse_query", web.RequireScopedAuthToken(web.ScopeContacts, web.RateLimited(web.RateLimitSearch, handleParseQuery)), web.Spec(&parseRequest{}, &parseResponse{}))
 }
 
 // Searches the contacts for an org
@@ -21,9 +21,16 @@ func init() {
 
 	// all slashed docs are served by our static dir
 	web.RegisterRoute(http.MethodGet, "/mr/docs/*", handleDocs)
+
+	// except our OpenAPI document which is generated from our registered routes
+	web.RegisterJSONRoute(http.MethodGet, "/mr/docs/openapi.json", handleOpenAPI)
 }
 
 func handleDocs(ctx context.Context, rt *runtime.Runtime, r *http.Request, rawW http.ResponseWriter) error {
 	docServer.ServeHTTP(rawW, r)
 	return nil
 }
+
+func handleOpenAPI(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return web.OpenAPI(rt.Config.Version), http.StatusOK, nil
+}
@@ -1,6 +1,8 @@
 package web
 
 import (
+	"time"
+
 	"github.com/nyaruka/goflow/utils"
 
 	"github.com/pkg/errors"
@@ -25,3 +27,12 @@ func NewErrorResponse(err error) *ErrorResponse {
 	}
 	return &ErrorResponse{Error: err.Error()}
 }
+
+// RateLimitError is returned as the response to a request which exceeds a rate limit
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limit exceeded, retry later"
+}
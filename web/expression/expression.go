@@ -12,7 +12,7 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/expression/migrate", web.RequireAuthToken(handleMigrate))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/expression/migrate", web.RequireAuthToken(handleMigrate), web.Spec(&migrateRequest{}, &migrateResponse{}))
 }
 
 // Migrates a legacy expression to the new flow definition specification
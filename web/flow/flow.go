@@ -18,10 +18,10 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/migrate", web.RequireAuthToken(handleMigrate))
-	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/inspect", web.RequireAuthToken(handleInspect))
-	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/clone", web.RequireAuthToken(handleClone))
-	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/change_language", web.RequireAuthToken(handleChangeLanguage))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/migrate", web.RequireScopedAuthToken(web.ScopeFlows, handleMigrate), web.Spec(&migrateRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/inspect", web.RequireScopedAuthToken(web.ScopeFlows, handleInspect), web.Spec(&inspectRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/clone", web.RequireScopedAuthToken(web.ScopeFlows, handleClone), web.Spec(&cloneRequest{}, nil))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/change_language", web.RequireScopedAuthToken(web.ScopeFlows, handleChangeLanguage), web.Spec(&changeLanguageRequest{}, nil))
 }
 
 // Migrates a flow to the latest flow specification
@@ -16,7 +16,8 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/preview_start", web.RequireAuthToken(handlePreviewStart))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/preview_start", web.RequireScopedAuthToken(web.ScopeFlows, web.RateLimited(web.RateLimitPreview, handlePreviewStart)), web.Spec(&previewStartRequest{}, &previewStartResponse{}))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/start_progress", web.RequireScopedAuthToken(web.ScopeFlows, handleStartProgress), web.Spec(&startProgressRequest{}, &models.DripProgress{}))
 }
 
 // Generates a preview of which contacts will be started in the given flow.
@@ -120,3 +121,42 @@ func handlePreviewStart(ctx context.Context, rt *runtime.Runtime, r *http.Reques
 		Metadata:  inspection,
 	}, http.StatusOK, nil
 }
+
+// Gets the progress of a flow start which is being drip fed at a rate of contacts per minute.
+//
+//	{
+//	  "org_id": 1,
+//	  "start_id": 123
+//	}
+//
+//	{
+//	  "contacts_per_minute": 80,
+//	  "total": 12000,
+//	  "processed": 4000,
+//	  "started_on": "2022-06-01T12:00:00Z",
+//	  "eta": "2022-06-02T14:30:00Z"
+//	}
+type startProgressRequest struct {
+	OrgID   models.OrgID   `json:"org_id"    validate:"required"`
+	StartID models.StartID `json:"start_id"  validate:"required"`
+}
+
+func handleStartProgress(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &startProgressRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progress, err := models.GetDripProgress(rc, models.DripKindStart, request.OrgID, int(request.StartID))
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error getting start progress")
+	}
+	if progress == nil {
+		return errors.Errorf("no progress for start: %d", request.StartID), http.StatusNotFound, nil
+	}
+
+	return progress, http.StatusOK, nil
+}
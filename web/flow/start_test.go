@@ -23,3 +23,16 @@ func TestPreviewStart(t *testing.T) {
 
 	web.RunWebTests(t, ctx, rt, "testdata/preview_start.json", nil)
 }
+
+func TestStartProgress(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	rc.Do("HSET", "drip_progress:start:1:123", "contacts_per_minute", 80, "total", 12000, "processed", 4000, "started_on", "2022-06-01T12:00:00Z", "eta", "2022-06-01T14:30:00Z")
+
+	web.RunWebTests(t, ctx, rt, "testdata/start_progress.json", nil)
+}
@@ -0,0 +1,151 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodGet, "/mr/health/live", handleLive)
+	web.RegisterJSONRoute(http.MethodGet, "/mr/health/ready", handleReady, web.Spec(nil, &readyResponse{}))
+}
+
+// how long we give all our dependency checks to complete
+const checkTimeout = time.Second * 5
+
+const (
+	statusOK      = "ok"
+	statusFailing = "failing"
+)
+
+// Returns whether this process is alive, which is always true if we're able to respond at all.
+//
+//	{
+//	  "status": "ok"
+//	}
+func handleLive(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return map[string]string{"status": statusOK}, http.StatusOK, nil
+}
+
+type checkResult struct {
+	Status    string `json:"status"`
+	Critical  bool   `json:"critical"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type readyResponse struct {
+	Status string                  `json:"status"`
+	Checks map[string]*checkResult `json:"checks"`
+}
+
+type check struct {
+	name     string
+	critical bool
+	fn       func(context.Context, *runtime.Runtime) error
+}
+
+// the dependencies we check, where we're not ready if any critical check fails
+var checks = []check{
+	{"db", true, checkDB},
+	{"readonly_db", false, checkReadonlyDB},
+	{"redis", true, checkRedis},
+	{"session_storage", true, checkSessionStorage},
+	{"attachment_storage", false, checkAttachmentStorage},
+	{"elastic", false, checkElastic},
+}
+
+// Returns whether this process is ready to handle requests and tasks, by checking each of its dependencies. If any
+// of the DB, Redis or session storage can't be reached then the status will be 503.
+//
+//	{
+//	  "status": "ok",
+//	  "checks": {
+//	    "db": {"status": "ok", "critical": true, "latency_ms": 2},
+//	    "elastic": {"status": "failing", "critical": false, "latency_ms": 5000, "error": "context deadline exceeded"},
+//	    ...
+//	  }
+//	}
+func handleReady(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	resp := &readyResponse{Status: statusOK, Checks: make(map[string]*checkResult, len(checks))}
+
+	for _, c := range checks {
+		start := dates.Now()
+		err := c.fn(ctx, rt)
+
+		result := &checkResult{Status: statusOK, Critical: c.critical, LatencyMS: dates.Since(start).Milliseconds()}
+		if err != nil {
+			result.Status = statusFailing
+			result.Error = err.Error()
+
+			if c.critical {
+				resp.Status = statusFailing
+			}
+		}
+		resp.Checks[c.name] = result
+	}
+
+	if resp.Status != statusOK {
+		return resp, http.StatusServiceUnavailable, nil
+	}
+	return resp, http.StatusOK, nil
+}
+
+func checkDB(ctx context.Context, rt *runtime.Runtime) error {
+	if rt.DB == nil {
+		return errors.New("not connected")
+	}
+	return rt.DB.PingContext(ctx)
+}
+
+func checkReadonlyDB(ctx context.Context, rt *runtime.Runtime) error {
+	if rt.ReadonlyDB == nil {
+		return errors.New("not connected")
+	}
+	return rt.ReadonlyDB.PingContext(ctx)
+}
+
+func checkRedis(ctx context.Context, rt *runtime.Runtime) error {
+	if rt.RP == nil {
+		return errors.New("not connected")
+	}
+
+	rc, err := rt.RP.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = redis.DoWithTimeout(rc, checkTimeout, "PING")
+	return err
+}
+
+func checkSessionStorage(ctx context.Context, rt *runtime.Runtime) error {
+	// if we're not writing sessions to storage then we don't depend on it
+	if rt.Config.SessionStorage != "s3" {
+		return nil
+	}
+	return rt.SessionStorage.Test(ctx)
+}
+
+func checkAttachmentStorage(ctx context.Context, rt *runtime.Runtime) error {
+	return rt.AttachmentStorage.Test(ctx)
+}
+
+func checkElastic(ctx context.Context, rt *runtime.Runtime) error {
+	if rt.ES == nil {
+		return errors.New("not connected")
+	}
+	_, err := rt.ES.ClusterHealth().Do(ctx)
+	return err
+}
@@ -0,0 +1,21 @@
+package health_test
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestHealth(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	web.RunWebTests(t, ctx, rt, "testdata/health.json", nil)
+
+	// swap out our redis pool for one which can't connect
+	rt2 := *rt
+	rt2.RP = &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", "127.0.0.1:1") }}
+
+	web.RunWebTests(t, ctx, &rt2, "testdata/health_failing.json", nil)
+}
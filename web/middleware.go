@@ -8,10 +8,27 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/nyaruka/mailroom/utils/logging"
+	"github.com/nyaruka/mailroom/utils/metrics"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// sets the ID of each request as the correlation ID of its context so that it's carried into any tasks it queues
+func requestCorrelator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := logging.WithCorrelationID(r.Context(), middleware.GetReqID(r.Context()))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func requestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
@@ -28,8 +45,10 @@ func requestLogger(next http.Handler) http.Handler {
 		uri := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.RequestURI)
 		ww.Header().Set("X-Elapsed-NS", strconv.FormatInt(int64(elapsed), 10))
 
+		metrics.RecordRequest(r.Method, chi.RouteContext(r.Context()).RoutePattern(), ww.Status(), elapsed)
+
 		if r.RequestURI != "/" {
-			log.WithFields(log.Fields{
+			logging.FromContext(r.Context()).WithFields(log.Fields{
 				"method":     r.Method,
 				"status":     ww.Status(),
 				"elapsed":    elapsed,
@@ -41,6 +60,31 @@ func requestLogger(next http.Handler) http.Handler {
 	})
 }
 
+// starts a server span for each request, continuing any trace propagated by the caller, and names it after the
+// matched route once that's known
+func requestTracer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPTargetKey.String(r.RequestURI),
+		))
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRouteKey.String(route))
+		}
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(ww.Status()))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(ww.Status(), trace.SpanKindServer))
+	})
+}
+
 // recovers from panics, logs them to sentry and returns an HTTP 500 response
 func panicRecovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,98 @@
+package msg
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/msg/broadcast_variant_stats", web.RequireScopedAuthToken(web.ScopeMsgs, handleBroadcastVariantStats), web.Spec(&variantStatsRequest{}, &variantStatsResponse{}))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/msg/broadcast_progress", web.RequireScopedAuthToken(web.ScopeMsgs, handleBroadcastProgress), web.Spec(&broadcastProgressRequest{}, &models.DripProgress{}))
+}
+
+// Request for the per-variant stats of a broadcast.
+//
+//	{
+//	  "org_id": 1,
+//	  "broadcast_id": 123
+//	}
+type variantStatsRequest struct {
+	OrgID       models.OrgID       `json:"org_id"        validate:"required"`
+	BroadcastID models.BroadcastID `json:"broadcast_id"  validate:"required"`
+}
+
+// Response with the number of messages sent and the number of contacts who responded for each variant.
+//
+//	{
+//	  "variants": {
+//	    "A": {"sent": 120, "responded": 34},
+//	    "B": {"sent": 118, "responded": 41}
+//	  }
+//	}
+type variantStatsResponse struct {
+	Variants map[string]*models.BroadcastVariantStats `json:"variants"`
+}
+
+// handles a request for the variant stats of a broadcast
+func handleBroadcastVariantStats(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &variantStatsRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	stats, err := models.GetBroadcastVariantStats(rc, request.OrgID, request.BroadcastID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error getting broadcast variant stats")
+	}
+
+	return &variantStatsResponse{Variants: stats}, http.StatusOK, nil
+}
+
+// Request for the progress of a broadcast which is being drip fed at a rate of contacts per minute.
+//
+//	{
+//	  "org_id": 1,
+//	  "broadcast_id": 123
+//	}
+//
+//	{
+//	  "contacts_per_minute": 80,
+//	  "total": 12000,
+//	  "processed": 4000,
+//	  "started_on": "2022-06-01T12:00:00Z",
+//	  "eta": "2022-06-02T14:30:00Z"
+//	}
+type broadcastProgressRequest struct {
+	OrgID       models.OrgID       `json:"org_id"        validate:"required"`
+	BroadcastID models.BroadcastID `json:"broadcast_id"  validate:"required"`
+}
+
+// handles a request for the progress of a drip fed broadcast
+func handleBroadcastProgress(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &broadcastProgressRequest{}
+	if err := web.ReadAndValidateJSON(r, request); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progress, err := models.GetDripProgress(rc, models.DripKindBroadcast, request.OrgID, int(request.BroadcastID))
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error getting broadcast progress")
+	}
+	if progress == nil {
+		return errors.Errorf("no progress for broadcast: %d", request.BroadcastID), http.StatusNotFound, nil
+	}
+
+	return progress, http.StatusOK, nil
+}
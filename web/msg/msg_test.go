@@ -28,3 +28,29 @@ func TestServer(t *testing.T) {
 		"george_msgout_id": fmt.Sprintf("%d", georgeOut.ID()),
 	})
 }
+
+func TestBroadcastVariantStats(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	rc.Do("HSET", "broadcast_variant_stats:1:123", "A:sent", 120, "A:responded", 34, "B:sent", 118)
+
+	web.RunWebTests(t, ctx, rt, "testdata/broadcast_variant_stats.json", nil)
+}
+
+func TestBroadcastProgress(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	rc.Do("HSET", "drip_progress:broadcast:1:123", "contacts_per_minute", 80, "total", 12000, "processed", 4000, "started_on", "2022-06-01T12:00:00Z", "eta", "2022-06-01T14:30:00Z")
+
+	web.RunWebTests(t, ctx, rt, "testdata/broadcast_progress.json", nil)
+}
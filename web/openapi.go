@@ -0,0 +1,403 @@
+package web
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RouteSpec describes the request and response bodies of a JSON route so that it can be included in our OpenAPI
+// document
+type RouteSpec struct {
+	Request  interface{}
+	Response interface{}
+}
+
+// Spec creates a new route spec from example values of the request and response types, either of which can be nil
+func Spec(request, response interface{}) *RouteSpec {
+	return &RouteSpec{Request: request, Response: response}
+}
+
+// OpenAPIDocument is an OpenAPI 3 document describing our JSON routes
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIComponents struct {
+	SecuritySchemes map[string]*OpenAPISecurityScheme `json:"securitySchemes"`
+}
+
+type OpenAPISecurityScheme struct {
+	Type string `json:"type"`
+	In   string `json:"in"`
+	Name string `json:"name"`
+}
+
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]*OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is the subset of OpenAPI schemas which we generate from Go types. An empty schema matches any value.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// OpenAPI builds an OpenAPI document from all registered JSON routes
+func OpenAPI(version string) *OpenAPIDocument {
+	return buildOpenAPI(version, jsonRoutes)
+}
+
+func buildOpenAPI(version string, routes []*jsonRoute) *OpenAPIDocument {
+	errorSchema := SchemaOf(&ErrorResponse{})
+
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "Mailroom", Version: version},
+		Paths:   make(map[string]map[string]*OpenAPIOperation),
+		Components: OpenAPIComponents{
+			SecuritySchemes: map[string]*OpenAPISecurityScheme{"token": {Type: "apiKey", In: "header", Name: "Authorization"}},
+		},
+		Security: []map[string][]string{{"token": {}}},
+	}
+
+	for _, route := range routes {
+		path, params := openAPIPath(route.pattern)
+		if strings.Contains(path, "*") {
+			continue
+		}
+
+		op := &OpenAPIOperation{
+			OperationID: openAPIOperationID(route.method, path),
+			Tags:        openAPITags(path),
+			Responses: map[string]*OpenAPIResponse{
+				"200":     {Description: "success", Content: jsonContent(&Schema{})},
+				"default": {Description: "error", Content: jsonContent(errorSchema)},
+			},
+		}
+		for _, p := range params {
+			op.Parameters = append(op.Parameters, &OpenAPIParameter{Name: p, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+		if route.spec != nil && route.spec.Request != nil {
+			op.RequestBody = &OpenAPIRequestBody{Required: true, Content: jsonContent(SchemaOf(route.spec.Request))}
+		}
+		if route.spec != nil && route.spec.Response != nil {
+			op.Responses["200"].Content = jsonContent(SchemaOf(route.spec.Response))
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*OpenAPIOperation)
+		}
+		doc.Paths[path][strings.ToLower(route.method)] = op
+	}
+
+	return doc
+}
+
+// ValidateRequestBody validates the passed in body of a request to a JSON route against the schema of that route's
+// request in our OpenAPI document. Requests to routes without a documented request are always valid.
+func ValidateRequestBody(method, path string, body []byte) error {
+	return validateRequestBody(jsonRoutes, method, path, body)
+}
+
+func validateRequestBody(routes []*jsonRoute, method, path string, body []byte) error {
+	path, _, _ = strings.Cut(path, "?")
+
+	for _, route := range routes {
+		pattern, _ := openAPIPath(route.pattern)
+		if route.method != method || !matchesOpenAPIPath(pattern, path) {
+			continue
+		}
+		if route.spec == nil || route.spec.Request == nil {
+			return nil
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			return errors.Wrapf(err, "request body to %s %s isn't valid JSON", method, path)
+		}
+		return errors.Wrapf(SchemaOf(route.spec.Request).Validate(value, ""), "request body to %s %s doesn't match spec", method, path)
+	}
+	return nil
+}
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// SchemaOf generates a schema for the type of the passed in value from its JSON and validation tags
+func SchemaOf(v interface{}) *Schema {
+	s := schemaOfType(reflect.TypeOf(v), map[reflect.Type]bool{})
+	s.Nullable = false
+	return s
+}
+
+func schemaOfType(t reflect.Type, visiting map[reflect.Type]bool) *Schema {
+	if t.Kind() == reflect.Ptr {
+		s := schemaOfType(t.Elem(), visiting)
+		s.Nullable = s.Type != ""
+		return s
+	}
+
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	// types which unmarshal themselves from something other than their kind can be anything
+	customJSON := reflect.PtrTo(t).Implements(jsonUnmarshalerType)
+	if customJSON && (t.Kind() == reflect.Struct || t.Kind() == reflect.Slice || t.Kind() == reflect.Interface) {
+		return &Schema{}
+	}
+	if !customJSON && reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return &Schema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Nullable: t.Kind() == reflect.Slice, Items: schemaOfType(t.Elem(), visiting)}
+	case reflect.Map:
+		return &Schema{Type: "object", Nullable: true, AdditionalProperties: schemaOfType(t.Elem(), visiting)}
+	case reflect.Struct:
+		// recursive types are documented as anything below their first occurrence
+		if visiting[t] {
+			return &Schema{}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		addStructFields(s, t, visiting)
+		sort.Strings(s.Required)
+		return s
+	}
+
+	// interfaces and anything else we can't describe
+	return &Schema{}
+}
+
+func addStructFields(s *Schema, t reflect.Type, visiting map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+
+		// fields of embedded structs are promoted to the parent
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addStructFields(s, f.Type, visiting)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s.Properties[name] = schemaOfType(f.Type, visiting)
+
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			if rule == "required" {
+				s.Required = append(s.Required, name)
+			}
+		}
+	}
+}
+
+// Validate checks that the passed in decoded JSON value matches this schema
+func (s *Schema) Validate(value interface{}, path string) error {
+	// like the Go JSON decoder, we accept null for anything
+	if value == nil || s.Type == "" {
+		return nil
+	}
+
+	switch s.Type {
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return errors.Errorf("%s should be a boolean", describePath(path))
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return errors.Errorf("%s should be an integer", describePath(path))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return errors.Errorf("%s should be a number", describePath(path))
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return errors.Errorf("%s should be a string", describePath(path))
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return errors.Errorf("%s should be an array", describePath(path))
+		}
+		for i, item := range items {
+			if err := s.Items.Validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("%s should be an object", describePath(path))
+		}
+		for _, name := range s.Required {
+			if _, present := obj[name]; !present {
+				return errors.Errorf("%s is required", describePath(joinPath(path, name)))
+			}
+		}
+		for name, v := range obj {
+			prop := s.Properties[name]
+			if prop == nil {
+				prop = s.AdditionalProperties
+			}
+			if prop != nil {
+				if err := prop.Validate(v, joinPath(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "body"
+	}
+	return fmt.Sprintf("'%s'", path)
+}
+
+func jsonContent(s *Schema) map[string]*OpenAPIMediaType {
+	return map[string]*OpenAPIMediaType{"application/json": {Schema: s}}
+}
+
+// converts a chi route pattern like /foo/{uuid:[0-9a-f]{8}} to an OpenAPI path like /foo/{uuid} and its parameters
+func openAPIPath(pattern string) (string, []string) {
+	var b strings.Builder
+	var params []string
+
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '{' {
+			b.WriteByte(pattern[i])
+			continue
+		}
+
+		// find the matching close brace, allowing for braces in the param's regex
+		depth, end := 0, i
+		for ; end < len(pattern); end++ {
+			if pattern[end] == '{' {
+				depth++
+			} else if pattern[end] == '}' {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+
+		name, _, _ := strings.Cut(pattern[i+1:end], ":")
+		params = append(params, name)
+		b.WriteString("{" + name + "}")
+		i = end
+	}
+	return b.String(), params
+}
+
+func matchesOpenAPIPath(pattern, path string) bool {
+	patternParts, pathParts := strings.Split(pattern, "/"), strings.Split(path, "/")
+	if len(patternParts) != len(pathParts) {
+		return false
+	}
+	for i := range patternParts {
+		if !strings.HasPrefix(patternParts[i], "{") && patternParts[i] != pathParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// generates an operation id like contact_search from a path like /mr/contact/search
+func openAPIOperationID(method, path string) string {
+	id := strings.Trim(strings.TrimPrefix(path, "/mr"), "/")
+	id = strings.NewReplacer("/", "_", "{", "", "}", "").Replace(id)
+	if method != "POST" {
+		id = strings.ToLower(method) + "_" + id
+	}
+	return id
+}
+
+// tags each operation with the group of endpoints it belongs to, e.g. contact for /mr/contact/search
+func openAPITags(path string) []string {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/mr"), "/"), "/")
+	if parts[0] == "" {
+		return nil
+	}
+	return []string{parts[0]}
+}
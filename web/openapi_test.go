@@ -0,0 +1,116 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/stretchr/testify/assert"
+)
+
+type testThing struct {
+	Name string `json:"name"`
+}
+
+type testRequest struct {
+	testBase
+	Query     string            `json:"query"      validate:"required"`
+	PageSize  int               `json:"page_size"`
+	Things    []*testThing      `json:"things"`
+	Extra     map[string]int    `json:"extra"`
+	Trigger   json.RawMessage   `json:"trigger"`
+	CreatedOn time.Time         `json:"created_on"`
+	Ignored   string            `json:"-"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type testBase struct {
+	OrgID int `json:"org_id" validate:"required"`
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := SchemaOf(&testRequest{})
+
+	assert.Equal(t, "object", s.Type)
+	assert.False(t, s.Nullable)
+	assert.Equal(t, []string{"org_id", "query"}, s.Required)
+	assert.Equal(t, []string{"created_on", "extra", "labels", "org_id", "page_size", "query", "things", "trigger"}, keys(s.Properties))
+	assert.Equal(t, &Schema{Type: "integer"}, s.Properties["org_id"])
+	assert.Equal(t, &Schema{Type: "string", Format: "date-time"}, s.Properties["created_on"])
+	assert.Equal(t, &Schema{}, s.Properties["trigger"])
+	assert.Equal(t, &Schema{Type: "object", Nullable: true, AdditionalProperties: &Schema{Type: "integer"}}, s.Properties["extra"])
+	assert.Equal(t, &Schema{
+		Type:     "array",
+		Nullable: true,
+		Items:    &Schema{Type: "object", Nullable: true, Properties: map[string]*Schema{"name": {Type: "string"}}},
+	}, s.Properties["things"])
+
+	tcs := []struct {
+		body string
+		err  string
+	}{
+		{`{"org_id": 1, "query": "age > 10"}`, ""},
+		{`{"org_id": 1, "query": "age > 10", "things": [{"name": "Bob"}], "extra": {"a": 1}, "trigger": [1, "x"], "other": true}`, ""},
+		{`{"org_id": 1, "query": "age > 10", "things": null, "page_size": null}`, ""},
+		{`{"query": "age > 10"}`, "'org_id' is required"},
+		{`{"org_id": 1.5, "query": "age > 10"}`, "'org_id' should be an integer"},
+		{`{"org_id": 1, "query": "age > 10", "things": [{"name": 3}]}`, "'things[0].name' should be a string"},
+		{`{"org_id": 1, "query": "age > 10", "extra": {"a": "b"}}`, "'extra.a' should be an integer"},
+		{`[]`, "body should be an object"},
+	}
+
+	for _, tc := range tcs {
+		var value interface{}
+		json.Unmarshal([]byte(tc.body), &value)
+
+		err := s.Validate(value, "")
+		if tc.err == "" {
+			assert.NoError(t, err, "unexpected error for %s", tc.body)
+		} else {
+			assert.EqualError(t, err, tc.err, "error mismatch for %s", tc.body)
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	handler := func(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+		return nil, http.StatusOK, nil
+	}
+	routes := []*jsonRoute{
+		{method: http.MethodPost, pattern: "/mr/test/search", handler: handler, spec: Spec(&testRequest{}, &testThing{})},
+		{method: http.MethodGet, pattern: "/mr/test/{uuid:[0-9a-f]{8}}/status", handler: handler},
+	}
+
+	doc := buildOpenAPI("1.2.3", routes)
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	assert.Equal(t, "1.2.3", doc.Info.Version)
+
+	search := doc.Paths["/mr/test/search"]["post"]
+	assert.Equal(t, "test_search", search.OperationID)
+	assert.Equal(t, []string{"test"}, search.Tags)
+	assert.Equal(t, SchemaOf(&testRequest{}), search.RequestBody.Content["application/json"].Schema)
+	assert.Equal(t, SchemaOf(&testThing{}), search.Responses["200"].Content["application/json"].Schema)
+
+	status := doc.Paths["/mr/test/{uuid}/status"]["get"]
+	assert.Equal(t, "get_test_uuid_status", status.OperationID)
+	assert.Nil(t, status.RequestBody)
+	assert.Equal(t, []*OpenAPIParameter{{Name: "uuid", In: "path", Required: true, Schema: &Schema{Type: "string"}}}, status.Parameters)
+
+	assert.NoError(t, validateRequestBody(routes, "POST", "/mr/test/search?foo=bar", []byte(`{"org_id": 1, "query": "x"}`)))
+	assert.EqualError(t, validateRequestBody(routes, "POST", "/mr/test/search", []byte(`{"org_id": 1}`)), "request body to POST /mr/test/search doesn't match spec: 'query' is required")
+	assert.NoError(t, validateRequestBody(routes, "GET", "/mr/test/1234abcd/status", []byte(`{"foo": 1}`)))
+	assert.NoError(t, validateRequestBody(routes, "POST", "/mr/unknown", []byte(`{}`)))
+}
+
+func keys(m map[string]*Schema) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
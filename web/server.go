@@ -4,6 +4,7 @@ import (
 	"compress/flate"
 	"context"
 	"fmt"
+	"math"
 	"net/http"
 	"sync"
 	"time"
@@ -12,6 +13,8 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/logging"
+	"github.com/nyaruka/mailroom/utils/metrics"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -34,6 +37,7 @@ type jsonRoute struct {
 	method  string
 	pattern string
 	handler JSONHandler
+	spec    *RouteSpec
 }
 
 var jsonRoutes = make([]*jsonRoute, 0)
@@ -46,8 +50,13 @@ type route struct {
 
 var routes = make([]*route, 0)
 
-func RegisterJSONRoute(method string, pattern string, handler JSONHandler) {
-	jsonRoutes = append(jsonRoutes, &jsonRoute{method, pattern, handler})
+// RegisterJSONRoute registers a JSON route, optionally with a spec of its request and response for our OpenAPI document
+func RegisterJSONRoute(method string, pattern string, handler JSONHandler, spec ...*RouteSpec) {
+	route := &jsonRoute{method: method, pattern: pattern, handler: handler}
+	if len(spec) > 0 {
+		route.spec = spec[0]
+	}
+	jsonRoutes = append(jsonRoutes, route)
 }
 
 func RegisterRoute(method string, pattern string, handler Handler) {
@@ -58,21 +67,29 @@ func RegisterRoute(method string, pattern string, handler Handler) {
 func NewServer(ctx context.Context, rt *runtime.Runtime, wg *sync.WaitGroup) *Server {
 	s := &Server{ctx: ctx, rt: rt, wg: wg}
 
+	// parse our scoped tokens up front rather than on the first request which needs them
+	if _, err := scopedTokens(rt.Config); err != nil {
+		logrus.WithError(err).Error("error parsing scoped tokens")
+	}
+
 	router := chi.NewRouter()
 
 	//  set up our middlewares
 	router.Use(middleware.Compress(flate.DefaultCompression))
 	router.Use(middleware.RequestID)
+	router.Use(requestCorrelator)
 	router.Use(middleware.RealIP)
 	router.Use(panicRecovery)
 	router.Use(middleware.Timeout(60 * time.Second))
 	router.Use(requestLogger)
+	router.Use(requestTracer)
 
 	// wire up our main pages
 	router.NotFound(s.WrapJSONHandler(handle404))
 	router.MethodNotAllowed(s.WrapJSONHandler(handle405))
 	router.Get("/", s.WrapJSONHandler(handleIndex))
 	router.Get("/mr/", s.WrapJSONHandler(handleIndex))
+	router.Get("/mr/metrics", s.WrapHandler(handleMetrics))
 
 	// add any registered json routes
 	for _, route := range jsonRoutes {
@@ -111,18 +128,23 @@ func (s *Server) WrapJSONHandler(handler JSONHandler) http.HandlerFunc {
 			if isError {
 				value = NewErrorResponse(asError)
 			}
+
+			// let rate limited clients know when they can try again
+			if rateLimited, isRateLimited := asError.(*RateLimitError); isRateLimited {
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(rateLimited.RetryAfter.Seconds()))))
+			}
 		}
 
 		serialized, serr := jsonx.MarshalPretty(value)
 		if serr != nil {
-			logrus.WithError(err).WithField("http_request", r).Error("error serializing handler response")
+			logging.FromContext(r.Context()).WithError(err).WithField("http_request", r).Error("error serializing handler response")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(`{"error": "error serializing handler response"}`))
 			return
 		}
 
 		if err != nil {
-			logrus.WithError(err).WithField("http_request", r).Error("error handling request")
+			logging.FromContext(r.Context()).WithError(err).WithField("http_request", r).Error("error handling request")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write(serialized)
 			return
@@ -141,7 +163,7 @@ func (s *Server) WrapHandler(handler Handler) http.HandlerFunc {
 			return
 		}
 
-		logrus.WithError(err).WithField("http_request", r).Error("error handling request")
+		logging.FromContext(r.Context()).WithError(err).WithField("http_request", r).Error("error handling request")
 		w.WriteHeader(http.StatusInternalServerError)
 		serialized := jsonx.MustMarshal(NewErrorResponse(err))
 		w.Write(serialized)
@@ -165,10 +187,13 @@ func (s *Server) Start() {
 	logrus.WithField("address", s.rt.Config.Address).WithField("port", s.rt.Config.Port).Info("server started")
 }
 
-// Stop stops our web server
+// Stop stops our web server, waiting up to our drain timeout for in-flight requests to complete
 func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(s.rt.Config.DrainTimeout))
+	defer cancel()
+
 	// shut down our HTTP server
-	if err := s.httpServer.Shutdown(context.Background()); err != nil {
+	if err := s.httpServer.Shutdown(ctx); err != nil {
 		logrus.WithField("state", "stopping").WithError(err).Error("error shutting down server")
 	}
 }
@@ -182,6 +207,25 @@ func handleIndex(ctx context.Context, rt *runtime.Runtime, r *http.Request) (int
 	return response, http.StatusOK, nil
 }
 
+func handleMetrics(ctx context.Context, rt *runtime.Runtime, r *http.Request, w http.ResponseWriter) error {
+	// metrics aren't JSON so we only write a response ourselves if authorization is denied
+	serve := RequireAuthToken(func(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+		metrics.Handler().ServeHTTP(w, r)
+		return nil, http.StatusOK, nil
+	})
+
+	value, status, err := serve(ctx, rt, r)
+	if err != nil {
+		return err
+	}
+
+	if denied, isDenied := value.(error); isDenied {
+		w.WriteHeader(status)
+		w.Write(jsonx.MustMarshal(NewErrorResponse(denied)))
+	}
+	return nil
+}
+
 func handle404(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
 	return errors.Errorf("not found: %s", r.URL.String()), http.StatusNotFound, nil
 }
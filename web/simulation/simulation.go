@@ -25,8 +25,8 @@ var testChannel = assets.NewChannelReference("440099cf-200c-4d45-a8e7-4a564f4a0e
 var testURN = urns.URN("tel:+12065551212")
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/sim/start", web.RequireAuthToken(handleStart))
-	web.RegisterJSONRoute(http.MethodPost, "/mr/sim/resume", web.RequireAuthToken(handleResume))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/sim/start", web.RequireScopedAuthToken(web.ScopeSimulation, web.RateLimited(web.RateLimitSimulation, handleStart)), web.Spec(&startRequest{}, &simulationResponse{}))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/sim/resume", web.RequireScopedAuthToken(web.ScopeSimulation, web.RateLimited(web.RateLimitSimulation, handleResume)), web.Spec(&resumeRequest{}, &simulationResponse{}))
 }
 
 type flowDefinition struct {
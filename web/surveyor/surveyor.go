@@ -21,7 +21,7 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/surveyor/submit", web.RequireUserToken(handleSubmit))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/surveyor/submit", web.RequireUserToken(handleSubmit), web.Spec(&submitRequest{}, &submitResponse{}))
 }
 
 // Represents a surveyor submission
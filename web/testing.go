@@ -115,6 +115,11 @@ func RunWebTests(t *testing.T, ctx context.Context, rt *runtime.Runtime, truthFi
 			assert.False(t, tc.HTTPMocks.HasUnused(), "%s: unused HTTP mocks in %s", tc.Label)
 		}
 
+		// check that the body of any successful JSON request matches our OpenAPI spec
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 && tc.BodyEncode == "" && len(tc.Body) > 0 && tc.Body[0] == '{' {
+			assert.NoError(t, ValidateRequestBody(tc.Method, tc.Path, tc.Body), "%s: request doesn't match spec", tc.Label)
+		}
+
 		// clone test case and populate with actual values
 		actual := tc
 		actual.Status = resp.StatusCode
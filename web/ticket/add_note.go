@@ -11,8 +11,8 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/note", web.RequireAuthToken(handleAddNote)) // deprecated
-	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/add_note", web.RequireAuthToken(handleAddNote))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/note", web.RequireScopedAuthToken(web.ScopeTickets, handleAddNote), web.Spec(&addNoteRequest{}, &bulkTicketResponse{})) // deprecated
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/add_note", web.RequireScopedAuthToken(web.ScopeTickets, handleAddNote), web.Spec(&addNoteRequest{}, &bulkTicketResponse{}))
 }
 
 type addNoteRequest struct {
@@ -41,7 +41,7 @@ func handleAddNote(ctx context.Context, rt *runtime.Runtime, r *http.Request) (i
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
-	tickets, err := models.LoadTickets(ctx, rt.DB, request.TicketIDs)
+	tickets, err := models.LoadOrgTickets(ctx, rt.DB, request.OrgID, request.TicketIDs)
 	if err != nil {
 		return nil, http.StatusBadRequest, errors.Wrapf(err, "error loading tickets for org: %d", request.OrgID)
 	}
@@ -11,7 +11,7 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/assign", web.RequireAuthToken(handleAssign))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/assign", web.RequireScopedAuthToken(web.ScopeTickets, handleAssign), web.Spec(&assignRequest{}, &bulkTicketResponse{}))
 }
 
 type assignRequest struct {
@@ -42,7 +42,7 @@ func handleAssign(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
-	tickets, err := models.LoadTickets(ctx, rt.DB, request.TicketIDs)
+	tickets, err := models.LoadOrgTickets(ctx, rt.DB, request.OrgID, request.TicketIDs)
 	if err != nil {
 		return nil, http.StatusBadRequest, errors.Wrapf(err, "error loading tickets for org: %d", request.OrgID)
 	}
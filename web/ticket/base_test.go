@@ -21,6 +21,9 @@ func TestTicketAssign(t *testing.T) {
 	testdata.InsertClosedTicket(db, testdata.Org1, testdata.Cathy, testdata.Internal, testdata.DefaultTopic, "Have you seen my cookies?", "34", nil)
 	testdata.InsertClosedTicket(db, testdata.Org1, testdata.Bob, testdata.Internal, testdata.DefaultTopic, "", "", nil)
 
+	// and a ticket in another org which can't be changed by requests for org 1
+	testdata.InsertOpenTicket(db, testdata.Org2, testdata.Org2Contact, testdata.Internal, testdata.DefaultTopic, "", "", time.Now(), nil)
+
 	web.RunWebTests(t, ctx, rt, "testdata/assign.json", nil)
 }
 
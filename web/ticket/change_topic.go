@@ -11,7 +11,7 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/change_topic", web.RequireAuthToken(handleChangeTopic))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/change_topic", web.RequireScopedAuthToken(web.ScopeTickets, handleChangeTopic), web.Spec(&changeTopicRequest{}, &bulkTicketResponse{}))
 }
 
 type changeTopicRequest struct {
@@ -40,7 +40,7 @@ func handleChangeTopic(ctx context.Context, rt *runtime.Runtime, r *http.Request
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
-	tickets, err := models.LoadTickets(ctx, rt.DB, request.TicketIDs)
+	tickets, err := models.LoadOrgTickets(ctx, rt.DB, request.OrgID, request.TicketIDs)
 	if err != nil {
 		return nil, http.StatusBadRequest, errors.Wrapf(err, "error loading tickets for org: %d", request.OrgID)
 	}
@@ -12,7 +12,7 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/close", web.RequireAuthToken(web.WithHTTPLogs(handleClose)))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/close", web.RequireScopedAuthToken(web.ScopeTickets, web.WithHTTPLogs(handleClose)), web.Spec(&bulkTicketRequest{}, &bulkTicketResponse{}))
 }
 
 // Closes any open tickets with the given ids. If force=true then even if tickets can't be closed on external service,
@@ -36,7 +36,7 @@ func handleClose(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *m
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
-	tickets, err := models.LoadTickets(ctx, rt.DB, request.TicketIDs)
+	tickets, err := models.LoadOrgTickets(ctx, rt.DB, request.OrgID, request.TicketIDs)
 	if err != nil {
 		return nil, http.StatusBadRequest, errors.Wrapf(err, "error loading tickets for org: %d", request.OrgID)
 	}
@@ -50,7 +50,7 @@ func handleClose(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *m
 	defer rc.Close()
 
 	for t, e := range evts {
-		err = handler.QueueTicketEvent(rc, t.ContactID(), e)
+		err = handler.QueueTicketEvent(ctx, rc, t.ContactID(), e)
 		if err != nil {
 			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queueing ticket event for ticket %d", t.ID())
 		}
@@ -12,7 +12,7 @@ import (
 )
 
 func init() {
-	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/reopen", web.RequireAuthToken(web.WithHTTPLogs(handleReopen)))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/reopen", web.RequireScopedAuthToken(web.ScopeTickets, web.WithHTTPLogs(handleReopen)), web.Spec(&bulkTicketRequest{}, &bulkTicketResponse{}))
 }
 
 // Reopens any closed tickets with the given ids
@@ -34,7 +34,7 @@ func handleReopen(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
-	tickets, err := models.LoadTickets(ctx, rt.DB, request.TicketIDs)
+	tickets, err := models.LoadOrgTickets(ctx, rt.DB, request.OrgID, request.TicketIDs)
 	if err != nil {
 		return nil, http.StatusBadRequest, errors.Wrapf(err, "error loading tickets for org: %d", request.OrgID)
 	}
@@ -1,13 +1,19 @@
 package web
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/ratelimit"
 
 	"github.com/pkg/errors"
 )
@@ -76,6 +82,135 @@ func RequireAuthToken(handler JSONHandler) JSONHandler {
 	}
 }
 
+// scopes of endpoints which scoped tokens can be restricted to
+const (
+	ScopeContacts   = "contacts"
+	ScopeFlows      = "flows"
+	ScopeMsgs       = "msgs"
+	ScopeTickets    = "tickets"
+	ScopeSimulation = "simulation"
+)
+
+// RequireScopedAuthToken wraps a handler to require that our request has either our global authorization header or
+// a scoped token which allows the passed in scope for the org_id of the request body
+func RequireScopedAuthToken(scope string, handler JSONHandler) JSONHandler {
+	return func(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+		// without a global token we're as open as endpoints which only check that (config validation ensures there
+		// can't be scoped tokens without a global token)
+		auth := r.Header.Get("authorization")
+		if rt.Config.AuthToken == "" || fmt.Sprintf("Token %s", rt.Config.AuthToken) == auth {
+			return handler(ctx, rt, r)
+		}
+
+		tokens, err := scopedTokens(rt.Config)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "error parsing scoped tokens")
+		}
+
+		token, hasToken := tokens[strings.TrimPrefix(auth, "Token ")]
+		if !strings.HasPrefix(auth, "Token ") || !hasToken {
+			return fmt.Errorf("invalid or missing authorization header, denying"), http.StatusUnauthorized, nil
+		}
+
+		orgID, err := readOrgID(r)
+		if err != nil {
+			return err, http.StatusBadRequest, nil
+		}
+
+		if (orgID == models.NilOrgID && len(token.OrgIDs) > 0) || !token.Allows(scope, int(orgID)) {
+			return fmt.Errorf("authorization token doesn't allow this request, denying"), http.StatusForbidden, nil
+		}
+
+		return handler(ctx, rt, r)
+	}
+}
+
+// parsed scoped tokens are kept so they're only parsed again if the config changes
+var parsedTokens struct {
+	sync.Mutex
+	raw    string
+	tokens map[string]*runtime.ScopedToken
+}
+
+// gets the parsed scoped tokens of the passed in config
+func scopedTokens(cfg *runtime.Config) (map[string]*runtime.ScopedToken, error) {
+	parsedTokens.Lock()
+	defer parsedTokens.Unlock()
+
+	if parsedTokens.tokens == nil || parsedTokens.raw != cfg.ScopedTokens {
+		tokens, err := cfg.ParseScopedTokens()
+		if err != nil {
+			return nil, err
+		}
+		parsedTokens.raw, parsedTokens.tokens = cfg.ScopedTokens, tokens
+	}
+	return parsedTokens.tokens, nil
+}
+
+// groups of endpoints which can be rate limited
+const (
+	RateLimitSearch     = "search"
+	RateLimitSimulation = "simulation"
+	RateLimitPreview    = "preview"
+)
+
+// RateLimited wraps a handler to limit how many requests each org can make to endpoints in the passed in group
+func RateLimited(group string, handler JSONHandler) JSONHandler {
+	return func(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+		limits, err := rt.Config.ParseRateLimits()
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "error parsing rate limits")
+		}
+
+		limit, isLimited := limits[group]
+		if !isLimited {
+			return handler(ctx, rt, r)
+		}
+
+		orgID, err := readOrgID(r)
+		if err != nil {
+			return err, http.StatusBadRequest, nil
+		}
+
+		// limits are per org so requests without one can't be let through to share a single bucket
+		if orgID == models.NilOrgID {
+			return errors.New("request failed validation: org_id is required"), http.StatusBadRequest, nil
+		}
+
+		rc := rt.RP.Get()
+		wait, err := ratelimit.Take(rc, fmt.Sprintf("rate_limit:%s:%d", group, orgID), limit, time.Minute)
+		rc.Close()
+
+		if err != nil {
+			return nil, 0, err
+		}
+		if wait > 0 {
+			return &RateLimitError{RetryAfter: wait}, http.StatusTooManyRequests, nil
+		}
+
+		return handler(ctx, rt, r)
+	}
+}
+
+// reads the org_id from the body of the passed in request, leaving the body intact for the handler
+func readOrgID(r *http.Request) (models.OrgID, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return models.NilOrgID, errors.Wrap(err, "unable to read request body")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	request := &struct {
+		OrgID models.OrgID `json:"org_id"`
+	}{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, request); err != nil {
+			return models.NilOrgID, errors.Wrap(err, "request failed validation")
+		}
+	}
+	return request.OrgID, nil
+}
+
 // LoggingJSONHandler is a JSON web handler which logs HTTP logs
 type LoggingJSONHandler func(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *models.HTTPLogger) (interface{}, int, error)
 
@@ -2,7 +2,9 @@ package web_test
 
 import (
 	"context"
+	"io"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
@@ -13,6 +15,7 @@ import (
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
+	"github.com/nyaruka/redisx/assertredis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -63,3 +66,102 @@ func TestWithHTTPLogs(t *testing.T) {
 	// check HTTP logs were created
 	assertdb.Query(t, db, `select count(*) from request_logs_httplog where ticketer_id = $1;`, testdata.Mailgun.ID).Returns(2)
 }
+
+func TestRequireScopedAuthToken(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	defer func() {
+		rt.Config.AuthToken = ""
+		rt.Config.ScopedTokens = ""
+	}()
+
+	rt.Config.AuthToken = "sesame"
+	rt.Config.ScopedTokens = "abc123:contacts+tickets:1+2,def456:simulation:*"
+
+	handler := func(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+		body, _ := io.ReadAll(r.Body)
+		return map[string]string{"body": string(body)}, http.StatusOK, nil
+	}
+
+	tcs := []struct {
+		scope  string
+		token  string
+		body   string
+		status int
+	}{
+		{web.ScopeContacts, "", `{"org_id": 1}`, http.StatusUnauthorized},
+		{web.ScopeContacts, "Token xyz", `{"org_id": 1}`, http.StatusUnauthorized},
+		{web.ScopeFlows, "Token sesame", `{"org_id": 1}`, http.StatusOK},
+		{web.ScopeContacts, "Token abc123", `{"org_id": 1}`, http.StatusOK},
+		{web.ScopeTickets, "Token abc123", `{"org_id": 2}`, http.StatusOK},
+		{web.ScopeContacts, "Token abc123", `{"org_id": 3}`, http.StatusForbidden},
+		{web.ScopeFlows, "Token abc123", `{"org_id": 1}`, http.StatusForbidden},
+		{web.ScopeContacts, "Token abc123", `{}`, http.StatusForbidden},
+		{web.ScopeContacts, "Token abc123", `xxx`, http.StatusBadRequest},
+		{web.ScopeSimulation, "Token def456", `{"org_id": 3}`, http.StatusOK},
+		{web.ScopeSimulation, "Token def456", `{}`, http.StatusOK},
+	}
+
+	for i, tc := range tcs {
+		r, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		if tc.token != "" {
+			r.Header.Set("Authorization", tc.token)
+		}
+
+		response, status, err := web.RequireScopedAuthToken(tc.scope, handler)(ctx, rt, r)
+		assert.NoError(t, err, "%d: unexpected error", i)
+		assert.Equal(t, tc.status, status, "%d: status mismatch", i)
+
+		// handler should still be able to read the body
+		if status == http.StatusOK {
+			assert.Equal(t, map[string]string{"body": tc.body}, response, "%d: response mismatch", i)
+		}
+	}
+
+	// with no tokens configured at all, requests are allowed
+	rt.Config.AuthToken = ""
+	rt.Config.ScopedTokens = ""
+
+	r, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(`{"org_id": 1}`))
+	_, status, err := web.RequireScopedAuthToken(web.ScopeContacts, handler)(ctx, rt, r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestRateLimited(t *testing.T) {
+	ctx, rt, _, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+	defer func() { rt.Config.RateLimits = "" }()
+
+	rt.Config.RateLimits = "search:2"
+
+	handler := func(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+		return map[string]string{"status": "OK"}, http.StatusOK, nil
+	}
+
+	call := func(group, body string) int {
+		r, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		_, status, err := web.RateLimited(group, handler)(ctx, rt, r)
+		assert.NoError(t, err)
+		return status
+	}
+
+	assert.Equal(t, http.StatusOK, call(web.RateLimitSearch, `{"org_id": 1}`))
+	assert.Equal(t, http.StatusOK, call(web.RateLimitSearch, `{"org_id": 1}`))
+	assert.Equal(t, http.StatusTooManyRequests, call(web.RateLimitSearch, `{"org_id": 1}`))
+
+	// other orgs have their own limits
+	assert.Equal(t, http.StatusOK, call(web.RateLimitSearch, `{"org_id": 2}`))
+
+	// requests without an org are rejected rather than sharing a limit
+	assert.Equal(t, http.StatusBadRequest, call(web.RateLimitSearch, `{}`))
+	assert.Equal(t, http.StatusBadRequest, call(web.RateLimitSearch, ``))
+
+	// and groups without a configured limit aren't limited
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, call(web.RateLimitSimulation, `{"org_id": 1}`))
+	}
+
+	assertredis.Exists(t, rp, "rate_limit:search:1")
+}
@@ -6,13 +6,20 @@ import (
 	"sync"
 	"time"
 
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/logging"
+	"github.com/nyaruka/mailroom/utils/metrics"
+	"github.com/nyaruka/mailroom/utils/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/sirupsen/logrus"
 )
 
-// Foreman takes care of managing our set of workers and assigns msgs for each to send
+// Foreman takes care of managing our set of workers and assigns msgs for each to send. If autoscaling is enabled, the
+// number of workers is adjusted between a minimum and maximum based on how backed up our queue is.
 type Foreman struct {
 	rt               *runtime.Runtime
 	wg               *sync.WaitGroup
@@ -20,21 +27,46 @@ type Foreman struct {
 	workers          []*Worker
 	availableWorkers chan *Worker
 	quit             chan bool
+	stopped          chan bool
+
+	minWorkers   int
+	maxWorkers   int
+	nextWorkerID int
+	retiring     int // number of workers to stop as they become available
+
+	// cumulative DB pool wait stats as of our last scaling, so we can calculate the average wait since
+	dbWaitCount    int64
+	dbWaitDuration time.Duration
+
+	// context for the tasks our workers perform, cancelled if they don't finish within our drain timeout
+	ctx       context.Context
+	cancel    context.CancelFunc
+	workersWG sync.WaitGroup
 }
 
 // NewForeman creates a new Foreman for the passed in server with the number of max workers
 func NewForeman(rt *runtime.Runtime, wg *sync.WaitGroup, queue string, maxWorkers int) *Foreman {
+	minWorkers := maxWorkers
+	if rt.Config.AutoscaleWorkers && rt.Config.AutoscaleMinWorkers < maxWorkers {
+		minWorkers = rt.Config.AutoscaleMinWorkers
+	}
+
 	foreman := &Foreman{
 		rt:               rt,
 		wg:               wg,
 		queue:            queue,
-		workers:          make([]*Worker, maxWorkers),
+		workers:          make([]*Worker, 0, maxWorkers),
 		availableWorkers: make(chan *Worker, maxWorkers),
 		quit:             make(chan bool),
+		stopped:          make(chan bool),
+		minWorkers:       minWorkers,
+		maxWorkers:       maxWorkers,
 	}
+	foreman.ctx, foreman.cancel = context.WithCancel(context.Background())
 
-	for i := 0; i < maxWorkers; i++ {
-		foreman.workers[i] = NewWorker(foreman, i)
+	// we start with our minimum number of workers
+	for i := 0; i < minWorkers; i++ {
+		foreman.addWorker()
 	}
 
 	return foreman
@@ -45,16 +77,41 @@ func (f *Foreman) Start() {
 	for _, worker := range f.workers {
 		worker.Start()
 	}
+	metrics.SetWorkers(f.queue, len(f.workers))
+
 	go f.Assign()
 }
 
-// Stop stops the foreman and all its workers, the wait group of the worker can be used to track progress
-func (f *Foreman) Stop() {
+// Stop stops the foreman popping new tasks and then waits for its workers to finish their current tasks. If they
+// haven't finished within the passed in timeout, the contexts of their tasks are cancelled.
+func (f *Foreman) Stop(timeout time.Duration) {
+	log := logrus.WithField("comp", "foreman").WithField("queue", f.queue)
+	log.WithField("state", "stopping").Info("foreman stopping")
+
+	// stop assigning tasks and wait until we know nothing else will be assigned
+	close(f.quit)
+	<-f.stopped
+
 	for _, worker := range f.workers {
 		worker.Stop()
 	}
-	close(f.quit)
-	logrus.WithField("comp", "foreman").WithField("queue", f.queue).WithField("state", "stopping").Info("foreman stopping")
+
+	drained := make(chan bool)
+	go func() {
+		f.workersWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.WithField("timeout", timeout).Warn("workers didn't finish within drain timeout, cancelling tasks")
+		f.cancel()
+		<-drained
+	}
+
+	f.cancel()
+	log.WithField("state", "stopped").Info("foreman stopped")
 }
 
 // Assign is our main loop for the Foreman, it takes care of popping the next outgoing task from our
@@ -62,6 +119,7 @@ func (f *Foreman) Stop() {
 func (f *Foreman) Assign() {
 	f.wg.Add(1)
 	defer f.wg.Done()
+	defer close(f.stopped)
 	log := logrus.WithField("comp", "foreman").WithField("queue", f.queue)
 
 	log.WithFields(logrus.Fields{
@@ -70,17 +128,34 @@ func (f *Foreman) Assign() {
 		"queue":   f.queue,
 	}).Info("workers started and waiting")
 
+	// if we can scale, periodically check whether we need more or fewer workers
+	var scaleTicks <-chan time.Time
+	if f.minWorkers < f.maxWorkers {
+		ticker := time.NewTicker(time.Second * time.Duration(f.rt.Config.AutoscaleInterval))
+		defer ticker.Stop()
+		scaleTicks = ticker.C
+	}
+
 	lastSleep := false
 
 	for {
 		select {
 		// return if we have been told to stop
 		case <-f.quit:
-			log.WithField("state", "stopped").Info("foreman stopped")
+			log.Info("foreman no longer assigning tasks")
 			return
 
+		case <-scaleTicks:
+			f.scale(log)
+
 		// otherwise, grab the next task and assign it to a worker
 		case worker := <-f.availableWorkers:
+			// if we're scaling down, stop this worker instead
+			if f.retiring > 0 {
+				f.retireWorker(worker)
+				continue
+			}
+
 			// see if we have a task to work on
 			rc := f.rt.RP.Get()
 			task, err := queue.PopNextTask(rc, f.queue)
@@ -108,6 +183,114 @@ func (f *Foreman) Assign() {
 	}
 }
 
+// scale adjusts our number of workers based on the size of our queue, the age of its oldest task and how long tasks
+// are waiting for DB connections
+func (f *Foreman) scale(log *logrus.Entry) {
+	cfg := f.rt.Config
+
+	rc := f.rt.RP.Get()
+	size, err := queue.Size(rc, f.queue)
+	if err != nil {
+		rc.Close()
+		log.WithError(err).Error("error getting queue size for autoscaling")
+		return
+	}
+	oldest, err := queue.OldestTaskAge(rc, f.queue)
+	rc.Close()
+	if err != nil {
+		log.WithError(err).Error("error getting oldest task age for autoscaling")
+		return
+	}
+
+	dbStats := f.rt.DB.Stats()
+	var dbWait time.Duration
+	if waits := dbStats.WaitCount - f.dbWaitCount; waits > 0 {
+		dbWait = (dbStats.WaitDuration - f.dbWaitDuration) / time.Duration(waits)
+	}
+	f.dbWaitCount, f.dbWaitDuration = dbStats.WaitCount, dbStats.WaitDuration
+
+	current := len(f.workers) - f.retiring
+	target := scaleWorkers(current, f.minWorkers, f.maxWorkers, size, oldest, dbWait,
+		time.Millisecond*time.Duration(cfg.AutoscaleTargetLatency),
+		time.Millisecond*time.Duration(cfg.AutoscaleMaxDBWait),
+	)
+	if target == current {
+		return
+	}
+
+	if target > current {
+		// cancel any pending retirements before adding new workers
+		for n := target - current; n > 0; n-- {
+			if f.retiring > 0 {
+				f.retiring--
+			} else {
+				f.addWorker().Start()
+			}
+		}
+	} else {
+		f.retiring += current - target
+	}
+
+	metrics.SetWorkers(f.queue, target)
+
+	log.WithFields(logrus.Fields{
+		"workers":     target,
+		"previous":    current,
+		"queue_size":  size,
+		"oldest_task": oldest,
+		"db_wait":     dbWait,
+	}).Info("workers scaled")
+}
+
+// creates a new worker and adds it to our workers without starting it
+func (f *Foreman) addWorker() *Worker {
+	worker := NewWorker(f, f.nextWorkerID)
+	f.nextWorkerID++
+	f.workers = append(f.workers, worker)
+	return worker
+}
+
+// stops and removes the passed in worker which must be available, i.e. not performing a task
+func (f *Foreman) retireWorker(worker *Worker) {
+	for i, w := range f.workers {
+		if w == worker {
+			f.workers = append(f.workers[:i], f.workers[i+1:]...)
+			break
+		}
+	}
+	f.retiring--
+	worker.Stop()
+}
+
+// returns the number of workers we should have, given the current number, the size of our queue, the age of its
+// oldest task and the average wait for DB connections
+func scaleWorkers(current, min, max, size int, oldest, dbWait, targetLatency, maxDBWait time.Duration) int {
+	target := current
+
+	switch {
+	case maxDBWait > 0 && dbWait > maxDBWait:
+		// the DB pool is saturated so more workers would only make things worse
+		target = current - (current+3)/4
+	case size > 0 && oldest > targetLatency:
+		// tasks are waiting too long, so double our workers but don't add more than there are tasks
+		target = current * 2
+		if target > current+size {
+			target = current + size
+		}
+	case size == 0:
+		// nothing to do, so shed a quarter of our workers
+		target = current - (current+3)/4
+	}
+
+	if target < min {
+		target = min
+	}
+	if target > max {
+		target = max
+	}
+	return target
+}
+
 // Worker is our type for a single goroutine that is handling queued events
 type Worker struct {
 	id      int
@@ -127,10 +310,10 @@ func NewWorker(foreman *Foreman, id int) *Worker {
 
 // Start starts our Worker's goroutine and has it start waiting for tasks from the foreman
 func (w *Worker) Start() {
-	w.foreman.wg.Add(1)
+	w.foreman.workersWG.Add(1)
 
 	go func() {
-		defer w.foreman.wg.Done()
+		defer w.foreman.workersWG.Done()
 
 		log := logrus.WithField("queue", w.foreman.queue).WithField("worker_id", w.id)
 		log.Debug("started")
@@ -159,16 +342,11 @@ func (w *Worker) Stop() {
 }
 
 func (w *Worker) handleTask(task *queue.Task) {
-	log := logrus.WithField("queue", w.foreman.queue).WithField("worker_id", w.id).WithField("task_type", task.Type).WithField("org_id", task.OrgID)
+	ctx := queue.WithDrain(w.foreman.ctx, w.foreman.quit)
+	ctx = logging.WithCorrelationID(ctx, task.CorrelationID)
+	log := logging.FromContext(ctx).WithField("queue", w.foreman.queue).WithField("worker_id", w.id).WithField("task_type", task.Type).WithField("org_id", task.OrgID)
 
 	defer func() {
-		// catch any panics and recover
-		panicLog := recover()
-		if panicLog != nil {
-			debug.PrintStack()
-			log.WithField("task", string(task.Task)).WithField("task_type", task.Type).WithField("org_id", task.OrgID).Errorf("panic handling task: %s", panicLog)
-		}
-
 		// mark our task as complete
 		rc := w.foreman.rt.RP.Get()
 		err := queue.MarkTaskComplete(rc, w.foreman.queue, task.OrgID)
@@ -178,21 +356,42 @@ func (w *Worker) handleTask(task *queue.Task) {
 		rc.Close()
 	}()
 
+	// tasks added by producers which don't know about our routing (e.g. RapidPro) can end up in the wrong queue
+	if q := queue.QueueFor(task.Type, w.foreman.queue); q != w.foreman.queue {
+		w.forwardTask(log, task, q)
+		return
+	}
+
 	log.Info("starting handling of task")
 	start := time.Now()
 
+	var err error
+
 	taskFunc, found := taskFunctions[task.Type]
 	if found {
-		err := taskFunc(context.Background(), w.foreman.rt, task)
+		err = w.performTask(ctx, taskFunc, task)
 		if err != nil {
-			log.WithError(err).WithField("task", string(task.Task)).Error("error running task")
+			log.WithError(err).WithField("task", string(task.Task)).WithField("error_count", task.ErrorCount).Error("error running task")
+			if retriedTaskTypes[task.Type] {
+				w.retryTask(log, task, err)
+			} else {
+				// retrying could duplicate work, e.g. sends, or the task function handles its own retries
+				task.ErrorCount++
+				w.deadLetterTask(log, task, err)
+			}
 		}
 	} else {
 		log.Error("unable to find function for task type")
+
+		// no point retrying this, but a later deploy might know what to do with it
+		err = errors.Errorf("unknown task type: %s", task.Type)
+		w.deadLetterTask(log, task, err)
 	}
 
 	elapsed := time.Since(start)
 
+	metrics.RecordTask(w.foreman.queue, task.Type, err, elapsed, dates.Since(task.QueuedOn))
+
 	log.WithField("elapsed", elapsed).Info("task complete")
 
 	// additionally if any task took longer than 1 minute, log as warning
@@ -200,3 +399,78 @@ func (w *Worker) handleTask(task *queue.Task) {
 		log.WithField("task", string(task.Task)).WithField("elapsed", elapsed).Warn("long running task")
 	}
 }
+
+// performTask calls the given task function, converting any panic into an error
+func (w *Worker) performTask(ctx context.Context, taskFunc TaskFunction, task *queue.Task) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "task "+task.Type,
+		attribute.String("mailroom.queue", w.foreman.queue),
+		attribute.String("mailroom.task_type", task.Type),
+		tracing.OrgID(int64(task.OrgID)),
+	)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	defer func() {
+		// catch any panics and recover
+		panicLog := recover()
+		if panicLog != nil {
+			debug.PrintStack()
+			err = errors.Errorf("panic handling task: %s", panicLog)
+		}
+	}()
+
+	return taskFunc(ctx, w.foreman.rt, task)
+}
+
+// forwardTask moves a task to the queue its type has been routed to
+func (w *Worker) forwardTask(log *logrus.Entry, task *queue.Task, q string) {
+	rc := w.foreman.rt.RP.Get()
+	defer rc.Close()
+
+	if err := queue.ForwardTask(rc, q, task); err != nil {
+		log.WithError(err).WithField("task", string(task.Task)).Error("error forwarding task to routed queue")
+		return
+	}
+
+	log.WithField("routed_queue", q).Debug("task forwarded to routed queue")
+}
+
+// retryTask requeues a failed task with an exponential backoff, or if it has already been retried
+// the maximum number of times, moves it to the dead letter set for our queue
+func (w *Worker) retryTask(log *logrus.Entry, task *queue.Task, taskErr error) {
+	cfg := w.foreman.rt.Config
+
+	task.ErrorCount++
+	task.LastError = taskErr.Error()
+
+	if task.ErrorCount > cfg.TaskMaxRetries {
+		w.deadLetterTask(log, task, taskErr)
+		return
+	}
+
+	backoff := time.Duration(cfg.TaskRetryBackoff) * time.Millisecond * (1 << (task.ErrorCount - 1))
+
+	rc := w.foreman.rt.RP.Get()
+	defer rc.Close()
+
+	if err := queue.RetryTask(rc, w.foreman.queue, task, backoff); err != nil {
+		log.WithError(err).Error("error requeuing failed task")
+		return
+	}
+
+	log.WithField("error_count", task.ErrorCount).WithField("backoff", backoff).Info("failed task requeued for retry")
+}
+
+// deadLetterTask moves a failed task to the dead letter set for our queue
+func (w *Worker) deadLetterTask(log *logrus.Entry, task *queue.Task, taskErr error) {
+	task.LastError = taskErr.Error()
+
+	rc := w.foreman.rt.RP.Get()
+	defer rc.Close()
+
+	if err := queue.DeadLetterTask(rc, w.foreman.queue, task); err != nil {
+		log.WithError(err).WithField("task", string(task.Task)).Error("error moving failed task to dead letter set")
+		return
+	}
+
+	log.WithField("error_count", task.ErrorCount).Error("task permanently failed, moved to dead letter set")
+}